@@ -1251,25 +1251,42 @@ func (hph *HexPatriciaHashed) RootHash() ([]byte, error) {
 
 func (hph *HexPatriciaHashed) ReviewKeys(plainKeys, hashedKeys [][]byte) (rootHash []byte, branchNodeUpdates map[string]BranchData, err error) {
 	branchNodeUpdates = make(map[string]BranchData)
+	rootHash, err = hph.ReviewKeysFunc(func(review func(plainKey, hashedKey []byte) error) error {
+		for i, hashedKey := range hashedKeys {
+			if err := review(plainKeys[i], hashedKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(updateKey []byte, branchData BranchData) error {
+		branchNodeUpdates[string(updateKey)] = branchData
+		return nil
+	})
+	return rootHash, branchNodeUpdates, err
+}
 
+// ReviewKeysFunc - same as ReviewKeys, but keys are not kept in memory: `keys` passes them to `review` one by one
+// (sorted by hashed key), and branch updates are passed to `onBranch` instead of being collected.
+func (hph *HexPatriciaHashed) ReviewKeysFunc(keys func(review func(plainKey, hashedKey []byte) error) error, onBranch func(updateKey []byte, branchData BranchData) error) (rootHash []byte, err error) {
 	stagedCell := new(Cell)
-	for i, hashedKey := range hashedKeys {
-		plainKey := plainKeys[i]
+	if err = keys(func(plainKey, hashedKey []byte) error {
 		if hph.trace {
 			fmt.Printf("plainKey=[%x], hashedKey=[%x], currentKey=[%x]\n", plainKey, hashedKey, hph.currentKey[:hph.currentKeyLen])
 		}
 		// Keep folding until the currentKey is the prefix of the key we modify
 		for hph.needFolding(hashedKey) {
 			if branchData, updateKey, err := hph.fold(); err != nil {
-				return nil, nil, fmt.Errorf("fold: %w", err)
+				return fmt.Errorf("fold: %w", err)
 			} else if branchData != nil {
-				branchNodeUpdates[string(updateKey)] = branchData
+				if err = onBranch(updateKey, branchData); err != nil {
+					return err
+				}
 			}
 		}
 		// Now unfold until we step on an empty cell
 		for unfolding := hph.needUnfolding(hashedKey); unfolding > 0; unfolding = hph.needUnfolding(hashedKey) {
 			if err := hph.unfold(hashedKey, unfolding); err != nil {
-				return nil, nil, fmt.Errorf("unfold: %w", err)
+				return fmt.Errorf("unfold: %w", err)
 			}
 		}
 
@@ -1277,7 +1294,7 @@ func (hph *HexPatriciaHashed) ReviewKeys(plainKeys, hashedKeys [][]byte) (rootHa
 		stagedCell.fillEmpty()
 		if len(plainKey) == hph.accountKeyLen {
 			if err := hph.accountFn(plainKey, stagedCell); err != nil {
-				return nil, nil, fmt.Errorf("accountFn for key %x failed: %w", plainKey, err)
+				return fmt.Errorf("accountFn for key %x failed: %w", plainKey, err)
 			}
 			if !stagedCell.Delete {
 				cell := hph.updateCell(plainKey, hashedKey)
@@ -1288,8 +1305,8 @@ func (hph *HexPatriciaHashed) ReviewKeys(plainKeys, hashedKeys [][]byte) (rootHa
 				}
 			}
 		} else {
-			if err = hph.storageFn(plainKey, stagedCell); err != nil {
-				return nil, nil, fmt.Errorf("storageFn for key %x failed: %w", plainKey, err)
+			if err := hph.storageFn(plainKey, stagedCell); err != nil {
+				return fmt.Errorf("storageFn for key %x failed: %w", plainKey, err)
 			}
 			if !stagedCell.Delete {
 				hph.updateCell(plainKey, hashedKey).setStorage(stagedCell.Storage[:stagedCell.StorageLen])
@@ -1305,21 +1322,26 @@ func (hph *HexPatriciaHashed) ReviewKeys(plainKeys, hashedKeys [][]byte) (rootHa
 			}
 			hph.deleteCell(hashedKey)
 		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 	// Folding everything up to the root
 	for hph.activeRows > 0 {
 		if branchData, updateKey, err := hph.fold(); err != nil {
-			return nil, nil, fmt.Errorf("final fold: %w", err)
+			return nil, fmt.Errorf("final fold: %w", err)
 		} else if branchData != nil {
-			branchNodeUpdates[string(updateKey)] = branchData
+			if err = onBranch(updateKey, branchData); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	rootHash, err = hph.RootHash()
 	if err != nil {
-		return nil, branchNodeUpdates, fmt.Errorf("root hash evaluation failed: %w", err)
+		return nil, fmt.Errorf("root hash evaluation failed: %w", err)
 	}
-	return rootHash, branchNodeUpdates, nil
+	return rootHash, nil
 }
 
 func (hph *HexPatriciaHashed) SetTrace(trace bool) { hph.trace = trace }
@@ -0,0 +1,468 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commitment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/holiman/uint256"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/rlp"
+)
+
+// Prove - Merkle proof of plainKey (account key or account key + storage location) at the state of the last
+// ProcessUpdates/ReviewKeys (or SetState): RLP-encoded trie nodes on the path from the root to the key, same as eth_getProof.
+// For storage key accountProof leads to the account, and storageProof starts from storage root of that account.
+// Nodes are rebuilt from branch data (branchFn) and values (accountFn/storageFn), nodes embedded
+// into parent node (shorter than 32 bytes) are not listed separately.
+// Proof of absent key ends with the node which proves absence: branch without child or leaf with other key.
+// Must not be called concurrently with ProcessUpdates/ReviewKeys - it uses same hashing buffers.
+func (hph *HexPatriciaHashed) Prove(plainKey []byte) (accountProof, storageProof [][]byte, err error) {
+	if hph.activeRows != 0 {
+		return nil, nil, fmt.Errorf("prove: trie has %d active rows", hph.activeRows)
+	}
+	if len(plainKey) < hph.accountKeyLen {
+		return nil, nil, fmt.Errorf("prove: key [%x] is shorter than account key", plainKey)
+	}
+	hashedKey := make([]byte, 128)
+	if err := hashKey(hph.keccak, plainKey[:hph.accountKeyLen], hashedKey, 0); err != nil {
+		return nil, nil, err
+	}
+	isStorage := len(plainKey) > hph.accountKeyLen
+	if isStorage {
+		if err := hashKey(hph.keccak, plainKey[hph.accountKeyLen:], hashedKey[64:], 0); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		hashedKey = hashedKey[:64]
+	}
+
+	root := hph.root
+	if !hph.rootChecked && root.hl == 0 && root.apl == 0 && root.downHashedLen == 0 {
+		// Root is not loaded yet - then it's a branch node with empty prefix (if any)
+		branchData, err := hph.branchFn(hexToCompact(nil))
+		if err != nil {
+			return nil, nil, err
+		}
+		root.extLen = 0
+		if len(branchData) > 0 {
+			root.hl = length.Hash
+		}
+	}
+
+	var leaf *Cell
+	var depth int
+	if accountProof, leaf, depth, err = hph.proveFrom(root, 0, hashedKey[:64], false); err != nil {
+		return nil, nil, err
+	}
+	if leaf == nil {
+		return accountProof, nil, nil
+	}
+	node, err := hph.accountLeafNode(leaf, depth)
+	if err != nil {
+		return nil, nil, err
+	}
+	accountProof = append(accountProof, node)
+	if !bytes.Equal(leaf.apk[:leaf.apl], plainKey[:hph.accountKeyLen]) || !isStorage {
+		return accountProof, nil, nil
+	}
+
+	// Storage root is described by the account cell: singleton storage leaf, or hash of the branch (optionally behind extension)
+	if storageProof, leaf, depth, err = hph.proveFrom(*leaf, 64, hashedKey, true); err != nil {
+		return nil, nil, err
+	}
+	if leaf == nil {
+		return accountProof, storageProof, nil
+	}
+	if node, err = hph.storageLeafNode(leaf, depth); err != nil {
+		return nil, nil, err
+	}
+	if depth == 64 || len(node) >= length.Hash {
+		storageProof = append(storageProof, node)
+	}
+	return accountProof, storageProof, nil
+}
+
+// proveFrom - walks from `cell` located at `depth` towards hashedKey and collects extension and branch nodes.
+// Returns leaf cell (of the account trie or of the storage trie) where path ends, or nil if path ends at empty slot.
+func (hph *HexPatriciaHashed) proveFrom(cell Cell, depth int, hashedKey []byte, storage bool) (proof [][]byte, leaf *Cell, leafDepth int, err error) {
+	for {
+		if (!storage && cell.apl > 0) || (storage && cell.spl > 0) {
+			return proof, &cell, depth, nil
+		}
+		if cell.hl == 0 {
+			return proof, nil, depth, nil
+		}
+		if cell.extLen > 0 {
+			proof = append(proof, extensionNode(cell.extension[:cell.extLen], cell.h[:cell.hl]))
+			if !bytes.HasPrefix(hashedKey[depth:], cell.extension[:cell.extLen]) {
+				return proof, nil, depth, nil
+			}
+			depth += cell.extLen
+		}
+		if depth >= len(hashedKey) {
+			return nil, nil, 0, fmt.Errorf("prove: branch node below key length, key [%x]", hashedKey)
+		}
+		row, bitmap, err := hph.proofBranch(hashedKey[:depth], depth+1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		node, err := hph.branchNode(row, bitmap, depth+1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		proof = append(proof, node)
+		nibble := hashedKey[depth]
+		if bitmap&(uint16(1)<<nibble) == 0 {
+			return proof, nil, depth, nil
+		}
+		cell = row[nibble]
+		depth++
+	}
+}
+
+// proofBranch - same as unfoldBranchNode, but fills separate row instead of the grid
+func (hph *HexPatriciaHashed) proofBranch(prefix []byte, depth int) (row *[16]Cell, bitmap uint16, err error) {
+	branchData, err := hph.branchFn(hexToCompact(prefix))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(branchData) < 2 {
+		return nil, 0, fmt.Errorf("prove: no branch data for prefix [%x]", prefix)
+	}
+	row = new([16]Cell)
+	bitmap = binary.BigEndian.Uint16(branchData[0:])
+	pos := 2
+	for bitset := bitmap; bitset != 0; {
+		bit := bitset & -bitset
+		nibble := bits.TrailingZeros16(bit)
+		cell := &row[nibble]
+		cell.fillEmpty()
+		fieldBits := branchData[pos]
+		pos++
+		if pos, err = cell.fillFromFields(branchData, pos, PartFlags(fieldBits)); err != nil {
+			return nil, 0, fmt.Errorf("prefix [%x], branchData[%x]: %w", prefix, branchData, err)
+		}
+		if cell.apl > 0 {
+			if err = hph.accountFn(cell.apk[:cell.apl], cell); err != nil {
+				return nil, 0, err
+			}
+		}
+		if cell.spl > 0 {
+			if err = hph.storageFn(cell.spk[:cell.spl], cell); err != nil {
+				return nil, 0, err
+			}
+		}
+		bitset ^= bit
+	}
+	return row, bitmap, nil
+}
+
+// branchNode - RLP of branch node: 16 children references and empty value
+func (hph *HexPatriciaHashed) branchNode(row *[16]Cell, bitmap uint16, depth int) ([]byte, error) {
+	var refs [16][]byte
+	payloadLen := 1 // value
+	for nibble := 0; nibble < 16; nibble++ {
+		if bitmap&(uint16(1)<<nibble) == 0 {
+			payloadLen++
+			continue
+		}
+		cell := row[nibble] // computeCellHash modifies downHashedKey
+		ref, err := hph.computeCellHash(&cell, depth, nil)
+		if err != nil {
+			return nil, err
+		}
+		refs[nibble] = common.Copy(ref) // embedded leaf is returned in auxBuffer
+		payloadLen += len(ref)
+	}
+	var prefix [9]byte
+	pt := rlp.GenerateStructLen(prefix[:], payloadLen)
+	node := make([]byte, 0, pt+payloadLen)
+	node = append(node, prefix[:pt]...)
+	for _, ref := range refs {
+		if ref == nil {
+			node = append(node, 0x80)
+			continue
+		}
+		node = append(node, ref...)
+	}
+	return append(node, 0x80), nil
+}
+
+// accountLeafNode - RLP of leaf node with account of the cell, same as accountLeafHashWithKey hashes
+func (hph *HexPatriciaHashed) accountLeafNode(cell *Cell, depth int) ([]byte, error) {
+	var storageRootHash [length.Hash]byte
+	switch {
+	case cell.spl > 0:
+		var key [65]byte
+		if err := hashKey(hph.keccak, cell.spk[hph.accountKeyLen:cell.spl], key[:], 0); err != nil {
+			return nil, err
+		}
+		key[64] = 16
+		aux, err := hph.leafHashWithKeyVal(make([]byte, 0, 33), key[:], cell.Storage[:cell.StorageLen], true)
+		if err != nil {
+			return nil, err
+		}
+		copy(storageRootHash[:], aux[1:])
+	case cell.extLen > 0 && cell.hl > 0:
+		var err error
+		if storageRootHash, err = hph.extensionHash(cell.extension[:cell.extLen], cell.h[:cell.hl]); err != nil {
+			return nil, err
+		}
+	case cell.extLen > 0:
+		return nil, fmt.Errorf("accountLeafNode extension without hash")
+	case cell.hl > 0:
+		storageRootHash = cell.h
+	default:
+		copy(storageRootHash[:], EmptyRootHash)
+	}
+	var key [65]byte
+	if err := hashKey(hph.keccak, cell.apk[:cell.apl], key[:], depth); err != nil {
+		return nil, err
+	}
+	key[64-depth] = 16
+	var valBuf [128]byte
+	valLen := cell.accountForHashing(valBuf[:], storageRootHash)
+	return leafNode(key[:65-depth], rlp.RlpEncodedBytes(valBuf[:valLen]))
+}
+
+// storageLeafNode - RLP of leaf node with storage value of the cell, same as leafHashWithKeyVal hashes
+func (hph *HexPatriciaHashed) storageLeafNode(cell *Cell, depth int) ([]byte, error) {
+	var key [65]byte
+	hashedKeyOffset := depth - 64
+	if err := hashKey(hph.keccak, cell.spk[hph.accountKeyLen:cell.spl], key[:], hashedKeyOffset); err != nil {
+		return nil, err
+	}
+	key[64-hashedKeyOffset] = 16
+	return leafNode(key[:65-hashedKeyOffset], rlp.RlpSerializableBytes(cell.Storage[:cell.StorageLen]))
+}
+
+// leafNode - RLP of leaf node, `key` is hex key with terminator
+func leafNode(key []byte, val rlp.RlpSerializable) ([]byte, error) {
+	compact := hexToCompact(key)
+	keyLen := len(compact)
+	if keyLen > 1 {
+		keyLen++
+	}
+	payloadLen := keyLen + val.DoubleRLPLen()
+	var prefix [9]byte
+	pt := rlp.GenerateStructLen(prefix[:], payloadLen)
+	node := bytes.NewBuffer(make([]byte, 0, pt+payloadLen))
+	node.Write(prefix[:pt])
+	if len(compact) > 1 {
+		node.WriteByte(0x80 + byte(len(compact)))
+	}
+	node.Write(compact)
+	if err := val.ToDoubleRLP(node, prefix[:]); err != nil {
+		return nil, err
+	}
+	return node.Bytes(), nil
+}
+
+// extensionNode - RLP of extension node, same as extensionHash hashes
+func extensionNode(key []byte, hash []byte) []byte {
+	compact := hexToCompact(key)
+	keyLen := len(compact)
+	if keyLen > 1 {
+		keyLen++
+	}
+	payloadLen := keyLen + 1 + len(hash)
+	var prefix [9]byte
+	pt := rlp.GenerateStructLen(prefix[:], payloadLen)
+	node := make([]byte, 0, pt+payloadLen)
+	node = append(node, prefix[:pt]...)
+	if len(compact) > 1 {
+		node = append(node, 0x80+byte(len(compact)))
+	}
+	node = append(node, compact...)
+	node = append(node, 0x80+byte(len(hash)))
+	return append(node, hash...)
+}
+
+var ErrProofInvalid = errors.New("invalid proof")
+
+// VerifyProof - checks Merkle proof of `key` (key of the trie, already hashed) against `rootHash`.
+// Returns value of the leaf (RLP-encoded account or storage value), nil if proof proves absence of the key.
+// Proof nodes can be listed in any order, unused nodes are ignored.
+func VerifyProof(rootHash, key []byte, proof [][]byte) (value []byte, err error) {
+	if len(proof) == 0 {
+		if bytes.Equal(rootHash, EmptyRootHash) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: empty proof for non-empty root %x", ErrProofInvalid, rootHash)
+	}
+	keccak := sha3.NewLegacyKeccak256()
+	nodes := make(map[string][]byte, len(proof))
+	for _, node := range proof {
+		keccak.Reset()
+		keccak.Write(node)
+		nodes[string(keccak.Sum(nil))] = node
+	}
+	nibbles := make([]byte, 0, len(key)*2)
+	for _, b := range key {
+		nibbles = append(nibbles, b>>4, b&0xf)
+	}
+
+	node, ok := nodes[string(rootHash)]
+	if !ok {
+		return nil, fmt.Errorf("%w: root node %x not found", ErrProofInvalid, rootHash)
+	}
+	for depth := 0; ; {
+		items, err := splitNode(node)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrProofInvalid, err)
+		}
+		var child []byte
+		switch len(items) {
+		case 17:
+			if depth >= len(nibbles) {
+				return nil, fmt.Errorf("%w: branch node below key length", ErrProofInvalid)
+			}
+			child = items[nibbles[depth]]
+			depth++
+		case 2:
+			compact, err := rlpStringPayload(items[0])
+			if err != nil || len(compact) == 0 {
+				return nil, fmt.Errorf("%w: bad key of short node: %v", ErrProofInvalid, err)
+			}
+			isLeaf := compact[0]&0x20 != 0
+			nodeKey := CompactedKeyToHex(compact)
+			if isLeaf {
+				if hasTerm(nodeKey) {
+					nodeKey = nodeKey[:len(nodeKey)-1]
+				}
+				if !bytes.Equal(nodeKey, nibbles[depth:]) {
+					return nil, nil
+				}
+				if value, err = rlpStringPayload(items[1]); err != nil {
+					return nil, fmt.Errorf("%w: bad leaf value: %v", ErrProofInvalid, err)
+				}
+				return value, nil
+			}
+			if !bytes.HasPrefix(nibbles[depth:], nodeKey) {
+				return nil, nil
+			}
+			child = items[1]
+			depth += len(nodeKey)
+		default:
+			return nil, fmt.Errorf("%w: node with %d items", ErrProofInvalid, len(items))
+		}
+
+		switch {
+		case len(child) == 1 && child[0] == 0x80:
+			return nil, nil
+		case child[0] >= 0xc0: // embedded node
+			node = child
+		case len(child) == length.Hash+1:
+			if node, ok = nodes[string(child[1:])]; !ok {
+				return nil, fmt.Errorf("%w: node %x not found", ErrProofInvalid, child[1:])
+			}
+		default:
+			return nil, fmt.Errorf("%w: bad child reference %x", ErrProofInvalid, child)
+		}
+	}
+}
+
+// ProvenAccount - account as it's hashed into the state trie
+type ProvenAccount struct {
+	Nonce       uint64
+	Balance     uint256.Int
+	StorageRoot [length.Hash]byte
+	CodeHash    [length.Hash]byte
+}
+
+// VerifyAccountProof - checks proof of account with plain key `addr` against state root.
+// Returns nil if proof proves absence of the account.
+func VerifyAccountProof(stateRoot, addr []byte, proof [][]byte) (*ProvenAccount, error) {
+	enc, err := VerifyProof(stateRoot, keccakOf(addr), proof)
+	if err != nil || enc == nil {
+		return nil, err
+	}
+	acc := &ProvenAccount{}
+	pos, _, err := rlp.List(enc, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: account: %v", ErrProofInvalid, err)
+	}
+	if pos, acc.Nonce, err = rlp.U64(enc, pos); err != nil {
+		return nil, fmt.Errorf("%w: account nonce: %v", ErrProofInvalid, err)
+	}
+	if pos, err = rlp.U256(enc, pos, &acc.Balance); err != nil {
+		return nil, fmt.Errorf("%w: account balance: %v", ErrProofInvalid, err)
+	}
+	if pos, err = rlp.ParseHash(enc, pos, acc.StorageRoot[:]); err != nil {
+		return nil, fmt.Errorf("%w: account storage root: %v", ErrProofInvalid, err)
+	}
+	if _, err = rlp.ParseHash(enc, pos, acc.CodeHash[:]); err != nil {
+		return nil, fmt.Errorf("%w: account code hash: %v", ErrProofInvalid, err)
+	}
+	return acc, nil
+}
+
+// VerifyStorageProof - checks proof of storage location `loc` against storage root of the account.
+// Returns nil if proof proves absence of the storage item.
+func VerifyStorageProof(storageRoot, loc []byte, proof [][]byte) ([]byte, error) {
+	enc, err := VerifyProof(storageRoot, keccakOf(loc), proof)
+	if err != nil || enc == nil {
+		return nil, err
+	}
+	value, err := rlpStringPayload(enc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: storage value: %v", ErrProofInvalid, err)
+	}
+	return value, nil
+}
+
+func keccakOf(data []byte) []byte {
+	keccak := sha3.NewLegacyKeccak256()
+	keccak.Write(data)
+	return keccak.Sum(nil)
+}
+
+// splitNode - returns RLP-encoded items of the node
+func splitNode(node []byte) (items [][]byte, err error) {
+	pos, l, err := rlp.List(node, 0)
+	if err != nil {
+		return nil, err
+	}
+	if pos+l != len(node) {
+		return nil, fmt.Errorf("trailing bytes after node")
+	}
+	for pos < len(node) {
+		dataPos, dataLen, _, err := rlp.Prefix(node, pos)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, node[pos:dataPos+dataLen])
+		pos = dataPos + dataLen
+	}
+	return items, nil
+}
+
+func rlpStringPayload(item []byte) ([]byte, error) {
+	pos, l, err := rlp.String(item, 0)
+	if err != nil {
+		return nil, err
+	}
+	return item[pos : pos+l], nil
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commitment
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+)
+
+func Test_HexPatriciaHashed_Prove(t *testing.T) {
+	ms := NewMockState(t)
+	hph := NewHexPatriciaHashed(length.Addr, ms.branchFn, ms.accountFn, ms.storageFn)
+
+	rnd := rand.New(rand.NewSource(42))
+	randHex := func(n int) string {
+		b := make([]byte, n)
+		rnd.Read(b)
+		return hex.EncodeToString(b)
+	}
+
+	type slot struct{ addr, loc, value string }
+	var accounts []string
+	var slots []slot
+	builder := NewUpdateBuilder()
+	for i := 0; i < 100; i++ {
+		addr := randHex(length.Addr)
+		accounts = append(accounts, addr)
+		builder.Balance(addr, uint64(i*1000+1)).Nonce(addr, uint64(i))
+	}
+	// account with single storage item (storage root is a leaf), account with many items (embedded and hashed leaves)
+	slots = append(slots, slot{accounts[0], randHex(length.Hash), "01"})
+	for i := 0; i < 40; i++ {
+		value := "ff"
+		if i%2 == 0 {
+			value = randHex(length.Hash)
+		}
+		slots = append(slots, slot{accounts[1], randHex(length.Hash), value})
+	}
+	for _, s := range slots {
+		builder.Storage(s.addr, s.loc, s.value)
+	}
+	plainKeys, hashedKeys, updates := builder.Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+	rootHash, branchNodeUpdates, err := hph.ReviewKeys(plainKeys, hashedKeys)
+	require.NoError(t, err)
+	ms.applyBranchNodeUpdates(branchNodeUpdates)
+
+	proveAccount := func(addr string) (*ProvenAccount, [][]byte) {
+		accountProof, storageProof, err := hph.Prove(decodeHex(addr))
+		require.NoError(t, err)
+		require.Nil(t, storageProof)
+		acc, err := VerifyAccountProof(rootHash, decodeHex(addr), accountProof)
+		require.NoError(t, err)
+		return acc, accountProof
+	}
+
+	for i, addr := range accounts {
+		acc, _ := proveAccount(addr)
+		require.NotNil(t, acc, addr)
+		require.EqualValues(t, i, acc.Nonce)
+		require.EqualValues(t, i*1000+1, acc.Balance.Uint64())
+		require.Equal(t, EmptyCodeHash, acc.CodeHash[:])
+		if i > 1 {
+			require.Equal(t, EmptyRootHash, acc.StorageRoot[:])
+		}
+	}
+
+	for _, s := range slots {
+		accountProof, storageProof, err := hph.Prove(decodeHex(s.addr + s.loc))
+		require.NoError(t, err)
+		acc, err := VerifyAccountProof(rootHash, decodeHex(s.addr), accountProof)
+		require.NoError(t, err)
+		require.NotNil(t, acc)
+		value, err := VerifyStorageProof(acc.StorageRoot[:], decodeHex(s.loc), storageProof)
+		require.NoError(t, err)
+		require.Equal(t, s.value, hex.EncodeToString(value))
+	}
+
+	t.Run("absent", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			acc, _ := proveAccount(randHex(length.Addr))
+			require.Nil(t, acc)
+		}
+		for _, addr := range accounts[:3] {
+			loc := randHex(length.Hash)
+			accountProof, storageProof, err := hph.Prove(decodeHex(addr + loc))
+			require.NoError(t, err)
+			acc, err := VerifyAccountProof(rootHash, decodeHex(addr), accountProof)
+			require.NoError(t, err)
+			value, err := VerifyStorageProof(acc.StorageRoot[:], decodeHex(loc), storageProof)
+			require.NoError(t, err)
+			require.Nil(t, value)
+		}
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		_, accountProof := proveAccount(accounts[5])
+		for i := range accountProof {
+			tampered := make([][]byte, len(accountProof))
+			copy(tampered, accountProof)
+			tampered[i] = append([]byte{}, accountProof[i]...)
+			tampered[i][len(tampered[i])-2] ^= 0x01
+			_, err := VerifyAccountProof(rootHash, decodeHex(accounts[5]), tampered)
+			require.ErrorIs(t, err, ErrProofInvalid, fmt.Sprintf("node %d", i))
+		}
+		_, err := VerifyAccountProof(rootHash, decodeHex(accounts[5]), accountProof[:len(accountProof)-1])
+		require.ErrorIs(t, err, ErrProofInvalid)
+	})
+
+	t.Run("after update", func(t *testing.T) {
+		plainKeys, hashedKeys, updates := NewUpdateBuilder().
+			Balance(accounts[7], 7).
+			Delete(accounts[8]).
+			Storage(slots[3].addr, slots[3].loc, "0123").
+			Build()
+		require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+		newRoot, branchNodeUpdates, err := hph.ReviewKeys(plainKeys, hashedKeys)
+		require.NoError(t, err)
+		ms.applyBranchNodeUpdates(branchNodeUpdates)
+		require.NotEqual(t, rootHash, newRoot)
+		rootHash = newRoot
+
+		acc, _ := proveAccount(accounts[7])
+		require.EqualValues(t, 7, acc.Balance.Uint64())
+		acc, _ = proveAccount(accounts[8])
+		require.Nil(t, acc)
+
+		accountProof, storageProof, err := hph.Prove(decodeHex(slots[3].addr + slots[3].loc))
+		require.NoError(t, err)
+		acc, err = VerifyAccountProof(rootHash, decodeHex(slots[3].addr), accountProof)
+		require.NoError(t, err)
+		value, err := VerifyStorageProof(acc.StorageRoot[:], decodeHex(slots[3].loc), storageProof)
+		require.NoError(t, err)
+		require.Equal(t, "0123", hex.EncodeToString(value))
+	})
+}
+
+func Test_HexPatriciaHashed_ProveSingleAccount(t *testing.T) {
+	ms := NewMockState(t)
+	hph := NewHexPatriciaHashed(length.Addr, ms.branchFn, ms.accountFn, ms.storageFn)
+
+	addr := "2f14582947e292a2ecd20c430b46f2d27cfe213c"
+	accountProof, _, err := hph.Prove(decodeHex(addr))
+	require.NoError(t, err)
+	require.Empty(t, accountProof)
+	acc, err := VerifyAccountProof(EmptyRootHash, decodeHex(addr), accountProof)
+	require.NoError(t, err)
+	require.Nil(t, acc)
+
+	plainKeys, hashedKeys, updates := NewUpdateBuilder().Balance(addr, 5).Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+	rootHash, branchNodeUpdates, err := hph.ReviewKeys(plainKeys, hashedKeys)
+	require.NoError(t, err)
+	ms.applyBranchNodeUpdates(branchNodeUpdates)
+
+	accountProof, _, err = hph.Prove(decodeHex(addr))
+	require.NoError(t, err)
+	require.Len(t, accountProof, 1) // root is the account leaf
+	acc, err = VerifyAccountProof(rootHash, decodeHex(addr), accountProof)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, acc.Balance.Uint64())
+}
@@ -203,6 +203,41 @@ func Test_HexPatriciaHashed_UniqueRepresentation(t *testing.T) {
 	require.Lenf(t, batchRoot, 32, "root hash length should be equal to 32 bytes")
 }
 
+func Test_HexPatriciaHashed_ReviewKeysFunc(t *testing.T) {
+	ms := NewMockState(t)
+	plainKeys, hashedKeys, updates := NewUpdateBuilder().
+		Balance("00", 4).
+		Balance("01", 5).
+		Nonce("02", 6).
+		Storage("03", "56", "050505").
+		Storage("03", "57", "060606").
+		Balance("05", 9).
+		Storage("05", "02", "8989").
+		Build()
+	require.NoError(t, ms.applyPlainUpdates(plainKeys, updates))
+
+	batch := NewHexPatriciaHashed(1, ms.branchFn, ms.accountFn, ms.storageFn)
+	batchRoot, batchUpdates, err := batch.ReviewKeys(plainKeys, hashedKeys)
+	require.NoError(t, err)
+
+	streamed := NewHexPatriciaHashed(1, ms.branchFn, ms.accountFn, ms.storageFn)
+	streamedUpdates := map[string]BranchData{}
+	streamedRoot, err := streamed.ReviewKeysFunc(func(review func(plainKey, hashedKey []byte) error) error {
+		for i := range plainKeys {
+			if err := review(plainKeys[i], hashedKeys[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(updateKey []byte, branchData BranchData) error {
+		streamedUpdates[string(updateKey)] = branchData
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, batchRoot, streamedRoot)
+	require.Equal(t, batchUpdates, streamedUpdates)
+}
+
 func Test_Sepolia(t *testing.T) {
 	ms := NewMockState(t)
 
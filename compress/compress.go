@@ -71,6 +71,8 @@ type Compressor struct {
 	trace            bool
 	logger           log.Logger
 	noFsync          bool // fsync is enabled by default, but tests can manually disable
+	metadata         []byte
+	dict             *DictionaryBuilder // if set - used instead of building dictionary from sampled superstrings
 }
 
 func NewCompressor(ctx context.Context, logPrefix, outputFile, tmpDir string, minPatternScore uint64, workers int, lvl log.Lvl, logger log.Logger) (*Compressor, error) {
@@ -127,6 +129,15 @@ func (c *Compressor) Close() {
 
 func (c *Compressor) SetTrace(trace bool) { c.trace = trace }
 
+// SetMetadata - arbitrary bytes written to the header of output file, readers get them by Decompressor.Metadata.
+// Files without metadata have no header - and stay readable by older versions of Decompressor.
+func (c *Compressor) SetMetadata(meta []byte) { c.metadata = common.Copy(meta) }
+
+// SetDictionary - compress words with patterns of given dictionary (for example taken from file of same kind by
+// DictionaryBuilderFromDecompressor) instead of sampling words and building new one. Must be called before AddWord.
+// Dictionary is consumed by Compress.
+func (c *Compressor) SetDictionary(db *DictionaryBuilder) { c.dict = db }
+
 func (c *Compressor) Count() int { return int(c.wordsCount) }
 
 func (c *Compressor) AddWord(word []byte) error {
@@ -137,6 +148,9 @@ func (c *Compressor) AddWord(word []byte) error {
 	}
 
 	c.wordsCount++
+	if c.dict != nil { // dictionary is known - no need in sampling
+		return c.uncompressedFile.Append(word)
+	}
 	l := 2*len(word) + 2
 	if c.superstringLen+l > superstringLimit {
 		if c.superstringCount%samplingFactor == 0 {
@@ -183,10 +197,12 @@ func (c *Compressor) Compress() error {
 		c.logger.Log(c.lvl, fmt.Sprintf("[%s] BuildDict start", c.logPrefix), "workers", c.workers)
 	}
 	t := time.Now()
-	db, err := DictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors, c.lvl, c.logger)
-	if err != nil {
-
-		return err
+	db := c.dict
+	if db == nil {
+		var err error
+		if db, err = DictionaryBuilderFromCollectors(c.ctx, compressLogPrefix, c.tmpDir, c.suffixCollectors, c.lvl, c.logger); err != nil {
+			return err
+		}
 	}
 	if c.trace {
 		_, fileName := filepath.Split(c.outputFile)
@@ -204,6 +220,9 @@ func (c *Compressor) Compress() error {
 		return err
 	}
 	defer cf.Close()
+	if err = writeMetadata(cf, c.metadata); err != nil {
+		return err
+	}
 	t = time.Now()
 	if err := reducedict(c.ctx, c.trace, c.logPrefix, c.tmpOutFilePath, cf, c.uncompressedFile, c.workers, db, c.lvl, c.logger); err != nil {
 		return err
@@ -364,6 +383,62 @@ func (db *DictionaryBuilder) Close() {
 	db.lastWord = nil
 }
 
+// DictionaryBuilderFromDecompressor - patterns of existing file. Scores are not stored in files:
+// they are approximated by pattern's depth in huffman tree (shallow - frequently used) and length.
+func DictionaryBuilderFromDecompressor(d *Decompressor) *DictionaryBuilder {
+	db := &DictionaryBuilder{limit: maxDictPatterns}
+	data := d.patternsData
+	var depths []uint64
+	var patterns [][]byte
+	var maxDepth uint64
+	for i := 0; i < len(data); {
+		depth, ns := binary.Uvarint(data[i:])
+		i += ns
+		l, n := binary.Uvarint(data[i:])
+		i += n
+		depths, patterns = append(depths, depth), append(patterns, data[i:i+int(l)])
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		i += int(l)
+	}
+	for i, p := range patterns {
+		db.items = append(db.items, &Pattern{word: common.Copy(p), score: uint64(len(p)) * (maxDepth - depths[i] + 1)})
+	}
+	db.Sort()
+	return db
+}
+
+// Optional header of compressed file: magic, 8 bytes of metadata length, metadata.
+// First 8 bytes of file without header - amount of words, magic starts with 0xff - such amount is not realistic.
+var metadataMagic = [8]byte{0xff, 'e', 'r', 'i', 'g', 'm', 'd', 1}
+
+func writeMetadata(w io.Writer, meta []byte) error {
+	if len(meta) == 0 {
+		return nil
+	}
+	var numBuf [8]byte
+	binary.BigEndian.PutUint64(numBuf[:], uint64(len(meta)))
+	for _, b := range [][]byte{metadataMagic[:], numBuf[:], meta} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMetadata - returns metadata and size of header (0 if file has no header)
+func readMetadata(data []byte) (meta []byte, hdrSize uint64, err error) {
+	if len(data) < 16 || !bytes.Equal(data[:8], metadataMagic[:]) {
+		return nil, 0, nil
+	}
+	l := binary.BigEndian.Uint64(data[8:16])
+	if l > uint64(len(data)-16) {
+		return nil, 0, fmt.Errorf("metadata header is invalid: len=%d, file size=%d", l, len(data))
+	}
+	return common.Copy(data[16 : 16+l]), 16 + l, nil
+}
+
 // Pattern is representation of a pattern that is searched in the superstrings to compress them
 // patterns are stored in a patricia tree and contain pattern score (calculated during
 // the initial dictionary building), frequency of usage, and code
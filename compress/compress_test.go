@@ -269,3 +269,55 @@ func TestCompressDictCmp(t *testing.T) {
 		t.Errorf("result file hash changed, %d", cs)
 	}
 }
+
+func TestCompressMetadata(t *testing.T) {
+	logger := log.New()
+	tmpDir := t.TempDir()
+	compressWords := func(file string, meta []byte, dict *DictionaryBuilder) *Decompressor {
+		c, err := NewCompressor(context.Background(), t.Name(), file, tmpDir, 1, 2, log.LvlDebug, logger)
+		require.NoError(t, err)
+		defer c.Close()
+		c.SetMetadata(meta)
+		if dict != nil {
+			c.SetDictionary(dict)
+		}
+		for i := 0; i < 100; i++ {
+			require.NoError(t, c.AddWord([]byte(fmt.Sprintf("%d longlongword %d", i, i))))
+			require.NoError(t, c.AddUncompressedWord([]byte(fmt.Sprintf("raw %d", i))))
+		}
+		require.NoError(t, c.Compress())
+		d, err := NewDecompressor(file)
+		require.NoError(t, err)
+		return d
+	}
+	checkWords := func(d *Decompressor) {
+		g := d.MakeGetter()
+		for i := 0; i < 100; i++ {
+			w, _ := g.Next(nil)
+			require.Equal(t, fmt.Sprintf("%d longlongword %d", i, i), string(w))
+			w, _ = g.NextUncompressed()
+			require.Equal(t, fmt.Sprintf("raw %d", i), string(w))
+		}
+		require.False(t, g.HasNext())
+	}
+
+	d := compressWords(filepath.Join(tmpDir, "with_meta"), []byte("codec=test"), nil)
+	defer d.Close()
+	require.Equal(t, []byte("codec=test"), d.Metadata())
+	require.Equal(t, 200, d.Count())
+	checkWords(d)
+
+	noMeta := compressWords(filepath.Join(tmpDir, "no_meta"), nil, nil)
+	defer noMeta.Close()
+	require.Nil(t, noMeta.Metadata())
+	checkWords(noMeta)
+	require.Equal(t, d.Size()-int64(16+len("codec=test")), noMeta.Size())
+
+	// reuse dictionary of existing file
+	dict := DictionaryBuilderFromDecompressor(d)
+	require.NotZero(t, dict.Len())
+	reused := compressWords(filepath.Join(tmpDir, "reused"), nil, dict)
+	defer reused.Close()
+	checkWords(reused)
+	require.LessOrEqual(t, reused.Size(), noMeta.Size())
+}
@@ -110,6 +110,8 @@ type Decompressor struct {
 	modTime         time.Time
 	wordsCount      uint64
 	emptyWordsCount uint64
+	metadata        []byte // optional header written by Compressor.SetMetadata
+	patternsData    []byte // serialized pattern dictionary, used by DictionaryBuilderFromDecompressor
 
 	filePath, fileName string
 }
@@ -176,10 +178,19 @@ func NewDecompressor(compressedFilePath string) (d *Decompressor, err error) {
 	d.data = d.mmapHandle1[:d.size]
 	defer d.EnableReadAhead().DisableReadAhead() //speedup opening on slow drives
 
-	d.wordsCount = binary.BigEndian.Uint64(d.data[:8])
-	d.emptyWordsCount = binary.BigEndian.Uint64(d.data[8:16])
-	dictSize := binary.BigEndian.Uint64(d.data[16:24])
-	data := d.data[24 : 24+dictSize]
+	var hdr uint64 // size of optional metadata header
+	if d.metadata, hdr, err = readMetadata(d.data); err != nil {
+		return nil, err
+	}
+	if d.size-int64(hdr) < 32 {
+		return nil, fmt.Errorf("compressed file is too short: %d", d.size)
+	}
+
+	d.wordsCount = binary.BigEndian.Uint64(d.data[hdr : hdr+8])
+	d.emptyWordsCount = binary.BigEndian.Uint64(d.data[hdr+8 : hdr+16])
+	dictSize := binary.BigEndian.Uint64(d.data[hdr+16 : hdr+24])
+	data := d.data[hdr+24 : hdr+24+dictSize]
+	d.patternsData = data
 
 	var depths []uint64
 	var patterns [][]byte
@@ -216,7 +227,7 @@ func NewDecompressor(compressedFilePath string) (d *Decompressor, err error) {
 	}
 
 	// read positions
-	pos := 24 + dictSize
+	pos := hdr + 24 + dictSize
 	dictSize = binary.BigEndian.Uint64(d.data[pos : pos+8])
 	data = d.data[pos+8 : pos+8+dictSize]
 
@@ -501,6 +512,9 @@ func (g *Getter) Size() int {
 func (d *Decompressor) Count() int           { return int(d.wordsCount) }
 func (d *Decompressor) EmptyWordsCount() int { return int(d.emptyWordsCount) }
 
+// Metadata - header written by Compressor.SetMetadata, nil if file has no header
+func (d *Decompressor) Metadata() []byte { return d.metadata }
+
 // MakeGetter creates an object that can be used to access superstrings in the decompressor's file
 // Getter is not thread-safe, but there can be multiple getters used simultaneously and concurrently
 // for the same decompressor
@@ -17,10 +17,17 @@
 package bitmapdb_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
 	"testing"
 
 	"github.com/RoaringBitmap/roaring"
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
 	"github.com/stretchr/testify/require"
 )
 
@@ -69,3 +76,125 @@ func TestCutLeft(t *testing.T) {
 	require.True(t, lft == nil)
 	require.True(t, bm.GetCardinality() == 0)
 }
+
+func TestAppend64(t *testing.T) {
+	require := require.New(t)
+	_, tx := memdb.NewTestTx(t)
+	table := kv.LogAddressIndex
+	key, otherKey := []byte{1, 2}, []byte{1, 3}
+
+	expect := roaring64.New()
+	for i := uint64(1); i < 20_000; i += 3 {
+		require.NoError(bitmapdb.Append64(tx, table, key, i, i+1))
+		expect.AddMany([]uint64{i, i + 1})
+		if i%1000 == 1 {
+			require.NoError(bitmapdb.Append64(tx, table, otherKey, i))
+		}
+	}
+	require.Error(bitmapdb.Append64(tx, table, key, 5))
+
+	require.NoError(tx.ForPrefix(table, key, func(k, v []byte) error {
+		require.LessOrEqual(uint64(len(v)), bitmapdb.ChunkLimit+256)
+		return nil
+	}))
+
+	got, err := bitmapdb.Get64(tx, table, key, 0, math.MaxUint64)
+	require.NoError(err)
+	require.True(expect.Equals(got))
+
+	check := func(from, to uint64) {
+		it, err := bitmapdb.Range64(tx, table, key, from, to)
+		require.NoError(err)
+		defer it.Close()
+		res, err := iter.ToU64Arr(it)
+		require.NoError(err)
+		var expectRange []uint64
+		for _, v := range expect.ToArray() {
+			if v >= from && v < to {
+				expectRange = append(expectRange, v)
+			}
+		}
+		require.Equal(expectRange, res, "from=%d, to=%d", from, to)
+	}
+	check(0, math.MaxUint64)
+	check(100, 200)
+	check(5_000, 15_000)
+	check(19_990, math.MaxUint64)
+	check(30_000, 40_000)
+
+	require.NoError(bitmapdb.Compact64(tx, table, key))
+	v, err := tx.GetOne(table, append(append([]byte{}, key...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff))
+	require.NoError(err)
+	require.Nil(v)
+	got, err = bitmapdb.Get64(tx, table, key, 0, math.MaxUint64)
+	require.NoError(err)
+	require.True(expect.Equals(got))
+	check(5_000, 15_000)
+
+	// after TruncateRange64 last chunk is treated as delta
+	require.NoError(bitmapdb.TruncateRange64(tx, table, key, 10_000))
+	require.NoError(bitmapdb.Append64(tx, table, key, 10_001))
+	expect.RemoveRange(10_000, math.MaxUint64)
+	expect.Add(10_001)
+	got, err = bitmapdb.Get64(tx, table, key, 0, math.MaxUint64)
+	require.NoError(err)
+	require.True(expect.Equals(got))
+	check(9_000, 11_000)
+}
+
+// bitmap written by WalkChunkWithKeys64 (before Append64 existed): its last chunk is read as delta
+func TestAppend64LegacyLayout(t *testing.T) {
+	require := require.New(t)
+	_, tx := memdb.NewTestTx(t)
+	table := kv.LogAddressIndex
+	key := []byte{1, 2}
+
+	expect := roaring64.New()
+	for i := uint64(0); i < 100_000; i += 7 {
+		expect.Add(i)
+	}
+	require.NoError(bitmapdb.WalkChunkWithKeys64(key, expect.Clone(), bitmapdb.ChunkLimit, func(chunkKey []byte, chunk *roaring64.Bitmap) error {
+		buf, err := chunk.ToBytes()
+		require.NoError(err)
+		return tx.Put(table, chunkKey, buf)
+	}))
+	deltaKey := append(append([]byte{}, key...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	legacyLast, err := tx.GetOne(table, deltaKey)
+	require.NoError(err)
+	require.Greater(uint64(len(legacyLast)), bitmapdb.DeltaLimit)
+
+	check := func() {
+		got, err := bitmapdb.Get64(tx, table, key, 0, math.MaxUint64)
+		require.NoError(err)
+		require.True(expect.Equals(got))
+		it, err := bitmapdb.Range64(tx, table, key, 50_000, math.MaxUint64)
+		require.NoError(err)
+		defer it.Close()
+		res, err := iter.ToU64Arr(it)
+		require.NoError(err)
+		require.Equal(int(expect.Rank(math.MaxUint64)-expect.Rank(49_999)), len(res))
+	}
+
+	// first append compacts legacy last chunk: delta is small again
+	require.NoError(bitmapdb.Append64(tx, table, key, 100_001))
+	expect.Add(100_001)
+	delta, err := tx.GetOne(table, deltaKey)
+	require.NoError(err)
+	require.LessOrEqual(uint64(len(delta)), bitmapdb.DeltaLimit)
+	check()
+
+	for i := uint64(100_002); i < 101_000; i += 5 {
+		require.NoError(bitmapdb.Append64(tx, table, key, i))
+		expect.Add(i)
+	}
+	check()
+	require.NoError(bitmapdb.Compact64(tx, table, key))
+	check()
+	require.NoError(tx.ForPrefix(table, key, func(k, v []byte) error {
+		chunk := roaring64.New()
+		_, err := chunk.ReadFrom(bytes.NewReader(v))
+		require.NoError(err)
+		require.Equal(chunk.Maximum(), binary.BigEndian.Uint64(k[len(key):]))
+		return nil
+	}))
+}
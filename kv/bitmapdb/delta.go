@@ -0,0 +1,268 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package bitmapdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/c2h5oh/datasize"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// Append-optimized layout:
+//
+//	key + chunk.Maximum() -> compacted chunk (up to ChunkLimit bytes)
+//	key + ^uint64(0)      -> delta chunk: small, only recently appended values
+//
+// Append64 does read-modify-write of small delta chunk only. When delta becomes bigger than DeltaLimit - it's
+// compacted: merged into last compacted chunk (and re-split by ChunkLimit).
+// All values in delta are greater than values in compacted chunks - so Get64 works without changes.
+//
+// Delta key is the key of last chunk written by WalkChunkWithKeys64/TruncateRange64: bitmaps of existing db
+// (and bitmaps after TruncateRange64) are read by Append64 as if their last chunk is delta. Such "delta" can be
+// up to ChunkLimit bytes - it's bigger than DeltaLimit, so first Append64 compacts it and bitmap moves to this layout.
+// Readers of chunks (Get64, Range64) don't distinguish delta chunk, so both layouts (and their mix) are readable.
+
+const DeltaLimit = uint64(256 * datasize.B)
+
+func deltaKey64(key []byte) []byte {
+	k := make([]byte, len(key)+8)
+	copy(k, key)
+	binary.BigEndian.PutUint64(k[len(key):], ^uint64(0))
+	return k
+}
+
+// Append64 - adds values to bitmap of `key`. Values must be greater than any value already stored for this key.
+func Append64(tx kv.RwTx, bucket string, key []byte, values ...uint64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	dk := deltaKey64(key)
+	delta := NewBitmap64()
+	defer ReturnToPool64(delta)
+	v, err := tx.GetOne(bucket, dk)
+	if err != nil {
+		return err
+	}
+	var lastMax uint64
+	var hasLast bool
+	if len(v) > 0 {
+		if _, err := delta.ReadFrom(bytes.NewReader(v)); err != nil {
+			return err
+		}
+		lastMax, hasLast = delta.Maximum(), !delta.IsEmpty()
+	}
+	if !hasLast {
+		c, err := tx.Cursor(bucket)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		lastK, _, err := lastCompacted(c, key)
+		if err != nil {
+			return err
+		}
+		if lastK != nil {
+			lastMax, hasLast = binary.BigEndian.Uint64(lastK[len(key):]), true
+		}
+	}
+	for _, n := range values {
+		if hasLast && n <= lastMax {
+			return fmt.Errorf("bitmapdb.Append64: %s, key=%x: value %d is not greater than %d", bucket, key, n, lastMax)
+		}
+		lastMax, hasLast = n, true
+	}
+	delta.AddMany(values)
+	delta.RunOptimize()
+	if delta.GetSerializedSizeInBytes() > DeltaLimit {
+		return compact64(tx, bucket, key, delta)
+	}
+	return putChunk64(tx, bucket, dk, delta)
+}
+
+// Compact64 - merges delta chunk of `key` into compacted chunks
+func Compact64(tx kv.RwTx, bucket string, key []byte) error {
+	v, err := tx.GetOne(bucket, deltaKey64(key))
+	if err != nil {
+		return err
+	}
+	if len(v) == 0 {
+		return nil
+	}
+	delta := NewBitmap64()
+	defer ReturnToPool64(delta)
+	if _, err := delta.ReadFrom(bytes.NewReader(v)); err != nil {
+		return err
+	}
+	return compact64(tx, bucket, key, delta)
+}
+
+func compact64(tx kv.RwTx, bucket string, key []byte, delta *roaring64.Bitmap) error {
+	c, err := tx.RwCursor(bucket)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	lastK, lastV, err := lastCompacted(c, key)
+	if err != nil {
+		return err
+	}
+	if lastK != nil && uint64(len(lastV)) < ChunkLimit {
+		last := NewBitmap64()
+		defer ReturnToPool64(last)
+		if _, err := last.ReadFrom(bytes.NewReader(lastV)); err != nil {
+			return err
+		}
+		delta.Or(last)
+		if err := c.Delete(lastK); err != nil {
+			return err
+		}
+	}
+	if err := c.Delete(deltaKey64(key)); err != nil {
+		return err
+	}
+	return WalkChunks64(delta, ChunkLimit, func(chunk *roaring64.Bitmap, isLast bool) error {
+		chunkKey := make([]byte, len(key)+8)
+		copy(chunkKey, key)
+		binary.BigEndian.PutUint64(chunkKey[len(key):], chunk.Maximum())
+		return putChunk64(tx, bucket, chunkKey, chunk)
+	})
+}
+
+// lastCompacted - returns last chunk of `key` which is not delta chunk
+func lastCompacted(c kv.Cursor, key []byte) (k, v []byte, err error) {
+	dk := deltaKey64(key)
+	k, _, err = c.Seek(dk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if k == nil {
+		k, v, err = c.Last()
+	} else {
+		k, v, err = c.Prev()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if k == nil || len(k) != len(dk) || !bytes.HasPrefix(k, key) || bytes.Equal(k, dk) {
+		return nil, nil, nil
+	}
+	return k, v, nil
+}
+
+func putChunk64(tx kv.RwTx, bucket string, chunkKey []byte, bm *roaring64.Bitmap) error {
+	buf := bytes.NewBuffer(make([]byte, 0, bm.GetSerializedSizeInBytes()))
+	if _, err := bm.WriteTo(buf); err != nil {
+		return err
+	}
+	return tx.Put(bucket, chunkKey, buf.Bytes())
+}
+
+// ChunksIter64 - streaming iterator over values of chunked bitmap in range [from, to).
+// Reads chunk-by-chunk - doesn't materialize full bitmap. Compatible with both layouts (with and without delta).
+type ChunksIter64 struct {
+	c        kv.Cursor
+	key      []byte
+	from, to uint64
+	bm       *roaring64.Bitmap
+	it       roaring64.IntPeekable64
+	started  bool
+	hasNext  bool
+	nextV    uint64
+	err      error
+}
+
+// Range64 - returns values of bitmap `key` in range [from, to). Iterator owns cursor: must be closed.
+func Range64(tx kv.Tx, bucket string, key []byte, from, to uint64) (*ChunksIter64, error) {
+	c, err := tx.Cursor(bucket)
+	if err != nil {
+		return nil, err
+	}
+	it := &ChunksIter64{c: c, key: common.Copy(key), from: from, to: to, bm: NewBitmap64()}
+	it.advance()
+	return it, nil
+}
+
+func (it *ChunksIter64) nextChunk() bool {
+	var k, v []byte
+	var err error
+	if !it.started {
+		it.started = true
+		fromKey := make([]byte, len(it.key)+8)
+		copy(fromKey, it.key)
+		binary.BigEndian.PutUint64(fromKey[len(it.key):], it.from)
+		k, v, err = it.c.Seek(fromKey)
+	} else {
+		k, v, err = it.c.Next()
+	}
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if k == nil || !bytes.HasPrefix(k, it.key) {
+		return false
+	}
+	it.bm.Clear()
+	if _, err := it.bm.ReadFrom(bytes.NewReader(v)); err != nil {
+		it.err = err
+		return false
+	}
+	it.it = it.bm.Iterator()
+	it.it.AdvanceIfNeeded(it.from)
+	return true
+}
+
+func (it *ChunksIter64) advance() {
+	it.hasNext = false
+	for it.err == nil {
+		if it.it != nil && it.it.HasNext() {
+			v := it.it.Next()
+			if v >= it.to {
+				return
+			}
+			it.hasNext, it.nextV = true, v
+			return
+		}
+		if !it.nextChunk() {
+			return
+		}
+	}
+}
+func (it *ChunksIter64) HasNext() bool { return it.err != nil || it.hasNext }
+func (it *ChunksIter64) Next() (uint64, error) {
+	if it.err != nil {
+		return 0, it.err
+	}
+	v := it.nextV
+	it.advance()
+	return v, nil
+}
+func (it *ChunksIter64) Close() {
+	if it.c != nil {
+		it.c.Close()
+		it.c = nil
+	}
+	if it.bm != nil {
+		ReturnToPool64(it.bm)
+		it.bm, it.it = nil, nil
+	}
+}
@@ -0,0 +1,562 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package iter
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+// Combinators below follow same rules as Union/Intersect:
+//   - error of underlying stream is returned from Next() and after it HasNext() stays true (to let user see error)
+//   - Close() closes all underlying streams which implement Closer
+
+func closeAll[T any](its ...T) {
+	for _, it := range its {
+		if c, ok := any(it).(Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+// MergeNIter - k-way merge of N sorted streams. `cmp` defines order of streams (negative: a before b).
+// Equal elements are not deduplicated (see DistinctBy) and returned in order of streams.
+type MergeNIter[T any] struct {
+	its   []Unary[T]
+	h     *mergeHeap[T]
+	limit int
+	err   error
+}
+
+type mergeItem[T any] struct {
+	v   T
+	src int
+}
+type mergeHeap[T any] struct {
+	items []mergeItem[T]
+	cmp   func(a, b T) int
+}
+
+func (h *mergeHeap[T]) Len() int { return len(h.items) }
+func (h *mergeHeap[T]) Less(i, j int) bool {
+	if c := h.cmp(h.items[i].v, h.items[j].v); c != 0 {
+		return c < 0
+	}
+	return h.items[i].src < h.items[j].src
+}
+func (h *mergeHeap[T]) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *mergeHeap[T]) Push(x any)    { h.items = append(h.items, x.(mergeItem[T])) }
+func (h *mergeHeap[T]) Pop() any {
+	old := h.items
+	n := len(old)
+	x := old[n-1]
+	h.items = old[0 : n-1]
+	return x
+}
+
+func MergeN[T any](its []Unary[T], cmp func(a, b T) int, limit int) *MergeNIter[T] {
+	m := &MergeNIter[T]{its: its, h: &mergeHeap[T]{cmp: cmp}, limit: limit}
+	for i := range its {
+		m.push(i)
+	}
+	return m
+}
+func (m *MergeNIter[T]) push(src int) {
+	if m.err != nil || m.its[src] == nil || !m.its[src].HasNext() {
+		return
+	}
+	v, err := m.its[src].Next()
+	if err != nil {
+		m.err = err
+		return
+	}
+	heap.Push(m.h, mergeItem[T]{v: v, src: src})
+}
+func (m *MergeNIter[T]) HasNext() bool {
+	return m.err != nil || (m.limit != 0 && m.h.Len() > 0)
+}
+func (m *MergeNIter[T]) Next() (v T, err error) {
+	if m.err != nil {
+		return v, m.err
+	}
+	m.limit--
+	item := heap.Pop(m.h).(mergeItem[T])
+	m.push(item.src)
+	return item.v, nil
+}
+func (m *MergeNIter[T]) Close() { closeAll(m.its...) }
+
+// IntersectNIter - values which present in all N streams (leapfrog join). Streams must be strictly sorted by `cmp`.
+// Unlike Intersect - supports any order (for example, descending).
+type IntersectNIter[T any] struct {
+	its     []Unary[T]
+	cmp     func(a, b T) int
+	limit   int
+	hasNext bool
+	nextV   T
+	err     error
+}
+
+func IntersectN[T any](its []Unary[T], cmp func(a, b T) int, limit int) *IntersectNIter[T] {
+	m := &IntersectNIter[T]{its: its, cmp: cmp, limit: limit}
+	m.advance()
+	return m
+}
+func (m *IntersectNIter[T]) advance() {
+	m.hasNext = false
+	if len(m.its) == 0 || m.its[0] == nil || !m.its[0].HasNext() {
+		return
+	}
+	target, err := m.its[0].Next()
+	if err != nil {
+		m.err = err
+		return
+	}
+	// `matched` streams are positioned on `target`, move others forward until they reach it
+	for i, matched := 1%len(m.its), 1; matched < len(m.its); i = (i + 1) % len(m.its) {
+		it := m.its[i]
+		for {
+			if it == nil || !it.HasNext() {
+				return
+			}
+			v, err := it.Next()
+			if err != nil {
+				m.err = err
+				return
+			}
+			c := m.cmp(v, target)
+			if c < 0 {
+				continue
+			}
+			if c == 0 {
+				matched++
+			} else {
+				target, matched = v, 1
+			}
+			break
+		}
+	}
+	m.hasNext, m.nextV = true, target
+}
+func (m *IntersectNIter[T]) HasNext() bool {
+	return m.err != nil || (m.limit != 0 && m.hasNext)
+}
+func (m *IntersectNIter[T]) Next() (v T, err error) {
+	if m.err != nil {
+		return v, m.err
+	}
+	m.limit--
+	v = m.nextV
+	m.advance()
+	return v, nil
+}
+func (m *IntersectNIter[T]) Close() { closeAll(m.its...) }
+
+// DistinctByIter - drops consecutive elements with same key (on sorted stream it means: drops all duplicates).
+// First element of each group is returned.
+type DistinctByIter[T any, K comparable] struct {
+	it      Unary[T]
+	key     func(T) K
+	lastKey K
+	started bool
+	hasNext bool
+	nextV   T
+	err     error
+}
+
+func DistinctBy[T any, K comparable](it Unary[T], key func(T) K) *DistinctByIter[T, K] {
+	m := &DistinctByIter[T, K]{it: it, key: key}
+	m.advance()
+	return m
+}
+func Distinct[T comparable](it Unary[T]) *DistinctByIter[T, T] {
+	return DistinctBy[T, T](it, func(v T) T { return v })
+}
+func (m *DistinctByIter[T, K]) advance() {
+	if m.err != nil {
+		return
+	}
+	m.hasNext = false
+	for m.it.HasNext() {
+		v, err := m.it.Next()
+		if err != nil {
+			m.err = err
+			return
+		}
+		k := m.key(v)
+		if m.started && k == m.lastKey {
+			continue
+		}
+		m.started, m.lastKey = true, k
+		m.hasNext, m.nextV = true, v
+		return
+	}
+}
+func (m *DistinctByIter[T, K]) HasNext() bool { return m.err != nil || m.hasNext }
+func (m *DistinctByIter[T, K]) Next() (v T, err error) {
+	v, err = m.nextV, m.err
+	m.advance()
+	return v, err
+}
+func (m *DistinctByIter[T, K]) Close() { closeAll(m.it) }
+
+// DistinctKVIter - drops consecutive pairs with same key. First pair of each group is returned.
+type DistinctKVIter struct {
+	it           KV
+	lastK        []byte
+	started      bool
+	hasNext      bool
+	nextK, nextV []byte // copies: underlying iterator may overwrite its slices before Next returns them
+	err          error
+}
+
+func DistinctKV(it KV) *DistinctKVIter {
+	m := &DistinctKVIter{it: it}
+	m.advance()
+	return m
+}
+func (m *DistinctKVIter) advance() {
+	if m.err != nil {
+		return
+	}
+	m.hasNext = false
+	for m.it.HasNext() {
+		k, v, err := m.it.Next()
+		if err != nil {
+			m.err = err
+			return
+		}
+		if m.started && bytes.Equal(k, m.lastK) {
+			continue
+		}
+		// k, v are valid only 2 .Next() calls, but duplicates may be many
+		m.started, m.lastK = true, append(m.lastK[:0], k...)
+		m.hasNext, m.nextK, m.nextV = true, common.Copy(k), common.Copy(v)
+		return
+	}
+}
+func (m *DistinctKVIter) HasNext() bool { return m.err != nil || m.hasNext }
+func (m *DistinctKVIter) Next() (k, v []byte, err error) {
+	k, v, err = m.nextK, m.nextV, m.err
+	m.advance()
+	return k, v, err
+}
+func (m *DistinctKVIter) Close() { closeAll(m.it) }
+
+// TakeIter - returns first `n` elements of stream
+type TakeIter[T any] struct {
+	it Unary[T]
+	n  int
+}
+
+func Take[T any](it Unary[T], n int) *TakeIter[T] { return &TakeIter[T]{it: it, n: n} }
+func (m *TakeIter[T]) HasNext() bool              { return m.n > 0 && m.it.HasNext() }
+func (m *TakeIter[T]) Next() (T, error) {
+	m.n--
+	return m.it.Next()
+}
+func (m *TakeIter[T]) Close() { closeAll(m.it) }
+
+type TakeDualIter[K, V any] struct {
+	it Dual[K, V]
+	n  int
+}
+
+func TakeDual[K, V any](it Dual[K, V], n int) *TakeDualIter[K, V] {
+	return &TakeDualIter[K, V]{it: it, n: n}
+}
+func TakeKV(it KV, n int) *TakeDualIter[[]byte, []byte] { return TakeDual[[]byte, []byte](it, n) }
+func (m *TakeDualIter[K, V]) HasNext() bool             { return m.n > 0 && m.it.HasNext() }
+func (m *TakeDualIter[K, V]) Next() (K, V, error) {
+	m.n--
+	return m.it.Next()
+}
+func (m *TakeDualIter[K, V]) Close() { closeAll(m.it) }
+
+// SkipIter - skips first `n` elements of stream. Skipping is lazy: happens on first HasNext() call.
+type SkipIter[T any] struct {
+	it  Unary[T]
+	n   int
+	err error
+}
+
+func Skip[T any](it Unary[T], n int) *SkipIter[T] { return &SkipIter[T]{it: it, n: n} }
+func (m *SkipIter[T]) skip() {
+	for ; m.n > 0 && m.err == nil && m.it.HasNext(); m.n-- {
+		_, m.err = m.it.Next()
+	}
+}
+func (m *SkipIter[T]) HasNext() bool {
+	m.skip()
+	return m.err != nil || m.it.HasNext()
+}
+func (m *SkipIter[T]) Next() (v T, err error) {
+	m.skip()
+	if m.err != nil {
+		return v, m.err
+	}
+	return m.it.Next()
+}
+func (m *SkipIter[T]) Close() { closeAll(m.it) }
+
+type SkipDualIter[K, V any] struct {
+	it  Dual[K, V]
+	n   int
+	err error
+}
+
+func SkipDual[K, V any](it Dual[K, V], n int) *SkipDualIter[K, V] {
+	return &SkipDualIter[K, V]{it: it, n: n}
+}
+func SkipKV(it KV, n int) *SkipDualIter[[]byte, []byte] { return SkipDual[[]byte, []byte](it, n) }
+func (m *SkipDualIter[K, V]) skip() {
+	for ; m.n > 0 && m.err == nil && m.it.HasNext(); m.n-- {
+		_, _, m.err = m.it.Next()
+	}
+}
+func (m *SkipDualIter[K, V]) HasNext() bool {
+	m.skip()
+	return m.err != nil || m.it.HasNext()
+}
+func (m *SkipDualIter[K, V]) Next() (k K, v V, err error) {
+	m.skip()
+	if m.err != nil {
+		return k, v, m.err
+	}
+	return m.it.Next()
+}
+func (m *SkipDualIter[K, V]) Close() { closeAll(m.it) }
+
+// ZipIter - pairs elements of 2 streams. Stops when shortest stream ends.
+type ZipIter[A, B any] struct {
+	x Unary[A]
+	y Unary[B]
+}
+
+func Zip[A, B any](x Unary[A], y Unary[B]) *ZipIter[A, B] { return &ZipIter[A, B]{x: x, y: y} }
+func (m *ZipIter[A, B]) HasNext() bool                    { return m.x.HasNext() && m.y.HasNext() }
+func (m *ZipIter[A, B]) Next() (a A, b B, err error) {
+	if a, err = m.x.Next(); err != nil {
+		return a, b, err
+	}
+	if b, err = m.y.Next(); err != nil {
+		return a, b, err
+	}
+	return a, b, nil
+}
+func (m *ZipIter[A, B]) Close() {
+	closeAll(m.x)
+	closeAll(m.y)
+}
+
+// BatchIter - groups stream into non-overlapping batches of `size` elements. Last batch may be shorter.
+// Returned batch is owned by caller.
+type BatchIter[T any] struct {
+	it   Unary[T]
+	size int
+}
+
+func Batch[T any](it Unary[T], size int) *BatchIter[T] {
+	if size < 1 {
+		size = 1
+	}
+	return &BatchIter[T]{it: it, size: size}
+}
+func (m *BatchIter[T]) HasNext() bool { return m.it.HasNext() }
+func (m *BatchIter[T]) Next() ([]T, error) {
+	batch := make([]T, 0, m.size)
+	for len(batch) < m.size && m.it.HasNext() {
+		v, err := m.it.Next()
+		if err != nil {
+			return batch, err
+		}
+		batch = append(batch, v)
+	}
+	return batch, nil
+}
+func (m *BatchIter[T]) Close() { closeAll(m.it) }
+
+// WindowIter - sliding window of `size` elements, moving by 1 element. Stream shorter than `size` produces nothing.
+// Returned window is owned by caller.
+type WindowIter[T any] struct {
+	it     Unary[T]
+	size   int
+	window []T
+	err    error
+}
+
+func Window[T any](it Unary[T], size int) *WindowIter[T] {
+	if size < 1 {
+		size = 1
+	}
+	return &WindowIter[T]{it: it, size: size}
+}
+func (m *WindowIter[T]) fill() {
+	for m.err == nil && len(m.window) < m.size && m.it.HasNext() {
+		var v T
+		if v, m.err = m.it.Next(); m.err == nil {
+			m.window = append(m.window, v)
+		}
+	}
+}
+func (m *WindowIter[T]) HasNext() bool {
+	m.fill()
+	return m.err != nil || len(m.window) == m.size
+}
+func (m *WindowIter[T]) Next() ([]T, error) {
+	m.fill()
+	if m.err != nil {
+		return nil, m.err
+	}
+	res := make([]T, len(m.window))
+	copy(res, m.window)
+	m.window = append(m.window[:0], m.window[1:]...)
+	return res, nil
+}
+func (m *WindowIter[T]) Close() { closeAll(m.it) }
+
+// ConcatIter - returns all elements of 1-st stream, then all elements of 2-nd stream, etc...
+type ConcatIter[T any] struct {
+	its []Unary[T]
+	i   int
+}
+
+func Concat[T any](its ...Unary[T]) *ConcatIter[T] { return &ConcatIter[T]{its: its} }
+func (m *ConcatIter[T]) HasNext() bool {
+	for ; m.i < len(m.its); m.i++ {
+		if m.its[m.i] != nil && m.its[m.i].HasNext() {
+			return true
+		}
+	}
+	return false
+}
+func (m *ConcatIter[T]) Next() (v T, err error) {
+	if !m.HasNext() {
+		return v, nil
+	}
+	return m.its[m.i].Next()
+}
+func (m *ConcatIter[T]) Close() { closeAll(m.its...) }
+
+type ConcatDualIter[K, V any] struct {
+	its []Dual[K, V]
+	i   int
+}
+
+func ConcatDual[K, V any](its ...Dual[K, V]) *ConcatDualIter[K, V] {
+	return &ConcatDualIter[K, V]{its: its}
+}
+func ConcatKV(its ...KV) *ConcatDualIter[[]byte, []byte] {
+	duals := make([]Dual[[]byte, []byte], len(its))
+	for i := range its {
+		duals[i] = its[i]
+	}
+	return ConcatDual[[]byte, []byte](duals...)
+}
+func (m *ConcatDualIter[K, V]) HasNext() bool {
+	for ; m.i < len(m.its); m.i++ {
+		if m.its[m.i] != nil && m.its[m.i].HasNext() {
+			return true
+		}
+	}
+	return false
+}
+func (m *ConcatDualIter[K, V]) Next() (k K, v V, err error) {
+	if !m.HasNext() {
+		return k, v, nil
+	}
+	return m.its[m.i].Next()
+}
+func (m *ConcatDualIter[K, V]) Close() { closeAll(m.its...) }
+
+// RangeKVIter - restricts ascending KV stream by [from, to). nil means unbounded.
+// Please prefer push-down of range to lower-level iterator (tx.Range) - it doesn't read skipped keys from disk.
+type RangeKVIter struct {
+	it           KV
+	from, to     []byte
+	hasNext      bool
+	nextK, nextV []byte
+	err          error
+}
+
+func RangeKV(it KV, from, to []byte) *RangeKVIter {
+	m := &RangeKVIter{it: it, from: from, to: to}
+	m.advance()
+	return m
+}
+func (m *RangeKVIter) advance() {
+	if m.err != nil {
+		return
+	}
+	m.hasNext = false
+	for m.it.HasNext() {
+		k, v, err := m.it.Next()
+		if err != nil {
+			m.err = err
+			return
+		}
+		if m.from != nil && bytes.Compare(k, m.from) < 0 {
+			continue
+		}
+		if m.to != nil && bytes.Compare(k, m.to) >= 0 {
+			return
+		}
+		m.hasNext, m.nextK, m.nextV = true, k, v
+		return
+	}
+}
+func (m *RangeKVIter) HasNext() bool { return m.err != nil || m.hasNext }
+func (m *RangeKVIter) Next() (k, v []byte, err error) {
+	k, v, err = m.nextK, m.nextV, m.err
+	m.advance()
+	return k, v, err
+}
+func (m *RangeKVIter) Close() { closeAll(m.it) }
+
+// Query - fluent builder over Unary stream combinators. Example:
+//
+//	it := iter.From[uint64](s).Filter(isEven).Skip(10).Take(5).Iter()
+type Query[T any] struct {
+	it Unary[T]
+}
+
+func From[T any](it Unary[T]) *Query[T] { return &Query[T]{it: it} }
+func (q *Query[T]) Filter(f func(T) bool) *Query[T] {
+	q.it = FilterUnary[T](q.it, f)
+	return q
+}
+func (q *Query[T]) Skip(n int) *Query[T] {
+	q.it = Skip[T](q.it, n)
+	return q
+}
+func (q *Query[T]) Take(n int) *Query[T] {
+	q.it = Take[T](q.it, n)
+	return q
+}
+func (q *Query[T]) Concat(its ...Unary[T]) *Query[T] {
+	q.it = Concat[T](append([]Unary[T]{q.it}, its...)...)
+	return q
+}
+func (q *Query[T]) MergeWith(cmp func(a, b T) int, its ...Unary[T]) *Query[T] {
+	q.it = MergeN[T](append([]Unary[T]{q.it}, its...), cmp, -1)
+	return q
+}
+func (q *Query[T]) Iter() Unary[T]        { return q.it }
+func (q *Query[T]) ToArray() ([]T, error) { return ToArr[T](q.it) }
+func (q *Query[T]) Close()                { closeAll(q.it) }
@@ -0,0 +1,298 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package iter_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"testing/quick"
+
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+)
+
+func cmpU8(a, b uint8) int { return int(a) - int(b) }
+
+func sortedCopy(arr []uint8) []uint8 {
+	arr = slices.Clone(arr)
+	slices.Sort(arr)
+	return arr
+}
+
+func toArr[T any](t *testing.T, it iter.Unary[T]) []T {
+	t.Helper()
+	res, err := iter.ToArr[T](it)
+	require.NoError(t, err)
+	return res
+}
+
+func TestMergeNProperty(t *testing.T) {
+	f := func(a, b, c []uint8) bool {
+		its := []iter.Unary[uint8]{iter.Array(sortedCopy(a)), iter.Array(sortedCopy(b)), iter.Array(sortedCopy(c))}
+		res := toArr[uint8](t, iter.MergeN[uint8](its, cmpU8, -1))
+		expect := sortedCopy(append(append(slices.Clone(a), b...), c...))
+		return len(res) == len(expect) && (len(res) == 0 || slices.Equal(res, expect))
+	}
+	require.NoError(t, quick.Check(f, nil))
+
+	desc := func(a, b uint8) int { return int(b) - int(a) }
+	its := []iter.Unary[uint8]{iter.ReverseArray([]uint8{1, 5, 9}), iter.ReverseArray([]uint8{2, 5})}
+	require.Equal(t, []uint8{9, 5, 5, 2}, toArr[uint8](t, iter.MergeN[uint8](its, desc, 4)))
+}
+
+func TestIntersectNProperty(t *testing.T) {
+	f := func(a, b, c []uint8) bool {
+		a, b, c = slices.Compact(sortedCopy(a)), slices.Compact(sortedCopy(b)), slices.Compact(sortedCopy(c))
+		its := []iter.Unary[uint8]{iter.Array(a), iter.Array(b), iter.Array(c)}
+		res := toArr[uint8](t, iter.IntersectN[uint8](its, cmpU8, -1))
+		var expect []uint8
+		for _, v := range a {
+			if slices.Contains(b, v) && slices.Contains(c, v) {
+				expect = append(expect, v)
+			}
+		}
+		return len(res) == len(expect) && (len(res) == 0 || slices.Equal(res, expect))
+	}
+	require.NoError(t, quick.Check(f, nil))
+
+	desc := func(a, b uint8) int { return int(b) - int(a) }
+	its := []iter.Unary[uint8]{iter.ReverseArray([]uint8{1, 2, 5, 7, 9}), iter.ReverseArray([]uint8{2, 5, 9})}
+	require.Equal(t, []uint8{9, 5}, toArr[uint8](t, iter.IntersectN[uint8](its, desc, 2)))
+	require.Equal(t, []uint8{3}, toArr[uint8](t, iter.IntersectN[uint8]([]iter.Unary[uint8]{iter.Array([]uint8{3})}, cmpU8, -1)))
+}
+
+func TestDistinctProperty(t *testing.T) {
+	f := func(a []uint8) bool {
+		res := toArr[uint8](t, iter.Distinct[uint8](iter.Array(sortedCopy(a))))
+		expect := slices.Compact(sortedCopy(a))
+		return len(res) == len(expect) && (len(res) == 0 || slices.Equal(res, expect))
+	}
+	require.NoError(t, quick.Check(f, nil))
+
+	byParity := iter.DistinctBy[uint8, bool](iter.Array([]uint8{2, 4, 1, 3, 6}), func(v uint8) bool { return v%2 == 0 })
+	require.Equal(t, []uint8{2, 1, 6}, toArr[uint8](t, byParity))
+}
+
+func TestDistinctKV(t *testing.T) {
+	keys := [][]byte{{1}, {1}, {2}, {3}, {3}, {3}}
+	values := [][]byte{{1}, {2}, {3}, {4}, {5}, {6}}
+	k, v, err := iter.ToKVArray(iter.DistinctKV(iter.PairsArray(keys, values)))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1}, {2}, {3}}, k)
+	require.Equal(t, [][]byte{{1}, {3}, {4}}, v)
+
+	// underlying iterator overwrites returned slices on each Next (like db cursors)
+	k, v, err = iter.ToKVArray(iter.DistinctKV(&reusingKV{keys: keys, values: values}))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1}, {2}, {3}}, k)
+	require.Equal(t, [][]byte{{1}, {3}, {4}}, v)
+}
+
+type reusingKV struct {
+	keys, values [][]byte
+	i            int
+	k, v         []byte
+}
+
+func (it *reusingKV) HasNext() bool { return it.i < len(it.keys) }
+func (it *reusingKV) Close()        {}
+func (it *reusingKV) Next() ([]byte, []byte, error) {
+	it.k, it.v = append(it.k[:0], it.keys[it.i]...), append(it.v[:0], it.values[it.i]...)
+	it.i++
+	return it.k, it.v, nil
+}
+
+func TestSkipTakeProperty(t *testing.T) {
+	f := func(a []uint8, skip, take uint8) bool {
+		s, n := int(skip)%(len(a)+2), int(take)%(len(a)+2)
+		res := toArr[uint8](t, iter.Take[uint8](iter.Skip[uint8](iter.Array(a), s), n))
+		from, to := s, s+n
+		if from > len(a) {
+			from = len(a)
+		}
+		if to > len(a) {
+			to = len(a)
+		}
+		return len(res) == to-from && (len(res) == 0 || slices.Equal(res, a[from:to]))
+	}
+	require.NoError(t, quick.Check(f, nil))
+
+	q := iter.From[uint8](iter.Array([]uint8{1, 2, 3, 4, 5, 6, 7, 8})).Filter(func(v uint8) bool { return v%2 == 0 }).Skip(1).Take(2)
+	res, err := q.ToArray()
+	require.NoError(t, err)
+	require.Equal(t, []uint8{4, 6}, res)
+
+	keys := [][]byte{{1}, {2}, {3}, {4}}
+	k, _, err := iter.ToKVArray(iter.TakeKV(iter.SkipKV(iter.PairsArray(keys, keys), 1), 2))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{2}, {3}}, k)
+}
+
+func TestConcatProperty(t *testing.T) {
+	f := func(a, b, c []uint8) bool {
+		res := toArr[uint8](t, iter.Concat[uint8](iter.Array(a), iter.Array(b), nil, iter.Array(c)))
+		expect := append(append(slices.Clone(a), b...), c...)
+		return len(res) == len(expect) && (len(res) == 0 || slices.Equal(res, expect))
+	}
+	require.NoError(t, quick.Check(f, nil))
+
+	keys := [][]byte{{1}, {2}}
+	k, _, err := iter.ToKVArray(iter.ConcatKV(iter.PairsArray(keys, keys), iter.EmptyKV, iter.PairsArray(keys, keys)))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1}, {2}, {1}, {2}}, k)
+}
+
+func TestZipProperty(t *testing.T) {
+	f := func(a []uint8, b []uint16) bool {
+		as, bs, err := iter.ToDualArray[uint8, uint16](iter.Zip[uint8, uint16](iter.Array(a), iter.Array(b)))
+		if err != nil {
+			return false
+		}
+		n := len(a)
+		if len(b) < n {
+			n = len(b)
+		}
+		return len(as) == n && len(bs) == n && (n == 0 || (slices.Equal(as, a[:n]) && slices.Equal(bs, b[:n])))
+	}
+	require.NoError(t, quick.Check(f, nil))
+}
+
+func TestBatchWindowProperty(t *testing.T) {
+	f := func(a []uint8, size uint8) bool {
+		n := int(size)%8 + 1
+		var flat []uint8
+		for _, batch := range toArr[[]uint8](t, iter.Batch[uint8](iter.Array(a), n)) {
+			if len(batch) == 0 || len(batch) > n {
+				return false
+			}
+			flat = append(flat, batch...)
+		}
+		if len(flat) != len(a) || (len(a) > 0 && !slices.Equal(flat, a)) {
+			return false
+		}
+
+		windows := toArr[[]uint8](t, iter.Window[uint8](iter.Array(a), n))
+		expectWindows := len(a) - n + 1
+		if expectWindows < 0 {
+			expectWindows = 0
+		}
+		if len(windows) != expectWindows {
+			return false
+		}
+		for i, w := range windows {
+			if !slices.Equal(w, a[i:i+n]) {
+				return false
+			}
+		}
+		return true
+	}
+	require.NoError(t, quick.Check(f, nil))
+}
+
+func TestRangeKV(t *testing.T) {
+	keys := [][]byte{{1}, {2}, {3}, {4}, {5}}
+	k, _, err := iter.ToKVArray(iter.RangeKV(iter.PairsArray(keys, keys), []byte{2}, []byte{4}))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{2}, {3}}, k)
+
+	k, _, err = iter.ToKVArray(iter.RangeKV(iter.PairsArray(keys, keys), nil, []byte{2}))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1}}, k)
+
+	k, _, err = iter.ToKVArray(iter.RangeKV(iter.PairsArray(keys, keys), []byte{4}, nil))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{4}, {5}}, k)
+}
+
+// closeTracker - stream which returns error at `errorAt` and remembers Close() call
+type closeTracker struct {
+	arr     []uint8
+	errorAt int
+	i       int
+	closed  bool
+}
+
+var errTracker = errors.New("tracker")
+
+func (it *closeTracker) HasNext() bool { return it.i < len(it.arr) }
+func (it *closeTracker) Next() (uint8, error) {
+	if it.i == it.errorAt {
+		return 0, errTracker
+	}
+	it.i++
+	return it.arr[it.i-1], nil
+}
+func (it *closeTracker) Close() { it.closed = true }
+
+func TestCombinatorsErrorsAndClose(t *testing.T) {
+	build := map[string]func(x, y iter.Unary[uint8]) iter.Unary[uint8]{
+		"merge": func(x, y iter.Unary[uint8]) iter.Unary[uint8] {
+			return iter.MergeN[uint8]([]iter.Unary[uint8]{x, y}, cmpU8, -1)
+		},
+		"distinct": func(x, y iter.Unary[uint8]) iter.Unary[uint8] { return iter.Concat[uint8](iter.Distinct[uint8](x), y) },
+		"skip":     func(x, y iter.Unary[uint8]) iter.Unary[uint8] { return iter.Concat[uint8](iter.Skip[uint8](x, 1), y) },
+		"take":     func(x, y iter.Unary[uint8]) iter.Unary[uint8] { return iter.Concat[uint8](iter.Take[uint8](x, 10), y) },
+		"concat":   func(x, y iter.Unary[uint8]) iter.Unary[uint8] { return iter.Concat[uint8](x, y) },
+		"query":    func(x, y iter.Unary[uint8]) iter.Unary[uint8] { return iter.From[uint8](x).Skip(1).Concat(y).Iter() },
+	}
+	for name, f := range build {
+		t.Run(name, func(t *testing.T) {
+			x := &closeTracker{arr: []uint8{1, 2, 3, 4}, errorAt: 2}
+			y := &closeTracker{arr: []uint8{1, 2, 3, 4}, errorAt: -1}
+			it := f(x, y)
+			var err error
+			for it.HasNext() {
+				if _, err = it.Next(); err != nil {
+					break
+				}
+			}
+			require.ErrorIs(t, err, errTracker)
+			it.(iter.Closer).Close()
+			require.True(t, x.closed)
+			require.True(t, y.closed)
+		})
+	}
+
+	t.Run("zip", func(t *testing.T) {
+		x := &closeTracker{arr: []uint8{1, 2, 3, 4}, errorAt: 2}
+		y := &closeTracker{arr: []uint8{1, 2, 3, 4}, errorAt: -1}
+		it := iter.Zip[uint8, uint8](x, y)
+		_, _, err := iter.ToDualArray[uint8, uint8](it)
+		require.ErrorIs(t, err, errTracker)
+		it.Close()
+		require.True(t, x.closed)
+		require.True(t, y.closed)
+	})
+	t.Run("kv", func(t *testing.T) {
+		_, _, err := iter.ToKVArray(iter.DistinctKV(iter.PairsWithError(3)))
+		require.Error(t, err)
+		_, _, err = iter.ToKVArray(iter.RangeKV(iter.PairsWithError(3), nil, nil))
+		require.Error(t, err)
+		_, _, err = iter.ToKVArray(iter.SkipKV(iter.PairsWithError(3), 5))
+		require.Error(t, err)
+		_, _, err = iter.ToKVArray(iter.TakeKV(iter.PairsWithError(3), 5))
+		require.Error(t, err)
+		k, _, err := iter.ToKVArray(iter.TakeKV(iter.PairsWithError(3), 2))
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte(fmt.Sprintf("%x", 1)), []byte(fmt.Sprintf("%x", 2))}, k)
+		_, _, err = iter.ToKVArray(iter.RangeKV(iter.PairsArray([][]byte{{1}}, [][]byte{{1}}), bytes.Repeat([]byte{0}, 1), nil))
+		require.NoError(t, err)
+	})
+}
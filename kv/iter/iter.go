@@ -69,6 +69,26 @@ func (it *ArrStream[V]) NextBatch() ([]V, error) {
 	return v, nil
 }
 
+type ArrDualStream[K, V any] struct {
+	keys   []K
+	values []V
+	i      int
+}
+
+func ArrayDual[K, V any](keys []K, values []V) *ArrDualStream[K, V] {
+	return &ArrDualStream[K, V]{keys: keys, values: values}
+}
+func PairsArray(keys, values [][]byte) *ArrDualStream[[]byte, []byte] {
+	return ArrayDual[[]byte, []byte](keys, values)
+}
+func (it *ArrDualStream[K, V]) HasNext() bool { return it.i < len(it.keys) }
+func (it *ArrDualStream[K, V]) Close()        {}
+func (it *ArrDualStream[K, V]) Next() (K, V, error) {
+	k, v := it.keys[it.i], it.values[it.i]
+	it.i++
+	return k, v, nil
+}
+
 func Range[T constraints.Integer](from, to T) *RangeIter[T] {
 	if from == to {
 		to++
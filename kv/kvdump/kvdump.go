@@ -0,0 +1,346 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package kvdump - streaming dump format for set of kv tables. Used to move tables between db files, machines
+// and test fixtures.
+//
+// Format (everything below is gzip-compressed):
+//
+//	magic "erigon-kvdump" | version u8
+//	for each table (sorted by name):
+//	  frameTable    | uvarint(len(name)) | name | uvarint(TableFlags) | u8(AutoDupSortKeysConversion)
+//	  framePair     | uvarint(len(k)) | k | uvarint(len(v)) | v      -- in order of table's cursor
+//	  ...
+//	  frameTableEnd | uvarint(amount of pairs)
+//	frameEnd | crc32c of all uncompressed bytes before it (u32 big-endian)
+package kvdump
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+const (
+	magic   = "erigon-kvdump"
+	version = 1
+
+	maxNameLen = 1024
+	maxItemLen = 1 << 30
+	readChunk  = 64 * 1024
+)
+
+const (
+	frameEnd byte = iota
+	frameTable
+	framePair
+	frameTableEnd
+)
+
+var (
+	ErrBadMagic      = errors.New("kvdump: bad magic")
+	ErrBadVersion    = errors.New("kvdump: unsupported version")
+	ErrBadChecksum   = errors.New("kvdump: checksum mismatch")
+	ErrCorrupted     = errors.New("kvdump: corrupted stream")
+	ErrTableNotEmpty = errors.New("kvdump: target table is not empty")
+	ErrTableCfg      = errors.New("kvdump: table config of dump doesn't match target db")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Export - writes all key/values of given tables to w. Tables are written in sorted order,
+// key/values - in cursor order (for DupSort tables: sorted by key, then by value).
+func Export(tx kv.Tx, tables kv.TableCfg, w io.Writer) error {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	enc := &encoder{w: bw, h: crc32.New(castagnoli)}
+	enc.writeBytes([]byte(magic))
+	enc.writeByte(version)
+	for _, name := range names {
+		if err := exportTable(tx, name, tables[name], enc); err != nil {
+			return err
+		}
+	}
+	enc.writeByte(frameEnd)
+	if enc.err != nil {
+		return enc.err
+	}
+	if err := binary.Write(bw, binary.BigEndian, enc.h.Sum32()); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func exportTable(tx kv.Tx, name string, cfg kv.TableCfgItem, enc *encoder) error {
+	enc.writeByte(frameTable)
+	enc.writeUvarint(uint64(len(name)))
+	enc.writeBytes([]byte(name))
+	enc.writeUvarint(uint64(cfg.Flags))
+	if cfg.AutoDupSortKeysConversion {
+		enc.writeByte(1)
+	} else {
+		enc.writeByte(0)
+	}
+
+	c, err := tx.Cursor(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	var amount uint64
+	for k, v, err := c.First(); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return fmt.Errorf("kvdump: export %s: %w", name, err)
+		}
+		enc.writeByte(framePair)
+		enc.writeUvarint(uint64(len(k)))
+		enc.writeBytes(k)
+		enc.writeUvarint(uint64(len(v)))
+		enc.writeBytes(v)
+		if enc.err != nil {
+			return enc.err
+		}
+		amount++
+	}
+	enc.writeByte(frameTableEnd)
+	enc.writeUvarint(amount)
+	return enc.err
+}
+
+// Import - loads stream produced by Export. All tables from stream must exist and be empty in target db,
+// `tables` - TableCfg of target db (see kv.RoDB.AllTables): flags of tables in stream must match it.
+// Data is loaded by Append/AppendDup. Returns amount of loaded pairs per table.
+func Import(tx kv.RwTx, tables kv.TableCfg, r io.Reader) (map[string]uint64, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	dec := &decoder{r: bufio.NewReader(zr), h: crc32.New(castagnoli)}
+
+	head := dec.readBytes(len(magic), nil)
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	if string(head) != magic {
+		return nil, ErrBadMagic
+	}
+	if v := dec.readByte(); dec.err == nil && v != version {
+		return nil, fmt.Errorf("%w: %d", ErrBadVersion, v)
+	}
+
+	loaded := map[string]uint64{}
+	for {
+		frame := dec.readByte()
+		if dec.err != nil {
+			return nil, dec.err
+		}
+		switch frame {
+		case frameTable:
+			name, amount, err := importTable(tx, tables, dec)
+			if err != nil {
+				return nil, err
+			}
+			loaded[name] = amount
+		case frameEnd:
+			expect := dec.h.Sum32()
+			var got uint32
+			if err := binary.Read(dec.r, binary.BigEndian, &got); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrCorrupted, err)
+			}
+			if got != expect {
+				return nil, ErrBadChecksum
+			}
+			return loaded, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected frame %d", ErrCorrupted, frame)
+		}
+	}
+}
+
+func importTable(tx kv.RwTx, tables kv.TableCfg, dec *decoder) (name string, amount uint64, err error) {
+	name = string(dec.readBytes(dec.readLen(maxNameLen), nil))
+	flags := kv.TableFlags(dec.readUvarint())
+	autoDupSort := dec.readByte() == 1
+	if dec.err != nil {
+		return "", 0, dec.err
+	}
+	// Append into DupSort table (or AppendDup into not DupSort) corrupts data or fails in the middle of import
+	cfg, ok := tables[name]
+	if !ok {
+		return "", 0, fmt.Errorf("%w: table %s is not in TableCfg of target db", ErrTableCfg, name)
+	}
+	if cfg.Flags != flags || cfg.AutoDupSortKeysConversion != autoDupSort {
+		return "", 0, fmt.Errorf("%w: table %s has flags %d (AutoDupSortKeysConversion=%t) in dump and %d (AutoDupSortKeysConversion=%t) in target db",
+			ErrTableCfg, name, flags, autoDupSort, cfg.Flags, cfg.AutoDupSortKeysConversion)
+	}
+
+	c, err := tx.RwCursorDupSort(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer c.Close()
+	if k, _, err := c.First(); err != nil {
+		return "", 0, err
+	} else if k != nil {
+		return "", 0, fmt.Errorf("%w: %s", ErrTableNotEmpty, name)
+	}
+
+	for {
+		frame := dec.readByte()
+		if dec.err != nil {
+			return "", 0, dec.err
+		}
+		switch frame {
+		case framePair:
+			dec.k = dec.readBytes(dec.readLen(maxItemLen), dec.k)
+			dec.v = dec.readBytes(dec.readLen(maxItemLen), dec.v)
+			k, v := dec.k, dec.v
+			if dec.err != nil {
+				return "", 0, dec.err
+			}
+			switch {
+			case autoDupSort: // keys transformation doesn't preserve order - can't use Append
+				err = c.Put(k, v)
+			case flags&kv.DupSort != 0:
+				err = c.AppendDup(k, v)
+			default:
+				err = c.Append(k, v)
+			}
+			if err != nil {
+				return "", 0, fmt.Errorf("kvdump: import %s: %w", name, err)
+			}
+			amount++
+		case frameTableEnd:
+			expect := dec.readUvarint()
+			if dec.err != nil {
+				return "", 0, dec.err
+			}
+			if expect != amount {
+				return "", 0, fmt.Errorf("%w: table %s has %d pairs, expected %d", ErrCorrupted, name, amount, expect)
+			}
+			return name, amount, nil
+		default:
+			return "", 0, fmt.Errorf("%w: unexpected frame %d in table %s", ErrCorrupted, frame, name)
+		}
+	}
+}
+
+// encoder - remembers first error, to keep frames writing code linear
+type encoder struct {
+	w   *bufio.Writer
+	h   hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	if e.err != nil {
+		return
+	}
+	_, _ = e.h.Write(b)
+	_, e.err = e.w.Write(b)
+}
+func (e *encoder) writeByte(b byte) {
+	e.buf[0] = b
+	e.writeBytes(e.buf[:1])
+}
+func (e *encoder) writeUvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	e.writeBytes(e.buf[:n])
+}
+
+type decoder struct {
+	r    *bufio.Reader
+	h    hash.Hash32
+	k, v []byte // buffers of current pair, db copies them on Append
+	err  error
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		d.err = fmt.Errorf("%w: %s", ErrCorrupted, err)
+		return 0
+	}
+	_, _ = d.h.Write([]byte{b})
+	return b
+}
+
+// readBytes - reads n bytes into buf[:0]. `n` is taken from stream, so buf grows by readChunk
+// as bytes arrive: truncated or corrupted stream can't make it allocate up to maxItemLen
+func (d *decoder) readBytes(n int, buf []byte) []byte {
+	buf = buf[:0]
+	for len(buf) < n && d.err == nil {
+		from := len(buf)
+		chunk := n - from
+		if chunk > readChunk {
+			chunk = readChunk
+		}
+		buf = append(buf, make([]byte, chunk)...)
+		if _, err := io.ReadFull(d.r, buf[from:]); err != nil {
+			d.err = fmt.Errorf("%w: %s", ErrCorrupted, err)
+		}
+	}
+	if d.err != nil {
+		return nil
+	}
+	_, _ = d.h.Write(buf)
+	return buf
+}
+func (d *decoder) readUvarint() uint64 {
+	var v uint64
+	for shift := uint(0); d.err == nil; shift += 7 {
+		if shift >= 64 {
+			d.err = fmt.Errorf("%w: varint overflow", ErrCorrupted)
+			return 0
+		}
+		b := d.readByte()
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v
+		}
+	}
+	return 0
+}
+func (d *decoder) readLen(limit uint64) int {
+	l := d.readUvarint()
+	if d.err == nil && l > limit {
+		d.err = fmt.Errorf("%w: length %d exceeds limit %d", ErrCorrupted, l, limit)
+		return 0
+	}
+	return int(l)
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package kvdump
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"runtime"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func dumpTables() kv.TableCfg {
+	return kv.TableCfg{
+		kv.Headers:        kv.ChaindataTablesCfg[kv.Headers],
+		kv.TblAccountKeys: kv.ChaindataTablesCfg[kv.TblAccountKeys],
+		kv.PlainState:     kv.ChaindataTablesCfg[kv.PlainState],
+		kv.BlockBody:      kv.ChaindataTablesCfg[kv.BlockBody], // empty table
+	}
+}
+
+func fill(t *testing.T, tx kv.RwTx) {
+	t.Helper()
+	for i := uint64(0); i < 100; i++ {
+		k := make([]byte, 8)
+		binary.BigEndian.PutUint64(k, i)
+		require.NoError(t, tx.Put(kv.Headers, k, bytes.Repeat(k, int(i%5))))
+		for j := uint64(0); j < i%4; j++ {
+			v := make([]byte, 8)
+			binary.BigEndian.PutUint64(v, j*1000+i)
+			require.NoError(t, tx.Put(kv.TblAccountKeys, k, v))
+		}
+		addr := bytes.Repeat([]byte{byte(i)}, 20)
+		require.NoError(t, tx.Put(kv.PlainState, addr, k))
+		storageKey := append(append(addr, k...), bytes.Repeat([]byte{byte(i)}, 32)...)
+		require.NoError(t, tx.Put(kv.PlainState, storageKey, k))
+	}
+}
+
+func readAll(t *testing.T, tx kv.Tx, table string) (res [][2][]byte) {
+	t.Helper()
+	require.NoError(t, tx.ForEach(table, nil, func(k, v []byte) error {
+		res = append(res, [2][]byte{k, v})
+		return nil
+	}))
+	return res
+}
+
+func TestRoundTrip(t *testing.T) {
+	require := require.New(t)
+	_, src := memdb.NewTestTx(t)
+	fill(t, src)
+
+	buf := &bytes.Buffer{}
+	require.NoError(Export(src, dumpTables(), buf))
+	dump := buf.Bytes()
+
+	dstDB, dst := memdb.NewTestTx(t)
+	loaded, err := Import(dst, dstDB.AllTables(), bytes.NewReader(dump))
+	require.NoError(err)
+	require.Equal(uint64(100), loaded[kv.Headers])
+	require.Equal(uint64(0), loaded[kv.BlockBody])
+	require.Equal(uint64(200), loaded[kv.PlainState])
+	for table := range dumpTables() {
+		require.Equal(readAll(t, src, table), readAll(t, dst, table), table)
+	}
+
+	// export is deterministic
+	buf2 := &bytes.Buffer{}
+	require.NoError(Export(dst, dumpTables(), buf2))
+	require.Equal(dump, buf2.Bytes())
+
+	// import into non-empty table
+	_, err = Import(dst, dstDB.AllTables(), bytes.NewReader(dump))
+	require.ErrorIs(err, ErrTableNotEmpty)
+}
+
+func TestCorrupted(t *testing.T) {
+	require := require.New(t)
+	_, src := memdb.NewTestTx(t)
+	fill(t, src)
+	buf := &bytes.Buffer{}
+	require.NoError(Export(src, dumpTables(), buf))
+
+	dstDB, dst := memdb.NewTestTx(t)
+	_, err := Import(dst, dstDB.AllTables(), bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	require.Error(err)
+}
+
+func TestTableCfgMismatch(t *testing.T) {
+	require := require.New(t)
+	_, src := memdb.NewTestTx(t)
+	fill(t, src)
+	buf := &bytes.Buffer{}
+	require.NoError(Export(src, dumpTables(), buf))
+
+	for name, target := range map[string]kv.TableCfg{
+		"not dupsort":        {kv.Headers: {}, kv.TblAccountKeys: {}, kv.PlainState: {}, kv.BlockBody: {}},
+		"dupsort":            {kv.Headers: {Flags: kv.DupSort}, kv.TblAccountKeys: {Flags: kv.DupSort}, kv.PlainState: {Flags: kv.DupSort}, kv.BlockBody: {}},
+		"no keys conversion": {kv.Headers: {}, kv.TblAccountKeys: {Flags: kv.DupSort}, kv.PlainState: {Flags: kv.DupSort}, kv.BlockBody: {}},
+		"unknown table":      {kv.Headers: {}},
+	} {
+		_, dst := memdb.NewTestTx(t)
+		_, err := Import(dst, target, bytes.NewReader(buf.Bytes()))
+		require.ErrorIs(err, ErrTableCfg, name)
+	}
+}
+
+// length of item is taken from stream: memory must be allocated only for bytes which are really in stream
+func TestCorruptedLength(t *testing.T) {
+	require := require.New(t)
+	raw := &bytes.Buffer{}
+	enc := &encoder{w: bufio.NewWriter(raw), h: crc32.New(castagnoli)}
+	enc.writeBytes([]byte(magic))
+	enc.writeByte(version)
+	enc.writeByte(frameTable)
+	enc.writeUvarint(uint64(len(kv.Headers)))
+	enc.writeBytes([]byte(kv.Headers))
+	enc.writeUvarint(0)
+	enc.writeByte(0)
+	enc.writeByte(framePair)
+	enc.writeUvarint(maxItemLen)
+	enc.writeBytes([]byte{1, 2, 3})
+	require.NoError(enc.w.Flush())
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(raw.Bytes())
+	require.NoError(err)
+	require.NoError(zw.Close())
+
+	dstDB, dst := memdb.NewTestTx(t)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = Import(dst, dstDB.AllTables(), bytes.NewReader(buf.Bytes()))
+	runtime.ReadMemStats(&after)
+	require.ErrorIs(err, ErrCorrupted)
+	require.Less(after.TotalAlloc-before.TotalAlloc, uint64(maxItemLen/16))
+}
@@ -0,0 +1,257 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package migrations
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Migration - named data migration. Migration work is split into steps: each Step call
+// receives `progress` returned by previous call (nil on first call) and does some bounded amount of work.
+// Not nil progress is persisted in kv.DatabaseInfo on each commit - it makes migration resumable after interruption.
+//
+// Step must be deterministic with respect to `progress`: if process was killed between commits,
+// steps after last commit will be re-executed with same `progress`.
+type Migration struct {
+	Name string
+	// Tables - tables written by migration, with config it expects. They must be in TableCfg of db with same flags,
+	// not existing ones are created by kv.BucketMigrator before first step.
+	Tables kv.TableCfg
+	// Drop - deprecated tables (see kv.TableCfgItem.IsDeprecated) dropped by kv.BucketMigrator when migration is applied
+	Drop []string
+	// CommitEvery - amount of Step calls per commit. 0 means commit after each step.
+	CommitEvery int
+	// Step - does one unit of work. Returns progress for next call (nil - start over), done=true - when migration finished.
+	Step func(ctx context.Context, tx kv.RwTx, progress []byte) (next []byte, done bool, err error)
+}
+
+var (
+	ErrDuplicateName = errors.New("duplicate migration name")
+	ErrEmptyName     = errors.New("migration name can't be empty")
+	ErrTableCfg      = errors.New("table config of migration doesn't match db")
+)
+
+// Keys in kv.DatabaseInfo table:
+//
+//	migration.applied.<name>  -> unix_timestamp_u64 of migration finish
+//	migration.progress.<name> -> progress returned by last committed Step
+var (
+	appliedPrefix  = []byte("migration.applied.")
+	progressPrefix = []byte("migration.progress.")
+)
+
+func appliedKey(name string) []byte  { return append(common.Copy(appliedPrefix), name...) }
+func progressKey(name string) []byte { return append(common.Copy(progressPrefix), name...) }
+
+// Migrator - ordered registry of migrations. Migrations are applied in order of registration:
+// next migration is not started until all previous are applied.
+type Migrator struct {
+	migrations []Migration
+	logger     log.Logger
+}
+
+func NewMigrator(logger log.Logger) *Migrator { return &Migrator{logger: logger} }
+
+func (m *Migrator) Register(mig Migration) error {
+	if mig.Name == "" {
+		return ErrEmptyName
+	}
+	for _, existing := range m.migrations {
+		if existing.Name == mig.Name {
+			return fmt.Errorf("%w: %s", ErrDuplicateName, mig.Name)
+		}
+	}
+	m.migrations = append(m.migrations, mig)
+	return nil
+}
+
+func (m *Migrator) Migrations() []Migration { return m.migrations }
+
+// Applied - return true if migration with given name finished
+func Applied(tx kv.Getter, name string) (bool, error) {
+	v, err := tx.GetOne(kv.DatabaseInfo, appliedKey(name))
+	if err != nil {
+		return false, err
+	}
+	return v != nil, nil
+}
+
+// Progress - return progress of last committed Step of not-finished migration. nil means: not started or finished.
+func Progress(tx kv.Getter, name string) ([]byte, error) {
+	v, err := tx.GetOne(kv.DatabaseInfo, progressKey(name))
+	if err != nil {
+		return nil, err
+	}
+	return common.Copy(v), nil
+}
+
+// Pending - names of registered but not applied migrations, in order of application
+func (m *Migrator) Pending(tx kv.Getter) ([]string, error) {
+	var pending []string
+	for _, mig := range m.migrations {
+		applied, err := Applied(tx, mig.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !applied {
+			pending = append(pending, mig.Name)
+		}
+	}
+	return pending, nil
+}
+
+// Apply - runs all pending migrations. Safe to call many times. If ctx canceled - progress of all
+// committed steps stays in db and next Apply call will continue from it.
+func (m *Migrator) Apply(ctx context.Context, db kv.RwDB) error {
+	for i := range m.migrations {
+		if err := m.apply(ctx, db, &m.migrations[i]); err != nil {
+			return fmt.Errorf("migration %s: %w", m.migrations[i].Name, err)
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) apply(ctx context.Context, db kv.RwDB, mig *Migration) error {
+	var applied bool
+	if err := db.View(ctx, func(tx kv.Tx) (err error) {
+		applied, err = Applied(tx, mig.Name)
+		return err
+	}); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if err := checkTables(db.AllTables(), mig.Tables); err != nil {
+		return err
+	}
+
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	m.logger.Info("[migrations] start", "name", mig.Name)
+	for done := false; !done; {
+		if err := db.Update(ctx, func(tx kv.RwTx) error {
+			progress, err := Progress(tx, mig.Name)
+			if err != nil {
+				return err
+			}
+			if progress == nil {
+				if err = createTables(tx, mig.Tables); err != nil {
+					return err
+				}
+			}
+			for i := 0; i < mig.CommitEvery || i == 0; i++ {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-logEvery.C:
+					m.logger.Info("[migrations] progress", "name", mig.Name, "progress", fmt.Sprintf("%x", progress))
+				default:
+				}
+
+				progress, done, err = mig.Step(ctx, tx, progress)
+				if err != nil {
+					return err
+				}
+				if done {
+					if err = dropTables(tx, mig.Drop); err != nil {
+						return err
+					}
+					return markApplied(tx, mig.Name)
+				}
+			}
+			if progress == nil { // start over
+				return tx.Delete(kv.DatabaseInfo, progressKey(mig.Name))
+			}
+			return tx.Put(kv.DatabaseInfo, progressKey(mig.Name), progress)
+		}); err != nil {
+			return err
+		}
+	}
+	m.logger.Info("[migrations] applied", "name", mig.Name)
+	return nil
+}
+
+func markApplied(tx kv.RwTx, name string) error {
+	if err := tx.Delete(kv.DatabaseInfo, progressKey(name)); err != nil {
+		return err
+	}
+	finishedAt := make([]byte, 8)
+	binary.BigEndian.PutUint64(finishedAt, uint64(time.Now().Unix()))
+	return tx.Put(kv.DatabaseInfo, appliedKey(name), finishedAt)
+}
+
+// checkTables - tables of migration must be in TableCfg of db with same layout: Append/Put of migration
+// into DupSort table (or opposite) leads to corrupted data
+func checkTables(have kv.TableCfg, want kv.TableCfg) error {
+	for _, name := range sortedTables(want) {
+		cfg, ok := have[name]
+		if !ok {
+			return fmt.Errorf("%w: table %s is not in TableCfg of db", ErrTableCfg, name)
+		}
+		if cfg.Flags != want[name].Flags || cfg.AutoDupSortKeysConversion != want[name].AutoDupSortKeysConversion {
+			return fmt.Errorf("%w: table %s has flags %d (AutoDupSortKeysConversion=%t) in db, migration expects %d (AutoDupSortKeysConversion=%t)",
+				ErrTableCfg, name, cfg.Flags, cfg.AutoDupSortKeysConversion, want[name].Flags, want[name].AutoDupSortKeysConversion)
+		}
+	}
+	return nil
+}
+
+func createTables(tx kv.RwTx, tables kv.TableCfg) error {
+	for _, name := range sortedTables(tables) {
+		exists, err := tx.ExistsBucket(name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err = tx.CreateBucket(name); err != nil {
+			return fmt.Errorf("create table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func dropTables(tx kv.RwTx, tables []string) error {
+	for _, name := range tables {
+		if err := tx.DropBucket(name); err != nil {
+			return fmt.Errorf("drop table %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func sortedTables(tables kv.TableCfg) []string {
+	names := make([]string, 0, len(tables))
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package migrations
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// copyMigration - copy kv.Headers to kv.BlockBody by 1 key per step
+func copyMigration(onStep func(k []byte)) Migration {
+	return Migration{
+		Name:        "copy_headers",
+		Tables:      kv.TableCfg{kv.BlockBody: kv.ChaindataTablesCfg[kv.BlockBody]},
+		CommitEvery: 2,
+		Step: func(ctx context.Context, tx kv.RwTx, progress []byte) ([]byte, bool, error) {
+			c, err := tx.Cursor(kv.Headers)
+			if err != nil {
+				return nil, false, err
+			}
+			defer c.Close()
+			var k, v []byte
+			if len(progress) == 0 {
+				k, v, err = c.First()
+			} else {
+				if _, _, err = c.SeekExact(progress); err != nil {
+					return nil, false, err
+				}
+				k, v, err = c.Next()
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			if k == nil {
+				return nil, true, nil
+			}
+			if onStep != nil {
+				onStep(k)
+			}
+			if err := tx.Put(kv.BlockBody, k, v); err != nil {
+				return nil, false, err
+			}
+			return common.Copy(k), false, nil
+		},
+	}
+}
+
+func fillHeaders(t *testing.T, db kv.RwDB, n uint64) {
+	t.Helper()
+	err := db.Update(context.Background(), func(tx kv.RwTx) error {
+		for i := uint64(0); i < n; i++ {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, i)
+			if err := tx.Put(kv.Headers, k, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestApply(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	db := memdb.NewTestDB(t)
+	fillHeaders(t, db, 10)
+
+	m := NewMigrator(log.New())
+	require.NoError(m.Register(copyMigration(nil)))
+	require.ErrorIs(m.Register(copyMigration(nil)), ErrDuplicateName)
+	require.ErrorIs(m.Register(Migration{}), ErrEmptyName)
+
+	require.NoError(m.Apply(ctx, db))
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		cnt, err := tx.BucketSize(kv.BlockBody)
+		require.NoError(err)
+		require.NotZero(cnt)
+		applied, err := Applied(tx, "copy_headers")
+		require.NoError(err)
+		require.True(applied)
+		pending, err := m.Pending(tx)
+		require.NoError(err)
+		require.Empty(pending)
+		progress, err := Progress(tx, "copy_headers")
+		require.NoError(err)
+		require.Nil(progress)
+		return nil
+	}))
+
+	// second apply is noop
+	m2 := NewMigrator(log.New())
+	require.NoError(m2.Register(copyMigration(func(k []byte) { t.Fatalf("must not be called") })))
+	require.NoError(m2.Apply(ctx, db))
+}
+
+func TestResume(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	db := memdb.NewTestDB(t)
+	fillHeaders(t, db, 10)
+
+	interrupt := errors.New("interrupt")
+	m := NewMigrator(log.New())
+	var steps int
+	mig := copyMigration(func(k []byte) { steps++ })
+	step := mig.Step
+	mig.Step = func(ctx context.Context, tx kv.RwTx, progress []byte) ([]byte, bool, error) {
+		if steps == 7 {
+			return nil, false, interrupt
+		}
+		return step(ctx, tx, progress)
+	}
+	require.NoError(m.Register(mig))
+	require.ErrorIs(m.Apply(ctx, db), interrupt)
+
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		applied, err := Applied(tx, "copy_headers")
+		require.NoError(err)
+		require.False(applied)
+		progress, err := Progress(tx, "copy_headers")
+		require.NoError(err)
+		require.Equal(uint64(5), binary.BigEndian.Uint64(progress)) // 3 batches of 2 steps committed
+		return nil
+	}))
+
+	var resumedFrom []byte
+	m2 := NewMigrator(log.New())
+	require.NoError(m2.Register(copyMigration(func(k []byte) {
+		if resumedFrom == nil {
+			resumedFrom = common.Copy(k)
+		}
+	})))
+	require.NoError(m2.Apply(ctx, db))
+	require.Equal(uint64(6), binary.BigEndian.Uint64(resumedFrom))
+
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		for i := uint64(0); i < 10; i++ {
+			k := make([]byte, 8)
+			binary.BigEndian.PutUint64(k, i)
+			v, err := tx.GetOne(kv.BlockBody, k)
+			require.NoError(err)
+			require.Equal(k, v)
+		}
+		return nil
+	}))
+}
+
+func TestTables(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	logger := log.New()
+	dir := t.TempDir()
+	openDB := func(oldDeprecated bool) kv.RwDB {
+		return mdbx.NewMDBX(logger).Path(dir).WithTableCfg(func(kv.TableCfg) kv.TableCfg {
+			return kv.TableCfg{kv.DatabaseInfo: {}, "Old": {IsDeprecated: oldDeprecated}, "New": {Flags: kv.DupSort}}
+		}).MustOpen()
+	}
+	db := openDB(false)
+	require.NoError(db.Update(ctx, func(tx kv.RwTx) error { return tx.Put("Old", []byte{1}, []byte{1}) }))
+	db.Close()
+	db = openDB(true)
+	defer db.Close()
+
+	done := func(ctx context.Context, tx kv.RwTx, progress []byte) ([]byte, bool, error) { return nil, true, nil }
+	m := NewMigrator(logger)
+	require.NoError(m.Register(Migration{Name: "not_dupsort", Tables: kv.TableCfg{"New": {}}, Step: done}))
+	require.ErrorIs(m.Apply(ctx, db), ErrTableCfg)
+	m = NewMigrator(logger)
+	require.NoError(m.Register(Migration{Name: "unknown", Tables: kv.TableCfg{"Unknown": {}}, Step: done}))
+	require.ErrorIs(m.Apply(ctx, db), ErrTableCfg)
+
+	m = NewMigrator(logger)
+	require.NoError(m.Register(Migration{Name: "drop_old", Tables: kv.TableCfg{"New": {Flags: kv.DupSort}}, Drop: []string{"Old"}, Step: done}))
+	require.NoError(m.Apply(ctx, db))
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		tables, err := tx.(kv.BucketMigrator).ListBuckets()
+		require.NoError(err)
+		require.Contains(tables, "New")
+		require.NotContains(tables, "Old")
+		return nil
+	}))
+}
+
+func TestNilProgressNotStored(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	db := memdb.NewTestDB(t)
+
+	interrupt := errors.New("interrupt")
+	var steps int
+	m := NewMigrator(log.New())
+	require.NoError(m.Register(Migration{Name: "restart", Step: func(ctx context.Context, tx kv.RwTx, progress []byte) ([]byte, bool, error) {
+		steps++
+		switch steps {
+		case 1:
+			return []byte{1}, false, nil
+		case 2:
+			return nil, false, nil
+		default:
+			return nil, false, interrupt
+		}
+	}}))
+	require.ErrorIs(m.Apply(ctx, db), interrupt)
+	require.NoError(db.View(ctx, func(tx kv.Tx) error {
+		v, err := tx.GetOne(kv.DatabaseInfo, progressKey("restart"))
+		require.NoError(err)
+		require.Nil(v)
+		return nil
+	}))
+}
@@ -0,0 +1,331 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rawdbv3
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// TxNumsSegmentSize - amount of blocks in 1 frozen segment of TxNumsIndex
+const TxNumsSegmentSize = 1 << 14
+
+// TxNumsIndex - in-memory index of kv.MaxTxNum table. Alternative to TxNums for hot paths (history queries):
+//   - blockNum -> maxTxNum: O(1)
+//   - txNum -> blockNum: O(log(segments)) + O(1) search inside segment
+//
+// Blocks are stored in immutable Elias-Fano segments of TxNumsSegmentSize blocks, plus small mutable tail.
+// Index must be kept in sync with db by using it's Append/Truncate methods instead of TxNums.Append/TxNums.Truncate.
+// Changes are visible immediately (to readers of same RwTx), after end of RwTx call Commit or Rollback of index -
+// Rollback returns index to state of last Commit.
+type TxNumsIndex struct {
+	lock     sync.RWMutex
+	segments []*eliasfano32.EliasFano // segment i has blocks [i*TxNumsSegmentSize, (i+1)*TxNumsSegmentSize)
+	tail     []uint64                 // maxTxNum of blocks after segments
+	frozen   int                      // amount of segments loaded from file - Load doesn't read them from db
+
+	committed *txNumsIndexState // state before first not-committed change, nil if there are no such changes
+}
+
+type txNumsIndexState struct {
+	segments []*eliasfano32.EliasFano // segments are immutable - enough to copy slice
+	tail     []uint64
+}
+
+// saveCommitted - must be called before each change of index
+func (idx *TxNumsIndex) saveCommitted() {
+	if idx.committed != nil {
+		return
+	}
+	idx.committed = &txNumsIndexState{
+		segments: append([]*eliasfano32.EliasFano(nil), idx.segments...),
+		tail:     append([]uint64(nil), idx.tail...),
+	}
+}
+
+// Commit - must be called after commit of RwTx which had Append/Truncate of index
+func (idx *TxNumsIndex) Commit() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.committed = nil
+}
+
+// Rollback - must be called after rollback of RwTx which had Append/Truncate of index: drops their changes
+func (idx *TxNumsIndex) Rollback() {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if idx.committed == nil {
+		return
+	}
+	idx.segments, idx.tail, idx.committed = idx.committed.segments, idx.committed.tail, nil
+}
+
+func NewTxNumsIndex() *TxNumsIndex { return &TxNumsIndex{} }
+
+func (idx *TxNumsIndex) frozenBlocks() uint64 { return uint64(len(idx.segments)) * TxNumsSegmentSize }
+
+// Blocks - amount of indexed blocks
+func (idx *TxNumsIndex) Blocks() uint64 {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.frozenBlocks() + uint64(len(idx.tail))
+}
+
+// Load - reads kv.MaxTxNum table. Blocks which were loaded by OpenFrozen are not read from db.
+func (idx *TxNumsIndex) Load(tx kv.Tx) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.segments, idx.tail, idx.committed = idx.segments[:idx.frozen], idx.tail[:0], nil
+
+	var seek [8]byte
+	from := idx.frozenBlocks()
+	binary.BigEndian.PutUint64(seek[:], from)
+	c, err := tx.Cursor(kv.MaxTxNum)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for k, v, err := c.Seek(seek[:]); k != nil; k, v, err = c.Next() {
+		if err != nil {
+			return err
+		}
+		blockNum := binary.BigEndian.Uint64(k)
+		if expect := idx.frozenBlocks() + uint64(len(idx.tail)); blockNum != expect {
+			return fmt.Errorf("TxNumsIndex.Load: gap in %s, expected block %d, got %d", kv.MaxTxNum, expect, blockNum)
+		}
+		idx.appendMem(binary.BigEndian.Uint64(v))
+	}
+	return nil
+}
+
+// Append - TxNums.Append and update of index
+func (idx *TxNumsIndex) Append(tx kv.RwTx, blockNum, maxTxNum uint64) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if expect := idx.frozenBlocks() + uint64(len(idx.tail)); blockNum != expect {
+		return fmt.Errorf("TxNumsIndex.Append: index out of sync, expected block %d, got %d", expect, blockNum)
+	}
+	if err := TxNums.Append(tx, blockNum, maxTxNum); err != nil {
+		return err
+	}
+	idx.saveCommitted()
+	idx.appendMem(maxTxNum)
+	return nil
+}
+
+func (idx *TxNumsIndex) appendMem(maxTxNum uint64) {
+	idx.tail = append(idx.tail, maxTxNum)
+	if len(idx.tail) < TxNumsSegmentSize {
+		return
+	}
+	ef := eliasfano32.NewEliasFano(uint64(len(idx.tail)), idx.tail[len(idx.tail)-1])
+	for _, v := range idx.tail {
+		ef.AddOffset(v)
+	}
+	ef.Build()
+	idx.segments = append(idx.segments, ef)
+	idx.tail = idx.tail[:0]
+}
+
+// Truncate - TxNums.Truncate and update of index. Blocks loaded by OpenFrozen can't be truncated.
+func (idx *TxNumsIndex) Truncate(tx kv.RwTx, blockNum uint64) error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if blockNum < uint64(idx.frozen)*TxNumsSegmentSize {
+		return fmt.Errorf("TxNumsIndex.Truncate: block %d is in frozen file (has %d blocks)", blockNum, uint64(idx.frozen)*TxNumsSegmentSize)
+	}
+	if err := TxNums.Truncate(tx, blockNum); err != nil {
+		return err
+	}
+	idx.saveCommitted()
+	if blockNum >= idx.frozenBlocks() {
+		if keep := blockNum - idx.frozenBlocks(); keep < uint64(len(idx.tail)) {
+			idx.tail = idx.tail[:keep]
+		}
+		return nil
+	}
+	// truncate inside of segment: move it's head back to tail
+	segI := blockNum / TxNumsSegmentSize
+	seg := idx.segments[segI]
+	idx.segments = idx.segments[:segI]
+	idx.tail = idx.tail[:0]
+	for i := uint64(0); i < blockNum%TxNumsSegmentSize; i++ {
+		idx.tail = append(idx.tail, seg.Get(i))
+	}
+	return nil
+}
+
+func (idx *TxNumsIndex) max(blockNum uint64) (maxTxNum uint64, ok bool) {
+	if blockNum < idx.frozenBlocks() {
+		return idx.segments[blockNum/TxNumsSegmentSize].Get(blockNum % TxNumsSegmentSize), true
+	}
+	i := blockNum - idx.frozenBlocks()
+	if i >= uint64(len(idx.tail)) {
+		return 0, false
+	}
+	return idx.tail[i], true
+}
+
+// Max - returns maxTxNum in given block
+func (idx *TxNumsIndex) Max(blockNum uint64) (maxTxNum uint64, ok bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.max(blockNum)
+}
+
+// Min = `max(blockNum-1)+1` - returns minTxNum in given block
+func (idx *TxNumsIndex) Min(blockNum uint64) (minTxNum uint64, ok bool) {
+	if blockNum == 0 {
+		return 0, idx.Blocks() > 0
+	}
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	if _, ok = idx.max(blockNum); !ok {
+		return 0, false
+	}
+	prevMax, _ := idx.max(blockNum - 1)
+	return prevMax + 1, true
+}
+
+func (idx *TxNumsIndex) findBlockNum(txNum uint64) (blockNum uint64, ok bool) {
+	segI := sort.Search(len(idx.segments), func(i int) bool { return idx.segments[i].Max() >= txNum })
+	if segI < len(idx.segments) {
+		_, i, ok := idx.segments[segI].SearchIdx(txNum)
+		if !ok {
+			return 0, false
+		}
+		return uint64(segI)*TxNumsSegmentSize + i, true
+	}
+	i := sort.Search(len(idx.tail), func(i int) bool { return idx.tail[i] >= txNum })
+	if i == len(idx.tail) {
+		return 0, false
+	}
+	return idx.frozenBlocks() + uint64(i), true
+}
+
+// FindBlockNum - same semantic as TxNums.FindBlockNum: returns first block which has maxTxNum >= txNum
+func (idx *TxNumsIndex) FindBlockNum(txNum uint64) (blockNum uint64, ok bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	return idx.findBlockNum(txNum)
+}
+
+// MaxBatch - Max for many blocks under 1 lock. Not found blocks have value 0 and false in `found`.
+func (idx *TxNumsIndex) MaxBatch(blockNums []uint64, maxTxNums []uint64, found []bool) ([]uint64, []bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	for _, blockNum := range blockNums {
+		v, ok := idx.max(blockNum)
+		maxTxNums, found = append(maxTxNums, v), append(found, ok)
+	}
+	return maxTxNums, found
+}
+
+// FindBlockNumBatch - FindBlockNum for many txNums under 1 lock. Not found txNums have value 0 and false in `found`.
+func (idx *TxNumsIndex) FindBlockNumBatch(txNums []uint64, blockNums []uint64, found []bool) ([]uint64, []bool) {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	for _, txNum := range txNums {
+		v, ok := idx.findBlockNum(txNum)
+		blockNums, found = append(blockNums, v), append(found, ok)
+	}
+	return blockNums, found
+}
+
+// Frozen-file format: u64 amount of segments, then for each segment: u64 size of segment + Elias-Fano bytes.
+// All parts are multiple of 8 bytes - so segments can be read without copy.
+
+// WriteFrozen - writes all full segments (first blocks which are already in snapshots) to file `path`
+func (idx *TxNumsIndex) WriteFrozen(path string) error {
+	idx.lock.RLock()
+	defer idx.lock.RUnlock()
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var numBuf [8]byte
+	binary.BigEndian.PutUint64(numBuf[:], uint64(len(idx.segments)))
+	if _, err := w.Write(numBuf[:]); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, seg := range idx.segments {
+		buf = seg.AppendBytes(buf[:0])
+		binary.BigEndian.PutUint64(numBuf[:], uint64(len(buf)))
+		if _, err := w.Write(numBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// OpenFrozen - replaces content of index by segments from file `path`. Call Load after it to read blocks after frozen.
+func (idx *TxNumsIndex) OpenFrozen(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) < 8 {
+		return fmt.Errorf("TxNumsIndex.OpenFrozen: %s: too short file", path)
+	}
+	cnt := binary.BigEndian.Uint64(data)
+	segments := make([]*eliasfano32.EliasFano, 0, cnt)
+	pos := 8
+	for i := uint64(0); i < cnt; i++ {
+		if pos+8 > len(data) {
+			return fmt.Errorf("TxNumsIndex.OpenFrozen: %s: unexpected end of file", path)
+		}
+		size := int(binary.BigEndian.Uint64(data[pos:]))
+		pos += 8
+		if size < 16 || pos+size > len(data) {
+			return fmt.Errorf("TxNumsIndex.OpenFrozen: %s: unexpected end of file", path)
+		}
+		seg, _ := eliasfano32.ReadEliasFano(data[pos : pos+size])
+		if seg.Count() != TxNumsSegmentSize {
+			return fmt.Errorf("TxNumsIndex.OpenFrozen: %s: segment %d has %d blocks", path, i, seg.Count())
+		}
+		segments = append(segments, seg)
+		pos += size
+	}
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.segments, idx.tail, idx.frozen, idx.committed = segments, idx.tail[:0], len(segments), nil
+	return nil
+}
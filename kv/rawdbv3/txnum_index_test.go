@@ -0,0 +1,142 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package rawdbv3
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/memdb"
+	"github.com/stretchr/testify/require"
+)
+
+func checkAgainstDB(t *testing.T, tx kv.Tx, idx *TxNumsIndex, maxTxNum uint64) {
+	t.Helper()
+	require := require.New(t)
+	lastBlock, _, err := TxNums.Last(tx)
+	require.NoError(err)
+	require.Equal(lastBlock+1, idx.Blocks())
+	for blockNum := uint64(0); blockNum <= lastBlock; blockNum += 97 {
+		expect, err := TxNums.Max(tx, blockNum)
+		require.NoError(err)
+		got, ok := idx.Max(blockNum)
+		require.True(ok)
+		require.Equal(expect, got)
+
+		expect, err = TxNums.Min(tx, blockNum)
+		require.NoError(err)
+		got, ok = idx.Min(blockNum)
+		require.True(ok)
+		require.Equal(expect, got)
+	}
+	for txNum := uint64(0); txNum <= maxTxNum+10; txNum += 131 {
+		expectOk, expect, err := TxNums.FindBlockNum(tx, txNum)
+		require.NoError(err)
+		got, ok := idx.FindBlockNum(txNum)
+		require.Equal(expectOk, ok, txNum)
+		require.Equal(expect, got, txNum)
+	}
+}
+
+func TestTxNumsIndex(t *testing.T) {
+	require := require.New(t)
+	_, tx := memdb.NewTestTx(t)
+	idx := NewTxNumsIndex()
+
+	blocks := uint64(TxNumsSegmentSize*2 + 100)
+	var maxTxNum uint64
+	for blockNum := uint64(0); blockNum < blocks; blockNum++ {
+		maxTxNum += 2 + blockNum%7
+		require.NoError(idx.Append(tx, blockNum, maxTxNum))
+	}
+	checkAgainstDB(t, tx, idx, maxTxNum)
+
+	maxs, found := idx.MaxBatch([]uint64{0, 1, blocks - 1, blocks}, nil, nil)
+	require.Equal([]bool{true, true, true, false}, found)
+	require.Equal(maxTxNum, maxs[2])
+	blockNums, found := idx.FindBlockNumBatch([]uint64{0, maxTxNum, maxTxNum + 1}, nil, nil)
+	require.Equal([]bool{true, true, false}, found)
+	require.Equal([]uint64{0, blocks - 1, 0}, blockNums)
+
+	// re-load from db gives same index
+	idx2 := NewTxNumsIndex()
+	require.NoError(idx2.Load(tx))
+	checkAgainstDB(t, tx, idx2, maxTxNum)
+
+	// truncate in tail and inside of segment
+	require.NoError(idx.Truncate(tx, blocks-50))
+	checkAgainstDB(t, tx, idx, maxTxNum)
+	require.NoError(idx.Truncate(tx, TxNumsSegmentSize+10))
+	checkAgainstDB(t, tx, idx, maxTxNum)
+	lastBlock, maxTxNum, err := TxNums.Last(tx)
+	require.NoError(err)
+	for blockNum := lastBlock + 1; blockNum < blocks; blockNum++ {
+		maxTxNum += 3
+		require.NoError(idx.Append(tx, blockNum, maxTxNum))
+	}
+	checkAgainstDB(t, tx, idx, maxTxNum)
+
+	// frozen file
+	path := filepath.Join(t.TempDir(), "txnums.ef")
+	require.NoError(idx.WriteFrozen(path))
+	idx3 := NewTxNumsIndex()
+	require.NoError(idx3.OpenFrozen(path))
+	require.Equal(uint64(TxNumsSegmentSize*2), idx3.Blocks())
+	require.NoError(idx3.Load(tx))
+	checkAgainstDB(t, tx, idx3, maxTxNum)
+	require.Error(idx3.Truncate(tx, 10))
+}
+
+func TestTxNumsIndexRollback(t *testing.T) {
+	require := require.New(t)
+	db := memdb.NewTestDB(t)
+	idx := NewTxNumsIndex()
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(err)
+	var maxTxNum uint64
+	for blockNum := uint64(0); blockNum < TxNumsSegmentSize+10; blockNum++ {
+		maxTxNum += 3
+		require.NoError(idx.Append(tx, blockNum, maxTxNum))
+	}
+	require.NoError(tx.Commit())
+	idx.Commit()
+
+	// out of sync Append doesn't write to db
+	tx, err = db.BeginRw(context.Background())
+	require.NoError(err)
+	defer tx.Rollback()
+	require.Error(idx.Append(tx, TxNumsSegmentSize+20, maxTxNum+3))
+	lastBlock, _, err := TxNums.Last(tx)
+	require.NoError(err)
+	require.Equal(uint64(TxNumsSegmentSize+9), lastBlock)
+
+	// rolled back Truncate and Append are dropped from index
+	require.NoError(idx.Truncate(tx, 5))
+	for blockNum := uint64(5); blockNum < TxNumsSegmentSize+30; blockNum++ {
+		require.NoError(idx.Append(tx, blockNum, blockNum*5))
+	}
+	tx.Rollback()
+	idx.Rollback()
+
+	tx, err = db.BeginRw(context.Background())
+	require.NoError(err)
+	defer tx.Rollback()
+	checkAgainstDB(t, tx, idx, maxTxNum)
+}
@@ -406,6 +406,9 @@ const (
 	TblTracesToKeys   = "TracesToKeys"
 	TblTracesToIdx    = "TracesToIdx"
 
+	// name of state component (filenameBase + file extension) -> progress of its prune, see state.PruneStats
+	TblPruningProgress = "PruningProgress"
+
 	Snapshots = "Snapshots" // name -> hash
 
 	//State Reconstitution
@@ -571,6 +574,7 @@ var ChaindataTables = []string{
 	TblTracesFromIdx,
 	TblTracesToKeys,
 	TblTracesToIdx,
+	TblPruningProgress,
 
 	Snapshots,
 	MaxTxNum,
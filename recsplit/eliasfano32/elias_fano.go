@@ -251,6 +251,11 @@ func (ef *EliasFano) Search(v uint64) (uint64, bool) {
 	return n, ok
 }
 
+// SearchIdx - like Search, but also returns index of found value in the sequence
+func (ef *EliasFano) SearchIdx(v uint64) (nextV uint64, nextI uint64, ok bool) {
+	return ef.search(v)
+}
+
 func (ef *EliasFano) Max() uint64 {
 	return ef.maxOffset
 }
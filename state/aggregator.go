@@ -66,6 +66,8 @@ var (
 	mxCommitmentWriteTook      = metrics.GetOrCreateHistogram("domain_commitment_write_took")
 	mxCommitmentUpdates        = metrics.GetOrCreateCounter("domain_commitment_updates")
 	mxCommitmentUpdatesApplied = metrics.GetOrCreateCounter("domain_commitment_updates_applied")
+	mxExistenceFilterSkips     = metrics.GetOrCreateCounter("domain_existence_filter_skips")
+	mxExistenceFilterFalsePos  = metrics.GetOrCreateCounter("domain_existence_filter_false_positives")
 )
 
 type Aggregator struct {
@@ -121,34 +123,40 @@ func NewAggregator(dir, tmpdir string, aggregationStep uint64, commitmentMode Co
 	if err != nil {
 		return nil, err
 	}
-	if a.accounts, err = NewDomain(dir, tmpdir, aggregationStep, "accounts", kv.TblAccountKeys, kv.TblAccountVals, kv.TblAccountHistoryKeys, kv.TblAccountHistoryVals, kv.TblAccountIdx, false, false, logger); err != nil {
+	if a.accounts, err = NewDomain(dir, tmpdir, aggregationStep, "accounts", kv.TblAccountKeys, kv.TblAccountVals, kv.TblAccountHistoryKeys, kv.TblAccountHistoryVals, kv.TblAccountIdx, RawValues, false, logger); err != nil {
 		return nil, err
 	}
-	if a.storage, err = NewDomain(dir, tmpdir, aggregationStep, "storage", kv.TblStorageKeys, kv.TblStorageVals, kv.TblStorageHistoryKeys, kv.TblStorageHistoryVals, kv.TblStorageIdx, false, false, logger); err != nil {
+	if a.storage, err = NewDomain(dir, tmpdir, aggregationStep, "storage", kv.TblStorageKeys, kv.TblStorageVals, kv.TblStorageHistoryKeys, kv.TblStorageHistoryVals, kv.TblStorageIdx, RawValues, false, logger); err != nil {
 		return nil, err
 	}
-	if a.code, err = NewDomain(dir, tmpdir, aggregationStep, "code", kv.TblCodeKeys, kv.TblCodeVals, kv.TblCodeHistoryKeys, kv.TblCodeHistoryVals, kv.TblCodeIdx, true, true, logger); err != nil {
+	if a.code, err = NewDomain(dir, tmpdir, aggregationStep, "code", kv.TblCodeKeys, kv.TblCodeVals, kv.TblCodeHistoryKeys, kv.TblCodeHistoryVals, kv.TblCodeIdx, CompressedValues, true, logger); err != nil {
 		return nil, err
 	}
 
-	commitd, err := NewDomain(dir, tmpdir, aggregationStep, "commitment", kv.TblCommitmentKeys, kv.TblCommitmentVals, kv.TblCommitmentHistoryKeys, kv.TblCommitmentHistoryVals, kv.TblCommitmentIdx, false, true, logger)
+	commitd, err := NewDomain(dir, tmpdir, aggregationStep, "commitment", kv.TblCommitmentKeys, kv.TblCommitmentVals, kv.TblCommitmentHistoryKeys, kv.TblCommitmentHistoryVals, kv.TblCommitmentIdx, RawValues, true, logger)
 	if err != nil {
 		return nil, err
 	}
 	a.commitment = NewCommittedDomain(commitd, commitmentMode, commitTrieVariant, logger)
 
-	if a.logAddrs, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "logaddrs", kv.TblLogAddressKeys, kv.TblLogAddressIdx, false, nil, logger); err != nil {
+	if a.logAddrs, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "logaddrs", kv.TblLogAddressKeys, kv.TblLogAddressIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
-	if a.logTopics, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "logtopics", kv.TblLogTopicsKeys, kv.TblLogTopicsIdx, false, nil, logger); err != nil {
+	if a.logTopics, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "logtopics", kv.TblLogTopicsKeys, kv.TblLogTopicsIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
-	if a.tracesFrom, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "tracesfrom", kv.TblTracesFromKeys, kv.TblTracesFromIdx, false, nil, logger); err != nil {
+	if a.tracesFrom, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "tracesfrom", kv.TblTracesFromKeys, kv.TblTracesFromIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
-	if a.tracesTo, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "tracesto", kv.TblTracesToKeys, kv.TblTracesToIdx, false, nil, logger); err != nil {
+	if a.tracesTo, err = NewInvertedIndex(dir, tmpdir, aggregationStep, "tracesto", kv.TblTracesToKeys, kv.TblTracesToIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
+	for _, d := range []*Domain{a.accounts, a.storage, a.code, a.commitment.Domain} {
+		d.pruneProgressTable = kv.TblPruningProgress
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		ii.pruneProgressTable = kv.TblPruningProgress
+	}
 	closeAgg = false
 
 	a.seekTxNum = a.EndTxNumMinimax()
@@ -157,30 +165,32 @@ func NewAggregator(dir, tmpdir string, aggregationStep uint64, commitmentMode Co
 
 func (a *Aggregator) SetDB(db kv.RwDB) { a.db = db }
 
-func (a *Aggregator) buildMissedIdxBlocking(d *Domain) error {
+func (a *Aggregator) buildMissedIdxBlocking() error {
 	eg, ctx := errgroup.WithContext(context.Background())
 	eg.SetLimit(32)
-	if err := d.BuildMissedIndices(ctx, eg, a.ps); err != nil {
-		return err
+	for _, d := range []*Domain{a.accounts, a.storage, a.code, a.commitment.Domain} {
+		if err := d.BuildMissedIndices(ctx, eg, a.ps); err != nil {
+			return err
+		}
+	}
+	for _, ii := range []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo} {
+		ii.BuildMissedIndices(ctx, eg, a.ps)
 	}
 	return eg.Wait()
 }
+
+// ReopenFolder - opens files of dir, builds missed indices of them
 func (a *Aggregator) ReopenFolder() (err error) {
-	{
-		if err = a.buildMissedIdxBlocking(a.accounts); err != nil {
-			return err
-		}
-		if err = a.buildMissedIdxBlocking(a.storage); err != nil {
-			return err
-		}
-		if err = a.buildMissedIdxBlocking(a.code); err != nil {
-			return err
-		}
-		if err = a.buildMissedIdxBlocking(a.commitment.Domain); err != nil {
-			return err
-		}
+	if err = a.openFolder(); err != nil {
+		return err
 	}
+	if err = a.buildMissedIdxBlocking(); err != nil {
+		return err
+	}
+	return a.openFolder() // open built indices
+}
 
+func (a *Aggregator) openFolder() (err error) {
 	if err = a.accounts.OpenFolder(); err != nil {
 		return fmt.Errorf("OpenFolder: %w", err)
 	}
@@ -333,6 +343,22 @@ func (a *Aggregator) SetWorkers(i int) {
 	a.tracesTo.compressWorkers = i
 }
 
+// SetCollateWorkers - >1: domains read keys for new files by partitions, while their compressors are fed by own goroutines
+func (a *Aggregator) SetCollateWorkers(i int) {
+	a.accounts.collateWorkers = i
+	a.storage.collateWorkers = i
+	a.code.collateWorkers = i
+	a.commitment.collateWorkers = i
+}
+
+// EnableExistenceFilters - build .kvf/.vif filters for new files of domains, to skip files without key on reads
+func (a *Aggregator) EnableExistenceFilters() {
+	a.accounts.EnableExistenceFilter()
+	a.storage.EnableExistenceFilter()
+	a.code.EnableExistenceFilter()
+	a.commitment.EnableExistenceFilter()
+}
+
 func (a *Aggregator) SetCommitmentMode(mode CommitmentMode) {
 	a.commitment.mode = mode
 }
@@ -410,6 +436,14 @@ func (a *Aggregator) mergeDomainSteps(ctx context.Context) error {
 		upmerges++
 	}
 
+	if upmerges > 0 {
+		// merge may produce new frozen files: extend LocalityIndex to them
+		if err := a.BuildOptionalMissedIndices(ctx); err != nil {
+			return err
+		}
+		a.renewDefaultContext()
+	}
+
 	if upmerges > 1 {
 		a.logger.Info("[stat] aggregation merged",
 			"upto_tx", maxEndTxNum,
@@ -420,6 +454,19 @@ func (a *Aggregator) mergeDomainSteps(ctx context.Context) error {
 	return nil
 }
 
+// BuildOptionalMissedIndices - builds LocalityIndex of domains if there are frozen files not covered by it
+func (a *Aggregator) BuildOptionalMissedIndices(ctx context.Context) error {
+	for _, d := range []*Domain{a.accounts, a.storage, a.code, a.commitment.Domain} {
+		dc := d.MakeContext()
+		err := d.localityIndex.BuildMissedIndices(ctx, dc.hc.ic)
+		dc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", d.filenameBase, err)
+		}
+	}
+	return nil
+}
+
 func (a *Aggregator) aggregate(ctx context.Context, step uint64) error {
 	var (
 		logEvery = time.NewTicker(time.Second * 30)
@@ -440,7 +487,7 @@ func (a *Aggregator) aggregate(ctx context.Context, step uint64) error {
 
 		mxRunningCollations.Inc()
 		start := time.Now()
-		collation, err := d.collateStream(ctx, step, txFrom, txTo, d.tx)
+		collation, err := d.collateParallel(ctx, step, txFrom, txTo, d.tx)
 		mxRunningCollations.Dec()
 		mxCollateTook.UpdateDuration(start)
 
@@ -475,7 +522,7 @@ func (a *Aggregator) aggregate(ctx context.Context, step uint64) error {
 		}(&wg, d, collation)
 
 		mxPruningProgress.Add(2) // domain and history
-		if err := d.prune(ctx, step, txFrom, txTo, math.MaxUint64, logEvery); err != nil {
+		if _, err := d.prune(ctx, step, txFrom, txTo, math.MaxUint64, logEvery); err != nil {
 			return err
 		}
 		mxPruningProgress.Dec()
@@ -544,7 +591,7 @@ func (a *Aggregator) aggregate(ctx context.Context, step uint64) error {
 
 		mxPruningProgress.Inc()
 		startPrune := time.Now()
-		if err := d.prune(ctx, txFrom, txTo, math.MaxUint64, logEvery); err != nil {
+		if _, err := d.prune(ctx, txFrom, txTo, math.MaxUint64, logEvery); err != nil {
 			return err
 		}
 		mxPruneTook.UpdateDuration(startPrune)
@@ -561,6 +608,9 @@ func (a *Aggregator) aggregate(ctx context.Context, step uint64) error {
 		return fmt.Errorf("domain collate-build failed: %w", err)
 	}
 
+	// step is moved to files and pruned from DB: writers must read previous values of keys from files
+	a.renewDefaultContext()
+
 	a.logger.Info("[stat] aggregation is finished",
 		"range", fmt.Sprintf("%.2fM-%.2fM", float64(txFrom)/10e5, float64(txTo)/10e5),
 		"took", time.Since(stepStartedAt))
@@ -833,10 +883,18 @@ func (a *Aggregator) integrateMergedFiles(outs SelectedStaticFiles, in MergedFil
 }
 
 func (a *Aggregator) cleanAfterNewFreeze(in MergedFiles) {
-	a.accounts.cleanAfterFreeze(in.accountsHist.endTxNum)
-	a.storage.cleanAfterFreeze(in.storageHist.endTxNum)
-	a.code.cleanAfterFreeze(in.codeHist.endTxNum)
-	a.commitment.cleanAfterFreeze(in.commitment.endTxNum)
+	if in.accountsHist != nil && in.accountsHist.frozen {
+		a.accounts.cleanAfterFreeze(in.accountsHist.endTxNum)
+	}
+	if in.storageHist != nil && in.storageHist.frozen {
+		a.storage.cleanAfterFreeze(in.storageHist.endTxNum)
+	}
+	if in.codeHist != nil && in.codeHist.frozen {
+		a.code.cleanAfterFreeze(in.codeHist.endTxNum)
+	}
+	if in.commitmentHist != nil && in.commitmentHist.frozen {
+		a.commitment.cleanAfterFreeze(in.commitmentHist.endTxNum)
+	}
 }
 
 // ComputeCommitment evaluates commitment for processed state.
@@ -898,6 +956,21 @@ func (a *Aggregator) AggregatedRoots() chan [length.Hash]byte {
 	return a.stepDoneNotice
 }
 
+// Prove - eth_getProof-like proof of account `addr` and, if `loc` is not empty, of its storage item, at the state of
+// last ComputeCommitment. Proofs can be checked by commitment.VerifyAccountProof/VerifyStorageProof against returned root.
+// Must be called between StartWrites and FinishWrites, not concurrently with ComputeCommitment.
+func (a *Aggregator) Prove(addr, loc []byte) (accountProof, storageProof [][]byte, err error) {
+	if a.defaultCtx == nil {
+		return nil, nil, fmt.Errorf("prove: aggregator has no writes started")
+	}
+	plainKey := make([]byte, len(addr)+len(loc))
+	copy(plainKey, addr)
+	copy(plainKey[len(addr):], loc)
+
+	a.commitment.patriciaTrie.ResetFns(a.defaultCtx.branchFn, a.defaultCtx.accountFn, a.defaultCtx.storageFn)
+	return a.commitment.Prove(plainKey)
+}
+
 func (a *Aggregator) notifyAggregated(rootHash []byte) {
 	rh := (*[length.Hash]byte)(rootHash)
 	select {
@@ -1027,17 +1100,7 @@ func (a *Aggregator) StartWrites() *Aggregator {
 	if a.defaultCtx != nil {
 		a.defaultCtx.Close()
 	}
-	a.defaultCtx = &AggregatorContext{
-		a:          a,
-		accounts:   a.accounts.defaultDc,
-		storage:    a.storage.defaultDc,
-		code:       a.code.defaultDc,
-		commitment: a.commitment.defaultDc,
-		logAddrs:   a.logAddrs.MakeContext(),
-		logTopics:  a.logTopics.MakeContext(),
-		tracesFrom: a.tracesFrom.MakeContext(),
-		tracesTo:   a.tracesTo.MakeContext(),
-	}
+	a.defaultCtx = a.MakeContext()
 	a.commitment.patriciaTrie.ResetFns(a.defaultCtx.branchFn, a.defaultCtx.accountFn, a.defaultCtx.storageFn)
 	return a
 }
@@ -1053,6 +1116,25 @@ func (a *Aggregator) FinishWrites() {
 	a.tracesTo.FinishWrites()
 }
 
+// renewDefaultContext - re-opens contexts of writers to see latest files. Every context holds references to files,
+// so stale contexts keep files replaced by merge open and on disk until writes are finished.
+// Domain.defaultDc is owned by domain (opened by StartWrites), Aggregator.defaultCtx - by aggregator: each is closed once.
+func (a *Aggregator) renewDefaultContext() {
+	for _, d := range []*Domain{a.accounts, a.storage, a.code, a.commitment.Domain} {
+		if d.defaultDc == nil {
+			continue
+		}
+		d.defaultDc.Close()
+		d.defaultDc = d.MakeContext()
+	}
+	if a.defaultCtx == nil {
+		return
+	}
+	a.defaultCtx.Close()
+	a.defaultCtx = a.MakeContext()
+	a.commitment.patriciaTrie.ResetFns(a.defaultCtx.branchFn, a.defaultCtx.accountFn, a.defaultCtx.storageFn)
+}
+
 // Flush - must be called before Collate, if you did some writes
 func (a *Aggregator) Flush(ctx context.Context) error {
 	flushers := []flusher{
@@ -1253,6 +1335,36 @@ func (ac *AggregatorContext) TraceToIterator(addr []byte, startTxNum, endTxNum i
 	return ac.tracesTo.IdxRange(addr, startTxNum, endTxNum, order.Asc, -1, roTx)
 }
 
+// DomainRange - latest state of domain in [fromKey, toKey), see DomainContext.DomainRange
+func (ac *AggregatorContext) DomainRange(name kv.Domain, fromKey, toKey []byte, asc order.By, limit int, roTx kv.Tx) (iter.KV, error) {
+	var dc *DomainContext
+	switch name {
+	case kv.AccountsDomain:
+		dc = ac.accounts
+	case kv.StorageDomain:
+		dc = ac.storage
+	case kv.CodeDomain:
+		dc = ac.code
+	default:
+		return nil, fmt.Errorf("unexpected domain: %s", name)
+	}
+	return dc.DomainRange(fromKey, toKey, asc, limit, roTx)
+}
+
+// FilesWithKey - names of values files of domain which have given key, see DomainContext.FilesWithKey
+func (ac *AggregatorContext) FilesWithKey(name kv.Domain, key []byte) ([]string, error) {
+	switch name {
+	case kv.AccountsDomain:
+		return ac.accounts.FilesWithKey(key)
+	case kv.StorageDomain:
+		return ac.storage.FilesWithKey(key)
+	case kv.CodeDomain:
+		return ac.code.FilesWithKey(key)
+	default:
+		return nil, fmt.Errorf("unexpected domain: %s", name)
+	}
+}
+
 func (ac *AggregatorContext) Close() {
 	ac.accounts.Close()
 	ac.storage.Close()
@@ -205,6 +205,46 @@ func Benchmark_BTree_Seek(b *testing.B) {
 	})
 }
 
+// compares persisted layout with legacy format (in-memory tree built on open)
+func Benchmark_BtreeIndex_Layout(b *testing.B) {
+	logger := log.New()
+	tmp := b.TempDir()
+
+	dataPath := generateCompressedKV(b, tmp, 52, 10, 1000000, logger)
+	keys, err := pivotKeysFromKV(dataPath)
+	require.NoError(b, err)
+
+	for _, legacy := range []bool{false, true} {
+		name := "layout"
+		if legacy {
+			name = "legacy"
+		}
+		indexPath := path.Join(tmp, name+".bt")
+		require.NoError(b, buildBtreeIndex(dataPath, indexPath, DefaultBtreeWriterM, legacy, logger))
+
+		b.Run(name+"_open", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				bt, err := OpenBtreeIndex(indexPath, dataPath, DefaultBtreeM)
+				require.NoError(b, err)
+				bt.Close()
+			}
+		})
+
+		bt, err := OpenBtreeIndex(indexPath, dataPath, DefaultBtreeM)
+		require.NoError(b, err)
+		rnd := rand.New(rand.NewSource(0))
+		b.Run(name+"_seek", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p := rnd.Intn(len(keys))
+				cur, err := bt.Seek(keys[p])
+				require.NoError(b, err)
+				require.EqualValues(b, keys[p], cur.key)
+			}
+		})
+		bt.Close()
+	}
+}
+
 // requires existing KV index file at ../../data/storage.kv
 func Benchmark_Recsplit_Find_ExternalFile(b *testing.B) {
 	dataPath := "../../data/storage.kv"
@@ -1,28 +1,36 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/c2h5oh/datasize"
 	"github.com/holiman/uint256"
 	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/log/v3"
 	"github.com/stretchr/testify/require"
+	btree2 "github.com/tidwall/btree"
 
 	"github.com/ledgerwatch/erigon-lib/commitment"
 	"github.com/ledgerwatch/erigon-lib/common"
 	"github.com/ledgerwatch/erigon-lib/common/length"
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 )
 
 func testDbAndAggregator(t *testing.T, aggStep uint64) (string, kv.RwDB, *Aggregator) {
@@ -38,6 +46,31 @@ func testDbAndAggregator(t *testing.T, aggStep uint64) (string, kv.RwDB, *Aggreg
 	return path, db, agg
 }
 
+// testAddr - address with `i` in last 8 bytes
+func testAddr(i uint64) []byte {
+	a := make([]byte, length.Addr)
+	binary.BigEndian.PutUint64(a[length.Addr-8:], i)
+	return a
+}
+
+// writeAggregatorV3 - calls `write` for each txNum in [from; to] in 1 committed transaction
+func writeAggregatorV3(t *testing.T, db kv.RwDB, agg *AggregatorV3, from, to uint64, write func(txNum uint64)) {
+	t.Helper()
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := from; txNum <= to; txNum++ {
+		agg.SetTxNum(txNum)
+		write(txNum)
+	}
+	require.NoError(t, agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(t, tx.Commit())
+}
+
 func TestAggregator_WinAccess(t *testing.T) {
 	_, db, agg := testDbAndAggregator(t, 100)
 	defer agg.Close()
@@ -91,6 +124,7 @@ func TestAggregator_Merge(t *testing.T) {
 		}
 	}()
 	agg.SetTx(tx)
+	agg.SetCollateWorkers(3) // domains collate not committed data of tx by partitions
 
 	agg.StartWrites()
 
@@ -158,11 +192,116 @@ func TestAggregator_Merge(t *testing.T) {
 	require.EqualValues(t, otherMaxWrite, binary.BigEndian.Uint64(v[:]))
 }
 
+// merge produces not frozen files: they must stay, only frozen file replaces smaller files
+func TestAggregator_MergeKeepsNotFrozenFiles(t *testing.T) {
+	_, db, agg := testDbAndAggregator(t, 10)
+	defer agg.Close()
+
+	tx, err := db.BeginRwNosync(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 45; txNum++ {
+		agg.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum%7)
+		require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(txNum), nil, 0)))
+		require.NoError(t, agg.FinishTx())
+	}
+	agg.FinishWrites()
+
+	// files cover all built steps without gaps
+	for _, files := range []*btree2.BTreeG[*filesItem]{agg.accounts.files, agg.accounts.History.files} {
+		var covered uint64
+		var names []string
+		files.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				require.FileExists(t, item.decompressor.FilePath())
+				names = append(names, item.decompressor.FileName())
+				if item.startTxNum <= covered && item.endTxNum > covered {
+					covered = item.endTxNum
+				}
+			}
+			return true
+		})
+		require.Equal(t, agg.EndTxNumMinimax(), covered, names)
+		require.Contains(t, names, fmt.Sprintf("accounts.0-2.%s", filepath.Ext(names[0])[1:]))
+	}
+}
+
+func TestAggregator_WritersReleaseMergedFiles(t *testing.T) {
+	_, db, agg := testDbAndAggregator(t, 10)
+	defer agg.Close()
+
+	tx, err := db.BeginRwNosync(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= 65; txNum++ {
+		if txNum == 25 {
+			// writers re-open contexts over already built files
+			agg.FinishWrites()
+			agg.StartWrites()
+		}
+		agg.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum%7)
+		require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(txNum), nil, 0)))
+		require.NoError(t, agg.FinishTx())
+	}
+	defer agg.FinishWrites()
+
+	// writes are not finished yet, but contexts of writers must not hold files replaced by merge
+	names := map[string]struct{}{}
+	agg.accounts.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			names[item.decompressor.FileName()] = struct{}{}
+		}
+		return true
+	})
+	entries, err := os.ReadDir(agg.accounts.dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "accounts.") && strings.HasSuffix(e.Name(), ".kv") {
+			require.Contains(t, names, e.Name())
+		}
+	}
+}
+
 // here we create a bunch of updates for further aggregation.
 // FinishTx should merge underlying files several times
 // Expected that:
 // - we could close first aggregator and open another with previous data still available
 // - new aggregator SeekCommitment must return txNum equal to amount of total txns
+// Domain.Put reads previous value of key by writer's context: it must see files built after StartWrites
+func TestAggregator_WritersSeeBuiltFiles(t *testing.T) {
+	_, db, agg := testDbAndAggregator(t, 10)
+	defer agg.Close()
+
+	tx, err := db.BeginRwNosync(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	defer agg.FinishWrites()
+	for txNum := uint64(1); txNum <= 45; txNum++ {
+		agg.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum%7)
+		require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(txNum), nil, 0)))
+		require.NoError(t, agg.FinishTx())
+	}
+
+	require.NotZero(t, agg.accounts.endTxNumMinimax())
+	for _, d := range []*Domain{agg.accounts, agg.storage, agg.code, agg.commitment.Domain} {
+		dc := d.defaultDc
+		require.NotEmpty(t, dc.files, d.filenameBase)
+		require.Equal(t, d.endTxNumMinimax(), dc.files[len(dc.files)-1].endTxNum, d.filenameBase)
+	}
+}
+
 func TestAggregator_RestartOnDatadir(t *testing.T) {
 	logger := log.New()
 	aggStep := uint64(50)
@@ -366,6 +505,321 @@ func TestAggregator_RestartOnFiles(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestAggregator_MergedCommitmentState(t *testing.T) {
+	aggStep := uint64(10)
+	_, db, agg := testDbAndAggregator(t, aggStep)
+	defer agg.Close()
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= aggStep*5; txNum++ {
+		agg.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum%13)
+		require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(txNum), nil, 0)))
+		require.NoError(t, agg.FinishTx())
+	}
+	agg.FinishWrites()
+
+	// commitment state record of every step is stored as is by merge: it's not branch data
+	var merged []*filesItem
+	agg.commitment.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum-item.startTxNum > aggStep {
+				merged = append(merged, item)
+			}
+		}
+		return true
+	})
+	require.NotEmpty(t, merged)
+	dc := agg.commitment.MakeContext()
+	defer dc.Close()
+	for _, item := range merged {
+		for step := item.startTxNum / aggStep; step < item.endTxNum/aggStep; step++ {
+			key := make([]byte, len(keyCommitmentState)+2)
+			copy(key, keyCommitmentState)
+			binary.BigEndian.PutUint16(key[len(keyCommitmentState):], uint16(step))
+			v, found, err := dc.readFromFiles(key, item.endTxNum)
+			require.NoError(t, err)
+			require.True(t, found, "step %d", step)
+
+			var cs commitmentState
+			require.NoError(t, cs.Decode(v), "step %d", step)
+			require.Equal(t, step, cs.txNum/aggStep)
+		}
+	}
+}
+
+func TestAggregator_RebuildFromFiles(t *testing.T) {
+	logger := log.New()
+	aggStep := uint64(16)
+	ctx := context.Background()
+	path, db, agg := testDbAndAggregator(t, aggStep)
+	dir := filepath.Join(path, "e4")
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	agg.SetTx(tx)
+	agg.StartWrites()
+
+	rnd := rand.New(rand.NewSource(0))
+	addrs := make([][]byte, 24)
+	for i := range addrs {
+		addrs[i] = make([]byte, length.Addr)
+		rnd.Read(addrs[i])
+	}
+	locs := make([][]byte, 8)
+	for i := range locs {
+		locs[i] = make([]byte, length.Hash)
+		rnd.Read(locs[i])
+	}
+	txs := aggStep * 5
+	roots := make([][]byte, txs+1)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		agg.SetTxNum(txNum)
+		for i := 0; i < 3; i++ {
+			addr := addrs[rnd.Intn(len(addrs))]
+			switch rnd.Intn(10) {
+			case 0:
+				require.NoError(t, agg.DeleteAccount(addr))
+			case 1:
+				require.NoError(t, agg.UpdateAccountCode(addr, []byte{byte(txNum), byte(i)}))
+			case 2, 3, 4:
+				require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(1), nil, 0)))
+				require.NoError(t, agg.WriteAccountStorage(addr, locs[rnd.Intn(len(locs))], []byte{byte(txNum), byte(i), 1}))
+			default:
+				require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(rnd.Uint64()), nil, 0)))
+			}
+		}
+		roots[txNum], err = agg.ComputeCommitment(false, false)
+		require.NoError(t, err)
+		require.NoError(t, agg.FinishTx())
+	}
+	// files have 4 steps, last step is only in DB
+	filesTxNum := agg.EndTxNumMinimax()
+	require.Equal(t, 4*aggStep, filesTxNum)
+	expected := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		expected[i], err = agg.defaultCtx.ReadAccountDataBeforeTxNum(addr, filesTxNum, tx)
+		require.NoError(t, err)
+	}
+	// merge runs concurrently with building of step files: lose indices of whatever file ends at filesTxNum
+	lastFileName := func(files *btree2.BTreeG[*filesItem], ext string) string {
+		var name string
+		files.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if item.endTxNum == filesTxNum {
+					name = strings.TrimSuffix(item.decompressor.FileName(), filepath.Ext(item.decompressor.FileName())) + "." + ext
+				}
+			}
+			return true
+		})
+		require.NotEmpty(t, name)
+		return name
+	}
+	missedIndices := []string{
+		lastFileName(agg.accounts.files, "bt"),
+		lastFileName(agg.accounts.files, "kvi"),
+		lastFileName(agg.accounts.History.files, "vi"),
+		lastFileName(agg.accounts.InvertedIndex.files, "efi"),
+		lastFileName(agg.commitment.InvertedIndex.files, "efi"),
+	}
+	agg.FinishWrites()
+	require.NoError(t, tx.Commit())
+	tx = nil
+	agg.Close()
+
+	// DB tables of recent data are corrupted, some indices are lost
+	for _, name := range missedIndices {
+		require.NoError(t, os.Remove(filepath.Join(dir, name)))
+	}
+	require.NoError(t, db.Update(ctx, func(tx kv.RwTx) error {
+		return tx.Put(kv.TblAccountVals, []byte("garbage"), []byte("garbage"))
+	}))
+
+	newAgg, err := NewAggregator(dir, filepath.Join(path, "e4tmp"), aggStep, CommitmentModeDirect, commitment.VariantHexPatriciaTrie, logger)
+	require.NoError(t, err)
+	defer newAgg.Close()
+	newTx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer newTx.Rollback()
+	newAgg.SetTx(newTx)
+
+	report, err := newAgg.RebuildFromFiles(ctx)
+	require.NoError(t, err)
+	require.Equal(t, filesTxNum, report.RestartTxNum)
+	require.Equal(t, roots[filesTxNum-1], report.Root)
+	require.Positive(t, report.Keys)
+	require.Contains(t, report.ClearedTables, kv.TblAccountVals)
+	for _, name := range missedIndices {
+		require.FileExists(t, filepath.Join(dir, name))
+	}
+	k, err := kv.FirstKey(newTx, kv.TblAccountVals)
+	require.NoError(t, err)
+	require.Nil(t, k)
+
+	newAgg.StartWrites()
+	defer newAgg.FinishWrites()
+	for i, addr := range addrs {
+		v, err := newAgg.defaultCtx.ReadAccountData(addr, newTx)
+		require.NoError(t, err)
+		if len(expected[i]) == 0 { // deleted
+			require.Empty(t, v, "addr %x", addr)
+			continue
+		}
+		require.Equal(t, expected[i], v, "addr %x", addr)
+	}
+	_, seekTxNum, err := newAgg.SeekCommitment()
+	require.NoError(t, err)
+	require.Equal(t, report.RestartTxNum, seekTxNum)
+}
+
+// aggregatorFilesInDir - produces files of aggregator with `steps` steps of accounts and logs, returns dir of files
+func aggregatorFilesInDir(t *testing.T, aggStep, steps uint64) string {
+	t.Helper()
+	path, db, agg := testDbAndAggregator(t, aggStep)
+	defer agg.Close()
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+	for txNum := uint64(1); txNum <= aggStep*(steps+1); txNum++ {
+		agg.SetTxNum(txNum)
+		addr := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(addr, txNum%13)
+		require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(txNum), nil, 0)))
+		require.NoError(t, agg.AddLogAddr(addr))
+		require.NoError(t, agg.FinishTx())
+	}
+	agg.FinishWrites()
+	require.NoError(t, tx.Commit())
+	return filepath.Join(path, "e4")
+}
+
+func TestAggregator_ReopenFolderBuildsMissedIndices(t *testing.T) {
+	aggStep := uint64(10)
+	dir := aggregatorFilesInDir(t, aggStep, 3)
+
+	removed, err := filepath.Glob(filepath.Join(dir, "*.efi"))
+	require.NoError(t, err)
+	require.NotEmpty(t, removed)
+	for _, f := range removed {
+		require.NoError(t, os.Remove(f))
+	}
+
+	agg, err := NewAggregator(dir, t.TempDir(), aggStep, CommitmentModeDirect, commitment.VariantHexPatriciaTrie, log.New())
+	require.NoError(t, err)
+	defer agg.Close()
+	require.NoError(t, agg.ReopenFolder())
+	for _, f := range removed {
+		require.FileExists(t, f)
+	}
+}
+
+func TestAggregator_ReopenFolderBuildsMissedBtree(t *testing.T) {
+	aggStep := uint64(10)
+	dir := aggregatorFilesInDir(t, aggStep, 3)
+
+	removed, err := filepath.Glob(filepath.Join(dir, "accounts.*.bt"))
+	require.NoError(t, err)
+	require.NotEmpty(t, removed)
+	for _, f := range removed {
+		require.NoError(t, os.Remove(f))
+	}
+
+	agg, err := NewAggregator(dir, t.TempDir(), aggStep, CommitmentModeDirect, commitment.VariantHexPatriciaTrie, log.New())
+	require.NoError(t, err)
+	defer agg.Close()
+	require.NoError(t, agg.ReopenFolder())
+	// .bt is built next to .kv
+	for _, f := range removed {
+		require.FileExists(t, f)
+	}
+}
+
+func TestAggregator_ReopenFolderOpensBuiltIndices(t *testing.T) {
+	aggStep := uint64(10)
+	dir := aggregatorFilesInDir(t, aggStep, 3)
+
+	for _, pattern := range []string{"*.efi", "*.vi", "*.kvi", "*.bt"} {
+		removed, err := filepath.Glob(filepath.Join(dir, pattern))
+		require.NoError(t, err)
+		for _, f := range removed {
+			require.NoError(t, os.Remove(f))
+		}
+	}
+
+	agg, err := NewAggregator(dir, t.TempDir(), aggStep, CommitmentModeDirect, commitment.VariantHexPatriciaTrie, log.New())
+	require.NoError(t, err)
+	defer agg.Close()
+	require.NoError(t, agg.ReopenFolder())
+
+	// files were opened without indices, indices built later must be attached to them
+	requireIndices := func(files *btree2.BTreeG[*filesItem], withBtree bool) {
+		files.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				require.NotNil(t, item.decompressor)
+				require.NotNil(t, item.index, item.decompressor.FileName())
+				if withBtree {
+					require.NotNil(t, item.bindex, item.decompressor.FileName())
+				}
+			}
+			return true
+		})
+	}
+	for _, d := range []*Domain{agg.accounts, agg.storage, agg.code, agg.commitment.Domain} {
+		requireIndices(d.files, true)
+		requireIndices(d.History.files, false)
+		requireIndices(d.InvertedIndex.files, false)
+	}
+	requireIndices(agg.logAddrs.files, false)
+}
+
+func TestAggregator_ReopenFolderBuildsMissedFilters(t *testing.T) {
+	aggStep := uint64(10)
+	dir := aggregatorFilesInDir(t, aggStep, 3)
+
+	agg, err := NewAggregator(dir, t.TempDir(), aggStep, CommitmentModeDirect, commitment.VariantHexPatriciaTrie, log.New())
+	require.NoError(t, err)
+	defer agg.Close()
+	agg.EnableExistenceFilters()
+	require.NoError(t, agg.ReopenFolder())
+
+	// filters are built for files opened without them and used by readers of live aggregator
+	agg.accounts.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			require.NotNil(t, item.existence, item.decompressor.FileName())
+		}
+		return true
+	})
+	dc := agg.accounts.MakeContext()
+	defer dc.Close()
+	missing := make([]byte, length.Addr)
+	binary.BigEndian.PutUint64(missing, 100)
+
+	skips := mxExistenceFilterSkips.Get()
+	_, found, err := dc.readFromFiles(missing, 0)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Greater(t, mxExistenceFilterSkips.Get(), skips)
+
+	skips = mxExistenceFilterSkips.Get()
+	_, found, err = dc.hc.GetNoState(missing, 5)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Greater(t, mxExistenceFilterSkips.Get(), skips)
+}
+
 func TestAggregator_ReplaceCommittedKeys(t *testing.T) {
 	aggStep := uint64(500)
 
@@ -461,6 +915,609 @@ func TestAggregator_ReplaceCommittedKeys(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestAggregator_Prove(t *testing.T) {
+	_, db, agg := testDbAndAggregator(t, 1000)
+	t.Cleanup(agg.Close)
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	defer agg.StartWrites().FinishWrites()
+
+	rnd := rand.New(rand.NewSource(0))
+	var addrs, locs [][]byte
+	for txNum := uint64(1); txNum <= 200; txNum++ {
+		agg.SetTxNum(txNum)
+
+		addr, loc := make([]byte, length.Addr), make([]byte, length.Hash)
+		rnd.Read(addr)
+		rnd.Read(loc)
+		if txNum%4 == 0 {
+			addr = addrs[0] // many storage items of one account
+		} else {
+			addrs = append(addrs, addr)
+			require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(txNum*10), nil, 0)))
+		}
+		if txNum%2 == 0 {
+			require.NoError(t, agg.WriteAccountStorage(addr, loc, []byte{addr[0], loc[0], 1}))
+			locs = append(locs, append(common.Copy(addr), loc...))
+		}
+	}
+	rootHash, err := agg.ComputeCommitment(true, false)
+	require.NoError(t, err)
+
+	for _, addr := range addrs {
+		accountProof, storageProof, err := agg.Prove(addr, nil)
+		require.NoError(t, err)
+		require.Nil(t, storageProof)
+		acc, err := commitment.VerifyAccountProof(rootHash, addr, accountProof)
+		require.NoError(t, err)
+		require.NotNil(t, acc)
+		enc, err := agg.defaultCtx.ReadAccountData(addr, tx)
+		require.NoError(t, err)
+		nonce, balance, _ := DecodeAccountBytes(enc)
+		require.Equal(t, nonce, acc.Nonce)
+		require.Equal(t, balance.Uint64(), acc.Balance.Uint64())
+	}
+	for _, key := range locs {
+		addr, loc := key[:length.Addr], key[length.Addr:]
+		accountProof, storageProof, err := agg.Prove(addr, loc)
+		require.NoError(t, err)
+		acc, err := commitment.VerifyAccountProof(rootHash, addr, accountProof)
+		require.NoError(t, err)
+		value, err := commitment.VerifyStorageProof(acc.StorageRoot[:], loc, storageProof)
+		require.NoError(t, err)
+		require.Equal(t, []byte{addr[0], loc[0], 1}, value)
+	}
+
+	absent := make([]byte, length.Addr)
+	rnd.Read(absent)
+	accountProof, _, err := agg.Prove(absent, nil)
+	require.NoError(t, err)
+	acc, err := commitment.VerifyAccountProof(rootHash, absent, accountProof)
+	require.NoError(t, err)
+	require.Nil(t, acc)
+}
+
+func TestAggregator_StateRootAsOf(t *testing.T) {
+	aggStep := uint64(16)
+	_, db, agg := testDbAndAggregator(t, aggStep)
+	t.Cleanup(agg.Close)
+
+	tx, err := db.BeginRw(context.Background())
+	require.NoError(t, err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	defer agg.StartWrites().FinishWrites()
+
+	rnd := rand.New(rand.NewSource(0))
+	addrs := make([][]byte, 24)
+	for i := range addrs {
+		addrs[i] = make([]byte, length.Addr)
+		rnd.Read(addrs[i])
+	}
+	locs := make([][]byte, 8)
+	for i := range locs {
+		locs[i] = make([]byte, length.Hash)
+		rnd.Read(locs[i])
+	}
+
+	txs := aggStep * 5
+	roots := make([][]byte, txs+1)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		agg.SetTxNum(txNum)
+		if txNum == 1 {
+			for _, addr := range addrs {
+				require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(0, uint256.NewInt(1), nil, 0)))
+			}
+		}
+		for i := 0; i < 3; i++ {
+			addr := addrs[rnd.Intn(len(addrs))]
+			switch rnd.Intn(10) {
+			case 0:
+				require.NoError(t, agg.DeleteAccount(addr))
+			case 1:
+				require.NoError(t, agg.UpdateAccountCode(addr, []byte{byte(txNum), byte(i)}))
+			case 2, 3, 4:
+				// storage of deleted account is deleted too, so account is re-created before write
+				require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(1), nil, 0)))
+				loc := locs[rnd.Intn(len(locs))]
+				var value []byte
+				if rnd.Intn(4) > 0 {
+					value = []byte{byte(txNum), byte(i), 1}
+				}
+				require.NoError(t, agg.WriteAccountStorage(addr, loc, value))
+			default:
+				require.NoError(t, agg.UpdateAccountData(addr, EncodeAccountBytes(txNum, uint256.NewInt(rnd.Uint64()), nil, 0)))
+			}
+		}
+		roots[txNum], err = agg.ComputeCommitment(false, false)
+		require.NoError(t, err)
+		require.NoError(t, agg.FinishTx())
+	}
+
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		root, err := agg.StateRootAsOf(txNum)
+		require.NoError(t, err)
+		require.Equal(t, roots[txNum], root, "txNum=%d", txNum)
+	}
+
+	_, err = agg.StateRootAsOf(txs + 1)
+	require.Error(t, err)
+}
+
+func TestAggregatorV3_ReadOnly(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	path, db, agg := testDbAndAggregatorV3(t, 16)
+	dir := filepath.Join(path, "e4")
+
+	writeAggregatorV3(t, db, agg, 1, 70, func(txNum uint64) {
+		var prev []byte
+		if txNum > 4 {
+			prev = []byte{byte(txNum - 4)}
+		}
+		require.NoError(agg.AddAccountPrev(testAddr(txNum%4), prev))
+		if txNum%3 == 0 {
+			require.NoError(agg.AddCodePrev(testAddr(txNum%4), prev))
+		}
+	})
+	for step := uint64(0); step < 2; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step))
+	}
+
+	// owner didn't finish index yet: reader must skip file and must not build index
+	require.NoError(os.Remove(filepath.Join(dir, "code.1-2.vi")))
+	onDisk := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(err)
+		var res []string
+		for _, e := range entries {
+			res = append(res, e.Name())
+		}
+		return res
+	}
+	before := onDisk()
+
+	ro, err := NewAggregatorV3ReadOnly(ctx, dir, 16, 10*time.Millisecond, log.New())
+	require.NoError(err)
+	defer ro.Close()
+	require.True(ro.ReadOnly())
+	require.Contains(ro.Files(), "accounts.0-1.v")
+	require.Contains(ro.Files(), "code.0-1.v")
+	require.NotContains(ro.Files(), "code.1-2.v")
+	ro.CleanDir()
+	require.ErrorIs(ro.BuildMissedIndices(ctx, 1), ErrAggregatorReadOnly)
+	require.ErrorIs(ro.MergeLoop(ctx, 1), ErrAggregatorReadOnly)
+	require.ErrorIs(ro.BuildFiles(70), ErrAggregatorReadOnly)
+	require.Equal(before, onDisk())
+
+	roCtx := ro.MakeContext()
+	v, ok, err := roCtx.accounts.GetNoState(testAddr(1), 6)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{5}, v)
+	small := roCtx.accounts.files[0].src
+	require.Equal(uint64(0), small.startTxNum)
+	require.Equal(uint64(16), small.endTxNum)
+
+	// owner builds more files and merges them: small files are removed from disk
+	for step := uint64(2); step < 4; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step))
+	}
+	require.NoError(agg.MergeLoop(ctx, 1))
+	require.NoFileExists(filepath.Join(dir, "accounts.0-1.v"))
+
+	require.Eventually(func() bool {
+		c := ro.MakeContext()
+		defer c.Close()
+		return len(c.accounts.files) == 1 && c.accounts.files[0].endTxNum == 64 &&
+			len(c.code.files) == 1 && c.code.files[0].endTxNum == 64
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(uint64(64), ro.EndTxNumMinimax())
+
+	// retired file is still open for context which uses it
+	require.True(small.canDelete.Load())
+	require.NotNil(small.decompressor)
+	v, ok, err = roCtx.accounts.GetNoState(testAddr(1), 6)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{5}, v)
+	roCtx.Close()
+	require.Nil(small.decompressor)
+
+	roCtx = ro.MakeContext()
+	defer roCtx.Close()
+	v, ok, err = roCtx.accounts.GetNoState(testAddr(1), 6)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{5}, v)
+	v, ok, err = roCtx.accounts.GetNoState(testAddr(2), 49)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{46}, v)
+}
+
+func TestAggregatorV3_RegisterMembers(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	logger := log.New()
+	path := t.TempDir()
+	db := mdbx.NewMDBX(logger).InMem(filepath.Join(path, "db4")).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		cfg := kv.TableCfg{}
+		for name, item := range kv.ChaindataTablesCfg {
+			cfg[name] = item
+		}
+		cfg["TransferToKeys"] = kv.TableCfgItem{Flags: kv.DupSort}
+		cfg["TransferToIdx"] = kv.TableCfgItem{Flags: kv.DupSort}
+		cfg["CreatorHistoryKeys"] = kv.TableCfgItem{Flags: kv.DupSort}
+		cfg["CreatorHistoryVals"] = kv.TableCfgItem{}
+		cfg["CreatorIdx"] = kv.TableCfgItem{Flags: kv.DupSort}
+		return cfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+	dir, tmpdir := filepath.Join(path, "e4"), filepath.Join(path, "e4tmp")
+	require.NoError(os.MkdirAll(dir, 0o755))
+	require.NoError(os.MkdirAll(tmpdir, 0o755))
+	agg, err := NewAggregatorV3(ctx, dir, tmpdir, 16, db, logger)
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+
+	// settings of aggregator made before registration apply to registered members too
+	agg.EnableExistenceFilters().DisableFsync()
+	agg.SetWorkers(2)
+
+	const transferTo, creatorIdx kv.InvertedIdx = "TransferToIdx", "CreatorHistoryIdx"
+	const creator kv.History = "CreatorHistory"
+	require.NoError(agg.RegisterInvertedIndex(transferTo, "transferto", "TransferToKeys", "TransferToIdx", xorValueCodec{}))
+	require.NoError(agg.RegisterHistory(creator, creatorIdx, "creator", "CreatorHistoryKeys", "CreatorIdx", "CreatorHistoryVals", RawValues, true))
+	require.Error(agg.RegisterInvertedIndex(kv.LogAddrIdx, "other", "TransferToKeys", "TransferToIdx", RawValues))
+	require.Error(agg.RegisterInvertedIndex("OtherIdx", "transferto", "TransferToKeys", "TransferToIdx", RawValues))
+	require.Error(agg.RegisterInvertedIndex(creatorIdx, "other", "TransferToKeys", "TransferToIdx", RawValues))
+	require.NoError(agg.OpenFolder())
+	for _, h := range agg.histories() {
+		require.True(h.withExistenceFilter, h.filenameBase)
+		require.True(h.noFsync, h.filenameBase)
+		require.Equal(2, h.compressWorkers, h.filenameBase)
+		require.Equal(kv.TblPruningProgress, h.pruneProgressTable, h.filenameBase)
+	}
+	for _, ii := range agg.invertedIndices() {
+		require.True(ii.noFsync, ii.filenameBase)
+		require.Equal(2, ii.compressWorkers, ii.filenameBase)
+		require.Equal(kv.TblPruningProgress, ii.pruneProgressTable, ii.filenameBase)
+	}
+
+	writeAggregatorV3(t, db, agg, 1, 70, func(txNum uint64) {
+		require.NoError(agg.PutIdx(transferTo, testAddr(txNum%3)))
+		var prev []byte
+		if txNum > 4 {
+			prev = []byte{byte(txNum - 4)}
+		}
+		require.NoError(agg.AddPrev(creator, testAddr(txNum%4), nil, prev))
+		if txNum == 1 {
+			require.Error(agg.AddPrev("UnknownHistory", testAddr(1), nil, nil))
+		}
+	})
+
+	for step := uint64(0); step < 4; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step))
+	}
+	require.NoError(agg.MergeLoop(ctx, 1))
+	require.Contains(agg.Files(), "transferto.0-4.ef")
+	require.Contains(agg.Files(), "creator.0-4.v")
+	require.Contains(agg.Files(), "creator.0-4.ef")
+	_, err = os.Stat(filepath.Join(dir, "creator.0-4.vif"))
+	require.NoError(err)
+	require.Equal(uint64(64), agg.EndTxNumMinimax())
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	require.NoError(agg.Prune(ctx, 1_000))
+	require.Contains(agg.StepsRangeInDBAsStr(tx), "transferto: 4.0-4.4")
+
+	expected := func(mod, to uint64) (res []uint64) {
+		for txNum := uint64(1); txNum <= to; txNum++ {
+			if txNum%3 == mod {
+				res = append(res, txNum)
+			}
+		}
+		return res
+	}
+	ac := agg.MakeContext()
+	it, err := ac.IndexRange(transferTo, testAddr(1), 0, -1, order.Asc, -1, tx)
+	require.NoError(err)
+	require.Equal(expected(1, 70), iter.ToArrU64Must(it))
+	it, err = ac.IndexRange(creatorIdx, testAddr(2), 60, -1, order.Asc, -1, tx)
+	require.NoError(err)
+	require.Equal([]uint64{62, 66, 70}, iter.ToArrU64Must(it))
+	_, err = ac.IndexRange("UnknownIdx", testAddr(2), 0, -1, order.Asc, -1, tx)
+	require.Error(err)
+
+	v, ok, err := ac.HistoryGet(creator, testAddr(1), 6, tx) // from files
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{5}, v)
+	v, ok, err = ac.HistoryGet(creator, testAddr(3), 66, tx) // from db
+	require.NoError(err)
+	require.True(ok)
+	require.Equal([]byte{63}, v)
+	_, ok, err = ac.HistoryGet(creator, testAddr(3), 71, tx)
+	require.NoError(err)
+	require.False(ok)
+	ac.Close()
+
+	require.NoError(agg.Unwind(ctx, 66))
+	ac = agg.MakeContext()
+	defer ac.Close()
+	it, err = ac.IndexRange(transferTo, testAddr(1), 0, -1, order.Asc, -1, tx)
+	require.NoError(err)
+	require.Equal(expected(1, 65), iter.ToArrU64Must(it))
+	_, ok, err = ac.HistoryGet(creator, testAddr(2), 65, tx)
+	require.NoError(err)
+	require.False(ok)
+}
+
+func TestAggregatorV3_MergePlan(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	path, db, agg := testDbAndAggregatorV3(t, 16)
+	dir := filepath.Join(path, "e4")
+
+	writeAggregatorV3(t, db, agg, 1, 70, func(txNum uint64) {
+		require.NoError(agg.AddAccountPrev(testAddr(txNum%4), []byte{byte(txNum)}))
+		require.NoError(agg.PutIdx(kv.TblLogAddressIdx, testAddr(txNum%5)))
+	})
+	for step := uint64(0); step < 4; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step))
+	}
+
+	plan, err := agg.PlanMerge()
+	require.NoError(err)
+	require.False(plan.Empty())
+	input, output, tmp := plan.Size()
+	require.Positive(input)
+	require.Positive(output)
+	require.Positive(tmp)
+
+	var accounts *MergePlanItem
+	for i := range plan.Items {
+		if it := plan.Items[i]; it.Name == "accounts" && it.Ext == "v" {
+			accounts = &plan.Items[i]
+		}
+	}
+	require.NotNil(accounts)
+	require.Equal("accounts.0-2.v", accounts.Output())
+	require.Equal([]string{"accounts.0-1.v", "accounts.1-2.v"}, accounts.Inputs)
+	require.Contains(plan.String(), "accounts.0-2.v <- accounts.0-1.v, accounts.1-2.v")
+	require.Zero(plan.EstimatedTime) // no merges were done, bandwidth is not limited
+
+	// estimate is limited by bandwidth
+	agg.Scheduler().SetCfg(MergeSchedulerCfg{Workers: 3, Bandwidth: datasize.ByteSize(input / 2)})
+	paced, err := agg.PlanMerge()
+	require.NoError(err)
+	require.InDelta(float64(2*time.Second), float64(paced.EstimatedTime), float64(time.Millisecond))
+	agg.Scheduler().SetCfg(DefaultMergeSchedulerCfg)
+
+	// plan is executed by scheduler: it waits while scheduler is paused
+	agg.Scheduler().Pause()
+	pausedCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	require.ErrorIs(agg.Merge(pausedCtx, plan, 1), context.DeadlineExceeded)
+	cancel()
+	for _, it := range plan.Items {
+		require.NotContains(agg.Files(), it.Output())
+	}
+	agg.Scheduler().Resume()
+	<-agg.Scheduler().Idle()
+
+	// planning is dry-run
+	for _, it := range plan.Items {
+		require.NoFileExists(filepath.Join(dir, it.Output()))
+		for _, in := range it.Inputs {
+			require.FileExists(filepath.Join(dir, in))
+		}
+	}
+
+	require.NoError(agg.Merge(ctx, plan, 1))
+	for _, it := range plan.Items {
+		require.FileExists(filepath.Join(dir, it.Output()))
+		require.Contains(agg.Files(), it.Output())
+		for _, in := range it.Inputs {
+			require.NotContains(agg.Files(), in)
+		}
+	}
+
+	// plans of next steps until nothing left to merge: same result as MergeLoop
+	for i := 0; ; i++ {
+		require.Less(i, 10)
+		next, err := agg.PlanMerge()
+		require.NoError(err)
+		if next.Empty() {
+			break
+		}
+		require.Positive(next.EstimatedTime) // by throughput of previous merges
+		require.NoError(agg.Merge(ctx, next, 1))
+	}
+	var merges int
+	for _, j := range agg.Scheduler().Stats().Finished {
+		if j.Kind == JobMerge && strings.HasPrefix(j.Name, "merge plan ") && j.State == JobDone {
+			merges++
+		}
+	}
+	require.GreaterOrEqual(merges, 2)
+	require.Contains(agg.Files(), "accounts.0-4.v")
+
+	// files of plan were merged by other call
+	require.ErrorIs(agg.Merge(ctx, plan, 1), ErrMergePlanOutdated)
+}
+
+func TestAggregatorV3_UnwindIntoFrozenFiles(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	path, db, agg := testDbAndAggregatorV3(t, 16)
+	dir := filepath.Join(path, "e4")
+	prev := func(txNum uint64, salt byte) []byte { return []byte{byte(txNum - 4), salt} }
+	write := func(from, to uint64, salt byte) {
+		writeAggregatorV3(t, db, agg, from, to, func(txNum uint64) {
+			require.NoError(agg.AddAccountPrev(testAddr(txNum%4), prev(txNum, salt)))
+			if txNum%3 == 0 {
+				require.NoError(agg.AddCodePrev(testAddr(txNum%4), []byte{byte(txNum), salt}))
+			}
+			require.NoError(agg.PutIdx(kv.TblLogAddressIdx, testAddr(txNum%5)))
+		})
+	}
+	buildAndPrune := func(fromStep, toStep uint64) {
+		for step := fromStep; step < toStep; step++ {
+			require.NoError(agg.buildFilesInBackground(ctx, step))
+		}
+		require.NoError(agg.MergeLoop(ctx, 1))
+		require.NoError(db.Update(ctx, func(tx kv.RwTx) error {
+			agg.SetTx(tx)
+			return agg.Prune(ctx, math.MaxUint64)
+		}))
+	}
+	expected := func(mod, div, from, to uint64) (res []uint64) {
+		for txNum := from; txNum < to; txNum++ {
+			if txNum%div == mod {
+				res = append(res, txNum)
+			}
+		}
+		return res
+	}
+
+	write(1, 600, 0)
+	buildAndPrune(0, 36)
+	require.Contains(agg.Files(), "accounts.0-32.v")
+	require.Contains(agg.Files(), "logaddrs.0-32.ef")
+	require.Equal(uint64(576), agg.EndTxNumMinimax())
+	ac := agg.MakeContext()
+	require.NoError(ac.BuildOptionalMissedIndices(ctx, 1))
+	ac.Close()
+	require.FileExists(filepath.Join(dir, "accounts.0-32.li"))
+
+	// copy of frozen files - to emulate files which were not removed from disk (by crash or other process)
+	frozen := []string{"accounts.0-32.v", "accounts.0-32.vi", "accounts.0-32.ef", "accounts.0-32.efi", "logaddrs.0-32.ef", "logaddrs.0-32.efi"}
+	backup := t.TempDir()
+	for _, name := range frozen {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(err)
+		require.NoError(os.WriteFile(filepath.Join(backup, name), data, 0o644))
+	}
+
+	// crash before commit of unwind: files before unwind are opened after restart
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	agg.SetTx(tx)
+	require.NoError(agg.Unwind(ctx, 500))
+	require.Equal(uint64(496), agg.EndTxNumMinimax())
+	for _, name := range frozen {
+		require.FileExists(filepath.Join(dir, name))
+	}
+	tx.Rollback()
+	agg.Close()
+	agg, err = NewAggregatorV3(ctx, dir, filepath.Join(path, "e4tmp"), 16, db, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+	require.NoError(agg.OpenFolder())
+	require.Contains(agg.Files(), "accounts.0-32.v")
+	require.NotContains(agg.Files(), "accounts.0-16.v")
+	require.Equal(uint64(576), agg.EndTxNumMinimax())
+	ac = agg.MakeContext()
+	v, ok, err := ac.accounts.GetNoState(testAddr(2), 550)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(prev(550, 0), v)
+	ac.Close()
+
+	oldCtx := agg.MakeContext()
+	tx, err = db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	require.NoError(agg.Unwind(ctx, 500))
+	require.NoError(tx.Commit())
+	agg.FinishUnwind()
+
+	// 500 is in step 31: steps before it are in files, 496-500 moved back to DB
+	require.Equal(uint64(496), agg.EndTxNumMinimax())
+	for _, name := range []string{"accounts.0-16.v", "accounts.16-24.v", "accounts.24-28.v", "accounts.28-30.v", "accounts.30-31.v", "code.30-31.v", "logaddrs.30-31.ef"} {
+		require.Contains(agg.Files(), name)
+		require.FileExists(filepath.Join(dir, name))
+	}
+	for _, name := range append(frozen, "accounts.32-36.v", "logaddrs.32-36.ef", "accounts.0-32.li", "accounts.0-32.l") {
+		require.NotContains(agg.Files(), name)
+		require.NoFileExists(filepath.Join(dir, name))
+	}
+
+	// context created before unwind still sees old files
+	v, ok, err = oldCtx.accounts.GetNoState(testAddr(2), 550)
+	require.NoError(err)
+	require.True(ok)
+	require.Equal(prev(550, 0), v)
+	oldCtx.Close()
+
+	check := func(salt byte, to uint64) {
+		roTx, err := db.BeginRo(ctx)
+		require.NoError(err)
+		defer roTx.Rollback()
+		ac := agg.MakeContext()
+		defer ac.Close()
+		v, ok, err := ac.accounts.GetNoStateWithRecent(testAddr(0), 480, roTx) // truncated file
+		require.NoError(err)
+		require.True(ok)
+		require.Equal(prev(480, 0), v)
+		v, ok, err = ac.accounts.GetNoStateWithRecent(testAddr(1), 497, roTx) // partial step
+		require.NoError(err)
+		require.True(ok)
+		require.Equal(prev(497, 0), v)
+		v, ok, err = ac.accounts.GetNoStateWithRecent(testAddr(2), 550, roTx)
+		require.NoError(err)
+		require.Equal(to > 550, ok)
+		if ok {
+			require.Equal(prev(550, salt), v)
+		}
+		it, err := ac.IndexRange(kv.AccountsHistoryIdx, testAddr(1), 0, -1, order.Asc, -1, roTx)
+		require.NoError(err)
+		require.Equal(expected(1, 4, 1, to), iter.ToArrU64Must(it))
+		it, err = ac.IndexRange(kv.CodeHistoryIdx, testAddr(3), 0, -1, order.Asc, -1, roTx)
+		require.NoError(err)
+		require.Equal(expected(3, 12, 1, to), iter.ToArrU64Must(it))
+		it, err = ac.IndexRange(kv.LogAddrIdx, testAddr(4), 0, -1, order.Asc, -1, roTx)
+		require.NoError(err)
+		require.Equal(expected(4, 5, 1, to), iter.ToArrU64Must(it))
+	}
+	check(0, 500)
+
+	// invalidated files are ignored after restart, even if they are still on disk
+	for _, name := range frozen {
+		data, err := os.ReadFile(filepath.Join(backup, name))
+		require.NoError(err)
+		require.NoError(os.WriteFile(filepath.Join(dir, name), data, 0o644))
+	}
+	agg.Close()
+	agg, err = NewAggregatorV3(ctx, dir, filepath.Join(path, "e4tmp"), 16, db, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+	require.NoError(agg.OpenFolder())
+	require.NotContains(agg.Files(), "accounts.0-32.v")
+	require.NotContains(agg.Files(), "logaddrs.0-32.ef")
+	require.Equal(uint64(496), agg.EndTxNumMinimax())
+	check(0, 500)
+
+	// re-execution: partial step is collated again, frozen file with same name is built again
+	write(500, 600, 1)
+	buildAndPrune(31, 36)
+	require.Contains(agg.Files(), "accounts.0-32.v")
+	require.Contains(agg.Files(), "logaddrs.0-32.ef")
+	require.Equal(uint64(576), agg.EndTxNumMinimax())
+	check(1, 601)
+	agg.Close()
+	agg, err = NewAggregatorV3(ctx, dir, filepath.Join(path, "e4tmp"), 16, db, log.New())
+	require.NoError(err)
+	t.Cleanup(agg.Close)
+	require.NoError(agg.OpenFolder())
+	require.Contains(agg.Files(), "accounts.0-32.v")
+	check(1, 601)
+}
+
 func Test_EncodeCommitmentState(t *testing.T) {
 	cs := commitmentState{
 		txNum:     rand.Uint64(),
@@ -635,3 +1692,156 @@ func Test_InitBtreeIndex(t *testing.T) {
 	require.EqualValues(t, bt.KeyCount(), keyCount)
 	bt.Close()
 }
+
+func Test_BtreeIndex_DefaultM(t *testing.T) {
+	logger := log.New()
+	tmp := t.TempDir()
+	dataPath := generateCompressedKV(t, tmp, 52, 10, 100, logger)
+
+	layoutPath := path.Join(tmp, "layout.bt")
+	require.NoError(t, BuildBtreeIndex(dataPath, layoutPath, logger))
+	layout, err := OpenBtreeIndex(layoutPath, dataPath, DefaultBtreeM)
+	require.NoError(t, err)
+	defer layout.Close()
+	require.EqualValues(t, DefaultBtreeWriterM, layout.M)
+
+	// legacy files are opened with fanout they were written for
+	legacyPath := path.Join(tmp, "legacy.bt")
+	require.NoError(t, buildBtreeIndex(dataPath, legacyPath, DefaultBtreeWriterM, true, logger))
+	legacy, err := OpenBtreeIndex(legacyPath, dataPath, DefaultBtreeM)
+	require.NoError(t, err)
+	defer legacy.Close()
+	require.EqualValues(t, 2048, legacy.alloc.M)
+}
+
+func Test_BtreeIndex_Layout(t *testing.T) {
+	logger := log.New()
+	M := uint64(16)
+
+	for _, keyCount := range []int{1, 3, 15, 16, 17, 33, 1000} {
+		tmp := t.TempDir()
+		dataPath := generateCompressedKV(t, tmp, 52, 10, keyCount, logger)
+		keys, err := pivotKeysFromKV(dataPath)
+		require.NoError(t, err)
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+		layoutPath := path.Join(tmp, "layout.bt")
+		require.NoError(t, buildBtreeIndex(dataPath, layoutPath, M, false, logger))
+		legacyPath := path.Join(tmp, "legacy.bt")
+		require.NoError(t, buildBtreeIndex(dataPath, legacyPath, M, true, logger))
+
+		layout, err := OpenBtreeIndex(layoutPath, dataPath, DefaultBtreeM)
+		require.NoError(t, err)
+		require.NotNil(t, layout.nodes)
+		require.EqualValues(t, M, layout.M) // fanout is taken from header, not from argument
+		legacy, err := OpenBtreeIndex(legacyPath, dataPath, M)
+		require.NoError(t, err)
+		require.Nil(t, legacy.nodes)
+
+		for _, bt := range []*BtIndex{layout, legacy} {
+			require.EqualValues(t, keyCount, bt.KeyCount())
+			for i, k := range keys {
+				cur, err := bt.Seek(k)
+				require.NoError(t, err)
+				require.EqualValuesf(t, k, cur.Key(), "keyCount=%d, i=%d", keyCount, i)
+				require.EqualValues(t, uint64(i), cur.d)
+
+				// non-existing key right before k
+				if alt := common.Copy(k); alt[len(alt)-1] > 0 {
+					alt[len(alt)-1]--
+					cur, err = bt.Seek(alt)
+					require.NoError(t, err)
+					require.EqualValuesf(t, k, cur.Key(), "keyCount=%d, i=%d", keyCount, i)
+				}
+
+				cur = bt.OrdinalLookup(uint64(i))
+				require.NotNil(t, cur)
+				require.EqualValues(t, k, cur.Key())
+			}
+			cur, err := bt.Seek(nil)
+			require.NoError(t, err)
+			require.EqualValues(t, keys[0], cur.Key())
+			n := 1
+			for cur.Next() {
+				require.EqualValues(t, keys[n], cur.Key())
+				n++
+			}
+			require.EqualValues(t, keyCount, n)
+
+			after := append(common.Copy(keys[len(keys)-1]), 0)
+			cur, err = bt.Seek(after)
+			require.NoError(t, err)
+			require.Nil(t, cur)
+			require.Nil(t, bt.OrdinalLookup(uint64(keyCount)))
+		}
+		layout.Close()
+		legacy.Close()
+	}
+}
+
+func Test_BtreeIndex_SeekLE_PrefixRange(t *testing.T) {
+	logger := log.New()
+	tmp := t.TempDir()
+	keyCount, M := 1000, uint64(16)
+	dataPath := generateCompressedKV(t, tmp, 52, 10, keyCount, logger)
+	keys, err := pivotKeysFromKV(dataPath)
+	require.NoError(t, err)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	for _, legacy := range []bool{false, true} {
+		indexPath := path.Join(tmp, fmt.Sprintf("legacy_%t.bt", legacy))
+		require.NoError(t, buildBtreeIndex(dataPath, indexPath, M, legacy, logger))
+		bt, err := OpenBtreeIndex(indexPath, dataPath, M)
+		require.NoError(t, err)
+
+		for i, k := range keys {
+			cur, err := bt.SeekLE(k)
+			require.NoError(t, err)
+			require.EqualValues(t, k, cur.Key())
+
+			// key right after k: greatest key <= it is still k
+			cur, err = bt.SeekLE(append(common.Copy(k), 0))
+			require.NoError(t, err)
+			require.EqualValues(t, k, cur.Key())
+
+			if i > 0 {
+				require.True(t, cur.Prev())
+				require.EqualValues(t, keys[i-1], cur.Key())
+				require.True(t, cur.Next())
+				require.EqualValues(t, k, cur.Key())
+			} else {
+				require.False(t, cur.Prev())
+			}
+		}
+		cur, err := bt.SeekLE([]byte{}) // smaller than any key
+		require.NoError(t, err)
+		require.Nil(t, cur)
+
+		for _, prefix := range [][]byte{nil, keys[0][:1], keys[len(keys)/2][:1], keys[len(keys)-1][:1], keys[7][:2], {0xff, 0xff, 0xff}} {
+			var expect [][]byte
+			for _, k := range keys {
+				if bytes.HasPrefix(k, prefix) {
+					expect = append(expect, k)
+				}
+			}
+			for _, asc := range []order.By{order.Asc, order.Desc} {
+				it, err := bt.PrefixRange(prefix, asc)
+				require.NoError(t, err)
+				var got [][]byte
+				for it.HasNext() {
+					k, v, err := it.Next()
+					require.NoError(t, err)
+					require.NotEmpty(t, v)
+					got = append(got, k)
+				}
+				if !asc {
+					for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+						got[i], got[j] = got[j], got[i]
+					}
+				}
+				require.Equal(t, expect, got, "prefix=%x, asc=%t", prefix, asc)
+			}
+		}
+		bt.Close()
+	}
+}
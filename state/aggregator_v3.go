@@ -42,42 +42,44 @@ import (
 )
 
 type AggregatorV3 struct {
-	rwTx             kv.RwTx
-	db               kv.RoDB
-	storage          *History
-	tracesTo         *InvertedIndex
-	backgroundResult *BackgroundResult
-	code             *History
-	logAddrs         *InvertedIndex
-	logTopics        *InvertedIndex
-	tracesFrom       *InvertedIndex
-	accounts         *History
-	logPrefix        string
-	dir              string
-	tmpdir           string
-	aggregationStep  uint64
-	keepInDB         uint64
+	rwTx            kv.RwTx
+	db              kv.RoDB
+	storage         *History
+	tracesTo        *InvertedIndex
+	code            *History
+	logAddrs        *InvertedIndex
+	logTopics       *InvertedIndex
+	tracesFrom      *InvertedIndex
+	accounts        *History
+	extraHistories  []registeredHistory       // see RegisterHistory
+	extraIdx        []registeredInvertedIndex // see RegisterInvertedIndex
+	logPrefix       string
+	dir             string
+	tmpdir          string
+	aggregationStep uint64
+	keepInDB        uint64
 
 	minimaxTxNumInFiles atomic.Uint64
 
 	filesMutationLock sync.Mutex
 
 	// To keep DB small - need move data to small files ASAP.
-	// It means goroutine which creating small files - can't be locked by merge or indexing.
-	buildingFiles           atomic.Bool
-	mergeingFiles           atomic.Bool
-	buildingOptionalIndices atomic.Bool
+	// It means job which creating small files - can't be locked by merge or indexing. See JobKind.
+	scheduler *MergeScheduler
 
 	//warmupWorking          atomic.Bool
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 
 	needSaveFilesListInDB atomic.Bool
-	wg                    sync.WaitGroup
 
 	onFreeze OnFreezeFunc
 	walLock  sync.RWMutex
 
+	members  membersCfg
+	readOnly bool           // see NewAggregatorV3ReadOnly
+	wg       sync.WaitGroup // folder watcher of read-only aggregator
+
 	ps *background.ProgressSet
 
 	// next fields are set only if agg.doTraceCtx is true. can enable by env: TRACE_AGG=true
@@ -90,41 +92,43 @@ type OnFreezeFunc func(frozenFileNames []string)
 func NewAggregatorV3(ctx context.Context, dir, tmpdir string, aggregationStep uint64, db kv.RoDB, logger log.Logger) (*AggregatorV3, error) {
 	ctx, ctxCancel := context.WithCancel(ctx)
 	a := &AggregatorV3{
-		ctx:              ctx,
-		ctxCancel:        ctxCancel,
-		onFreeze:         func(frozenFileNames []string) {},
-		dir:              dir,
-		tmpdir:           tmpdir,
-		aggregationStep:  aggregationStep,
-		db:               db,
-		keepInDB:         2 * aggregationStep,
-		leakDetector:     dbg.NewLeakDetector("agg", dbg.SlowTx()),
-		ps:               background.NewProgressSet(),
-		backgroundResult: &BackgroundResult{},
-		logger:           logger,
+		ctx:             ctx,
+		ctxCancel:       ctxCancel,
+		onFreeze:        func(frozenFileNames []string) {},
+		dir:             dir,
+		tmpdir:          tmpdir,
+		aggregationStep: aggregationStep,
+		db:              db,
+		keepInDB:        2 * aggregationStep,
+		leakDetector:    dbg.NewLeakDetector("agg", dbg.SlowTx()),
+		ps:              background.NewProgressSet(),
+		scheduler:       NewMergeScheduler(ctx, DefaultMergeSchedulerCfg, logger),
+		members:         membersCfg{compressWorkers: 1, collateWorkers: 1, pruneProgressTable: kv.TblPruningProgress},
+		logger:          logger,
 	}
 	var err error
-	if a.accounts, err = NewHistory(dir, a.tmpdir, aggregationStep, "accounts", kv.TblAccountHistoryKeys, kv.TblAccountIdx, kv.TblAccountHistoryVals, false, nil, false, logger); err != nil {
+	if a.accounts, err = NewHistory(dir, a.tmpdir, aggregationStep, "accounts", kv.TblAccountHistoryKeys, kv.TblAccountIdx, kv.TblAccountHistoryVals, RawValues, nil, false, logger); err != nil {
 		return nil, err
 	}
-	if a.storage, err = NewHistory(dir, a.tmpdir, aggregationStep, "storage", kv.TblStorageHistoryKeys, kv.TblStorageIdx, kv.TblStorageHistoryVals, false, nil, false, logger); err != nil {
+	if a.storage, err = NewHistory(dir, a.tmpdir, aggregationStep, "storage", kv.TblStorageHistoryKeys, kv.TblStorageIdx, kv.TblStorageHistoryVals, RawValues, nil, false, logger); err != nil {
 		return nil, err
 	}
-	if a.code, err = NewHistory(dir, a.tmpdir, aggregationStep, "code", kv.TblCodeHistoryKeys, kv.TblCodeIdx, kv.TblCodeHistoryVals, true, nil, true, logger); err != nil {
+	if a.code, err = NewHistory(dir, a.tmpdir, aggregationStep, "code", kv.TblCodeHistoryKeys, kv.TblCodeIdx, kv.TblCodeHistoryVals, CompressedValues, nil, true, logger); err != nil {
 		return nil, err
 	}
-	if a.logAddrs, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "logaddrs", kv.TblLogAddressKeys, kv.TblLogAddressIdx, false, nil, logger); err != nil {
+	if a.logAddrs, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "logaddrs", kv.TblLogAddressKeys, kv.TblLogAddressIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
-	if a.logTopics, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "logtopics", kv.TblLogTopicsKeys, kv.TblLogTopicsIdx, false, nil, logger); err != nil {
+	if a.logTopics, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "logtopics", kv.TblLogTopicsKeys, kv.TblLogTopicsIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
-	if a.tracesFrom, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "tracesfrom", kv.TblTracesFromKeys, kv.TblTracesFromIdx, false, nil, logger); err != nil {
+	if a.tracesFrom, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "tracesfrom", kv.TblTracesFromKeys, kv.TblTracesFromIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
-	if a.tracesTo, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "tracesto", kv.TblTracesToKeys, kv.TblTracesToIdx, false, nil, logger); err != nil {
+	if a.tracesTo, err = NewInvertedIndex(dir, a.tmpdir, aggregationStep, "tracesto", kv.TblTracesToKeys, kv.TblTracesToIdx, RawValues, false, nil, logger); err != nil {
 		return nil, err
 	}
+	a.configureMembers()
 	a.recalcMaxTxNum()
 
 	return a, nil
@@ -134,56 +138,53 @@ func (a *AggregatorV3) OnFreeze(f OnFreezeFunc) { a.onFreeze = f }
 func (a *AggregatorV3) OpenFolder() error {
 	a.filesMutationLock.Lock()
 	defer a.filesMutationLock.Unlock()
-	var err error
-	if err = a.accounts.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
-	}
-	if err = a.storage.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
-	}
-	if err = a.code.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
-	}
-	if err = a.logAddrs.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
-	}
-	if err = a.logTopics.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
-	}
-	if err = a.tracesFrom.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
+	for _, h := range a.histories() {
+		if err := h.OpenFolder(); err != nil {
+			return fmt.Errorf("OpenFolder: %w", err)
+		}
 	}
-	if err = a.tracesTo.OpenFolder(); err != nil {
-		return fmt.Errorf("OpenFolder: %w", err)
+	for _, ii := range a.invertedIndices() {
+		if err := ii.OpenFolder(); err != nil {
+			return fmt.Errorf("OpenFolder: %w", err)
+		}
 	}
 	a.recalcMaxTxNum()
 	return nil
 }
+
+// CheckFiles - fsck: reports drift between files manifests, files on disk and open files.
+// `checksums=true` reads all files to verify their content.
+func (a *AggregatorV3) CheckFiles(checksums bool) (drift []FileDrift, err error) {
+	for _, h := range a.histories() {
+		d, err := h.CheckFiles(checksums)
+		if err != nil {
+			return nil, fmt.Errorf("CheckFiles: %s, %w", h.filenameBase, err)
+		}
+		drift = append(drift, d...)
+	}
+	for _, ii := range a.invertedIndices() {
+		d, err := ii.CheckFiles(checksums)
+		if err != nil {
+			return nil, fmt.Errorf("CheckFiles: %s, %w", ii.filenameBase, err)
+		}
+		drift = append(drift, d...)
+	}
+	return drift, nil
+}
+
 func (a *AggregatorV3) OpenList(fNames []string) error {
 	a.filesMutationLock.Lock()
 	defer a.filesMutationLock.Unlock()
 
-	var err error
-	if err = a.accounts.OpenList(fNames); err != nil {
-		return err
-	}
-	if err = a.storage.OpenList(fNames); err != nil {
-		return err
-	}
-	if err = a.code.OpenList(fNames); err != nil {
-		return err
-	}
-	if err = a.logAddrs.OpenList(fNames); err != nil {
-		return err
-	}
-	if err = a.logTopics.OpenList(fNames); err != nil {
-		return err
-	}
-	if err = a.tracesFrom.OpenList(fNames); err != nil {
-		return err
+	for _, h := range a.histories() {
+		if err := h.OpenList(fNames); err != nil {
+			return err
+		}
 	}
-	if err = a.tracesTo.OpenList(fNames); err != nil {
-		return err
+	for _, ii := range a.invertedIndices() {
+		if err := ii.OpenList(fNames); err != nil {
+			return err
+		}
 	}
 	a.recalcMaxTxNum()
 	return nil
@@ -191,104 +192,105 @@ func (a *AggregatorV3) OpenList(fNames []string) error {
 
 func (a *AggregatorV3) Close() {
 	a.ctxCancel()
+	a.scheduler.Close()
 	a.wg.Wait()
 
 	a.filesMutationLock.Lock()
 	defer a.filesMutationLock.Unlock()
 
-	a.accounts.Close()
-	a.storage.Close()
-	a.code.Close()
-	a.logAddrs.Close()
-	a.logTopics.Close()
-	a.tracesFrom.Close()
-	a.tracesTo.Close()
+	for _, h := range a.histories() {
+		h.Close()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.Close()
+	}
 }
 
 // CleanDir - call it manually on startup of Main application (don't call it from utilities or nother processes)
 //   - remove files ignored during opening of aggregator
 //   - remove files which marked as deleted but have no readers (usually last reader removing files marked as deleted)
 func (a *AggregatorV3) CleanDir() {
-	a.accounts.deleteGarbageFiles()
-	a.storage.deleteGarbageFiles()
-	a.code.deleteGarbageFiles()
-	a.logAddrs.deleteGarbageFiles()
-	a.logTopics.deleteGarbageFiles()
-	a.tracesFrom.deleteGarbageFiles()
-	a.tracesTo.deleteGarbageFiles()
+	if a.readOnly {
+		return
+	}
+	for _, h := range a.histories() {
+		h.deleteGarbageFiles()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.deleteGarbageFiles()
+	}
 
 	ac := a.MakeContext()
 	defer ac.Close()
-	ac.a.accounts.cleanAfterFreeze(ac.accounts.frozenTo())
-	ac.a.storage.cleanAfterFreeze(ac.storage.frozenTo())
-	ac.a.code.cleanAfterFreeze(ac.code.frozenTo())
-	ac.a.logAddrs.cleanAfterFreeze(ac.logAddrs.frozenTo())
-	ac.a.logTopics.cleanAfterFreeze(ac.logTopics.frozenTo())
-	ac.a.tracesFrom.cleanAfterFreeze(ac.tracesFrom.frozenTo())
-	ac.a.tracesTo.cleanAfterFreeze(ac.tracesTo.frozenTo())
+	for _, hc := range ac.histories() {
+		hc.h.cleanAfterFreeze(hc.frozenTo())
+	}
+	for _, ic := range ac.invertedIndices() {
+		ic.ii.cleanAfterFreeze(ic.frozenTo())
+	}
 }
 
 func (a *AggregatorV3) SetWorkers(i int) {
-	a.accounts.compressWorkers = i
-	a.storage.compressWorkers = i
-	a.code.compressWorkers = i
-	a.logAddrs.compressWorkers = i
-	a.logTopics.compressWorkers = i
-	a.tracesFrom.compressWorkers = i
-	a.tracesTo.compressWorkers = i
+	a.members.compressWorkers = i
+	a.configureMembers()
+}
+
+// SetCollateWorkers - read partitions of key space in parallel read transactions during collation.
+// Files are same as with serial collation
+func (a *AggregatorV3) SetCollateWorkers(i int) {
+	a.members.collateWorkers = i
+	a.configureMembers()
 }
 
 func (a *AggregatorV3) HasBackgroundFilesBuild() bool { return a.ps.Has() }
 func (a *AggregatorV3) BackgroundProgress() string    { return a.ps.String() }
 
+// Scheduler - runs background files build, merge and indexing. Use it to set pace, Pause/Resume, see Stats.
+func (a *AggregatorV3) Scheduler() *MergeScheduler { return a.scheduler }
+
 func (a *AggregatorV3) Files() (res []string) {
 	a.filesMutationLock.Lock()
 	defer a.filesMutationLock.Unlock()
 
-	res = append(res, a.accounts.Files()...)
-	res = append(res, a.storage.Files()...)
-	res = append(res, a.code.Files()...)
-	res = append(res, a.logAddrs.Files()...)
-	res = append(res, a.logTopics.Files()...)
-	res = append(res, a.tracesFrom.Files()...)
-	res = append(res, a.tracesTo.Files()...)
+	for _, h := range a.histories() {
+		res = append(res, h.Files()...)
+	}
+	for _, ii := range a.invertedIndices() {
+		res = append(res, ii.Files()...)
+	}
 	return res
 }
 func (a *AggregatorV3) BuildOptionalMissedIndicesInBackground(ctx context.Context, workers int) {
-	if ok := a.buildingOptionalIndices.CompareAndSwap(false, true); !ok {
+	if a.readOnly {
 		return
 	}
-	a.wg.Add(1)
-	go func() {
-		defer a.wg.Done()
-		defer a.buildingOptionalIndices.Store(false)
+	a.scheduler.ScheduleExclusive(JobBuildIndices, "optional indices", 0, func(_ context.Context, budget *IOBudget) error {
+		if err := budget.Wait(ctx); err != nil {
+			return err
+		}
 		aggCtx := a.MakeContext()
 		defer aggCtx.Close()
-		if err := aggCtx.BuildOptionalMissedIndices(ctx, workers); err != nil {
-			if errors.Is(err, context.Canceled) {
-				return
-			}
-			log.Warn("[snapshots] merge", "err", err)
-		}
-	}()
+		return aggCtx.BuildOptionalMissedIndices(ctx, workers)
+	})
 }
 
 func (ac *AggregatorV3Context) BuildOptionalMissedIndices(ctx context.Context, workers int) error {
+	if ac.a.readOnly {
+		return ErrAggregatorReadOnly
+	}
 	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(workers)
-	if ac.accounts != nil {
-		g.Go(func() error { return ac.accounts.BuildOptionalMissedIndices(ctx) })
-	}
-	if ac.storage != nil {
-		g.Go(func() error { return ac.storage.BuildOptionalMissedIndices(ctx) })
-	}
-	if ac.code != nil {
-		g.Go(func() error { return ac.code.BuildOptionalMissedIndices(ctx) })
+	for _, hc := range ac.histories() {
+		hc := hc
+		g.Go(func() error { return hc.BuildOptionalMissedIndices(ctx) })
 	}
 	return g.Wait()
 }
 
 func (a *AggregatorV3) BuildMissedIndices(ctx context.Context, workers int) error {
+	if a.readOnly {
+		return ErrAggregatorReadOnly
+	}
 	startIndexingTime := time.Now()
 	{
 		ps := background.NewProgressSet()
@@ -310,13 +312,12 @@ func (a *AggregatorV3) BuildMissedIndices(ctx context.Context, workers int) erro
 			}
 		}()
 
-		a.accounts.BuildMissedIndices(ctx, g, ps)
-		a.storage.BuildMissedIndices(ctx, g, ps)
-		a.code.BuildMissedIndices(ctx, g, ps)
-		a.logAddrs.BuildMissedIndices(ctx, g, ps)
-		a.logTopics.BuildMissedIndices(ctx, g, ps)
-		a.tracesFrom.BuildMissedIndices(ctx, g, ps)
-		a.tracesTo.BuildMissedIndices(ctx, g, ps)
+		for _, h := range a.histories() {
+			h.BuildMissedIndices(ctx, g, ps)
+		}
+		for _, ii := range a.invertedIndices() {
+			ii.BuildMissedIndices(ctx, g, ps)
+		}
 
 		if err := g.Wait(); err != nil {
 			return err
@@ -335,23 +336,21 @@ func (a *AggregatorV3) SetLogPrefix(v string) { a.logPrefix = v }
 
 func (a *AggregatorV3) SetTx(tx kv.RwTx) {
 	a.rwTx = tx
-	a.accounts.SetTx(tx)
-	a.storage.SetTx(tx)
-	a.code.SetTx(tx)
-	a.logAddrs.SetTx(tx)
-	a.logTopics.SetTx(tx)
-	a.tracesFrom.SetTx(tx)
-	a.tracesTo.SetTx(tx)
+	for _, h := range a.histories() {
+		h.SetTx(tx)
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.SetTx(tx)
+	}
 }
 
 func (a *AggregatorV3) SetTxNum(txNum uint64) {
-	a.accounts.SetTxNum(txNum)
-	a.storage.SetTxNum(txNum)
-	a.code.SetTxNum(txNum)
-	a.logAddrs.SetTxNum(txNum)
-	a.logTopics.SetTxNum(txNum)
-	a.tracesFrom.SetTxNum(txNum)
-	a.tracesTo.SetTxNum(txNum)
+	for _, h := range a.histories() {
+		h.SetTxNum(txNum)
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.SetTxNum(txNum)
+	}
 }
 
 type AggV3Collation struct {
@@ -362,12 +361,24 @@ type AggV3Collation struct {
 	accounts   HistoryCollation
 	storage    HistoryCollation
 	code       HistoryCollation
+
+	// registered histories and inverted indices, in order of registration
+	extraHistories []HistoryCollation
+	extraIdx       []map[string]*roaring64.Bitmap
 }
 
 func (c AggV3Collation) Close() {
 	c.accounts.Close()
 	c.storage.Close()
 	c.code.Close()
+	for _, hc := range c.extraHistories {
+		hc.Close()
+	}
+	for _, m := range c.extraIdx {
+		for _, b := range m {
+			bitmapdb.ReturnToPool64(b)
+		}
+	}
 
 	for _, b := range c.logAddrs {
 		bitmapdb.ReturnToPool64(b)
@@ -403,10 +414,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.accounts, err = a.accounts.collate(step, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.accounts, err = a.accounts.collateParallel(ctx, step, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -420,10 +428,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.storage, err = a.storage.collate(step, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.storage, err = a.storage.collateParallel(ctx, step, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -436,10 +441,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.code, err = a.code.collate(step, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.code, err = a.code.collateParallel(ctx, step, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -452,10 +454,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.logAddrs, err = a.logAddrs.collate(ctx, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.logAddrs, err = a.logAddrs.collateParallel(ctx, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -468,10 +467,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.logTopics, err = a.logTopics.collate(ctx, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.logTopics, err = a.logTopics.collateParallel(ctx, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -484,10 +480,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.tracesFrom, err = a.tracesFrom.collate(ctx, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.tracesFrom, err = a.tracesFrom.collateParallel(ctx, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -500,10 +493,7 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 	//go func() {
 	//	defer wg.Done()
 	//	var err error
-	if err = a.db.View(ctx, func(tx kv.Tx) error {
-		ac.tracesTo, err = a.tracesTo.collate(ctx, txFrom, txTo, tx)
-		return err
-	}); err != nil {
+	if ac.tracesTo, err = a.tracesTo.collateParallel(ctx, txFrom, txTo, a.db); err != nil {
 		return sf, err
 		//errCh <- err
 	}
@@ -512,6 +502,30 @@ func (a *AggregatorV3) buildFiles(ctx context.Context, step, txFrom, txTo uint64
 		return sf, err
 		//		errCh <- err
 	}
+	for _, r := range a.extraHistories {
+		var coll HistoryCollation
+		if coll, err = r.h.collateParallel(ctx, step, txFrom, txTo, a.db); err != nil {
+			return sf, err
+		}
+		ac.extraHistories = append(ac.extraHistories, coll)
+		hf, err := r.h.buildFiles(ctx, step, coll, a.ps)
+		if err != nil {
+			return sf, err
+		}
+		sf.extraHistories = append(sf.extraHistories, hf)
+	}
+	for _, r := range a.extraIdx {
+		var coll map[string]*roaring64.Bitmap
+		if coll, err = r.ii.collateParallel(ctx, txFrom, txTo, a.db); err != nil {
+			return sf, err
+		}
+		ac.extraIdx = append(ac.extraIdx, coll)
+		iif, err := r.ii.buildFiles(ctx, step, coll, a.ps)
+		if err != nil {
+			return sf, err
+		}
+		sf.extraIdx = append(sf.extraIdx, iif)
+	}
 	//}()
 	//go func() {
 	//	wg.Wait()
@@ -537,6 +551,9 @@ type AggV3StaticFiles struct {
 	logTopics  InvertedFiles
 	tracesFrom InvertedFiles
 	tracesTo   InvertedFiles
+
+	extraHistories []HistoryFiles
+	extraIdx       []InvertedFiles
 }
 
 func (sf AggV3StaticFiles) Close() {
@@ -547,32 +564,35 @@ func (sf AggV3StaticFiles) Close() {
 	sf.logTopics.Close()
 	sf.tracesFrom.Close()
 	sf.tracesTo.Close()
+	for _, hf := range sf.extraHistories {
+		hf.Close()
+	}
+	for _, iif := range sf.extraIdx {
+		iif.Close()
+	}
 }
 
 func (a *AggregatorV3) BuildFiles(toTxNum uint64) (err error) {
-	a.BuildFilesInBackground(toTxNum)
-	if !(a.buildingFiles.Load() || a.mergeingFiles.Load() || a.buildingOptionalIndices.Load()) {
-		return nil
+	if a.readOnly {
+		return ErrAggregatorReadOnly
 	}
+	a.BuildFilesInBackground(toTxNum)
+	idle := a.scheduler.Idle()
 
 	logEvery := time.NewTicker(20 * time.Second)
 	defer logEvery.Stop()
-Loop:
 	for {
 		select {
 		case <-a.ctx.Done():
 			return a.ctx.Err()
+		case <-idle:
+			return nil
 		case <-logEvery.C:
-			if !(a.buildingFiles.Load() || a.mergeingFiles.Load() || a.buildingOptionalIndices.Load()) {
-				break Loop
-			}
 			if a.HasBackgroundFilesBuild() {
 				log.Info("[snapshots] Files build", "progress", a.BackgroundProgress())
 			}
 		}
 	}
-
-	return nil
 }
 
 func (a *AggregatorV3) buildFilesInBackground(ctx context.Context, step uint64) (err error) {
@@ -594,44 +614,81 @@ func (a *AggregatorV3) buildFilesInBackground(ctx context.Context, step uint64)
 	return nil
 }
 
-func (a *AggregatorV3) mergeLoopStep(ctx context.Context, workers int) (somethingDone bool, err error) {
+// scheduleMerge - schedules 1 merge step, job re-schedules itself while there is something to merge.
+// When nothing to merge - schedules build of optional indices.
+func (a *AggregatorV3) scheduleMerge() {
+	ac := a.MakeContext()
+	r := ac.findMergeRange(a.minimaxTxNumInFiles.Load(), a.aggregationStep*StepsInBiggestFile)
+	var size uint64
+	if r.any() {
+		sf, err := ac.staticFilesInRange(r)
+		if err != nil {
+			ac.Close()
+			log.Warn("[snapshots] merge", "err", err)
+			return
+		}
+		size = sf.size()
+	}
+	ac.Close()
+	if !r.any() {
+		a.BuildOptionalMissedIndicesInBackground(a.ctx, 1)
+		return
+	}
+
+	a.scheduler.Schedule(JobMerge, "merge", size, func(ctx context.Context, budget *IOBudget) error {
+		if err := budget.Wait(ctx); err != nil {
+			return err
+		}
+		in, somethingMerged, err := a.mergeLoopStep(ctx, 1)
+		budget.Spend(writtenFiles(in.items()...))
+		if err != nil {
+			return err
+		}
+		if somethingMerged {
+			a.scheduleMerge()
+		} else {
+			a.BuildOptionalMissedIndicesInBackground(a.ctx, 1)
+		}
+		return nil
+	})
+}
+
+// mergeLoopStep - returns merged files: they are already integrated, only for accounting of written bytes
+func (a *AggregatorV3) mergeLoopStep(ctx context.Context, workers int) (in MergedFilesV3, somethingDone bool, err error) {
 	ac := a.MakeContext() // this need, to ensure we do all operations on files in "transaction-style", maybe we will ensure it on type-level in future
 	defer ac.Close()
 
-	closeAll := true
 	maxSpan := a.aggregationStep * StepsInBiggestFile
 	r := ac.findMergeRange(a.minimaxTxNumInFiles.Load(), maxSpan)
 	if !r.any() {
-		return false, nil
+		return in, false, nil
 	}
 
 	outs, err := ac.staticFilesInRange(r)
-	defer func() {
-		if closeAll {
-			outs.Close()
-		}
-	}()
 	if err != nil {
-		return false, err
+		return in, false, err
 	}
+	in, err = a.mergeStaticFiles(ctx, ac, outs, r, workers)
+	return in, true, err
+}
 
+// mergeStaticFiles - merges files `outs` selected by `r` in context `ac` and replaces them by merged files.
+// `outs` are open files of aggregator: they are not closed on failure (for example, cancellation), readers use them
+func (a *AggregatorV3) mergeStaticFiles(ctx context.Context, ac *AggregatorV3Context, outs SelectedStaticFilesV3, r RangesV3, workers int) (MergedFilesV3, error) {
 	in, err := ac.mergeFiles(ctx, outs, r, workers)
 	if err != nil {
-		return true, err
+		return MergedFilesV3{}, err
 	}
-	defer func() {
-		if closeAll {
-			in.Close()
-		}
-	}()
 	a.integrateMergedFiles(outs, in)
 	a.onFreeze(in.FrozenList())
-	closeAll = false
-	return true, nil
+	return in, nil
 }
 func (a *AggregatorV3) MergeLoop(ctx context.Context, workers int) error {
+	if a.readOnly {
+		return ErrAggregatorReadOnly
+	}
 	for {
-		somethingMerged, err := a.mergeLoopStep(ctx, workers)
+		_, somethingMerged, err := a.mergeLoopStep(ctx, workers)
 		if err != nil {
 			return err
 		}
@@ -653,77 +710,145 @@ func (a *AggregatorV3) integrateFiles(sf AggV3StaticFiles, txNumFrom, txNumTo ui
 	a.logTopics.integrateFiles(sf.logTopics, txNumFrom, txNumTo)
 	a.tracesFrom.integrateFiles(sf.tracesFrom, txNumFrom, txNumTo)
 	a.tracesTo.integrateFiles(sf.tracesTo, txNumFrom, txNumTo)
+	for i, r := range a.extraHistories {
+		r.h.integrateFiles(sf.extraHistories[i], txNumFrom, txNumTo)
+	}
+	for i, r := range a.extraIdx {
+		r.ii.integrateFiles(sf.extraIdx[i], txNumFrom, txNumTo)
+	}
 }
 
 func (a *AggregatorV3) HasNewFrozenFiles() bool {
 	return a.needSaveFilesListInDB.CompareAndSwap(true, false)
 }
 
+// Unwind - removes data at or after `txUnwindTo`. If it's inside of files (even frozen): waits for background builds and merges,
+// then truncates files, see unwind_files.go
 func (a *AggregatorV3) Unwind(ctx context.Context, txUnwindTo uint64) error {
+	if a.readOnly {
+		return ErrAggregatorReadOnly
+	}
+	if err := a.unwindFiles(ctx, txUnwindTo); err != nil {
+		return err
+	}
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
-	if err := a.accounts.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	for _, h := range a.histories() {
+		if _, err := h.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
+			return err
+		}
+		if err := h.resetPruneProgress(); err != nil {
+			return err
+		}
 	}
-	if err := a.storage.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	for _, ii := range a.invertedIndices() {
+		if _, err := ii.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
+			return err
+		}
+		if err := ii.resetPruneProgress(); err != nil {
+			return err
+		}
 	}
-	if err := a.code.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	return nil
+}
+
+func (a *AggregatorV3) unwindFiles(ctx context.Context, txUnwindTo uint64) error {
+	stepFrom := txUnwindTo / a.aggregationStep * a.aggregationStep
+	if !a.hasFilesAfter(stepFrom) && !a.scheduler.Running(JobBuildFiles) {
+		return nil
 	}
-	if err := a.logAddrs.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	// background jobs may integrate files which are going to be truncated
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-a.scheduler.Idle():
 	}
-	if err := a.logTopics.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	a.filesMutationLock.Lock()
+	defer a.filesMutationLock.Unlock()
+	if !a.hasFilesAfter(stepFrom) {
+		return nil
 	}
-	if err := a.tracesFrom.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	for _, h := range a.histories() {
+		if err := h.InvertedIndex.checkUnwindFiles(txUnwindTo); err != nil {
+			return err
+		}
 	}
-	if err := a.tracesTo.prune(ctx, txUnwindTo, math2.MaxUint64, math2.MaxUint64, logEvery); err != nil {
-		return err
+	for _, ii := range a.invertedIndices() {
+		if err := ii.checkUnwindFiles(txUnwindTo); err != nil {
+			return err
+		}
+	}
+	defer a.needSaveFilesListInDB.Store(true)
+	defer a.recalcMaxTxNum()
+	for _, h := range a.histories() {
+		if err := h.unwindFiles(ctx, txUnwindTo, a.ps); err != nil {
+			return fmt.Errorf("unwind files: %w", err)
+		}
+	}
+	for _, ii := range a.invertedIndices() {
+		if err := ii.unwindFiles(ctx, txUnwindTo, a.ps); err != nil {
+			return fmt.Errorf("unwind files: %w", err)
+		}
 	}
+	a.logger.Info("[snapshots] unwind files", "to", txUnwindTo, "step", txUnwindTo/a.aggregationStep)
 	return nil
 }
 
+// FinishUnwind - must be called after commit of tx passed to SetTx before Unwind: files replaced by Unwind
+// are removed from disk and files manifests. See unwind_files.go
+func (a *AggregatorV3) FinishUnwind() {
+	a.filesMutationLock.Lock()
+	defer a.filesMutationLock.Unlock()
+	for _, h := range a.histories() {
+		h.finishUnwind()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.finishUnwind()
+	}
+}
+
+func (a *AggregatorV3) hasFilesAfter(txNum uint64) bool {
+	for _, h := range a.histories() {
+		if h.endTxNumMinimax() > txNum {
+			return true
+		}
+	}
+	for _, ii := range a.invertedIndices() {
+		if ii.endTxNumMinimax() > txNum {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *AggregatorV3) Warmup(ctx context.Context, txFrom, limit uint64) error {
 	if a.db == nil {
 		return nil
 	}
 	e, ctx := errgroup.WithContext(ctx)
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.accounts.warmup(ctx, txFrom, limit, tx) })
-	})
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.storage.warmup(ctx, txFrom, limit, tx) })
-	})
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.code.warmup(ctx, txFrom, limit, tx) })
-	})
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.logAddrs.warmup(ctx, txFrom, limit, tx) })
-	})
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.logTopics.warmup(ctx, txFrom, limit, tx) })
-	})
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.tracesFrom.warmup(ctx, txFrom, limit, tx) })
-	})
-	e.Go(func() error {
-		return a.db.View(ctx, func(tx kv.Tx) error { return a.tracesTo.warmup(ctx, txFrom, limit, tx) })
-	})
+	for _, h := range a.histories() {
+		h := h
+		e.Go(func() error {
+			return a.db.View(ctx, func(tx kv.Tx) error { return h.warmup(ctx, txFrom, limit, tx) })
+		})
+	}
+	for _, ii := range a.invertedIndices() {
+		ii := ii
+		e.Go(func() error {
+			return a.db.View(ctx, func(tx kv.Tx) error { return ii.warmup(ctx, txFrom, limit, tx) })
+		})
+	}
 	return e.Wait()
 }
 
 // StartWrites - pattern: `defer agg.StartWrites().FinishWrites()`
 func (a *AggregatorV3) DiscardHistory() *AggregatorV3 {
-	a.accounts.DiscardHistory()
-	a.storage.DiscardHistory()
-	a.code.DiscardHistory()
-	a.logAddrs.DiscardHistory(a.tmpdir)
-	a.logTopics.DiscardHistory(a.tmpdir)
-	a.tracesFrom.DiscardHistory(a.tmpdir)
-	a.tracesTo.DiscardHistory(a.tmpdir)
+	for _, h := range a.histories() {
+		h.DiscardHistory()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.DiscardHistory(a.tmpdir)
+	}
 	return a
 }
 
@@ -731,37 +856,34 @@ func (a *AggregatorV3) DiscardHistory() *AggregatorV3 {
 func (a *AggregatorV3) StartWrites() *AggregatorV3 {
 	a.walLock.Lock()
 	defer a.walLock.Unlock()
-	a.accounts.StartWrites()
-	a.storage.StartWrites()
-	a.code.StartWrites()
-	a.logAddrs.StartWrites()
-	a.logTopics.StartWrites()
-	a.tracesFrom.StartWrites()
-	a.tracesTo.StartWrites()
+	for _, h := range a.histories() {
+		h.StartWrites()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.StartWrites()
+	}
 	return a
 }
 func (a *AggregatorV3) StartUnbufferedWrites() *AggregatorV3 {
 	a.walLock.Lock()
 	defer a.walLock.Unlock()
-	a.accounts.StartWrites()
-	a.storage.StartWrites()
-	a.code.StartWrites()
-	a.logAddrs.StartWrites()
-	a.logTopics.StartWrites()
-	a.tracesFrom.StartWrites()
-	a.tracesTo.StartWrites()
+	for _, h := range a.histories() {
+		h.StartWrites()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.StartWrites()
+	}
 	return a
 }
 func (a *AggregatorV3) FinishWrites() {
 	a.walLock.Lock()
 	defer a.walLock.Unlock()
-	a.accounts.FinishWrites()
-	a.storage.FinishWrites()
-	a.code.FinishWrites()
-	a.logAddrs.FinishWrites()
-	a.logTopics.FinishWrites()
-	a.tracesFrom.FinishWrites()
-	a.tracesTo.FinishWrites()
+	for _, h := range a.histories() {
+		h.FinishWrites()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.FinishWrites()
+	}
 }
 
 type flusher interface {
@@ -771,15 +893,14 @@ type flusher interface {
 func (a *AggregatorV3) rotate() []flusher {
 	a.walLock.Lock()
 	defer a.walLock.Unlock()
-	return []flusher{
-		a.accounts.Rotate(),
-		a.storage.Rotate(),
-		a.code.Rotate(),
-		a.logAddrs.Rotate(),
-		a.logTopics.Rotate(),
-		a.tracesFrom.Rotate(),
-		a.tracesTo.Rotate(),
+	var flushers []flusher
+	for _, h := range a.histories() {
+		flushers = append(flushers, h.Rotate())
 	}
+	for _, ii := range a.invertedIndices() {
+		flushers = append(flushers, ii.Rotate())
+	}
+	return flushers
 }
 func (a *AggregatorV3) Flush(ctx context.Context, tx kv.RwTx) error {
 	flushers := a.rotate()
@@ -808,24 +929,32 @@ func (a *AggregatorV3) CanPruneFrom(tx kv.Tx) uint64 {
 
 func (a *AggregatorV3) PruneWithTiemout(ctx context.Context, timeout time.Duration) error {
 	t := time.Now()
+	stat := &AggregatorPruneStats{}
 	for a.CanPrune(a.rwTx) && time.Since(t) < timeout {
-		if err := a.Prune(ctx, 1_000); err != nil { // prune part of retired data, before commit
+		s, err := a.PruneWithStats(ctx, 1_000) // prune part of retired data, before commit
+		if err != nil {
 			return err
 		}
+		stat.Accumulate(s)
+		if s.Total.RowsDeleted == 0 { // left rows are not prunable, don't spin until timeout
+			break
+		}
+	}
+	if stat.Total.RowsDeleted > 0 {
+		a.logger.Debug("[snapshots] prune", "stat", stat.String())
 	}
 	return nil
 }
 
 func (a *AggregatorV3) StepsRangeInDBAsStr(tx kv.Tx) string {
-	return strings.Join([]string{
-		a.accounts.stepsRangeInDBAsStr(tx),
-		a.storage.stepsRangeInDBAsStr(tx),
-		a.code.stepsRangeInDBAsStr(tx),
-		a.logAddrs.stepsRangeInDBAsStr(tx),
-		a.logTopics.stepsRangeInDBAsStr(tx),
-		a.tracesFrom.stepsRangeInDBAsStr(tx),
-		a.tracesTo.stepsRangeInDBAsStr(tx),
-	}, ", ")
+	var steps []string
+	for _, h := range a.histories() {
+		steps = append(steps, h.stepsRangeInDBAsStr(tx))
+	}
+	for _, ii := range a.invertedIndices() {
+		steps = append(steps, ii.stepsRangeInDBAsStr(tx))
+	}
+	return strings.Join(steps, ", ")
 }
 
 func (a *AggregatorV3) Prune(ctx context.Context, limit uint64) error {
@@ -839,34 +968,35 @@ func (a *AggregatorV3) Prune(ctx context.Context, limit uint64) error {
 	//		_ = a.Warmup(ctx, 0, cmp.Max(a.aggregationStep, limit)) // warmup is asyn and moving faster than data deletion
 	//	}()
 	//}
+	_, err := a.PruneWithStats(ctx, limit)
+	return err
+}
+
+// PruneWithStats - same as Prune, but reports what was done. Progress is persisted in kv.TblPruningProgress:
+// next call continues from where previous one stopped
+func (a *AggregatorV3) PruneWithStats(ctx context.Context, limit uint64) (*AggregatorPruneStats, error) {
 	return a.prune(ctx, 0, a.minimaxTxNumInFiles.Load(), limit)
 }
 
-func (a *AggregatorV3) prune(ctx context.Context, txFrom, txTo, limit uint64) error {
+func (a *AggregatorV3) prune(ctx context.Context, txFrom, txTo, limit uint64) (*AggregatorPruneStats, error) {
 	logEvery := time.NewTicker(30 * time.Second)
 	defer logEvery.Stop()
-	if err := a.accounts.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
-	}
-	if err := a.storage.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
-	}
-	if err := a.code.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
-	}
-	if err := a.logAddrs.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
-	}
-	if err := a.logTopics.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
-	}
-	if err := a.tracesFrom.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	stat := &AggregatorPruneStats{}
+	for _, h := range a.histories() {
+		s, err := h.prune(ctx, txFrom, txTo, limit, logEvery)
+		if err != nil {
+			return stat, err
+		}
+		stat.add(string(pruneProgressKey(h.filenameBase, "v")), s)
 	}
-	if err := a.tracesTo.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return err
+	for _, ii := range a.invertedIndices() {
+		s, err := ii.prune(ctx, txFrom, txTo, limit, logEvery)
+		if err != nil {
+			return stat, err
+		}
+		stat.add(string(pruneProgressKey(ii.filenameBase, "ef")), s)
 	}
-	return nil
+	return stat, nil
 }
 
 func (a *AggregatorV3) LogStats(tx kv.Tx, tx2block func(endTxNumMinimax uint64) uint64) {
@@ -920,23 +1050,15 @@ func (a *AggregatorV3) EndTxNumFrozenAndIndexed() uint64 {
 }
 func (a *AggregatorV3) recalcMaxTxNum() {
 	min := a.accounts.endTxNumMinimax()
-	if txNum := a.storage.endTxNumMinimax(); txNum < min {
-		min = txNum
-	}
-	if txNum := a.code.endTxNumMinimax(); txNum < min {
-		min = txNum
-	}
-	if txNum := a.logAddrs.endTxNumMinimax(); txNum < min {
-		min = txNum
-	}
-	if txNum := a.logTopics.endTxNumMinimax(); txNum < min {
-		min = txNum
-	}
-	if txNum := a.tracesFrom.endTxNumMinimax(); txNum < min {
-		min = txNum
+	for _, h := range a.histories() {
+		if txNum := h.endTxNumMinimax(); txNum < min {
+			min = txNum
+		}
 	}
-	if txNum := a.tracesTo.endTxNumMinimax(); txNum < min {
-		min = txNum
+	for _, ii := range a.invertedIndices() {
+		if txNum := ii.endTxNumMinimax(); txNum < min {
+			min = txNum
+		}
 	}
 	a.minimaxTxNumInFiles.Store(min)
 }
@@ -957,10 +1079,32 @@ type RangesV3 struct {
 	logTopics            bool
 	tracesFrom           bool
 	tracesTo             bool
+
+	extraHistories []HistoryRanges
+	extraIdx       []idxRange
+}
+
+// idxRange - merge range of InvertedIndex
+type idxRange struct {
+	needMerge            bool
+	startTxNum, endTxNum uint64
 }
 
 func (r RangesV3) any() bool {
-	return r.accounts.any() || r.storage.any() || r.code.any() || r.logAddrs || r.logTopics || r.tracesFrom || r.tracesTo
+	if r.accounts.any() || r.storage.any() || r.code.any() || r.logAddrs || r.logTopics || r.tracesFrom || r.tracesTo {
+		return true
+	}
+	for _, hr := range r.extraHistories {
+		if hr.any() {
+			return true
+		}
+	}
+	for _, ir := range r.extraIdx {
+		if ir.needMerge {
+			return true
+		}
+	}
+	return false
 }
 
 func (ac *AggregatorV3Context) findMergeRange(maxEndTxNum, maxSpan uint64) RangesV3 {
@@ -972,6 +1116,14 @@ func (ac *AggregatorV3Context) findMergeRange(maxEndTxNum, maxSpan uint64) Range
 	r.logTopics, r.logTopicsStartTxNum, r.logTopicsEndTxNum = ac.a.logTopics.findMergeRange(maxEndTxNum, maxSpan)
 	r.tracesFrom, r.tracesFromStartTxNum, r.tracesFromEndTxNum = ac.a.tracesFrom.findMergeRange(maxEndTxNum, maxSpan)
 	r.tracesTo, r.tracesToStartTxNum, r.tracesToEndTxNum = ac.a.tracesTo.findMergeRange(maxEndTxNum, maxSpan)
+	for _, reg := range ac.a.extraHistories {
+		r.extraHistories = append(r.extraHistories, reg.h.findMergeRange(maxEndTxNum, maxSpan))
+	}
+	for _, reg := range ac.a.extraIdx {
+		var ir idxRange
+		ir.needMerge, ir.startTxNum, ir.endTxNum = reg.ii.findMergeRange(maxEndTxNum, maxSpan)
+		r.extraIdx = append(r.extraIdx, ir)
+	}
 	//log.Info(fmt.Sprintf("findMergeRange(%d, %d)=%+v\n", maxEndTxNum, maxSpan, r))
 	return r
 }
@@ -994,11 +1146,34 @@ type SelectedStaticFilesV3 struct {
 	tracesFromI  int
 	accountsI    int
 	tracesToI    int
+
+	extraHistoriesIdx  [][]*filesItem
+	extraHistoriesHist [][]*filesItem
+	extraIdx           [][]*filesItem
+}
+
+// size - total size of data files selected for merge
+func (sf SelectedStaticFilesV3) size() (size uint64) {
+	for _, group := range sf.groups() {
+		for _, item := range group {
+			if item != nil && item.decompressor != nil {
+				size += uint64(item.decompressor.Size())
+			}
+		}
+	}
+	return size
+}
+
+func (sf SelectedStaticFilesV3) groups() [][]*filesItem {
+	groups := [][]*filesItem{sf.accountsIdx, sf.accountsHist, sf.storageIdx, sf.storageHist, sf.codeIdx, sf.codeHist,
+		sf.logAddrs, sf.logTopics, sf.tracesFrom, sf.tracesTo}
+	groups = append(groups, sf.extraHistoriesIdx...)
+	groups = append(groups, sf.extraHistoriesHist...)
+	return append(groups, sf.extraIdx...)
 }
 
 func (sf SelectedStaticFilesV3) Close() {
-	for _, group := range [][]*filesItem{sf.accountsIdx, sf.accountsHist, sf.storageIdx, sf.accountsHist, sf.codeIdx, sf.codeHist,
-		sf.logAddrs, sf.logTopics, sf.tracesFrom, sf.tracesTo} {
+	for _, group := range sf.groups() {
 		for _, item := range group {
 			if item != nil {
 				if item.decompressor != nil {
@@ -1043,6 +1218,22 @@ func (ac *AggregatorV3Context) staticFilesInRange(r RangesV3) (sf SelectedStatic
 	if r.tracesTo {
 		sf.tracesTo, sf.tracesToI = ac.tracesTo.staticFilesInRange(r.tracesToStartTxNum, r.tracesToEndTxNum)
 	}
+	sf.extraHistoriesIdx = make([][]*filesItem, len(r.extraHistories))
+	sf.extraHistoriesHist = make([][]*filesItem, len(r.extraHistories))
+	for i, hr := range r.extraHistories {
+		if hr.any() {
+			sf.extraHistoriesIdx[i], sf.extraHistoriesHist[i], _, err = ac.extraHistories[i].staticFilesInRange(hr)
+			if err != nil {
+				return sf, err
+			}
+		}
+	}
+	sf.extraIdx = make([][]*filesItem, len(r.extraIdx))
+	for i, ir := range r.extraIdx {
+		if ir.needMerge {
+			sf.extraIdx[i], _ = ac.extraIdx[i].staticFilesInRange(ir.startTxNum, ir.endTxNum)
+		}
+	}
 	return sf, err
 }
 
@@ -1054,6 +1245,17 @@ type MergedFilesV3 struct {
 	logTopics                 *filesItem
 	tracesFrom                *filesItem
 	tracesTo                  *filesItem
+
+	extraHistoriesIdx, extraHistoriesHist []*filesItem
+	extraIdx                              []*filesItem
+}
+
+func (mf MergedFilesV3) items() []*filesItem {
+	items := []*filesItem{mf.accountsIdx, mf.accountsHist, mf.storageIdx, mf.storageHist, mf.codeIdx, mf.codeHist,
+		mf.logAddrs, mf.logTopics, mf.tracesFrom, mf.tracesTo}
+	items = append(items, mf.extraHistoriesIdx...)
+	items = append(items, mf.extraHistoriesHist...)
+	return append(items, mf.extraIdx...)
 }
 
 func (mf MergedFilesV3) FrozenList() (frozen []string) {
@@ -1090,11 +1292,17 @@ func (mf MergedFilesV3) FrozenList() (frozen []string) {
 	if mf.tracesTo != nil && mf.tracesTo.frozen {
 		frozen = append(frozen, mf.tracesTo.decompressor.FileName())
 	}
+	for _, group := range [][]*filesItem{mf.extraHistoriesHist, mf.extraHistoriesIdx, mf.extraIdx} {
+		for _, item := range group {
+			if item != nil && item.frozen {
+				frozen = append(frozen, item.decompressor.FileName())
+			}
+		}
+	}
 	return frozen
 }
 func (mf MergedFilesV3) Close() {
-	for _, item := range []*filesItem{mf.accountsIdx, mf.accountsHist, mf.storageIdx, mf.storageHist, mf.codeIdx, mf.codeHist,
-		mf.logAddrs, mf.logTopics, mf.tracesFrom, mf.tracesTo} {
+	for _, item := range mf.items() {
 		if item != nil {
 			if item.decompressor != nil {
 				item.decompressor.Close()
@@ -1166,6 +1374,31 @@ func (ac *AggregatorV3Context) mergeFiles(ctx context.Context, files SelectedSta
 			return err
 		})
 	}
+	mf.extraHistoriesIdx = make([]*filesItem, len(r.extraHistories))
+	mf.extraHistoriesHist = make([]*filesItem, len(r.extraHistories))
+	for i, hr := range r.extraHistories {
+		if !hr.any() {
+			continue
+		}
+		i, hr := i, hr
+		g.Go(func() error {
+			var err error
+			mf.extraHistoriesIdx[i], mf.extraHistoriesHist[i], err = ac.a.extraHistories[i].h.mergeFiles(ctx, files.extraHistoriesIdx[i], files.extraHistoriesHist[i], hr, workers, ac.a.ps)
+			return err
+		})
+	}
+	mf.extraIdx = make([]*filesItem, len(r.extraIdx))
+	for i, ir := range r.extraIdx {
+		if !ir.needMerge {
+			continue
+		}
+		i, ir := i, ir
+		g.Go(func() error {
+			var err error
+			mf.extraIdx[i], err = ac.a.extraIdx[i].ii.mergeFiles(ctx, files.extraIdx[i], ir.startTxNum, ir.endTxNum, workers, ac.a.ps)
+			return err
+		})
+	}
 	err := g.Wait()
 	if err == nil {
 		closeFiles = false
@@ -1185,6 +1418,12 @@ func (a *AggregatorV3) integrateMergedFiles(outs SelectedStaticFilesV3, in Merge
 	a.logTopics.integrateMergedFiles(outs.logTopics, in.logTopics)
 	a.tracesFrom.integrateMergedFiles(outs.tracesFrom, in.tracesFrom)
 	a.tracesTo.integrateMergedFiles(outs.tracesTo, in.tracesTo)
+	for i, r := range a.extraHistories {
+		r.h.integrateMergedFiles(outs.extraHistoriesIdx[i], outs.extraHistoriesHist[i], in.extraHistoriesIdx[i], in.extraHistoriesHist[i])
+	}
+	for i, r := range a.extraIdx {
+		r.ii.integrateMergedFiles(outs.extraIdx[i], in.extraIdx[i])
+	}
 	a.cleanAfterNewFreeze(in)
 	return frozen
 }
@@ -1210,68 +1449,88 @@ func (a *AggregatorV3) cleanAfterNewFreeze(in MergedFilesV3) {
 	if in.tracesTo != nil && in.tracesTo.frozen {
 		a.tracesTo.cleanAfterFreeze(in.tracesTo.endTxNum)
 	}
+	for i, r := range a.extraHistories {
+		if item := in.extraHistoriesHist[i]; item != nil && item.frozen {
+			r.h.cleanAfterFreeze(item.endTxNum)
+		}
+	}
+	for i, r := range a.extraIdx {
+		if item := in.extraIdx[i]; item != nil && item.frozen {
+			r.ii.cleanAfterFreeze(item.endTxNum)
+		}
+	}
 }
 
 // KeepInDB - usually equal to one a.aggregationStep, but when we exec blocks from snapshots
 // we can set it to 0, because no re-org on this blocks are possible
 func (a *AggregatorV3) KeepInDB(v uint64) { a.keepInDB = v }
 
+// SetRetention - retention policy of histories and indices, applied by next merges. See RetentionPolicy.
+func (a *AggregatorV3) SetRetention(p RetentionPolicy) {
+	a.members.retention = p
+	a.configureMembers()
+}
+
 func (a *AggregatorV3) BuildFilesInBackground(txNum uint64) {
-	if (txNum + 1) <= a.minimaxTxNumInFiles.Load()+a.aggregationStep+a.keepInDB { // Leave one step worth in the DB
+	if a.readOnly {
 		return
 	}
-
-	if ok := a.buildingFiles.CompareAndSwap(false, true); !ok {
+	if (txNum + 1) <= a.minimaxTxNumInFiles.Load()+a.aggregationStep+a.keepInDB { // Leave one step worth in the DB
 		return
 	}
 
-	step := a.minimaxTxNumInFiles.Load() / a.aggregationStep
-	toTxNum := (step + 1) * a.aggregationStep
-	hasData := false
-	a.wg.Add(1)
-	go func() {
-		defer a.wg.Done()
-		defer a.buildingFiles.Store(false)
+	a.scheduler.ScheduleExclusive(JobBuildFiles, "build files", 0, func(ctx context.Context, budget *IOBudget) error {
+		// step is calculated when job starts: previous build job may already create some files
+		step := a.minimaxTxNumInFiles.Load() / a.aggregationStep
+		toTxNum := (step + 1) * a.aggregationStep
 
 		// check if db has enough data (maybe we didn't commit them yet)
 		lastInDB := lastIdInDB(a.db, a.accounts.indexKeysTable)
-		hasData = lastInDB >= toTxNum
-		if !hasData {
-			return
+		if lastInDB < toTxNum {
+			return nil
 		}
 
 		// trying to create as much small-step-files as possible:
 		// - to reduce amount of small merges
 		// - to remove old data from db as early as possible
 		// - during files build, may happen commit of new data. on each loop step getting latest id in db
+		var err error
 		for step < lastIdInDB(a.db, a.accounts.indexKeysTable)/a.aggregationStep {
-			if err := a.buildFilesInBackground(a.ctx, step); err != nil {
-				if errors.Is(err, context.Canceled) {
-					return
-				}
-				log.Warn("[snapshots] buildFilesInBackground", "err", err)
+			if err = budget.Wait(ctx); err != nil {
 				break
 			}
+			if err = a.buildFilesInBackground(ctx, step); err != nil {
+				break
+			}
+			budget.Spend(writtenFiles(a.stepFiles(step)...))
 			step++
 		}
-
-		if ok := a.mergeingFiles.CompareAndSwap(false, true); !ok {
-			return
+		if errors.Is(err, context.Canceled) {
+			return err
 		}
-		a.wg.Add(1)
-		go func() {
-			defer a.wg.Done()
-			defer a.mergeingFiles.Store(false)
-			if err := a.MergeLoop(a.ctx, 1); err != nil {
-				if errors.Is(err, context.Canceled) {
-					return
-				}
-				log.Warn("[snapshots] merge", "err", err)
-			}
 
-			a.BuildOptionalMissedIndicesInBackground(a.ctx, 1)
-		}()
-	}()
+		a.scheduleMerge()
+		return err
+	})
+}
+
+// stepFiles - files of given step (only files which cover exactly this step)
+func (a *AggregatorV3) stepFiles(step uint64) (items []*filesItem) {
+	from, to := step*a.aggregationStep, (step+1)*a.aggregationStep
+	for _, h := range a.histories() {
+		if item, ok := h.InvertedIndex.files.Get(&filesItem{startTxNum: from, endTxNum: to}); ok {
+			items = append(items, item)
+		}
+		if item, ok := h.files.Get(&filesItem{startTxNum: from, endTxNum: to}); ok {
+			items = append(items, item)
+		}
+	}
+	for _, ii := range a.invertedIndices() {
+		if item, ok := ii.files.Get(&filesItem{startTxNum: from, endTxNum: to}); ok {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func (a *AggregatorV3) BatchHistoryWriteStart() *AggregatorV3 {
@@ -1306,48 +1565,63 @@ func (a *AggregatorV3) PutIdx(idx kv.InvertedIdx, key []byte) error {
 	case kv.LogTopicIndex:
 		return a.logTopics.Add(key)
 	default:
+		for _, r := range a.extraIdx {
+			if r.name == idx {
+				return r.ii.Add(key)
+			}
+		}
 		panic(idx)
 	}
 }
 
 // DisableReadAhead - usage: `defer d.EnableReadAhead().DisableReadAhead()`. Please don't use this funcs without `defer` to avoid leak.
 func (a *AggregatorV3) DisableReadAhead() {
-	a.accounts.DisableReadAhead()
-	a.storage.DisableReadAhead()
-	a.code.DisableReadAhead()
-	a.logAddrs.DisableReadAhead()
-	a.logTopics.DisableReadAhead()
-	a.tracesFrom.DisableReadAhead()
-	a.tracesTo.DisableReadAhead()
+	for _, h := range a.histories() {
+		h.DisableReadAhead()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.DisableReadAhead()
+	}
 }
 func (a *AggregatorV3) EnableReadAhead() *AggregatorV3 {
-	a.accounts.EnableReadAhead()
-	a.storage.EnableReadAhead()
-	a.code.EnableReadAhead()
-	a.logAddrs.EnableReadAhead()
-	a.logTopics.EnableReadAhead()
-	a.tracesFrom.EnableReadAhead()
-	a.tracesTo.EnableReadAhead()
+	for _, h := range a.histories() {
+		h.EnableReadAhead()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.EnableReadAhead()
+	}
+	return a
+}
+
+// EnableExistenceFilters - build .vif filters for new history files, to skip files without key in GetNoState
+func (a *AggregatorV3) EnableExistenceFilters() *AggregatorV3 {
+	a.members.withExistenceFilter = true
+	a.configureMembers()
+	return a
+}
+
+// DisableFsync - of all files and indices built by aggregator. For tests only.
+func (a *AggregatorV3) DisableFsync() *AggregatorV3 {
+	a.members.noFsync = true
+	a.configureMembers()
 	return a
 }
 func (a *AggregatorV3) EnableMadvWillNeed() *AggregatorV3 {
-	a.accounts.EnableMadvWillNeed()
-	a.storage.EnableMadvWillNeed()
-	a.code.EnableMadvWillNeed()
-	a.logAddrs.EnableMadvWillNeed()
-	a.logTopics.EnableMadvWillNeed()
-	a.tracesFrom.EnableMadvWillNeed()
-	a.tracesTo.EnableMadvWillNeed()
+	for _, h := range a.histories() {
+		h.EnableMadvWillNeed()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.EnableMadvWillNeed()
+	}
 	return a
 }
 func (a *AggregatorV3) EnableMadvNormal() *AggregatorV3 {
-	a.accounts.EnableMadvNormalReadAhead()
-	a.storage.EnableMadvNormalReadAhead()
-	a.code.EnableMadvNormalReadAhead()
-	a.logAddrs.EnableMadvNormalReadAhead()
-	a.logTopics.EnableMadvNormalReadAhead()
-	a.tracesFrom.EnableMadvNormalReadAhead()
-	a.tracesTo.EnableMadvNormalReadAhead()
+	for _, h := range a.histories() {
+		h.EnableMadvNormalReadAhead()
+	}
+	for _, ii := range a.invertedIndices() {
+		ii.EnableMadvNormalReadAhead()
+	}
 	return a
 }
 
@@ -1367,13 +1641,37 @@ func (ac *AggregatorV3Context) IndexRange(name kv.InvertedIdx, k []byte, fromTs,
 		return ac.tracesFrom.IdxRange(k, fromTs, toTs, asc, limit, tx)
 	case kv.TracesToIdx:
 		return ac.tracesTo.IdxRange(k, fromTs, toTs, asc, limit, tx)
-	default:
-		return nil, fmt.Errorf("unexpected history name: %s", name)
 	}
+	for i, r := range ac.a.extraHistories {
+		if r.idxName == name {
+			return ac.extraHistories[i].IdxRange(k, fromTs, toTs, asc, limit, tx)
+		}
+	}
+	for i, r := range ac.a.extraIdx {
+		if r.name == name {
+			return ac.extraIdx[i].IdxRange(k, fromTs, toTs, asc, limit, tx)
+		}
+	}
+	return nil, fmt.Errorf("unexpected history name: %s", name)
 }
 
 // -- range end
 
+// FilesWithKey - names of .ef files of history or inverted index `filenameBase` which have given key. For debugging.
+func (ac *AggregatorV3Context) FilesWithKey(filenameBase string, key []byte) ([]string, error) {
+	for _, hc := range ac.histories() {
+		if hc.h.filenameBase == filenameBase {
+			return hc.FilesWithKey(key), nil
+		}
+	}
+	for _, ic := range ac.invertedIndices() {
+		if ic.ii.filenameBase == filenameBase {
+			return ic.FilesWithKey(key), nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected history name: %s", filenameBase)
+}
+
 func (ac *AggregatorV3Context) ReadAccountDataNoStateWithRecent(addr []byte, txNum uint64, tx kv.Tx) ([]byte, bool, error) {
 	return ac.accounts.GetNoStateWithRecent(addr, txNum, tx)
 }
@@ -1472,6 +1770,9 @@ type AggregatorV3Context struct {
 	tracesTo   *InvertedIndexContext
 	keyBuf     []byte
 
+	extraHistories []*HistoryContext       // same order as AggregatorV3.extraHistories
+	extraIdx       []*InvertedIndexContext // same order as AggregatorV3.extraIdx
+
 	id uint64 // set only if TRACE_AGG=true
 }
 
@@ -1488,7 +1789,12 @@ func (a *AggregatorV3) MakeContext() *AggregatorV3Context {
 
 		id: a.leakDetector.Add(),
 	}
-
+	for _, r := range a.extraHistories {
+		ac.extraHistories = append(ac.extraHistories, r.h.MakeContext())
+	}
+	for _, r := range a.extraIdx {
+		ac.extraIdx = append(ac.extraIdx, r.ii.MakeContext())
+	}
 	return ac
 }
 func (ac *AggregatorV3Context) Close() {
@@ -1500,21 +1806,22 @@ func (ac *AggregatorV3Context) Close() {
 	ac.logTopics.Close()
 	ac.tracesFrom.Close()
 	ac.tracesTo.Close()
+	for _, hc := range ac.extraHistories {
+		hc.Close()
+	}
+	for _, ic := range ac.extraIdx {
+		ic.Close()
+	}
 }
 
-// BackgroundResult - used only indicate that some work is done
-// no much reason to pass exact results by this object, just get latest state when need
-type BackgroundResult struct {
-	err error
-	has bool
+// histories - contexts of built-in and registered histories, same order as AggregatorV3.histories
+func (ac *AggregatorV3Context) histories() []*HistoryContext {
+	return append([]*HistoryContext{ac.accounts, ac.storage, ac.code}, ac.extraHistories...)
 }
 
-func (br *BackgroundResult) Has() bool     { return br.has }
-func (br *BackgroundResult) Set(err error) { br.has, br.err = true, err }
-func (br *BackgroundResult) GetAndReset() (bool, error) {
-	has, err := br.has, br.err
-	br.has, br.err = false, nil
-	return has, err
+// invertedIndices - contexts of built-in and registered inverted indices, same order as AggregatorV3.invertedIndices
+func (ac *AggregatorV3Context) invertedIndices() []*InvertedIndexContext {
+	return append([]*InvertedIndexContext{ac.logAddrs, ac.logTopics, ac.tracesFrom, ac.tracesTo}, ac.extraIdx...)
 }
 
 func lastIdInDB(db kv.RoDB, table string) (lstInDb uint64) {
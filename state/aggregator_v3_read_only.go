@@ -0,0 +1,137 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
+)
+
+var ErrAggregatorReadOnly = errors.New("aggregator is read-only")
+
+// NewAggregatorV3ReadOnly - aggregator over files of datadir owned by other process (for example: RPC daemon reading files of node).
+// Never writes to `dir`: doesn't build missed indices, doesn't delete garbage, can't build or merge files.
+// Opens only files listed in manifests and having all indices. Every `pollEvery` re-reads folder (0 - never):
+// new and merged files are swapped in atomically, files removed by owner of datadir are closed by last AggregatorV3Context using them.
+func NewAggregatorV3ReadOnly(ctx context.Context, dir string, aggregationStep uint64, pollEvery time.Duration, logger log.Logger) (*AggregatorV3, error) {
+	a, err := NewAggregatorV3(ctx, dir, "", aggregationStep, nil, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.readOnly = true
+	a.configureMembers()
+	if err = a.OpenFolder(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	if pollEvery > 0 {
+		a.wg.Add(1)
+		go a.watchFolder(pollEvery)
+	}
+	return a, nil
+}
+
+func (a *AggregatorV3) ReadOnly() bool { return a.readOnly }
+
+func (a *AggregatorV3) watchFolder(every time.Duration) {
+	defer a.wg.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := a.OpenFolder(); err != nil {
+				a.logger.Warn("[snapshots] read-only aggregator: can't re-open folder", "dir", a.dir, "err", err)
+			}
+		}
+	}
+}
+
+// filesReadyForReadOnly - owner of datadir builds indices after data files: skip data files without indices, they will be opened by next poll
+func filesReadyForReadOnly(fNames []string) []string {
+	has := make(map[string]struct{}, len(fNames))
+	for _, name := range fNames {
+		has[name] = struct{}{}
+	}
+	required := func(name string) []string {
+		switch {
+		case strings.HasSuffix(name, ".v"):
+			base := strings.TrimSuffix(name, ".v")
+			return []string{base + ".vi", base + ".ef", base + ".efi"}
+		case strings.HasSuffix(name, ".ef"):
+			return []string{strings.TrimSuffix(name, ".ef") + ".efi"}
+		case strings.HasSuffix(name, ".li"):
+			return []string{strings.TrimSuffix(name, ".li") + ".l"}
+		}
+		return nil
+	}
+	res := make([]string, 0, len(fNames))
+Loop:
+	for _, name := range fNames {
+		for _, req := range required(name) {
+			if _, ok := has[req]; !ok {
+				continue Loop
+			}
+		}
+		res = append(res, name)
+	}
+	return res
+}
+
+// retireWhatNotInList - read-only analog of closeWhatNotInList: removes from `files` items not in list (merged or removed by owner of datadir),
+// but doesn't close them - contexts may still use them. See closeRetired.
+func retireWhatNotInList(files *btree2.BTreeG[*filesItem], fNames []string) (retired []*filesItem) {
+	files.Walk(func(items []*filesItem) bool {
+	Loop1:
+		for _, item := range items {
+			for _, protectName := range fNames {
+				if item.decompressor != nil && item.decompressor.FileName() == protectName {
+					continue Loop1
+				}
+			}
+			retired = append(retired, item)
+		}
+		return true
+	})
+	for _, item := range retired {
+		files.Delete(item)
+		item.canDelete.Store(true)
+	}
+	return retired
+}
+
+// closeRetired - closes retired files without readers, others are closed by last reader (see `canDelete`).
+// Must be called after reCalcRoFiles. Frozen files have no refcount - they are appended to `frozen` and closed on Close.
+func closeRetired(retired, frozen []*filesItem) []*filesItem {
+	for _, item := range retired {
+		if item.frozen {
+			frozen = append(frozen, item)
+			continue
+		}
+		if item.refcount.Load() == 0 {
+			item.closeFilesAndRemove()
+		}
+	}
+	return frozen
+}
@@ -0,0 +1,193 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// registeredHistory - application-specific History, see AggregatorV3.RegisterHistory
+type registeredHistory struct {
+	name    kv.History
+	idxName kv.InvertedIdx
+	h       *History
+}
+
+// registeredInvertedIndex - application-specific InvertedIndex, see AggregatorV3.RegisterInvertedIndex
+type registeredInvertedIndex struct {
+	name kv.InvertedIdx
+	ii   *InvertedIndex
+}
+
+// RegisterHistory - adds application-specific History. It takes part in all lifecycle operations of aggregator
+// (files build, merge, prune, unwind, warmup, ...). Write by AddPrev, read by AggregatorV3Context.HistoryGet (by `name`)
+// and AggregatorV3Context.IndexRange (by `idxName`).
+// Tables must exist in DB (see kv.TableCfg), `indexKeysTable` and `indexTable` must be DupSort.
+// Must be called before OpenFolder and before any writes: not thread-safe.
+func (a *AggregatorV3) RegisterHistory(name kv.History, idxName kv.InvertedIdx, filenameBase, indexKeysTable, indexTable, historyValsTable string, codec ValueCodec, largeValues bool) error {
+	if err := a.checkNewMember(string(name), filenameBase); err != nil {
+		return err
+	}
+	if err := a.checkNewMember(string(idxName), filenameBase); err != nil {
+		return err
+	}
+	h, err := NewHistory(a.dir, a.tmpdir, a.aggregationStep, filenameBase, indexKeysTable, indexTable, historyValsTable, codec, nil, largeValues, a.logger)
+	if err != nil {
+		return err
+	}
+	a.configureHistory(h)
+	a.extraHistories = append(a.extraHistories, registeredHistory{name: name, idxName: idxName, h: h})
+	return nil
+}
+
+// RegisterInvertedIndex - adds application-specific InvertedIndex (for example: index of ERC-20 transfer recipients).
+// It takes part in all lifecycle operations of aggregator. Write by PutIdx, read by AggregatorV3Context.IndexRange (by `name`).
+// Tables must exist in DB (see kv.TableCfg) and must be DupSort.
+// Must be called before OpenFolder and before any writes: not thread-safe.
+func (a *AggregatorV3) RegisterInvertedIndex(name kv.InvertedIdx, filenameBase, indexKeysTable, indexTable string, codec ValueCodec) error {
+	if err := a.checkNewMember(string(name), filenameBase); err != nil {
+		return err
+	}
+	ii, err := NewInvertedIndex(a.dir, a.tmpdir, a.aggregationStep, filenameBase, indexKeysTable, indexTable, codec, false, nil, a.logger)
+	if err != nil {
+		return err
+	}
+	a.configureInvertedIndex(ii)
+	a.extraIdx = append(a.extraIdx, registeredInvertedIndex{name: name, ii: ii})
+	return nil
+}
+
+// membersCfg - settings which AggregatorV3 applies to all its members, built-in and registered. Changed by methods of
+// AggregatorV3 (SetWorkers, SetRetention, EnableExistenceFilters, ...), applied by configureMembers.
+type membersCfg struct {
+	compressWorkers     int
+	collateWorkers      int
+	pruneProgressTable  string
+	retention           RetentionPolicy
+	withExistenceFilter bool // histories only
+	noFsync             bool
+}
+
+func (a *AggregatorV3) configureMembers() {
+	for _, h := range a.histories() {
+		a.configureHistory(h)
+	}
+	for _, ii := range a.invertedIndices() {
+		a.configureInvertedIndex(ii)
+	}
+}
+
+func (a *AggregatorV3) configureInvertedIndex(ii *InvertedIndex) {
+	ii.readOnly = a.readOnly
+	ii.compressWorkers = a.members.compressWorkers
+	ii.collateWorkers = a.members.collateWorkers
+	ii.pruneProgressTable = a.members.pruneProgressTable
+	ii.retention = a.members.retention
+	ii.noFsync = a.members.noFsync
+}
+
+func (a *AggregatorV3) configureHistory(h *History) {
+	a.configureInvertedIndex(h.InvertedIndex)
+	h.compressWorkers = a.members.compressWorkers
+	h.withExistenceFilter = a.members.withExistenceFilter
+}
+
+func (a *AggregatorV3) checkNewMember(name, filenameBase string) error {
+	if name == "" || filenameBase == "" {
+		return fmt.Errorf("name and filenameBase must not be empty")
+	}
+	switch kv.History(name) {
+	case kv.AccountsHistory, kv.StorageHistory, kv.CodeHistory:
+		return fmt.Errorf("name %q is already used", name)
+	}
+	switch kv.InvertedIdx(name) {
+	case kv.AccountsHistoryIdx, kv.StorageHistoryIdx, kv.CodeHistoryIdx, kv.LogTopicIdx, kv.LogAddrIdx, kv.TracesFromIdx, kv.TracesToIdx:
+		return fmt.Errorf("name %q is already used", name)
+	}
+	for _, r := range a.extraHistories {
+		if string(r.name) == name || string(r.idxName) == name {
+			return fmt.Errorf("name %q is already used", name)
+		}
+	}
+	for _, r := range a.extraIdx {
+		if string(r.name) == name {
+			return fmt.Errorf("name %q is already used", name)
+		}
+	}
+	for _, h := range a.histories() {
+		if h.filenameBase == filenameBase {
+			return fmt.Errorf("filenameBase %q is already used", filenameBase)
+		}
+	}
+	for _, ii := range a.invertedIndices() {
+		if ii.filenameBase == filenameBase {
+			return fmt.Errorf("filenameBase %q is already used", filenameBase)
+		}
+	}
+	return nil
+}
+
+// histories - built-in and registered histories
+func (a *AggregatorV3) histories() []*History {
+	res := make([]*History, 0, 3+len(a.extraHistories))
+	res = append(res, a.accounts, a.storage, a.code)
+	for _, r := range a.extraHistories {
+		res = append(res, r.h)
+	}
+	return res
+}
+
+// invertedIndices - built-in and registered inverted indices (without indices of histories)
+func (a *AggregatorV3) invertedIndices() []*InvertedIndex {
+	res := make([]*InvertedIndex, 0, 4+len(a.extraIdx))
+	res = append(res, a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo)
+	for _, r := range a.extraIdx {
+		res = append(res, r.ii)
+	}
+	return res
+}
+
+// AddPrev - writes value of key before current txNum to History registered by RegisterHistory
+func (a *AggregatorV3) AddPrev(name kv.History, key1, key2, prev []byte) error {
+	for _, r := range a.extraHistories {
+		if r.name == name {
+			return r.h.AddPrevValue(key1, key2, prev)
+		}
+	}
+	return fmt.Errorf("AddPrev: unknown history %s", name)
+}
+
+// HistoryGet - value of key before `ts`. Recent history is read from DB by `tx`.
+// ok=false if key has no changes at or after `ts` (latest value is not stored in AggregatorV3).
+func (ac *AggregatorV3Context) HistoryGet(name kv.History, key []byte, ts uint64, tx kv.Tx) (v []byte, ok bool, err error) {
+	switch name {
+	case kv.AccountsHistory:
+		return ac.accounts.GetNoStateWithRecent(key, ts, tx)
+	case kv.StorageHistory:
+		return ac.storage.GetNoStateWithRecent(key, ts, tx)
+	case kv.CodeHistory:
+		return ac.code.GetNoStateWithRecent(key, ts, tx)
+	}
+	for i, r := range ac.a.extraHistories {
+		if r.name == name {
+			return ac.extraHistories[i].GetNoStateWithRecent(key, ts, tx)
+		}
+	}
+	return nil, false, fmt.Errorf("HistoryGet: unexpected history name: %s", name)
+}
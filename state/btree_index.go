@@ -25,6 +25,8 @@ import (
 	"github.com/ledgerwatch/erigon-lib/common/length"
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 )
 
 func logBase(n, base uint64) uint64 {
@@ -55,8 +57,9 @@ type node struct {
 }
 
 type Cursor struct {
-	ctx context.Context
-	ix  *btAlloc
+	ctx        context.Context
+	keyCount   uint64
+	dataLookup func(di uint64) ([]byte, []byte, error)
 
 	key   []byte
 	value []byte
@@ -65,11 +68,12 @@ type Cursor struct {
 
 func (a *btAlloc) newCursor(ctx context.Context, k, v []byte, d uint64) *Cursor {
 	return &Cursor{
-		ctx:   ctx,
-		key:   common.Copy(k),
-		value: common.Copy(v),
-		d:     d,
-		ix:    a,
+		ctx:        ctx,
+		key:        common.Copy(k),
+		value:      common.Copy(v),
+		d:          d,
+		keyCount:   a.K,
+		dataLookup: a.dataLookup,
 	}
 }
 
@@ -86,10 +90,10 @@ func (c *Cursor) Value() []byte {
 }
 
 func (c *Cursor) Next() bool {
-	if c.d > c.ix.K-1 {
+	if c.d+1 >= c.keyCount {
 		return false
 	}
-	k, v, err := c.ix.dataLookup(c.d + 1)
+	k, v, err := c.dataLookup(c.d + 1)
 	if err != nil {
 		return false
 	}
@@ -99,6 +103,20 @@ func (c *Cursor) Next() bool {
 	return true
 }
 
+func (c *Cursor) Prev() bool {
+	if c.d == 0 {
+		return false
+	}
+	k, v, err := c.dataLookup(c.d - 1)
+	if err != nil {
+		return false
+	}
+	c.key = common.Copy(k)
+	c.value = common.Copy(v)
+	c.d--
+	return true
+}
+
 type btAlloc struct {
 	d       uint64 // depth
 	M       uint64 // child limit of any node
@@ -619,11 +637,7 @@ func (r *BtIndexReader) Lookup2(key1, key2 []byte) uint64 {
 
 func (r *BtIndexReader) Seek(x []byte) (*Cursor, error) {
 	if r.index != nil {
-		cursor, err := r.index.alloc.Seek(x)
-		if err != nil {
-			return nil, fmt.Errorf("seek key %x: %w", x, err)
-		}
-		return cursor, nil
+		return r.index.Seek(x)
 	}
 	return nil, fmt.Errorf("seek has been failed")
 }
@@ -652,6 +666,11 @@ type BtIndexWriter struct {
 	bytesPerRec int
 	logger      log.Logger
 	noFsync     bool // fsync is enabled by default, but tests can manually disable
+
+	M        uint64   // every M-th key is node of persisted layout, see btree_index_layout.go
+	legacy   bool     // write index without header and layout - just for benchmarks and tests of old files
+	loaded   uint64   // amount of offsets written by loadFuncBucket
+	nodeKeys [][]byte // keys of nodes in sorted order
 }
 
 type BtIndexWriterArgs struct {
@@ -659,6 +678,7 @@ type BtIndexWriterArgs struct {
 	TmpDir      string
 	KeyCount    int
 	EtlBufLimit datasize.ByteSize
+	M           uint64 // fanout of persisted layout: Seek does ~log2(M) lookups into data file. 0 - DefaultBtreeWriterM
 }
 
 const BtreeLogPrefix = "btree"
@@ -679,6 +699,10 @@ func NewBtIndexWriter(args BtIndexWriterArgs, logger log.Logger) (*BtIndexWriter
 	if btw.etlBufLimit == 0 {
 		btw.etlBufLimit = etl.BufferOptimalSize
 	}
+	btw.M = args.M
+	if btw.M == 0 {
+		btw.M = DefaultBtreeWriterM
+	}
 
 	btw.bucketCollector = etl.NewCollector(BtreeLogPrefix+" "+fname, btw.tmpDir, etl.NewSortableBuffer(btw.etlBufLimit), logger)
 	btw.bucketCollector.LogLvl(log.LvlDebug)
@@ -702,6 +726,10 @@ func (btw *BtIndexWriter) loadFuncBucket(k, v []byte, _ etl.CurrentTableReader,
 	if _, err := btw.indexW.Write(v[8-btw.bytesPerRec:]); err != nil {
 		return err
 	}
+	if !btw.legacy && btw.loaded%btw.M == 0 {
+		btw.nodeKeys = append(btw.nodeKeys, common.Copy(k))
+	}
+	btw.loaded++
 
 	//btw.keys = append(btw.keys, binary.BigEndian.Uint64(k), binary.BigEndian.Uint64(k[8:]))
 	//btw.vals = append(btw.vals, binary.BigEndian.Uint64(v))
@@ -724,6 +752,11 @@ func (btw *BtIndexWriter) Build() error {
 	defer btw.indexF.Close()
 	btw.indexW = bufio.NewWriterSize(btw.indexF, etl.BufIOSize)
 
+	if !btw.legacy {
+		if _, err = btw.indexW.Write(btIndexMagic[:]); err != nil {
+			return fmt.Errorf("write magic: %w", err)
+		}
+	}
 	// Write number of keys
 	binary.BigEndian.PutUint64(btw.numBuf[:], btw.keyCount)
 	if _, err = btw.indexW.Write(btw.numBuf[:]); err != nil {
@@ -734,12 +767,27 @@ func (btw *BtIndexWriter) Build() error {
 	if err = btw.indexW.WriteByte(byte(btw.bytesPerRec)); err != nil {
 		return fmt.Errorf("write bytes per record: %w", err)
 	}
+	if !btw.legacy {
+		binary.BigEndian.PutUint64(btw.numBuf[:], btw.M)
+		if _, err = btw.indexW.Write(btw.numBuf[:]); err != nil {
+			return fmt.Errorf("write M: %w", err)
+		}
+		binary.BigEndian.PutUint64(btw.numBuf[:], (btw.keyCount+btw.M-1)/btw.M)
+		if _, err = btw.indexW.Write(btw.numBuf[:]); err != nil {
+			return fmt.Errorf("write number of nodes: %w", err)
+		}
+	}
 
 	defer btw.bucketCollector.Close()
 	log.Log(btw.lvl, "[index] calculating", "file", btw.indexFileName)
 	if err := btw.bucketCollector.Load(nil, "", btw.loadFuncBucket, etl.TransformArgs{}); err != nil {
 		return err
 	}
+	if !btw.legacy {
+		if err = writeBtLayout(btw.indexW, btw.nodeKeys, btw.M); err != nil {
+			return fmt.Errorf("write layout: %w", err)
+		}
+	}
 
 	btw.logger.Log(btw.lvl, "[index] write", "file", btw.indexFileName)
 	btw.built = true
@@ -825,20 +873,31 @@ type BtIndex struct {
 	auxBuf       []byte
 	decompressor *compress.Decompressor
 	getter       *compress.Getter
+
+	// persisted layout, see btree_index_layout.go. Legacy files have in-memory `alloc` instead.
+	M          uint64
+	nodesCount uint64
+	nodes      []byte
+	nodeKeys   []byte
 }
 
 func CreateBtreeIndex(indexPath, dataPath string, M uint64, logger log.Logger) (*BtIndex, error) {
-	err := BuildBtreeIndex(dataPath, indexPath, logger)
+	err := buildBtreeIndex(dataPath, indexPath, M, false, logger)
 	if err != nil {
 		return nil, err
 	}
 	return OpenBtreeIndex(indexPath, dataPath, M)
 }
 
+// DefaultBtreeM - fanout of in-memory tree which is built on open of legacy files (without header).
+// It must not change: Seek of legacy files was tuned for it.
 var DefaultBtreeM = uint64(2048)
 
+// DefaultBtreeWriterM - fanout of new files, stored in their header
+var DefaultBtreeWriterM = uint64(256)
+
 func CreateBtreeIndexWithDecompressor(indexPath string, M uint64, decompressor *compress.Decompressor, p *background.Progress, tmpdir string, logger log.Logger) (*BtIndex, error) {
-	err := BuildBtreeIndexWithDecompressor(indexPath, decompressor, p, tmpdir, logger)
+	err := buildBtreeIndexWithDecompressor(indexPath, decompressor, M, p, tmpdir, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -846,11 +905,16 @@ func CreateBtreeIndexWithDecompressor(indexPath string, M uint64, decompressor *
 }
 
 func BuildBtreeIndexWithDecompressor(indexPath string, kv *compress.Decompressor, p *background.Progress, tmpdir string, logger log.Logger) error {
+	return buildBtreeIndexWithDecompressor(indexPath, kv, DefaultBtreeWriterM, p, tmpdir, logger)
+}
+
+func buildBtreeIndexWithDecompressor(indexPath string, kv *compress.Decompressor, M uint64, p *background.Progress, tmpdir string, logger log.Logger) error {
 	defer kv.EnableReadAhead().DisableReadAhead()
 
 	args := BtIndexWriterArgs{
 		IndexFile: indexPath,
 		TmpDir:    tmpdir,
+		M:         M,
 	}
 
 	iw, err := NewBtIndexWriter(args, logger)
@@ -891,6 +955,10 @@ func BuildBtreeIndexWithDecompressor(indexPath string, kv *compress.Decompressor
 
 // Opens .kv at dataPath and generates index over it to file 'indexPath'
 func BuildBtreeIndex(dataPath, indexPath string, logger log.Logger) error {
+	return buildBtreeIndex(dataPath, indexPath, DefaultBtreeWriterM, false, logger)
+}
+
+func buildBtreeIndex(dataPath, indexPath string, M uint64, legacy bool, logger log.Logger) error {
 	decomp, err := compress.NewDecompressor(dataPath)
 	if err != nil {
 		return err
@@ -902,6 +970,7 @@ func BuildBtreeIndex(dataPath, indexPath string, logger log.Logger) error {
 	args := BtIndexWriterArgs{
 		IndexFile: indexPath,
 		TmpDir:    filepath.Dir(indexPath),
+		M:         M,
 	}
 
 	iw, err := NewBtIndexWriter(args, logger)
@@ -909,6 +978,7 @@ func BuildBtreeIndex(dataPath, indexPath string, logger log.Logger) error {
 		return err
 	}
 	defer iw.Close()
+	iw.legacy = legacy
 
 	getter := decomp.MakeGetter()
 	getter.Reset(0)
@@ -958,6 +1028,16 @@ func OpenBtreeIndexWithDecompressor(indexPath string, M uint64, kv *compress.Dec
 	}
 	idx.data = idx.m[:idx.size]
 
+	var ok bool
+	if ok, err = idx.openLayout(); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if ok {
+		idx.getter = kv.MakeGetter()
+		return idx, nil
+	}
+
 	// Read number of keys and bytes per record
 	pos := 8
 	idx.keyCount = binary.BigEndian.Uint64(idx.data[:pos])
@@ -1007,6 +1087,20 @@ func OpenBtreeIndex(indexPath, dataPath string, M uint64) (*BtIndex, error) {
 	}
 	idx.data = idx.m[:idx.size]
 
+	var layout bool
+	if layout, err = idx.openLayout(); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	if layout {
+		if idx.decompressor, err = compress.NewDecompressor(dataPath); err != nil {
+			idx.Close()
+			return nil, err
+		}
+		idx.getter = idx.decompressor.MakeGetter()
+		return idx, nil
+	}
+
 	// Read number of keys and bytes per record
 	pos := 8
 	idx.keyCount = binary.BigEndian.Uint64(idx.data[:pos])
@@ -1105,6 +1199,9 @@ func (b *BtIndex) Close() {
 }
 
 func (b *BtIndex) Seek(x []byte) (*Cursor, error) {
+	if b.nodes != nil {
+		return b.seekLayout(x)
+	}
 	if b.alloc == nil {
 		return nil, nil
 	}
@@ -1118,29 +1215,92 @@ func (b *BtIndex) Seek(x []byte) (*Cursor, error) {
 
 // deprecated
 func (b *BtIndex) Lookup(key []byte) uint64 {
-	if b.alloc == nil {
-		return 0
-	}
-	cursor, err := b.alloc.Seek(key)
+	cursor, err := b.Seek(key)
 	if err != nil {
 		panic(err)
 	}
+	if cursor == nil {
+		return 0
+	}
 	return binary.BigEndian.Uint64(cursor.value)
 }
 
 func (b *BtIndex) OrdinalLookup(i uint64) *Cursor {
-	if b.alloc == nil {
+	if b.nodes == nil && b.alloc == nil {
 		return nil
 	}
-	if i > b.alloc.K {
+	if i >= b.keyCount {
 		return nil
 	}
 	k, v, err := b.dataLookup(i)
 	if err != nil {
 		return nil
 	}
+	return b.newCursor(k, v, i)
+}
 
-	return &Cursor{
-		key: k, value: v, d: i, ix: b.alloc,
+// SeekLE - cursor at greatest key <= x, nil if there is no such key
+func (b *BtIndex) SeekLE(x []byte) (*Cursor, error) {
+	if b.Empty() {
+		return nil, nil
+	}
+	cur, err := b.Seek(x)
+	if err != nil {
+		return nil, err
+	}
+	if cur == nil { // all keys < x
+		return b.OrdinalLookup(b.keyCount - 1), nil
+	}
+	if bytes.Equal(cur.Key(), x) {
+		return cur, nil
+	}
+	if !cur.Prev() {
+		return nil, nil
+	}
+	return cur, nil
+}
+
+// PrefixRange - iterator over keys with given prefix (all keys if prefix is empty). Values are as stored in file
+func (b *BtIndex) PrefixRange(prefix []byte, asc order.By) (*BtPrefixIter, error) {
+	it := &BtPrefixIter{prefix: prefix, asc: asc}
+	if b.Empty() {
+		return it, nil
+	}
+	var err error
+	if asc {
+		it.cur, err = b.Seek(prefix)
+	} else if to, ok := kv.NextSubtree(prefix); ok {
+		if it.cur, err = b.SeekLE(to); err == nil && it.cur != nil && bytes.Equal(it.cur.Key(), to) && !it.cur.Prev() {
+			it.cur = nil
+		}
+	} else {
+		it.cur = b.OrdinalLookup(b.keyCount - 1)
+	}
+	if err != nil {
+		return nil, err
 	}
+	it.hasNext = it.cur != nil && bytes.HasPrefix(it.cur.Key(), prefix)
+	return it, nil
+}
+
+// BtPrefixIter - implements iter.KV over BtIndex cursor
+type BtPrefixIter struct {
+	cur     *Cursor
+	prefix  []byte
+	asc     order.By
+	hasNext bool
+}
+
+func (it *BtPrefixIter) HasNext() bool { return it.hasNext }
+func (it *BtPrefixIter) Close()        {}
+func (it *BtPrefixIter) Next() ([]byte, []byte, error) {
+	k, v := it.cur.Key(), it.cur.Value()
+	var ok bool
+	if it.asc {
+		ok = it.cur.Next()
+	} else {
+		ok = it.cur.Prev()
+	}
+	it.hasNext = ok && bytes.HasPrefix(it.cur.Key(), it.prefix)
+	return k, v, nil
 }
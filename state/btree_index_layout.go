@@ -0,0 +1,180 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// Persisted layout of BtIndex - index doesn't need to build btAlloc on open and to read keys of nodes from data file:
+//
+//	magic[8] | keyCount u64 | bytesPerRec u8 | M u64 | nodesCount u64 | offsets [keyCount*bytesPerRec] | nodes [nodesCount*16] | keys
+//
+// Every M-th key (ordinals 0, M, 2M, ...) is a node. Nodes are stored in Eytzinger order (BFS order of implicit binary search tree):
+// first levels of search are in few cache lines. Node is ordinal u64 and end of its key in `keys` u64 (keys are in same order).
+// Seek finds 2 neighbour nodes in memory (mmap) and does binary search between them by data file: ~log2(M) lookups.
+// Files without magic (legacy) start with keyCount - its highest byte is never 0xff.
+
+var btIndexMagic = [8]byte{0xff, 'b', 't', 'i', 'd', 'x', 0, 1}
+
+const btNodeSize = 16
+
+// eytzingerOrder - i-th element is position in sorted array of i-th element in Eytzinger order
+func eytzingerOrder(n int) []int {
+	order := make([]int, n)
+	var next int
+	var fill func(k int)
+	fill = func(k int) { // k - 1-based position in Eytzinger order
+		if k > n {
+			return
+		}
+		fill(2 * k)
+		order[k-1] = next
+		next++
+		fill(2*k + 1)
+	}
+	fill(1)
+	return order
+}
+
+func writeBtLayout(w *bufio.Writer, nodeKeys [][]byte, M uint64) error {
+	order := eytzingerOrder(len(nodeKeys))
+	var buf [btNodeSize]byte
+	var keysEnd uint64
+	for _, sorted := range order {
+		keysEnd += uint64(len(nodeKeys[sorted]))
+		binary.BigEndian.PutUint64(buf[:8], uint64(sorted)*M)
+		binary.BigEndian.PutUint64(buf[8:], keysEnd)
+		if _, err := w.Write(buf[:]); err != nil {
+			return err
+		}
+	}
+	for _, sorted := range order {
+		if _, err := w.Write(nodeKeys[sorted]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openLayout - parses header of file with persisted layout. Returns false for legacy files.
+func (b *BtIndex) openLayout() (ok bool, err error) {
+	if len(b.data) < len(btIndexMagic) || !bytes.Equal(b.data[:len(btIndexMagic)], btIndexMagic[:]) {
+		return false, nil
+	}
+	const headerSize = 8 + 8 + 1 + 8 + 8
+	if len(b.data) < headerSize {
+		return true, fmt.Errorf("%s: header is too short", b.FileName())
+	}
+	pos := len(btIndexMagic)
+	b.keyCount = binary.BigEndian.Uint64(b.data[pos:])
+	pos += 8
+	b.bytesPerRec = int(b.data[pos])
+	pos++
+	b.M = binary.BigEndian.Uint64(b.data[pos:])
+	pos += 8
+	b.nodesCount = binary.BigEndian.Uint64(b.data[pos:])
+	pos += 8
+	b.dataoffset = uint64(pos)
+
+	nodesFrom := b.dataoffset + b.keyCount*uint64(b.bytesPerRec)
+	keysFrom := nodesFrom + b.nodesCount*btNodeSize
+	if b.M == 0 || b.nodesCount != (b.keyCount+b.M-1)/b.M || uint64(len(b.data)) < keysFrom {
+		return true, fmt.Errorf("%s: broken layout: keyCount=%d, M=%d, nodes=%d, size=%d", b.FileName(), b.keyCount, b.M, b.nodesCount, len(b.data))
+	}
+	b.nodes = b.data[nodesFrom:keysFrom]
+	b.nodeKeys = b.data[keysFrom:]
+	if b.nodesCount > 0 && b.nodeKeyEnd(b.nodesCount) != uint64(len(b.nodeKeys)) {
+		return true, fmt.Errorf("%s: broken layout: keys size %d, expected %d", b.FileName(), len(b.nodeKeys), b.nodeKeyEnd(b.nodesCount))
+	}
+	return true, nil
+}
+
+// k - 1-based position in Eytzinger order
+func (b *BtIndex) nodeOrdinal(k uint64) uint64 {
+	return binary.BigEndian.Uint64(b.nodes[(k-1)*btNodeSize:])
+}
+func (b *BtIndex) nodeKeyEnd(k uint64) uint64 {
+	return binary.BigEndian.Uint64(b.nodes[(k-1)*btNodeSize+8:])
+}
+func (b *BtIndex) nodeKey(k uint64) []byte {
+	var from uint64
+	if k > 1 {
+		from = b.nodeKeyEnd(k - 1)
+	}
+	return b.nodeKeys[from:b.nodeKeyEnd(k)]
+}
+
+func (b *BtIndex) newCursor(k, v []byte, d uint64) *Cursor {
+	return &Cursor{
+		ctx:        context.TODO(),
+		key:        k,
+		value:      v,
+		d:          d,
+		keyCount:   b.keyCount,
+		dataLookup: b.dataLookup,
+	}
+}
+
+// seekLayout - cursor at first key >= x, nil if there is no such key
+func (b *BtIndex) seekLayout(x []byte) (*Cursor, error) {
+	if b.keyCount == 0 {
+		return nil, nil
+	}
+	// lower bound: first node with key >= x
+	k := uint64(1)
+	for k <= b.nodesCount {
+		if bytes.Compare(b.nodeKey(k), x) < 0 {
+			k = 2*k + 1
+		} else {
+			k = 2 * k
+		}
+	}
+	k >>= bits.TrailingZeros64(^k) + 1
+
+	var lo, hi uint64 // answer is in [lo, hi]: hi is ordinal of found node or keyCount
+	if k == 0 {
+		lo, hi = (b.nodesCount-1)*b.M+1, b.keyCount
+	} else {
+		hi = b.nodeOrdinal(k)
+		if hi == 0 || bytes.Equal(b.nodeKey(k), x) {
+			key, val, err := b.dataLookup(hi)
+			if err != nil {
+				return nil, err
+			}
+			return b.newCursor(key, val, hi), nil
+		}
+		lo = hi - b.M + 1
+	}
+	var foundKey, foundVal []byte
+	found := hi
+	for lo < hi {
+		m := (lo + hi) >> 1
+		key, val, err := b.dataLookup(m)
+		if err != nil {
+			return nil, err
+		}
+		switch bytes.Compare(key, x) {
+		case 0:
+			return b.newCursor(key, val, m), nil
+		case -1:
+			lo = m + 1
+		default:
+			hi, found, foundKey, foundVal = m, m, key, val
+		}
+	}
+	if found == b.keyCount {
+		return nil, nil
+	}
+	if foundKey == nil {
+		key, val, err := b.dataLookup(found)
+		if err != nil {
+			return nil, err
+		}
+		foundKey, foundVal = key, val
+	}
+	return b.newCursor(foundKey, foundVal, found), nil
+}
@@ -0,0 +1,337 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/exp/slices"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+)
+
+// Parallel collation: key space (or txNum range) is split into partitions, each partition is read
+// by own goroutine in own read-only transaction, and results are fed to compressor in partitions order.
+// So files are byte-identical to files of serial collation.
+// Used by AggregatorV3 which collates committed data. Domains of Aggregator collate inside of its write
+// transaction, which other transactions don't see: they read partitions through that transaction, see Domain.collateParallel.
+
+const domainCollatePartitions = 256 // by first byte of key
+
+var historyCollateChunk = 4096 // keys per partition
+
+// collateInOrder - `read` partitions [0; partitions) by `workers` goroutines, each in own read-only transaction,
+// and pass results to `write` in order of partitions. At most 2*workers partitions are in memory.
+func collateInOrder[T any](ctx context.Context, db kv.RoDB, workers, partitions int, read func(tx kv.Tx, i int) (T, error), write func(T) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]chan T, partitions)
+	for i := range results {
+		results[i] = make(chan T, 1)
+	}
+	inMemory := make(chan struct{}, 2*workers)
+
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		readers, rCtx := errgroup.WithContext(gCtx)
+		readers.SetLimit(workers)
+	Loop:
+		for i := 0; i < partitions; i++ {
+			select {
+			case inMemory <- struct{}{}:
+			case <-rCtx.Done():
+				break Loop
+			}
+			i := i
+			readers.Go(func() error {
+				var res T
+				if err := db.View(rCtx, func(tx kv.Tx) (err error) {
+					res, err = read(tx, i)
+					return err
+				}); err != nil {
+					return err
+				}
+				results[i] <- res
+				return nil
+			})
+		}
+		return readers.Wait()
+	})
+	g.Go(func() error {
+		for i := 0; i < partitions; i++ {
+			select {
+			case res := <-results[i]:
+				if err := write(res); err != nil {
+					return err
+				}
+				<-inMemory
+			case <-gCtx.Done():
+				return gCtx.Err()
+			}
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+// domainCollatePartition - [from; to) of keys with first byte `i`, nil means unbounded
+func domainCollatePartition(i int) (from, to []byte) {
+	if i > 0 {
+		from = []byte{byte(i)}
+	}
+	if i < domainCollatePartitions-1 {
+		to = []byte{byte(i + 1)}
+	}
+	return from, to
+}
+
+// collateParallel - same as `collate`, but reads partitions of txNum range in parallel (see collateWorkers)
+func (ii *InvertedIndex) collateParallel(ctx context.Context, txFrom, txTo uint64, db kv.RoDB) (indexBitmaps map[string]*roaring64.Bitmap, err error) {
+	if ii.collateWorkers <= 1 || txTo-txFrom < uint64(ii.collateWorkers) {
+		err = db.View(ctx, func(tx kv.Tx) (err error) {
+			indexBitmaps, err = ii.collate(ctx, txFrom, txTo, tx)
+			return err
+		})
+		return indexBitmaps, err
+	}
+
+	partitions := ii.collateWorkers
+	span := (txTo - txFrom + uint64(partitions) - 1) / uint64(partitions)
+	indexBitmaps = map[string]*roaring64.Bitmap{}
+	if err = collateInOrder(ctx, db, ii.collateWorkers, partitions, func(tx kv.Tx, i int) (map[string]*roaring64.Bitmap, error) {
+		from := txFrom + uint64(i)*span
+		to := from + span
+		if to > txTo {
+			to = txTo
+		}
+		if from >= to {
+			return nil, nil
+		}
+		return ii.collate(ctx, from, to, tx)
+	}, func(part map[string]*roaring64.Bitmap) error {
+		for key, bitmap := range part {
+			if acc, ok := indexBitmaps[key]; ok {
+				acc.Or(bitmap)
+				bitmapdb.ReturnToPool64(bitmap)
+				continue
+			}
+			indexBitmaps[key] = bitmap
+		}
+		return nil
+	}); err != nil {
+		for _, bitmap := range indexBitmaps {
+			bitmapdb.ReturnToPool64(bitmap)
+		}
+		return nil, err
+	}
+	return indexBitmaps, nil
+}
+
+// collateParallel - same as `collate`, but reads partitions of keys in parallel (see collateWorkers)
+func (h *History) collateParallel(ctx context.Context, step, txFrom, txTo uint64, db kv.RoDB) (HistoryCollation, error) {
+	if h.collateWorkers <= 1 {
+		var coll HistoryCollation
+		err := db.View(ctx, func(tx kv.Tx) (err error) {
+			coll, err = h.collate(step, txFrom, txTo, tx)
+			return err
+		})
+		return coll, err
+	}
+
+	indexBitmaps, err := h.InvertedIndex.collateParallel(ctx, txFrom, txTo, db)
+	if err != nil {
+		return HistoryCollation{}, err
+	}
+	coll := HistoryCollation{indexBitmaps: indexBitmaps}
+	closeColl := true
+	defer func() {
+		if closeColl {
+			coll.Close()
+		}
+	}()
+	coll.historyPath = filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, step, step+1))
+	if coll.historyComp, err = compress.NewCompressor(context.Background(), "collate history", coll.historyPath, h.tmpdir, compress.MinPatternScore, h.compressWorkers, log.LvlTrace, h.logger); err != nil {
+		return HistoryCollation{}, fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
+	}
+	setValueCodec(coll.historyComp, h.codec, nil)
+
+	keys := make([]string, 0, len(indexBitmaps))
+	for key := range indexBitmaps {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var valBuf []byte
+	partitions := (len(keys) + historyCollateChunk - 1) / historyCollateChunk
+	if err = collateInOrder(ctx, db, h.collateWorkers, partitions, func(tx kv.Tx, i int) (vals [][]byte, err error) {
+		partKeys := keys[i*historyCollateChunk:]
+		if len(partKeys) > historyCollateChunk {
+			partKeys = partKeys[:historyCollateChunk]
+		}
+		err = h.collateValues(tx, partKeys, indexBitmaps, func(val []byte) error {
+			vals = append(vals, common.Copy(val))
+			return nil
+		})
+		return vals, err
+	}, func(vals [][]byte) (err error) {
+		for _, val := range vals {
+			coll.historyCount++
+			if valBuf, err = addCollatedValue(coll.historyComp, h.codec, val, valBuf); err != nil {
+				return fmt.Errorf("add %s history val [%x]: %w", h.filenameBase, val, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return HistoryCollation{}, err
+	}
+	closeColl = false
+	return coll, nil
+}
+
+// collateParallel - same as `collate`, but history values and domain values are read by partitions of keys and
+// added to their compressors by 2 goroutines. All reads go through `roTx` in calling goroutine: Aggregator collates
+// data of its not committed write transaction, which is bound to its thread. Up to collateWorkers partitions of
+// each compressor are in memory. Without collateWorkers falls back to collateStream.
+func (d *Domain) collateParallel(ctx context.Context, step, txFrom, txTo uint64, roTx kv.Tx) (Collation, error) {
+	if d.collateWorkers <= 1 {
+		return d.collateStream(ctx, step, txFrom, txTo, roTx)
+	}
+
+	started := time.Now()
+	defer func() {
+		d.stats.LastCollationTook = time.Since(started)
+	}()
+
+	indexBitmaps, err := d.History.InvertedIndex.collate(ctx, txFrom, txTo, roTx)
+	if err != nil {
+		return Collation{}, err
+	}
+	coll := Collation{indexBitmaps: indexBitmaps}
+	closeColl := true
+	defer func() {
+		if closeColl {
+			coll.Close()
+			for _, bitmap := range indexBitmaps {
+				bitmapdb.ReturnToPool64(bitmap)
+			}
+		}
+	}()
+	coll.historyPath = filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.v", d.filenameBase, step, step+1))
+	if coll.historyComp, err = compress.NewCompressor(context.Background(), "collate history", coll.historyPath, d.tmpdir, compress.MinPatternScore, d.History.compressWorkers, log.LvlTrace, d.logger); err != nil {
+		return Collation{}, fmt.Errorf("create %s history compressor: %w", d.filenameBase, err)
+	}
+	setValueCodec(coll.historyComp, d.History.codec, nil)
+	coll.valuesPath = filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, step, step+1))
+	if coll.valuesComp, err = compress.NewCompressor(context.Background(), "collate values", coll.valuesPath, d.tmpdir, compress.MinPatternScore, 1, log.LvlTrace, d.logger); err != nil {
+		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
+	}
+	setValueCodec(coll.valuesComp, d.codec, nil)
+
+	var (
+		historyParts = make(chan [][]byte, d.collateWorkers)
+		valuesParts  = make(chan []kvpair, d.collateWorkers)
+	)
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() (err error) {
+		var valBuf []byte
+		for vals := range historyParts {
+			for _, val := range vals {
+				coll.historyCount++
+				if valBuf, err = addCollatedValue(coll.historyComp, d.History.codec, val, valBuf); err != nil {
+					return fmt.Errorf("add %s history val [%x]: %w", d.filenameBase, val, err)
+				}
+			}
+		}
+		return nil
+	})
+	g.Go(func() (err error) {
+		var valBuf []byte
+		for pairs := range valuesParts {
+			for _, p := range pairs {
+				coll.valuesCount++ // Only counting keys, not values
+				if valBuf, err = d.addCollationPair(coll.valuesComp, p.k, p.v, valBuf); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	readErr := func() error {
+		defer close(historyParts)
+		defer close(valuesParts)
+
+		keys := make([]string, 0, len(indexBitmaps))
+		for key := range indexBitmaps {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for i := 0; i < len(keys); i += historyCollateChunk {
+			partKeys := keys[i:]
+			if len(partKeys) > historyCollateChunk {
+				partKeys = partKeys[:historyCollateChunk]
+			}
+			var vals [][]byte
+			if err := d.History.collateValues(roTx, partKeys, indexBitmaps, func(val []byte) error {
+				vals = append(vals, common.Copy(val))
+				return nil
+			}); err != nil {
+				return err
+			}
+			select {
+			case historyParts <- vals:
+			case <-gCtx.Done():
+				return gCtx.Err()
+			}
+		}
+		for i := 0; i < domainCollatePartitions; i++ {
+			from, to := domainCollatePartition(i)
+			var pairs []kvpair
+			if err := d.collateValues(gCtx, step, roTx, from, to, func(k, v []byte) error {
+				pairs = append(pairs, kvpair{k: common.Copy(k), v: common.Copy(v)})
+				return nil
+			}); err != nil {
+				return err
+			}
+			select {
+			case valuesParts <- pairs:
+			case <-gCtx.Done():
+				return gCtx.Err()
+			}
+		}
+		return nil
+	}()
+	// error of compressors is the reason why reading stopped
+	if err = g.Wait(); err != nil {
+		return Collation{}, err
+	}
+	if readErr != nil {
+		return Collation{}, readErr
+	}
+	closeColl = false
+	return coll, nil
+}
@@ -43,7 +43,9 @@ import (
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
 )
 
 // filesItem corresponding to a pair of files (.dat and .idx)
@@ -51,8 +53,10 @@ type filesItem struct {
 	decompressor *compress.Decompressor
 	index        *recsplit.Index
 	bindex       *BtIndex
+	existence    *ExistenceFilter // optional: .kvf for .kv, .vif for .v
 	startTxNum   uint64
 	endTxNum     uint64
+	codec        ValueCodec // codec of values file (.v, .kv), read from file header
 
 	// Frozen: file of size StepsInBiggestFile. Completely immutable.
 	// Cold: file of size < StepsInBiggestFile. Immutable, but can be closed/removed after merge to bigger file.
@@ -60,9 +64,13 @@ type filesItem struct {
 	frozen   bool         // immutable, don't need atomic
 	refcount atomic.Int32 // only for `frozen=false`
 
+	retention RetentionPolicy        // versions dropped from this file by merge, see `.efr`
+	fenced    *eliasfano32.EliasFano // offsets of keys which have fence, see `.eft`. nil - no such keys
+
 	// file can be deleted in 2 cases: 1. when `refcount == 0 && canDelete == true` 2. on app startup when `file.isSubsetOfFrozenFile()`
 	// other processes (which also reading files, may have same logic)
 	canDelete atomic.Bool
+	readOnly  bool // file owned by other process: can be closed, but never removed. See NewAggregatorV3ReadOnly
 }
 
 func newFilesItem(startTxNum, endTxNum uint64, stepSize uint64) *filesItem {
@@ -86,17 +94,27 @@ func (i *filesItem) closeFilesAndRemove() {
 	if i.decompressor != nil {
 		i.decompressor.Close()
 		// paranoic-mode on: don't delete frozen files
-		if !i.frozen {
+		if !i.frozen && !i.readOnly {
 			if err := os.Remove(i.decompressor.FilePath()); err != nil {
 				log.Trace("close", "err", err, "file", i.decompressor.FileName())
 			}
+			if !i.retention.Empty() {
+				if err := os.Remove(retentionFilePath(i.decompressor.FilePath())); err != nil {
+					log.Trace("close", "err", err, "file", i.decompressor.FileName())
+				}
+			}
+			if i.fenced != nil {
+				if err := os.Remove(fencedFilePath(i.decompressor.FilePath())); err != nil {
+					log.Trace("close", "err", err, "file", i.decompressor.FileName())
+				}
+			}
 		}
 		i.decompressor = nil
 	}
 	if i.index != nil {
 		i.index.Close()
 		// paranoic-mode on: don't delete frozen files
-		if !i.frozen {
+		if !i.frozen && !i.readOnly {
 			if err := os.Remove(i.index.FilePath()); err != nil {
 				log.Trace("close", "err", err, "file", i.index.FileName())
 			}
@@ -105,11 +123,56 @@ func (i *filesItem) closeFilesAndRemove() {
 	}
 	if i.bindex != nil {
 		i.bindex.Close()
-		if err := os.Remove(i.bindex.FilePath()); err != nil {
-			log.Trace("close", "err", err, "file", i.bindex.FileName())
+		if !i.readOnly {
+			if err := os.Remove(i.bindex.FilePath()); err != nil {
+				log.Trace("close", "err", err, "file", i.bindex.FileName())
+			}
 		}
 		i.bindex = nil
 	}
+	if i.existence != nil {
+		i.existence.Close()
+		if !i.frozen && !i.readOnly {
+			if err := os.Remove(i.existence.FilePath()); err != nil {
+				log.Trace("close", "err", err, "file", i.existence.FileName())
+			}
+		}
+		i.existence = nil
+	}
+}
+
+// filePaths - paths of data file, its sidecars and indices
+func (i *filesItem) filePaths() (paths []string) {
+	if i.decompressor != nil {
+		paths = append(paths, i.decompressor.FilePath())
+		if !i.retention.Empty() {
+			paths = append(paths, retentionFilePath(i.decompressor.FilePath()))
+		}
+		if i.fenced != nil {
+			paths = append(paths, fencedFilePath(i.decompressor.FilePath()))
+		}
+	}
+	if i.index != nil {
+		paths = append(paths, i.index.FilePath())
+	}
+	if i.bindex != nil {
+		paths = append(paths, i.bindex.FilePath())
+	}
+	if i.existence != nil {
+		paths = append(paths, i.existence.FilePath())
+	}
+	return paths
+}
+
+// unlink - removes files from disk, but keeps them open for readers: name of file may be re-used by new file
+// before last reader closes it. After unlink closeFilesAndRemove only closes files (even not frozen).
+func (i *filesItem) unlink() {
+	for _, path := range i.filePaths() {
+		if err := os.Remove(path); err != nil {
+			log.Trace("unlink", "err", err, "file", path)
+		}
+	}
+	i.readOnly = true
 }
 
 type DomainStats struct {
@@ -162,12 +225,13 @@ type Domain struct {
 	mergesCount uint64
 
 	garbageFiles []*filesItem // files that exist on disk, but ignored on opening folder - because they are garbage
+	manifest     *filesManifest
 	logger       log.Logger
 }
 
 func NewDomain(dir, tmpdir string, aggregationStep uint64,
 	filenameBase, keysTable, valsTable, indexKeysTable, historyValsTable, indexTable string,
-	compressVals, largeValues bool, logger log.Logger) (*Domain, error) {
+	codec ValueCodec, largeValues bool, logger log.Logger) (*Domain, error) {
 	d := &Domain{
 		keysTable: keysTable,
 		valsTable: valsTable,
@@ -178,13 +242,25 @@ func NewDomain(dir, tmpdir string, aggregationStep uint64,
 	d.roFiles.Store(&[]ctxItem{})
 
 	var err error
-	if d.History, err = NewHistory(dir, tmpdir, aggregationStep, filenameBase, indexKeysTable, indexTable, historyValsTable, compressVals, []string{"kv"}, largeValues, logger); err != nil {
+	if d.History, err = NewHistory(dir, tmpdir, aggregationStep, filenameBase, indexKeysTable, indexTable, historyValsTable, codec, []string{"kv"}, largeValues, logger); err != nil {
 		return nil, err
 	}
+	d.manifest = newFilesManifest(dir, filenameBase, "kv", aggregationStep)
 
 	return d, nil
 }
 
+// SetRetention - Domain reads latest values from files, which are found by LocalityIndex of its history `.ef` files.
+// KeepSince drops keys from `.ef` files (but not from `.kv`), so it's not supported. KeepLast keeps at least 1 version of
+// each key and is allowed.
+func (d *Domain) SetRetention(p RetentionPolicy) error {
+	if p.KeepSince > 0 {
+		return fmt.Errorf("domain %s: retention %s: KeepSince is not supported by domains", d.filenameBase, p)
+	}
+	d.History.SetRetention(p)
+	return nil
+}
+
 // LastStepInDB - return the latest available step in db (at-least 1 value in such step)
 func (d *Domain) LastStepInDB(tx kv.Tx) (lstInDb uint64) {
 	lst, _ := kv.FirstKey(tx, d.valsTable)
@@ -200,7 +276,10 @@ func (d *Domain) StartWrites() {
 }
 
 func (d *Domain) FinishWrites() {
-	d.defaultDc.Close()
+	if d.defaultDc != nil {
+		d.defaultDc.Close()
+		d.defaultDc = nil
+	}
 	d.History.FinishWrites()
 }
 
@@ -229,7 +308,38 @@ func (d *Domain) OpenFolder() error {
 	if err != nil {
 		return err
 	}
-	return d.OpenList(files)
+	files, iiGarbage, err := d.InvertedIndex.manifest.filter(files, d.logger)
+	if err != nil {
+		return err
+	}
+	files, hGarbage, err := d.History.manifest.filter(files, d.logger)
+	if err != nil {
+		return err
+	}
+	files, garbage, err := d.manifest.filter(files, d.logger)
+	if err != nil {
+		return err
+	}
+	if err = d.OpenList(files); err != nil {
+		return err
+	}
+	d.InvertedIndex.garbageFiles = append(d.InvertedIndex.garbageFiles, iiGarbage...)
+	d.History.garbageFiles = append(d.History.garbageFiles, hGarbage...)
+	d.garbageFiles = append(d.garbageFiles, garbage...)
+	return nil
+}
+
+// CheckFiles - reports drift between files manifests, files on disk and open files
+func (d *Domain) CheckFiles(checksums bool) ([]FileDrift, error) {
+	drift, err := d.History.CheckFiles(checksums)
+	if err != nil {
+		return nil, err
+	}
+	dDrift, err := d.manifest.check(d.files, checksums)
+	if err != nil {
+		return nil, err
+	}
+	return append(drift, dDrift...), nil
 }
 
 func (d *Domain) GetAndResetStats() DomainStats {
@@ -314,33 +424,38 @@ func (d *Domain) openFiles() (err error) {
 	invalidFileItems := make([]*filesItem, 0)
 	d.files.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.decompressor != nil {
-				continue
-			}
 			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
-			datPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, fromStep, toStep))
-			if !dir.FileExist(datPath) {
-				invalidFileItems = append(invalidFileItems, item)
-				continue
+			if item.decompressor == nil {
+				datPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kv", d.filenameBase, fromStep, toStep))
+				if !dir.FileExist(datPath) {
+					invalidFileItems = append(invalidFileItems, item)
+					continue
+				}
+				if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+					return false
+				}
+				if item.codec, err = fileValueCodec(item.decompressor); err != nil {
+					return false
+				}
 			}
-			if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-				return false
+			if filterPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvf", d.filenameBase, fromStep, toStep)); item.existence == nil && dir.FileExist(filterPath) {
+				if item.existence, err = OpenExistenceFilter(filterPath); err != nil {
+					return false
+				}
 			}
 
-			if item.index != nil {
-				continue
-			}
+			// indices may be missed before, then built by BuildMissedIndices
 			idxPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, fromStep, toStep))
-			if dir.FileExist(idxPath) {
+			if item.index == nil && dir.FileExist(idxPath) {
 				if item.index, err = recsplit.OpenIndex(idxPath); err != nil {
 					d.logger.Debug("InvertedIndex.openFiles: %w, %s", err, idxPath)
 					return false
 				}
 				totalKeys += item.index.KeyCount()
 			}
-			if item.bindex == nil {
-				bidxPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.bt", d.filenameBase, fromStep, toStep))
-				if item.bindex, err = OpenBtreeIndexWithDecompressor(bidxPath, 2048, item.decompressor); err != nil {
+			bidxPath := filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.bt", d.filenameBase, fromStep, toStep))
+			if item.bindex == nil && dir.FileExist(bidxPath) {
+				if item.bindex, err = OpenBtreeIndexWithDecompressor(bidxPath, DefaultBtreeM, item.decompressor); err != nil {
 					d.logger.Debug("InvertedIndex.openFiles: %w, %s", err, bidxPath)
 					return false
 				}
@@ -387,6 +502,10 @@ func (d *Domain) closeWhatNotInList(fNames []string) {
 			item.bindex.Close()
 			item.bindex = nil
 		}
+		if item.existence != nil {
+			item.existence.Close()
+			item.existence = nil
+		}
 		d.files.Delete(item)
 	}
 }
@@ -518,11 +637,15 @@ type CursorItem struct {
 	c        kv.CursorDupSort
 	dg       *compress.Getter
 	dg2      *compress.Getter
+	btCursor *Cursor
+	codec    ValueCodec // codec of values file of FILE_CURSOR
+	idxCodec ValueCodec // codec of .ef values of `dg` - when `dg2` is values file
 	key      []byte
 	val      []byte
 	endTxNum uint64
 	t        CursorType // Whether this item represents state file or DB record, or tree
 	reverse  bool
+	desc     bool // keys are iterated in descending order
 }
 
 type CursorHeap []*CursorItem
@@ -540,6 +663,9 @@ func (ch CursorHeap) Less(i, j int) bool {
 		}
 		return ch[i].endTxNum < ch[j].endTxNum
 	}
+	if ch[i].desc {
+		return cmp > 0
+	}
 	return cmp < 0
 }
 
@@ -692,13 +818,14 @@ type kvpair struct {
 }
 
 func (d *Domain) writeCollationPair(valuesComp *compress.Compressor, pairs chan kvpair) (count int, err error) {
+	var valBuf []byte
 	for kv := range pairs {
 		if err = valuesComp.AddUncompressedWord(kv.k); err != nil {
 			return count, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, kv.k, err)
 		}
 		mxCollationSize.Inc()
 		count++ // Only counting keys, not values
-		if err = valuesComp.AddUncompressedWord(kv.v); err != nil {
+		if valBuf, err = addCollatedValue(valuesComp, d.codec, kv.v, valBuf); err != nil {
 			return count, fmt.Errorf("add %s values val [%x]=>[%x]: %w", d.filenameBase, kv.k, kv.v, err)
 		}
 	}
@@ -770,12 +897,18 @@ func (d *Domain) collateStream(ctx context.Context, step, txFrom, txTo uint64, r
 	if valuesComp, err = compress.NewCompressor(context.Background(), "collate values", valuesPath, d.tmpdir, compress.MinPatternScore, 1, log.LvlTrace, d.logger); err != nil {
 		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
 	}
+	setValueCodec(valuesComp, d.codec, nil)
 
 	keysCursor, err := roTx.CursorDupSort(d.keysTable)
 	if err != nil {
 		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
 	}
 	defer keysCursor.Close()
+	stepCursor, err := roTx.CursorDupSort(d.keysTable)
+	if err != nil {
+		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
+	}
+	defer stepCursor.Close()
 
 	var (
 		k, v     []byte
@@ -790,7 +923,7 @@ func (d *Domain) collateStream(ctx context.Context, step, txFrom, txTo uint64, r
 	//}
 
 	eg, _ := errgroup.WithContext(ctx)
-	eg.Go(func() error {
+	eg.Go(func() (err error) {
 		valCount, err = d.writeCollationPair(valuesComp, pairs)
 		return err
 	})
@@ -804,10 +937,11 @@ func (d *Domain) collateStream(ctx context.Context, step, txFrom, txTo uint64, r
 	for k, _, err = keysCursor.First(); err == nil && k != nil; k, _, err = keysCursor.NextNoDup() {
 		pos++
 
-		if v, err = keysCursor.LastDup(); err != nil {
-			return Collation{}, fmt.Errorf("find last %s key for aggregation step k=[%x]: %w", d.filenameBase, k, err)
+		// key may also have entry of older step: it's not pruned while there is no newer step
+		if _, v, err = stepCursor.SeekBothExact(k, stepBytes); err != nil {
+			return Collation{}, fmt.Errorf("find %s key for aggregation step k=[%x]: %w", d.filenameBase, k, err)
 		}
-		if bytes.Equal(v, stepBytes) {
+		if v != nil {
 			copy(keySuffix, k)
 			copy(keySuffix[len(k):], v)
 			ks := len(k) + len(v)
@@ -874,79 +1008,113 @@ func (d *Domain) collate(ctx context.Context, step, txFrom, txTo uint64, roTx kv
 	if valuesComp, err = compress.NewCompressor(context.Background(), "collate values", valuesPath, d.tmpdir, compress.MinPatternScore, 1, log.LvlTrace, d.logger); err != nil {
 		return Collation{}, fmt.Errorf("create %s values compressor: %w", d.filenameBase, err)
 	}
-	keysCursor, err := roTx.CursorDupSort(d.keysTable)
-	if err != nil {
-		return Collation{}, fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
-	}
-	defer keysCursor.Close()
+	setValueCodec(valuesComp, d.codec, nil)
 
 	var (
-		k, v        []byte
-		pos         uint64
-		valuesCount uint
+		valuesCount int
+		valBuf      []byte
 	)
-
 	//TODO: use prorgesSet
 	//totalKeys, err := keysCursor.Count()
 	//if err != nil {
 	//	return Collation{}, fmt.Errorf("failed to obtain keys count for domain %q", d.filenameBase)
 	//}
-	for k, _, err = keysCursor.First(); err == nil && k != nil; k, _, err = keysCursor.NextNoDup() {
-		if err != nil {
-			return Collation{}, err
+	if err = d.collateValues(ctx, step, roTx, nil, nil, func(k, v []byte) (err error) {
+		valuesCount++ // Only counting keys, not values
+		valBuf, err = d.addCollationPair(valuesComp, k, v, valBuf)
+		return err
+	}); err != nil {
+		return Collation{}, err
+	}
+	closeComp = false
+	return Collation{
+		valuesPath:   valuesPath,
+		valuesComp:   valuesComp,
+		valuesCount:  valuesCount,
+		historyPath:  hCollation.historyPath,
+		historyComp:  hCollation.historyComp,
+		historyCount: hCollation.historyCount,
+		indexBitmaps: hCollation.indexBitmaps,
+	}, nil
+}
+
+// collateValues - calls `f` for keys in [from; to) which have value of given step (nil bound means unbounded).
+// `k` and `v` are valid only until `f` returns
+func (d *Domain) collateValues(ctx context.Context, step uint64, roTx kv.Tx, from, to []byte, f func(k, v []byte) error) error {
+	keysCursor, err := roTx.CursorDupSort(d.keysTable)
+	if err != nil {
+		return fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
+	}
+	defer keysCursor.Close()
+	stepCursor, err := roTx.CursorDupSort(d.keysTable)
+	if err != nil {
+		return fmt.Errorf("create %s keys cursor: %w", d.filenameBase, err)
+	}
+	defer stepCursor.Close()
+
+	var (
+		k, v        []byte
+		stepBytes   = make([]byte, 8)
+		keySuffix   []byte
+		initialSeek = keysCursor.First
+	)
+	binary.BigEndian.PutUint64(stepBytes, ^step)
+	if from != nil {
+		initialSeek = func() ([]byte, []byte, error) { return keysCursor.Seek(from) }
+	}
+	for k, _, err = initialSeek(); err == nil && k != nil; k, _, err = keysCursor.NextNoDup() {
+		if to != nil && bytes.Compare(k, to) >= 0 {
+			break
 		}
-		pos++
 		select {
 		case <-ctx.Done():
 			d.logger.Warn("[snapshots] collate domain cancelled", "name", d.filenameBase, "err", ctx.Err())
-			return Collation{}, ctx.Err()
+			return ctx.Err()
 		default:
 		}
 
-		if v, err = keysCursor.LastDup(); err != nil {
-			return Collation{}, fmt.Errorf("find last %s key for aggregation step k=[%x]: %w", d.filenameBase, k, err)
+		// key may also have entry of older step: it's not pruned while there is no newer step
+		if _, v, err = stepCursor.SeekBothExact(k, stepBytes); err != nil {
+			return fmt.Errorf("find %s key for aggregation step k=[%x]: %w", d.filenameBase, k, err)
 		}
-		s := ^binary.BigEndian.Uint64(v)
-		if s == step {
-			keySuffix := make([]byte, len(k)+8)
-			copy(keySuffix, k)
-			copy(keySuffix[len(k):], v)
-			v, err := roTx.GetOne(d.valsTable, keySuffix)
-			if err != nil {
-				return Collation{}, fmt.Errorf("find last %s value for aggregation step k=[%x]: %w", d.filenameBase, k, err)
-			}
-			if err = valuesComp.AddUncompressedWord(k); err != nil {
-				return Collation{}, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
-			}
-			valuesCount++ // Only counting keys, not values
-			if err = valuesComp.AddUncompressedWord(v); err != nil {
-				return Collation{}, fmt.Errorf("add %s values val [%x]=>[%x]: %w", d.filenameBase, k, v, err)
-			}
+		if v == nil {
+			continue
+		}
+		keySuffix = append(append(keySuffix[:0], k...), v...)
+		if v, err = roTx.GetOne(d.valsTable, keySuffix); err != nil {
+			return fmt.Errorf("find last %s value for aggregation step k=[%x]: %w", d.filenameBase, k, err)
+		}
+		if err = f(k, v); err != nil {
+			return err
 		}
 	}
 	if err != nil {
-		return Collation{}, fmt.Errorf("iterate over %s keys cursor: %w", d.filenameBase, err)
+		return fmt.Errorf("iterate over %s keys cursor: %w", d.filenameBase, err)
 	}
-	closeComp = false
-	return Collation{
-		valuesPath:   valuesPath,
-		valuesComp:   valuesComp,
-		valuesCount:  int(valuesCount),
-		historyPath:  hCollation.historyPath,
-		historyComp:  hCollation.historyComp,
-		historyCount: hCollation.historyCount,
-		indexBitmaps: hCollation.indexBitmaps,
-	}, nil
+	return nil
+}
+
+func (d *Domain) addCollationPair(valuesComp *compress.Compressor, k, v, valBuf []byte) ([]byte, error) {
+	if err := valuesComp.AddUncompressedWord(k); err != nil {
+		return valBuf, fmt.Errorf("add %s values key [%x]: %w", d.filenameBase, k, err)
+	}
+	valBuf, err := addCollatedValue(valuesComp, d.codec, v, valBuf)
+	if err != nil {
+		return valBuf, fmt.Errorf("add %s values val [%x]=>[%x]: %w", d.filenameBase, k, v, err)
+	}
+	return valBuf, nil
 }
 
 type StaticFiles struct {
 	valuesDecomp    *compress.Decompressor
 	valuesIdx       *recsplit.Index
 	valuesBt        *BtIndex
+	valuesFilter    *ExistenceFilter
 	historyDecomp   *compress.Decompressor
 	historyIdx      *recsplit.Index
 	efHistoryDecomp *compress.Decompressor
 	efHistoryIdx    *recsplit.Index
+	historyFilter   *ExistenceFilter
 }
 
 func (sf StaticFiles) Close() {
@@ -971,6 +1139,8 @@ func (sf StaticFiles) Close() {
 	if sf.efHistoryIdx != nil {
 		sf.efHistoryIdx.Close()
 	}
+	sf.valuesFilter.Close()
+	sf.historyFilter.Close()
 }
 
 // buildFiles performs potentially resource intensive operations of creating
@@ -1014,6 +1184,9 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 	if valuesDecomp, err = compress.NewDecompressor(collation.valuesPath); err != nil {
 		return StaticFiles{}, fmt.Errorf("open %s values decompressor: %w", d.filenameBase, err)
 	}
+	if err = d.manifest.prepare(valuesDecomp); err != nil {
+		return StaticFiles{}, fmt.Errorf("checksum %s values: %w", d.filenameBase, err)
+	}
 
 	valuesIdxFileName := fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, step, step+1)
 	valuesIdxPath := filepath.Join(d.dir, valuesIdxFileName)
@@ -1031,21 +1204,32 @@ func (d *Domain) buildFiles(ctx context.Context, step uint64, collation Collatio
 		btPath := filepath.Join(d.dir, btFileName)
 		p := ps.AddNew(btFileName, uint64(valuesDecomp.Count()*2))
 		defer ps.Delete(p)
-		bt, err = CreateBtreeIndexWithDecompressor(btPath, DefaultBtreeM, valuesDecomp, p, d.tmpdir, d.logger)
+		bt, err = CreateBtreeIndexWithDecompressor(btPath, DefaultBtreeWriterM, valuesDecomp, p, d.tmpdir, d.logger)
 		if err != nil {
 			return StaticFiles{}, fmt.Errorf("build %s values bt idx: %w", d.filenameBase, err)
 		}
 	}
 
+	var valuesFilter *ExistenceFilter
+	if d.withExistenceFilter {
+		filterPath := filepath.Join(d.dir, strings.TrimSuffix(valuesIdxFileName, "kvi")+"kvf")
+		if valuesFilter, err = buildExistenceFilterThenOpen(ctx, valuesDecomp, d.codec, filterPath, d.noFsync); err != nil {
+			bt.Close()
+			return StaticFiles{}, fmt.Errorf("build %s values filter: %w", d.filenameBase, err)
+		}
+	}
+
 	closeComp = false
 	return StaticFiles{
 		valuesDecomp:    valuesDecomp,
 		valuesIdx:       valuesIdx,
 		valuesBt:        bt,
+		valuesFilter:    valuesFilter,
 		historyDecomp:   hStaticFiles.historyDecomp,
 		historyIdx:      hStaticFiles.historyIdx,
 		efHistoryDecomp: hStaticFiles.efHistoryDecomp,
 		efHistoryIdx:    hStaticFiles.efHistoryIdx,
+		historyFilter:   hStaticFiles.historyFilter,
 	}, nil
 }
 
@@ -1062,16 +1246,42 @@ func (d *Domain) missedIdxFiles() (l []*filesItem) {
 	return l
 }
 
+func (d *Domain) missedKviFiles() (l []*filesItem) {
+	d.files.Walk(func(items []*filesItem) bool { // don't run slow logic while iterating on btree
+		for _, item := range items {
+			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			if !dir.FileExist(filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, fromStep, toStep))) {
+				l = append(l, item)
+			}
+		}
+		return true
+	})
+	return l
+}
+
+func (d *Domain) missedFilterFiles() (l []*filesItem) {
+	if !d.withExistenceFilter {
+		return nil
+	}
+	d.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			fromStep, toStep := item.startTxNum/d.aggregationStep, item.endTxNum/d.aggregationStep
+			if !dir.FileExist(filepath.Join(d.dir, fmt.Sprintf("%s.%d-%d.kvf", d.filenameBase, fromStep, toStep))) {
+				l = append(l, item)
+			}
+		}
+		return true
+	})
+	return l
+}
+
 // BuildMissedIndices - produce .efi/.vi/.kvi from .ef/.v/.kv
 func (d *Domain) BuildMissedIndices(ctx context.Context, g *errgroup.Group, ps *background.ProgressSet) (err error) {
 	d.History.BuildMissedIndices(ctx, g, ps)
-	d.InvertedIndex.BuildMissedIndices(ctx, g, ps)
 	for _, item := range d.missedIdxFiles() {
-		//TODO: build .kvi
 		fitem := item
 		g.Go(func() error {
-			idxPath := filepath.Join(fitem.decompressor.FilePath(), fitem.decompressor.FileName())
-			idxPath = strings.TrimSuffix(idxPath, "kv") + "bt"
+			idxPath := strings.TrimSuffix(fitem.decompressor.FilePath(), "kv") + "bt"
 
 			p := ps.AddNew("fixme", uint64(fitem.decompressor.Count()))
 			defer ps.Delete(p)
@@ -1081,6 +1291,28 @@ func (d *Domain) BuildMissedIndices(ctx context.Context, g *errgroup.Group, ps *
 			return nil
 		})
 	}
+	for _, item := range d.missedKviFiles() {
+		fitem := item
+		g.Go(func() error {
+			idxPath := strings.TrimSuffix(fitem.decompressor.FilePath(), "kv") + "kvi"
+			p := ps.AddNew(filepath.Base(idxPath), uint64(fitem.decompressor.Count()))
+			defer ps.Delete(p)
+			// .kv is key-value pairs: index has keys only
+			return buildIndex(ctx, fitem.decompressor, idxPath, d.tmpdir, fitem.decompressor.Count()/2, false, p, d.logger, d.noFsync)
+		})
+	}
+	for _, item := range d.missedFilterFiles() {
+		fitem := item
+		g.Go(func() error {
+			filterPath := strings.TrimSuffix(fitem.decompressor.FilePath(), "kv") + "kvf"
+			filter, err := buildExistenceFilterThenOpen(ctx, fitem.decompressor, fitem.codec, filterPath, d.noFsync)
+			if err != nil {
+				return fmt.Errorf("build %s: %w", filepath.Base(filterPath), err)
+			}
+			filter.Close()
+			return nil
+		})
+	}
 	return nil
 }
 
@@ -1156,51 +1388,92 @@ func (d *Domain) integrateFiles(sf StaticFiles, txNumFrom, txNumTo uint64) {
 		historyIdx:      sf.historyIdx,
 		efHistoryDecomp: sf.efHistoryDecomp,
 		efHistoryIdx:    sf.efHistoryIdx,
+		historyFilter:   sf.historyFilter,
 	}, txNumFrom, txNumTo)
 
 	fi := newFilesItem(txNumFrom, txNumTo, d.aggregationStep)
 	fi.decompressor = sf.valuesDecomp
+	fi.codec = d.codec
 	fi.index = sf.valuesIdx
 	fi.bindex = sf.valuesBt
+	fi.existence = sf.valuesFilter
 	d.files.Set(fi)
+	d.manifest.update(d.files, d.noFsync, d.logger)
 
 	d.reCalcRoFiles()
 }
 
 // [txFrom; txTo)
-func (d *Domain) prune(ctx context.Context, step uint64, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+func (d *Domain) prune(ctx context.Context, step uint64, txFrom, txTo, limit uint64, logEvery *time.Ticker) (stat *PruneStats, err error) {
 	defer func(t time.Time) { d.stats.LastPruneTook = time.Since(t) }(time.Now())
 	mxPruningProgress.Inc()
 	defer mxPruningProgress.Dec()
 
+	stat = &PruneStats{}
+	started := time.Now()
+	progressKey := pruneProgressKey(d.filenameBase, "kv")
+	from, done, err := stepPruneProgress(d.tx, d.pruneProgressTable, progressKey, step)
+	if err != nil {
+		return stat, err
+	}
+	if !done {
+		if done, err = d.pruneValues(ctx, step, txFrom, txTo, from, limit, stat, logEvery); err != nil {
+			return stat, err
+		}
+	}
+	stat.Took = time.Since(started)
+	if !done { // limit reached: history is pruned by next call
+		return stat, nil
+	}
+
+	defer func(t time.Time) { d.stats.LastPruneHistTook = time.Since(t) }(time.Now())
+
+	hStat, err := d.History.prune(ctx, txFrom, txTo, limit, logEvery)
+	stat.Accumulate(hStat)
+	if err != nil {
+		return stat, fmt.Errorf("prune history at step %d [%d, %d): %w", step, txFrom, txTo, err)
+	}
+	return stat, nil
+}
+
+// pruneValues - deletes keys and values of `step` which have newer step, starting from key `from` (nil - from first key).
+// done=false if `limit` of deleted rows was reached, then progress is saved and next call continues from there
+func (d *Domain) pruneValues(ctx context.Context, step, txFrom, txTo uint64, from []byte, limit uint64, stat *PruneStats, logEvery *time.Ticker) (done bool, err error) {
 	var (
-		_state    = "scan steps"
-		pos       atomic.Uint64
-		totalKeys uint64
+		_state      = "scan steps"
+		pos         atomic.Uint64
+		totalKeys   uint64
+		progressKey = pruneProgressKey(d.filenameBase, "kv")
 	)
 
 	keysCursor, err := d.tx.RwCursorDupSort(d.keysTable)
 	if err != nil {
-		return fmt.Errorf("%s keys cursor: %w", d.filenameBase, err)
+		return false, fmt.Errorf("%s keys cursor: %w", d.filenameBase, err)
 	}
 	defer keysCursor.Close()
 
 	totalKeys, err = keysCursor.Count()
 	if err != nil {
-		return fmt.Errorf("get count of %s keys: %w", d.filenameBase, err)
+		return false, fmt.Errorf("get count of %s keys: %w", d.filenameBase, err)
 	}
 
 	var (
 		k, v, stepBytes []byte
-		keyMaxSteps     = make(map[string]uint64)
-		c               = 0
+		initialSeek     = keysCursor.First
 	)
 	stepBytes = make([]byte, 8)
 	binary.BigEndian.PutUint64(stepBytes, ^step)
+	if from != nil {
+		initialSeek = func() ([]byte, []byte, error) { return keysCursor.Seek(from) }
+	}
 
-	for k, v, err = keysCursor.First(); err == nil && k != nil; k, v, err = keysCursor.Next() {
+	// It is important to clean up tables in a specific order
+	// First keysTable, because it is the first one access in the `get` function, i.e. if the record is deleted from there, other tables will not be accessed
+	for k, v, err = initialSeek(); err == nil && k != nil; k, v, err = keysCursor.Next() {
 		if bytes.Equal(v, stepBytes) {
-			c++
+			if stat.RowsDeleted >= limit {
+				return false, saveStepPruneProgress(d.tx, d.pruneProgressTable, progressKey, step, false, k)
+			}
 			kl, vl, err := keysCursor.PrevDup()
 			if err != nil {
 				break
@@ -1215,11 +1488,16 @@ func (d *Domain) prune(ctx context.Context, step uint64, txFrom, txTo, limit uin
 					break
 				}
 				if bytes.Equal(vn, stepBytes) {
+					valKey := append(common.Copy(k), stepBytes...)
 					if err := keysCursor.DeleteCurrent(); err != nil {
-						return fmt.Errorf("prune key %x: %w", k, err)
+						return false, fmt.Errorf("prune key %x: %w", valKey[:len(valKey)-8], err)
+					}
+					mxPruneSize.Inc()
+					if err := d.tx.Delete(d.valsTable, valKey); err != nil {
+						return false, fmt.Errorf("prune val %x: %w", valKey, err)
 					}
 					mxPruneSize.Inc()
-					keyMaxSteps[string(k)] = s
+					stat.RowsDeleted += 2
 				}
 			}
 		}
@@ -1227,12 +1505,12 @@ func (d *Domain) prune(ctx context.Context, step uint64, txFrom, txTo, limit uin
 
 		if ctx.Err() != nil {
 			d.logger.Warn("[snapshots] prune domain cancelled", "name", d.filenameBase, "err", ctx.Err())
-			return ctx.Err()
+			return false, ctx.Err()
 		}
 
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return false, ctx.Err()
 		case <-logEvery.C:
 			d.logger.Info("[snapshots] prune domain", "name", d.filenameBase,
 				"stage", _state,
@@ -1242,50 +1520,10 @@ func (d *Domain) prune(ctx context.Context, step uint64, txFrom, txTo, limit uin
 		}
 	}
 	if err != nil {
-		return fmt.Errorf("iterate of %s keys: %w", d.filenameBase, err)
+		return false, fmt.Errorf("iterate of %s keys: %w", d.filenameBase, err)
 	}
-
-	pos.Store(0)
-	// It is important to clean up tables in a specific order
-	// First keysTable, because it is the first one access in the `get` function, i.e. if the record is deleted from there, other tables will not be accessed
-	var valsCursor kv.RwCursor
-	if valsCursor, err = d.tx.RwCursor(d.valsTable); err != nil {
-		return fmt.Errorf("%s vals cursor: %w", d.filenameBase, err)
-	}
-	defer valsCursor.Close()
-
-	for k, _, err := valsCursor.First(); err == nil && k != nil; k, _, err = valsCursor.Next() {
-		if bytes.HasSuffix(k, stepBytes) {
-			if _, ok := keyMaxSteps[string(k)]; !ok {
-				continue
-			}
-			if err := valsCursor.DeleteCurrent(); err != nil {
-				return fmt.Errorf("prune val %x: %w", k, err)
-			}
-			mxPruneSize.Inc()
-		}
-		pos.Add(1)
-		//_prog = 100 * (float64(pos) / float64(totalKeys))
-
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-logEvery.C:
-			d.logger.Info("[snapshots] prune domain", "name", d.filenameBase, "step", step)
-			//"steps", fmt.Sprintf("%.2f-%.2f", float64(txFrom)/float64(d.aggregationStep), float64(txTo)/float64(d.aggregationStep)))
-		default:
-		}
-	}
-	if err != nil {
-		return fmt.Errorf("iterate over %s vals: %w", d.filenameBase, err)
-	}
-
-	defer func(t time.Time) { d.stats.LastPruneHistTook = time.Since(t) }(time.Now())
-
-	if err = d.History.prune(ctx, txFrom, txTo, limit, logEvery); err != nil {
-		return fmt.Errorf("prune history at step %d [%d, %d): %w", step, txFrom, txTo, err)
-	}
-	return nil
+	stat.RangesDone++
+	return true, saveStepPruneProgress(d.tx, d.pruneProgressTable, progressKey, step, true, nil)
 }
 
 func (d *Domain) isEmpty(tx kv.Tx) (bool, error) {
@@ -1362,10 +1600,21 @@ func (dc *DomainContext) readFromFiles(filekey []byte, fromTxNum uint64) ([]byte
 	var val []byte
 	var found bool
 
+	li := dc.d.localityIndex
+	fileNums, lastIndexedTxNum, indexed := dc.lookupFiles(filekey)
+	keyHash := newExistenceHash(filekey)
 	for i := len(dc.files) - 1; i >= 0; i-- {
 		if dc.files[i].endTxNum < fromTxNum {
 			break
 		}
+		if indexed && !li.mayContain(&dc.files[i], fileNums, lastIndexedTxNum) {
+			continue
+		}
+		filter := dc.files[i].src.existence
+		if filter != nil && !filter.contains(keyHash) {
+			mxExistenceFilterSkips.Inc()
+			continue
+		}
 		reader := dc.statelessBtree(i)
 		if reader.Empty() {
 			continue
@@ -1376,18 +1625,58 @@ func (dc *DomainContext) readFromFiles(filekey []byte, fromTxNum uint64) ([]byte
 			return nil, false, err
 		}
 		if cur == nil {
+			if filter != nil {
+				mxExistenceFilterFalsePos.Inc()
+			}
 			continue
 		}
 
 		if bytes.Equal(cur.Key(), filekey) {
-			val = cur.Value()
+			if val, err = decodeValue(dc.files[i].src.codec, cur.Value()); err != nil {
+				return nil, false, err
+			}
 			found = true
 			break
 		}
+		if filter != nil {
+			mxExistenceFilterFalsePos.Inc()
+		}
 	}
 	return val, found, nil
 }
 
+// lookupFiles - values file has same keys as .ef file of same range: LocalityIndex of history tells which frozen files
+// to skip. Not if KeepSince dropped keys from .ef files (see Domain.SetRetention) - then `indexed` is false.
+func (dc *DomainContext) lookupFiles(key []byte) (fileNums []uint64, lastIndexedTxNum uint64, indexed bool) {
+	if dc.hc.ic.keysDropped() {
+		return nil, 0, false
+	}
+	return dc.d.localityIndex.lookupFiles(dc.hc.ic.loc, key)
+}
+
+// FilesWithKey - names of values files which have given key. Frozen files which LocalityIndex excludes are not opened. For debugging.
+func (dc *DomainContext) FilesWithKey(key []byte) (res []string, err error) {
+	li := dc.d.localityIndex
+	fileNums, lastIndexedTxNum, indexed := dc.lookupFiles(key)
+	for i := range dc.files {
+		if indexed && !li.mayContain(&dc.files[i], fileNums, lastIndexedTxNum) {
+			continue
+		}
+		reader := dc.statelessBtree(i)
+		if reader.Empty() {
+			continue
+		}
+		cur, err := reader.Seek(key)
+		if err != nil {
+			return nil, err
+		}
+		if cur != nil && bytes.Equal(cur.Key(), key) {
+			res = append(res, dc.files[i].src.decompressor.FileName())
+		}
+	}
+	return res, nil
+}
+
 // historyBeforeTxNum searches history for a value of specified key before txNum
 // second return value is true if the value is found in the history (even if it is nil)
 func (dc *DomainContext) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx) ([]byte, bool, error) {
@@ -1431,7 +1720,9 @@ func (dc *DomainContext) historyBeforeTxNum(key []byte, txNum uint64, roTx kv.Tx
 				continue
 			}
 			if bytes.Equal(cur.Key(), key) {
-				val = cur.Value()
+				if val, err = decodeValue(dc.files[i].src.codec, cur.Value()); err != nil {
+					return nil, false, err
+				}
 				break
 			}
 		}
@@ -1517,15 +1808,17 @@ func (dc *DomainContext) IteratePrefix(prefix []byte, it func(k, v []byte)) erro
 		}
 
 		cursor, err := bg.Seek(prefix)
-		if err != nil {
+		if err != nil || cursor == nil {
 			continue
 		}
 
-		g := dc.statelessGetter(i)
 		key := cursor.Key()
 		if bytes.HasPrefix(key, prefix) {
-			val := cursor.Value()
-			heap.Push(&cp, &CursorItem{t: FILE_CURSOR, key: key, val: val, dg: g, endTxNum: item.endTxNum, reverse: true})
+			val, err := decodeValue(item.src.codec, cursor.Value())
+			if err != nil {
+				return err
+			}
+			heap.Push(&cp, &CursorItem{t: FILE_CURSOR, key: key, val: val, btCursor: cursor, codec: item.src.codec, endTxNum: item.endTxNum, reverse: true})
 		}
 	}
 	for cp.Len() > 0 {
@@ -1536,10 +1829,12 @@ func (dc *DomainContext) IteratePrefix(prefix []byte, it func(k, v []byte)) erro
 			ci1 := cp[0]
 			switch ci1.t {
 			case FILE_CURSOR:
-				if ci1.dg.HasNext() {
-					ci1.key, _ = ci1.dg.Next(ci1.key[:0])
+				if ci1.btCursor.Next() {
+					ci1.key = ci1.btCursor.Key()
 					if bytes.HasPrefix(ci1.key, prefix) {
-						ci1.val, _ = ci1.dg.Next(ci1.val[:0])
+						if ci1.val, err = decodeValue(ci1.codec, ci1.btCursor.Value()); err != nil {
+							return err
+						}
 						heap.Fix(&cp, 0)
 					} else {
 						heap.Pop(&cp)
@@ -1573,3 +1868,198 @@ func (dc *DomainContext) IteratePrefix(prefix []byte, it func(k, v []byte)) erro
 	}
 	return nil
 }
+
+// DomainRange - iterator over latest values of keys in [fromKey, toKey) in given order, deleted keys are skipped.
+// nil fromKey/toKey means unbounded, limit -1 means unlimited
+func (dc *DomainContext) DomainRange(fromKey, toKey []byte, asc order.By, limit int, roTx kv.Tx) (*DomainRangeIter, error) {
+	dc.d.stats.HistoryQueries.Add(1)
+
+	it := &DomainRangeIter{fromKey: fromKey, toKey: toKey, asc: asc, limit: limit, roTx: roTx, valsTable: dc.d.valsTable}
+	heap.Init(&it.h)
+	if err := it.init(dc); err != nil {
+		it.Close()
+		return nil, err
+	}
+	if err := it.advance(); err != nil {
+		it.Close()
+		return nil, err
+	}
+	return it, nil
+}
+
+type DomainRangeIter struct {
+	fromKey, toKey []byte
+	asc            order.By
+	limit          int
+
+	roTx       kv.Tx
+	valsTable  string
+	keysCursor kv.CursorDupSort
+	h          CursorHeap
+
+	nextKey, nextVal []byte
+}
+
+func (it *DomainRangeIter) inRange(k []byte) bool {
+	if it.asc {
+		return it.toKey == nil || bytes.Compare(k, it.toKey) < 0
+	}
+	return bytes.Compare(k, it.fromKey) >= 0
+}
+
+func (it *DomainRangeIter) init(dc *DomainContext) (err error) {
+	if it.keysCursor, err = it.roTx.CursorDupSort(dc.d.keysTable); err != nil {
+		return err
+	}
+	var k, invStep []byte
+	if it.asc {
+		k, invStep, err = it.keysCursor.Seek(it.fromKey)
+	} else {
+		// latest step of key is first dup: keysTable stores inverted steps
+		if it.toKey != nil {
+			if k, _, err = it.keysCursor.Seek(it.toKey); err == nil && k != nil {
+				k, _, err = it.keysCursor.PrevNoDup()
+			} else if err == nil {
+				k, _, err = it.keysCursor.Last()
+			}
+		} else {
+			k, _, err = it.keysCursor.Last()
+		}
+		if err == nil && k != nil {
+			invStep, err = it.keysCursor.FirstDup()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if k != nil && it.inRange(k) {
+		v, err := it.dbValue(k, invStep)
+		if err != nil {
+			return err
+		}
+		heap.Push(&it.h, &CursorItem{t: DB_CURSOR, key: common.Copy(k), val: v, c: it.keysCursor, endTxNum: math.MaxUint64, reverse: true, desc: it.asc == order.Desc})
+	}
+
+	for i, item := range dc.files {
+		bt := dc.statelessBtree(i)
+		if bt.Empty() {
+			continue
+		}
+		var cursor *Cursor
+		switch {
+		case bool(it.asc):
+			cursor, err = bt.Seek(it.fromKey)
+		case it.toKey == nil:
+			cursor = bt.OrdinalLookup(bt.KeyCount() - 1)
+		default:
+			if cursor, err = bt.SeekLE(it.toKey); err == nil && cursor != nil && bytes.Equal(cursor.Key(), it.toKey) && !cursor.Prev() {
+				cursor = nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if cursor == nil || !it.inRange(cursor.Key()) {
+			continue
+		}
+		val, err := decodeValue(item.src.codec, cursor.Value())
+		if err != nil {
+			return err
+		}
+		heap.Push(&it.h, &CursorItem{t: FILE_CURSOR, key: cursor.Key(), val: val, btCursor: cursor, codec: item.src.codec, endTxNum: item.endTxNum, reverse: true, desc: it.asc == order.Desc})
+	}
+	return nil
+}
+
+func (it *DomainRangeIter) dbValue(k, invStep []byte) ([]byte, error) {
+	keySuffix := make([]byte, len(k)+8)
+	copy(keySuffix, k)
+	copy(keySuffix[len(k):], invStep)
+	v, err := it.roTx.GetOne(it.valsTable, keySuffix)
+	if err != nil {
+		return nil, err
+	}
+	return common.Copy(v), nil
+}
+
+// step - moves item to the next key in iteration order, returns false if item is exhausted
+func (it *DomainRangeIter) step(ci *CursorItem) (bool, error) {
+	switch ci.t {
+	case FILE_CURSOR:
+		var ok bool
+		if it.asc {
+			ok = ci.btCursor.Next()
+		} else {
+			ok = ci.btCursor.Prev()
+		}
+		if !ok || !it.inRange(ci.btCursor.Key()) {
+			return false, nil
+		}
+		ci.key = ci.btCursor.Key()
+		var err error
+		if ci.val, err = decodeValue(ci.codec, ci.btCursor.Value()); err != nil {
+			return false, err
+		}
+	case DB_CURSOR:
+		var k, invStep []byte
+		var err error
+		if it.asc {
+			k, invStep, err = ci.c.NextNoDup()
+		} else if k, _, err = ci.c.PrevNoDup(); err == nil && k != nil {
+			invStep, err = ci.c.FirstDup()
+		}
+		if err != nil {
+			return false, err
+		}
+		if k == nil || !it.inRange(k) {
+			return false, nil
+		}
+		ci.key = common.Copy(k)
+		if ci.val, err = it.dbValue(k, invStep); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (it *DomainRangeIter) advance() error {
+	it.nextKey, it.nextVal = nil, nil
+	for it.nextKey == nil && it.h.Len() > 0 {
+		lastKey := common.Copy(it.h[0].key)
+		lastVal := common.Copy(it.h[0].val)
+		// Advance all the items that have this key (including the top)
+		for it.h.Len() > 0 && bytes.Equal(it.h[0].key, lastKey) {
+			ok, err := it.step(it.h[0])
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Fix(&it.h, 0)
+			} else {
+				heap.Pop(&it.h)
+			}
+		}
+		if len(lastVal) > 0 {
+			it.nextKey, it.nextVal = lastKey, lastVal
+		}
+	}
+	return nil
+}
+
+func (it *DomainRangeIter) HasNext() bool { return it.limit != 0 && it.nextKey != nil }
+
+func (it *DomainRangeIter) Next() ([]byte, []byte, error) {
+	k, v := it.nextKey, it.nextVal
+	it.limit--
+	if err := it.advance(); err != nil {
+		return nil, nil, err
+	}
+	return k, v, nil
+}
+
+func (it *DomainRangeIter) Close() {
+	if it.keysCursor != nil {
+		it.keysCursor.Close()
+		it.keysCursor = nil
+	}
+}
@@ -390,6 +390,7 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 				if historyIn.bindex != nil {
 					historyIn.bindex.Close()
 				}
+				historyIn.existence.Close()
 			}
 			if valuesIn != nil {
 				if valuesIn.decompressor != nil {
@@ -401,6 +402,7 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 				if valuesIn.bindex != nil {
 					valuesIn.bindex.Close()
 				}
+				valuesIn.existence.Close()
 			}
 		}
 	}()
@@ -424,6 +426,7 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 		if comp, err = compress.NewCompressor(ctx, "merge", datPath, d.dir, compress.MinPatternScore, workers, log.LvlTrace, d.logger); err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s compressor: %w", d.filenameBase, err)
 		}
+		setValueCodec(comp, d.codec, domainFiles)
 		var cp CursorHeap
 		heap.Init(&cp)
 		for _, item := range domainFiles {
@@ -431,11 +434,9 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 			g.Reset(0)
 			if g.HasNext() {
 				key, _ := g.NextUncompressed()
-				var val []byte
-				if d.compressVals {
-					val, _ = g.Next(nil)
-				} else {
-					val, _ = g.NextUncompressed()
+				val, err := nextValue(g, item.codec)
+				if err != nil {
+					return nil, nil, nil, err
 				}
 				if d.trace {
 					fmt.Printf("merge: read value '%x'\n", key)
@@ -443,6 +444,7 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 				heap.Push(&cp, &CursorItem{
 					t:        FILE_CURSOR,
 					dg:       g,
+					codec:    item.codec,
 					key:      key,
 					val:      val,
 					endTxNum: item.endTxNum,
@@ -456,7 +458,7 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 		// instead, the pair from the previous iteration is processed first - `keyBuf=>valBuf`. After that, `keyBuf` and `valBuf` are assigned
 		// to `lastKey` and `lastVal` correspondingly, and the next step of multi-way merge happens. Therefore, after the multi-way merge loop
 		// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
-		var keyBuf, valBuf []byte
+		var keyBuf, valBuf, encBuf []byte
 		for cp.Len() > 0 {
 			lastKey := common.Copy(cp[0].key)
 			lastVal := common.Copy(cp[0].val)
@@ -465,10 +467,8 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 				ci1 := cp[0]
 				if ci1.dg.HasNext() {
 					ci1.key, _ = ci1.dg.NextUncompressed()
-					if d.compressVals {
-						ci1.val, _ = ci1.dg.Next(ci1.val[:0])
-					} else {
-						ci1.val, _ = ci1.dg.NextUncompressed()
+					if ci1.val, err = nextValue(ci1.dg, ci1.codec); err != nil {
+						return nil, nil, nil, err
 					}
 					heap.Fix(&cp, 0)
 				} else {
@@ -483,15 +483,8 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 						return nil, nil, nil, err
 					}
 					keyCount++ // Only counting keys, not values
-					switch d.compressVals {
-					case true:
-						if err = comp.AddWord(valBuf); err != nil {
-							return nil, nil, nil, err
-						}
-					default:
-						if err = comp.AddUncompressedWord(valBuf); err != nil {
-							return nil, nil, nil, err
-						}
+					if encBuf, err = addValue(comp, d.codec, valBuf, encBuf); err != nil {
+						return nil, nil, nil, err
 					}
 				}
 				keyBuf = append(keyBuf[:0], lastKey...)
@@ -504,19 +497,16 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 			}
 			keyCount++ // Only counting keys, not values
 			//fmt.Printf("last heap key %x\n", keyBuf)
-			valBuf, err = d.commitmentValTransform(&oldFiles, &mergedFiles, valBuf)
-			if err != nil {
-				return nil, nil, nil, fmt.Errorf("merge: 2valTransform [%x] %w", valBuf, err)
-			}
-			if d.compressVals {
-				if err = comp.AddWord(valBuf); err != nil {
-					return nil, nil, nil, err
-				}
-			} else {
-				if err = comp.AddUncompressedWord(valBuf); err != nil {
-					return nil, nil, nil, err
+			// commitment state records (see storeCommitmentState) are sorted after branches and are not branch data
+			if !bytes.HasPrefix(keyBuf, keyCommitmentState) {
+				valBuf, err = d.commitmentValTransform(&oldFiles, &mergedFiles, valBuf)
+				if err != nil {
+					return nil, nil, nil, fmt.Errorf("merge: 2valTransform [%x] %w", valBuf, err)
 				}
 			}
+			if _, err = addValue(comp, d.codec, valBuf, encBuf); err != nil {
+				return nil, nil, nil, err
+			}
 		}
 		if err = comp.Compress(); err != nil {
 			return nil, nil, nil, err
@@ -527,6 +517,10 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 		if valuesIn.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 		}
+		if err = d.manifest.prepare(valuesIn.decompressor); err != nil {
+			return nil, nil, nil, fmt.Errorf("merge %s checksum [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+		}
+		valuesIn.codec = d.codec
 		ps.Delete(p)
 
 		idxFileName := fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, r.valuesStartTxNum/d.aggregationStep, r.valuesEndTxNum/d.aggregationStep)
@@ -539,10 +533,17 @@ func (d *DomainCommitted) mergeFiles(ctx context.Context, oldFiles SelectedStati
 		}
 
 		btPath := strings.TrimSuffix(idxPath, "kvi") + "bt"
-		valuesIn.bindex, err = CreateBtreeIndexWithDecompressor(btPath, 2048, valuesIn.decompressor, p, d.tmpdir, d.logger)
+		valuesIn.bindex, err = CreateBtreeIndexWithDecompressor(btPath, DefaultBtreeWriterM, valuesIn.decompressor, p, d.tmpdir, d.logger)
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("create btindex %s [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 		}
+
+		if d.withExistenceFilter {
+			filterPath := strings.TrimSuffix(idxPath, "kvi") + "kvf"
+			if valuesIn.existence, err = buildExistenceFilterThenOpen(ctx, valuesIn.decompressor, d.codec, filterPath, d.noFsync); err != nil {
+				return nil, nil, nil, fmt.Errorf("merge %s filter [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+			}
+		}
 	}
 	closeItem = false
 	d.stats.MergesCount++
@@ -585,6 +586,16 @@ func (d *DomainCommitted) ComputeCommitment(trace bool) (rootHash []byte, branch
 	return rootHash, branchNodeUpdates, err
 }
 
+// Prove - Merkle proof of account (plainKey=addr) or storage item (plainKey=addr+loc) at the state of last ComputeCommitment.
+// Proof nodes are built by the trie from branch data and values, so data accessing functions should be set before.
+func (d *DomainCommitted) Prove(plainKey []byte) (accountProof, storageProof [][]byte, err error) {
+	hext, ok := d.patriciaTrie.(*commitment.HexPatriciaHashed)
+	if !ok {
+		return nil, nil, fmt.Errorf("proofs are only supported by hex patricia trie")
+	}
+	return hext.Prove(plainKey)
+}
+
 var keyCommitmentState = []byte("state")
 
 // SeekCommitment searches for last encoded state from DomainCommitted
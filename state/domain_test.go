@@ -17,11 +17,14 @@
 package state
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -31,8 +34,10 @@ import (
 	"github.com/stretchr/testify/require"
 	btree2 "github.com/tidwall/btree"
 
+	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/kv"
 	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 )
 
@@ -47,16 +52,17 @@ func testDbAndDomain(t *testing.T, logger log.Logger) (string, kv.RwDB, *Domain)
 	indexTable := "Index"
 	db := mdbx.NewMDBX(logger).InMem(path).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
 		return kv.TableCfg{
-			keysTable:        kv.TableCfgItem{Flags: kv.DupSort},
-			valsTable:        kv.TableCfgItem{},
-			historyKeysTable: kv.TableCfgItem{Flags: kv.DupSort},
-			historyValsTable: kv.TableCfgItem{Flags: kv.DupSort},
-			settingsTable:    kv.TableCfgItem{},
-			indexTable:       kv.TableCfgItem{Flags: kv.DupSort},
+			keysTable:             kv.TableCfgItem{Flags: kv.DupSort},
+			valsTable:             kv.TableCfgItem{},
+			historyKeysTable:      kv.TableCfgItem{Flags: kv.DupSort},
+			historyValsTable:      kv.TableCfgItem{Flags: kv.DupSort},
+			settingsTable:         kv.TableCfgItem{},
+			indexTable:            kv.TableCfgItem{Flags: kv.DupSort},
+			kv.TblPruningProgress: kv.TableCfgItem{},
 		}
 	}).MustOpen()
 	t.Cleanup(db.Close)
-	d, err := NewDomain(path, path, 16, "base", keysTable, valsTable, historyKeysTable, historyValsTable, indexTable, true, false, logger)
+	d, err := NewDomain(path, path, 16, "base", keysTable, valsTable, historyKeysTable, historyValsTable, indexTable, CompressedValues, false, logger)
 	require.NoError(t, err)
 	t.Cleanup(d.Close)
 	d.DisableFsync()
@@ -172,6 +178,51 @@ func TestIterationBasic(t *testing.T) {
 	require.Equal(t, []string{"value1", "value1"}, vals)
 }
 
+func TestDomain_IteratePrefixInFiles(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	_, db, d := testDbAndDomain(t, logger)
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+
+	d.SetTxNum(2)
+	for _, addr := range []string{"addr1", "addr2", "addr3"} {
+		for _, loc := range []string{"loc1", "loc2", "loc3"} {
+			require.NoError(t, d.Put([]byte(addr), []byte(loc), []byte(addr+loc)))
+		}
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+	d.FinishWrites()
+
+	c, err := d.collate(ctx, 0, 0, d.aggregationStep, tx, logEvery)
+	require.NoError(t, err)
+	sf, err := d.buildFiles(ctx, 0, c, background.NewProgressSet())
+	require.NoError(t, err)
+	d.integrateFiles(sf, 0, d.aggregationStep)
+	tx.Rollback()
+
+	// DB is empty: all keys are read from file, not only the first one found by prefix
+	tx, err = db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	dc := d.MakeContext()
+	defer dc.Close()
+	var keys, vals []string
+	err = dc.IteratePrefix([]byte("addr2"), func(k, v []byte) {
+		keys = append(keys, string(k))
+		vals = append(vals, string(v))
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"addr2loc1", "addr2loc2", "addr2loc3"}, keys)
+	require.Equal(t, keys, vals)
+}
+
 func TestAfterPrune(t *testing.T) {
 	logger := log.New()
 	logEvery := time.NewTicker(30 * time.Second)
@@ -226,7 +277,7 @@ func TestAfterPrune(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("value2.2"), v)
 
-	err = d.prune(ctx, 0, 0, 16, math.MaxUint64, logEvery)
+	_, err = d.prune(ctx, 0, 0, 16, math.MaxUint64, logEvery)
 	require.NoError(t, err)
 
 	isEmpty, err := d.isEmpty(tx)
@@ -339,7 +390,7 @@ func TestHistory(t *testing.T) {
 			require.NoError(t, err)
 			d.integrateFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
 
-			err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
+			_, err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
 			require.NoError(t, err)
 		}()
 	}
@@ -401,7 +452,7 @@ func TestIterationMultistep(t *testing.T) {
 			sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
 			require.NoError(t, err)
 			d.integrateFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
-			err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
+			_, err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
 			require.NoError(t, err)
 		}()
 	}
@@ -419,6 +470,405 @@ func TestIterationMultistep(t *testing.T) {
 	require.Equal(t, []string{"value1", "value1", "value1"}, vals)
 }
 
+func TestDomainRange(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	_, db, d := testDbAndDomain(t, logger)
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	latest := map[string]string{}
+	put := func(i int, v string) {
+		k := fmt.Sprintf("k%02d", i)
+		require.NoError(t, d.Put([]byte(k[:1]), []byte(k[1:]), []byte(v)))
+		latest[k] = v
+	}
+	d.SetTxNum(2)
+	for i := 0; i < 20; i++ {
+		put(i, fmt.Sprintf("v0-%d", i))
+	}
+	d.SetTxNum(2 + 16)
+	for i := 0; i < 20; i += 2 {
+		put(i, fmt.Sprintf("v1-%d", i))
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+	for step := uint64(0); step <= 1; step++ {
+		c, err := d.collate(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, tx, logEvery)
+		require.NoError(t, err)
+		sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
+		require.NoError(t, err)
+		d.integrateFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
+		_, err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
+		require.NoError(t, err)
+	}
+
+	// recent step stays in db: updates, deletes of keys from files and new keys
+	d.SetTxNum(2 + 16 + 16)
+	for i := 0; i < 20; i += 3 {
+		put(i, fmt.Sprintf("v2-%d", i))
+	}
+	for i := 0; i < 20; i += 5 {
+		k := fmt.Sprintf("k%02d", i)
+		require.NoError(t, d.Delete([]byte(k[:1]), []byte(k[1:])))
+		delete(latest, k)
+	}
+	put(25, "v2-25")
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+
+	var sorted []string
+	for k := range latest {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	dc := d.MakeContext()
+	defer dc.Close()
+	check := func(from, to string, asc order.By, limit int) {
+		t.Helper()
+		var fromKey, toKey []byte
+		if from != "" {
+			fromKey = []byte(from)
+		}
+		if to != "" {
+			toKey = []byte(to)
+		}
+		var expect []string
+		for _, k := range sorted {
+			if (from == "" || k >= from) && (to == "" || k < to) {
+				expect = append(expect, k)
+			}
+		}
+		if !asc {
+			for i, j := 0, len(expect)-1; i < j; i, j = i+1, j-1 {
+				expect[i], expect[j] = expect[j], expect[i]
+			}
+		}
+		if limit >= 0 && len(expect) > limit {
+			expect = expect[:limit]
+		}
+
+		it, err := dc.DomainRange(fromKey, toKey, asc, limit, tx)
+		require.NoError(t, err)
+		defer it.Close()
+		var keys []string
+		for it.HasNext() {
+			k, v, err := it.Next()
+			require.NoError(t, err)
+			require.Equal(t, latest[string(k)], string(v))
+			keys = append(keys, string(k))
+		}
+		require.Equal(t, expect, keys, "from=%s, to=%s, asc=%t, limit=%d", from, to, asc, limit)
+	}
+	for _, asc := range []order.By{order.Asc, order.Desc} {
+		check("", "", asc, -1)
+		check("", "", asc, 3)
+		check("k03", "k11", asc, -1)
+		check("k04", "k12", asc, 2)
+		check("k10", "", asc, -1)
+		check("", "k10", asc, -1)
+		check("k0", "k1", asc, -1)
+		check("k19", "k25", asc, -1)
+		check("k26", "", asc, -1)
+		check("", "k00", asc, -1)
+	}
+}
+
+func TestDomain_LocalityIndex(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	_, db, d := testDbAndDomain(t, logger)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	// 100 steps: 3 frozen files (0-32, 32-64, 64-96) and recent ones
+	txs := uint64(1600)
+	frozenTxs := d.aggregationStep * StepsInBiggestFile
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		d.SetTxNum(txNum)
+		v := []byte(fmt.Sprintf("%d", txNum))
+		require.NoError(t, d.Put([]byte("filler"), nil, v))
+		switch {
+		case txNum == 10:
+			require.NoError(t, d.Put([]byte("a"), nil, v))
+			require.NoError(t, d.Put([]byte("c"), nil, v))
+		case txNum == frozenTxs+10:
+			require.NoError(t, d.Put([]byte("b"), nil, v))
+		case txNum == 2*frozenTxs+10:
+			require.NoError(t, d.Put([]byte("c"), nil, v))
+		case txNum == 3*frozenTxs+10:
+			require.NoError(t, d.Put([]byte("d"), nil, v))
+		}
+		if txNum%10 == 0 {
+			require.NoError(t, d.Rotate().Flush(ctx, tx))
+		}
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+	collateAndMerge(t, db, tx, d, txs)
+
+	dc := d.MakeContext()
+	require.NoError(t, dc.hc.BuildOptionalMissedIndices(ctx))
+	dc.Close()
+	require.Contains(t, d.Files(), "base.0-96.li")
+	require.Contains(t, d.Files(), "base.0-96.l")
+
+	dc = d.MakeContext()
+	defer dc.Close()
+	fileNums, lastIndexedTxNum, ok := d.localityIndex.lookupFiles(dc.hc.ic.loc, []byte("c"))
+	require.True(t, ok)
+	require.Equal(t, []uint64{0, 2}, fileNums)
+	require.Equal(t, 3*frozenTxs, lastIndexedTxNum)
+
+	for key, expect := range map[string][]string{
+		"a":       {"base.0-32.kv"},
+		"b":       {"base.32-64.kv"},
+		"c":       {"base.0-32.kv", "base.64-96.kv"},
+		"d":       {"base.96-98.kv"},
+		"missing": nil,
+	} {
+		files, err := dc.FilesWithKey([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, expect, files, key)
+		var efs []string
+		for _, f := range expect {
+			efs = append(efs, strings.TrimSuffix(f, ".kv")+".ef")
+		}
+		require.Equal(t, efs, dc.hc.FilesWithKey([]byte(key)), key)
+	}
+
+	for key, expect := range map[string]uint64{"a": 10, "b": frozenTxs + 10, "c": 2*frozenTxs + 10, "d": 3*frozenTxs + 10} {
+		v, found, err := dc.readFromFiles([]byte(key), 0)
+		require.NoError(t, err)
+		require.True(t, found, key)
+		require.Equal(t, fmt.Sprintf("%d", expect), string(v), key)
+	}
+	_, found, err := dc.readFromFiles([]byte("missing"), 0)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestDomain_Retention(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	_, db, d := testDbAndDomain(t, logger)
+
+	frozenTxs := d.aggregationStep * StepsInBiggestFile
+	require.Error(t, d.SetRetention(RetentionPolicy{KeepSince: frozenTxs}))
+	require.True(t, d.retention.Empty())
+	require.NoError(t, d.SetRetention(RetentionPolicy{KeepLast: 1}))
+	require.Equal(t, RetentionPolicy{KeepLast: 1}, d.retention)
+
+	// files merged with KeepSince (by older version or by History's method): "a" is dropped from .ef, but not from .kv
+	d.History.SetRetention(RetentionPolicy{KeepSince: frozenTxs + 5})
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	txs := uint64(1600)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		d.SetTxNum(txNum)
+		v := []byte(fmt.Sprintf("%d", txNum))
+		require.NoError(t, d.Put([]byte("filler"), nil, v))
+		if txNum == 10 {
+			require.NoError(t, d.Put([]byte("a"), nil, v))
+		}
+		if txNum%10 == 0 {
+			require.NoError(t, d.Rotate().Flush(ctx, tx))
+		}
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+	collateAndMerge(t, db, tx, d, txs)
+
+	dc := d.MakeContext()
+	require.NoError(t, dc.hc.BuildOptionalMissedIndices(ctx))
+	dc.Close()
+
+	dc = d.MakeContext()
+	defer dc.Close()
+	require.Empty(t, dc.hc.FilesWithKey([]byte("a")))
+	files, err := dc.FilesWithKey([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"base.0-32.kv"}, files)
+	v, found, err := dc.readFromFiles([]byte("a"), 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "10", string(v))
+}
+
+func TestDomain_CollateParallel(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	_, db, d := testDbAndDomain(t, logger)
+	defer func(chunk int) { historyCollateChunk = chunk }(historyCollateChunk)
+	historyCollateChunk = 7
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	// keys are spread over first bytes, so they fall into different partitions
+	txs := uint64(64)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		d.SetTxNum(txNum)
+		for keyNum := uint64(1); keyNum <= 100; keyNum++ {
+			if txNum%keyNum != 0 {
+				continue
+			}
+			k := []byte{byte(keyNum * 67), byte(keyNum)}
+			if keyNum%13 == 0 && txNum%2 == 0 {
+				require.NoError(t, d.Delete(k, nil))
+				continue
+			}
+			require.NoError(t, d.Put(k, nil, []byte(fmt.Sprintf("%d.%d", keyNum, txNum))))
+		}
+		if txNum%10 == 0 {
+			require.NoError(t, d.Rotate().Flush(ctx, tx))
+		}
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+
+	// data is not committed: like Aggregator, collation reads it through write transaction
+	collate := func(step uint64, workers int) (c Collation, values, history []byte) {
+		t.Helper()
+		d.collateWorkers = workers
+		c, err := d.collateParallel(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, tx)
+		require.NoError(t, err)
+		require.NoError(t, c.valuesComp.Compress())
+		require.NoError(t, c.historyComp.Compress())
+		values, err = os.ReadFile(c.valuesPath)
+		require.NoError(t, err)
+		history, err = os.ReadFile(c.historyPath)
+		require.NoError(t, err)
+		c.Close()
+		return c, values, history
+	}
+	for step := uint64(0); step < txs/d.aggregationStep; step++ {
+		serial, serialValues, serialHistory := collate(step, 1)
+		parallel, parallelValues, parallelHistory := collate(step, 3)
+		require.Positive(t, serial.valuesCount)
+		require.Equal(t, serial.valuesCount, parallel.valuesCount)
+		require.Equal(t, serial.historyCount, parallel.historyCount)
+		require.Equal(t, len(serial.indexBitmaps), len(parallel.indexBitmaps))
+		for k, bitmap := range serial.indexBitmaps {
+			require.Equal(t, bitmap.ToArray(), parallel.indexBitmaps[k].ToArray(), "%x", k)
+		}
+		require.Equal(t, serialValues, parallelValues, step)
+		require.Equal(t, serialHistory, parallelHistory, step)
+	}
+}
+
+func TestDomain_ExistenceFilter(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	_, db, d := testDbAndDomain(t, logger)
+	d.EnableExistenceFilter()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	txs := uint64(1000)
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		d.SetTxNum(txNum)
+		v := []byte(fmt.Sprintf("%d", txNum))
+		require.NoError(t, d.Put([]byte("filler"), nil, v))
+		switch txNum {
+		case 10, 20:
+			require.NoError(t, d.Put([]byte("a"), nil, v))
+		case 600:
+			require.NoError(t, d.Put([]byte("b"), nil, v))
+		}
+		if txNum%10 == 0 {
+			require.NoError(t, d.Rotate().Flush(ctx, tx))
+		}
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+	collateAndMerge(t, db, tx, d, txs)
+
+	// every file, collated or merged, has filter
+	d.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			require.NotNil(t, item.existence, item.decompressor.FileName())
+			require.True(t, item.existence.Contains([]byte("filler")), item.existence.FileName())
+		}
+		return true
+	})
+	d.History.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			require.NotNil(t, item.existence, item.decompressor.FileName())
+			require.True(t, item.existence.Contains([]byte("filler")), item.existence.FileName())
+		}
+		return true
+	})
+	require.FileExists(t, filepath.Join(d.dir, "base.0-32.kvf"))
+	require.FileExists(t, filepath.Join(d.dir, "base.0-32.vif"))
+
+	dc := d.MakeContext()
+	defer dc.Close()
+	for key, expect := range map[string]string{"a": "20", "b": "600"} {
+		v, found, err := dc.readFromFiles([]byte(key), 0)
+		require.NoError(t, err)
+		require.True(t, found, key)
+		require.Equal(t, expect, string(v), key)
+	}
+
+	skips := mxExistenceFilterSkips.Get()
+	_, found, err := dc.readFromFiles([]byte("missing"), 0)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Greater(t, mxExistenceFilterSkips.Get(), skips)
+
+	v, found, err := dc.hc.GetNoState([]byte("a"), 15)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "10", string(v))
+
+	skips = mxExistenceFilterSkips.Get()
+	_, found, err = dc.hc.GetNoState([]byte("missing"), 15)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.Greater(t, mxExistenceFilterSkips.Get(), skips)
+
+	// filter survives reopen and has no false-negatives
+	var filterPath string
+	d.files.Walk(func(items []*filesItem) bool {
+		filterPath = items[0].existence.FilePath()
+		return false
+	})
+	f, err := OpenExistenceFilter(filterPath)
+	require.NoError(t, err)
+	defer f.Close()
+	require.True(t, f.Contains([]byte("a")))
+	require.True(t, f.Contains([]byte("filler")))
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if f.Contains([]byte(fmt.Sprintf("absent%d", i))) {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 50)
+}
+
 func collateAndMerge(t *testing.T, db kv.RwDB, tx kv.RwTx, d *Domain, txs uint64) {
 	t.Helper()
 
@@ -440,7 +890,7 @@ func collateAndMerge(t *testing.T, db kv.RwDB, tx kv.RwTx, d *Domain, txs uint64
 		sf, err := d.buildFiles(ctx, step, c, background.NewProgressSet())
 		require.NoError(t, err)
 		d.integrateFiles(sf, step*d.aggregationStep, (step+1)*d.aggregationStep)
-		err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
+		_, err = d.prune(ctx, step, step*d.aggregationStep, (step+1)*d.aggregationStep, math.MaxUint64, logEvery)
 		require.NoError(t, err)
 	}
 	var r DomainRanges
@@ -484,7 +934,7 @@ func collateAndMergeOnce(t *testing.T, d *Domain, step uint64) {
 	require.NoError(t, err)
 	d.integrateFiles(sf, txFrom, txTo)
 
-	err = d.prune(ctx, step, txFrom, txTo, math.MaxUint64, logEvery)
+	_, err = d.prune(ctx, step, txFrom, txTo, math.MaxUint64, logEvery)
 	require.NoError(t, err)
 
 	var r DomainRanges
@@ -789,3 +1239,191 @@ func TestScanStaticFilesD(t *testing.T) {
 	})
 	require.Equal(t, 6, len(found))
 }
+
+// key which was changed in 2 steps has entries of both steps in keys table until older one is pruned:
+// collation of newer step must not skip it
+func TestDomain_CollateKeyWithOlderStep(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	_, db, d := testDbAndDomain(t, logger)
+	ctx := context.Background()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	d.SetTxNum(2)
+	require.NoError(t, d.Put([]byte("key1"), nil, []byte("value1.1")))
+	require.NoError(t, d.Put([]byte("key2"), nil, []byte("value2.1")))
+	d.SetTxNum(d.aggregationStep + 2)
+	require.NoError(t, d.Put([]byte("key1"), nil, []byte("value1.2")))
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+
+	c, err := d.collate(ctx, 1, d.aggregationStep, 2*d.aggregationStep, tx, logEvery)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, 1, c.valuesCount)
+
+	cs, err := d.collateStream(ctx, 1, d.aggregationStep, 2*d.aggregationStep, tx)
+	require.NoError(t, err)
+	defer cs.Close()
+	require.Equal(t, 2, cs.valuesComp.Count()) // key and value words
+}
+
+func TestDomain_ValueCodec(t *testing.T) {
+	logger := log.New()
+	for _, codec := range []ValueCodec{RawValues, CompressedValuesReuseDict, xorValueCodec{}, xorValueCodec{compressed: true}} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			_, db, d, txs := filledDomain(t, logger)
+			d.codec = codec
+			collateAndMerge(t, db, nil, d, txs)
+			checkHistory(t, db, d, txs)
+
+			// files are read by codec from their header
+			d.codec = CompressedValues
+			d.closeWhatNotInList([]string{})
+			require.NoError(t, d.OpenFolder())
+			want := codec.Name()
+			if isDefaultValueCodec(codec) {
+				want = headerlessValues.Name()
+			}
+			d.files.Walk(func(items []*filesItem) bool {
+				for _, item := range items {
+					require.Equal(t, want, item.codec.Name(), item.decompressor.FileName())
+				}
+				return true
+			})
+			checkHistory(t, db, d, txs)
+		})
+	}
+}
+
+func TestDomain_CollatedValuesNotCompressed(t *testing.T) {
+	logger := log.New()
+	_, db, d := testDbAndDomain(t, logger)
+	require.True(t, d.codec.Compressed())
+	ctx := context.Background()
+	tx, err := db.BeginRw(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+
+	value := func(keyNum, txNum uint64) []byte { // compressible
+		v := bytes.Repeat([]byte("0123456789abcdef"), 4)
+		binary.BigEndian.PutUint64(v, keyNum)
+		binary.BigEndian.PutUint64(v[len(v)-8:], txNum)
+		return v
+	}
+	txs := d.aggregationStep * 4
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		d.SetTxNum(txNum)
+		for keyNum := uint64(1); keyNum <= 64; keyNum++ {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			require.NoError(t, d.Put(k[:], nil, value(keyNum, txNum)))
+		}
+	}
+	require.NoError(t, d.Rotate().Flush(ctx, tx))
+	d.FinishWrites()
+	collateAndMerge(t, db, tx, d, txs)
+
+	// collation stores values as before codecs were introduced, only merge compresses them
+	var collated, merged int
+	d.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			patterns := compress.DictionaryBuilderFromDecompressor(item.decompressor).Len()
+			if item.endTxNum-item.startTxNum == d.aggregationStep {
+				collated++
+				require.Zero(t, patterns, item.decompressor.FileName())
+			} else {
+				merged++
+				require.NotZero(t, patterns, item.decompressor.FileName())
+			}
+		}
+		return true
+	})
+	require.Positive(t, collated)
+	require.Positive(t, merged)
+
+	dc := d.MakeContext()
+	defer dc.Close()
+	for _, txNum := range []uint64{d.aggregationStep, 2 * d.aggregationStep, 3 * d.aggregationStep} {
+		for keyNum := uint64(1); keyNum <= 64; keyNum++ {
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			v, err := dc.GetBeforeTxNum(k[:], txNum+1, tx)
+			require.NoError(t, err)
+			require.Equal(t, value(keyNum, txNum), v)
+		}
+	}
+}
+
+func TestDomain_PruneProgress(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	_, db, d := testDbAndDomain(t, logger)
+	d.pruneProgressTable = kv.TblPruningProgress
+	ctx, require := context.Background(), require.New(t)
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	d.SetTx(tx)
+	d.StartWrites()
+	defer d.FinishWrites()
+
+	keysCount := uint64(20)
+	for _, txNum := range []uint64{1, d.aggregationStep + 1} {
+		d.SetTxNum(txNum)
+		for keyNum := uint64(1); keyNum <= keysCount; keyNum++ {
+			var k, v [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			binary.BigEndian.PutUint64(v[:], txNum)
+			require.NoError(d.Put(k[:], nil, v[:]))
+		}
+	}
+	require.NoError(d.Rotate().Flush(ctx, tx))
+
+	// values of step 0 are deleted by portions, history is pruned after them
+	limit := uint64(6)
+	var total PruneStats
+	for i := 0; total.RangesDone == 0; i++ {
+		require.Less(i, 100)
+		stat, err := d.prune(ctx, 0, 0, d.aggregationStep, limit, logEvery)
+		require.NoError(err)
+		if stat.RangesDone == 0 {
+			require.LessOrEqual(stat.RowsDeleted, limit+1)
+		}
+		total.Accumulate(stat)
+	}
+	require.GreaterOrEqual(total.RowsDeleted, 2*keysCount)
+
+	_, done, err := stepPruneProgress(tx, d.pruneProgressTable, pruneProgressKey(d.filenameBase, "kv"), 0)
+	require.NoError(err)
+	require.True(done)
+
+	step0 := make([]byte, 8)
+	binary.BigEndian.PutUint64(step0, ^uint64(0))
+	require.NoError(tx.ForEach(d.valsTable, nil, func(k, v []byte) error {
+		require.NotEqual(step0, k[len(k)-8:], "value of pruned step %x", k)
+		return nil
+	}))
+
+	dc := d.MakeContext()
+	defer dc.Close()
+	for keyNum := uint64(1); keyNum <= keysCount; keyNum++ {
+		var k, v [8]byte
+		binary.BigEndian.PutUint64(k[:], keyNum)
+		binary.BigEndian.PutUint64(v[:], d.aggregationStep+1)
+		val, err := dc.Get(k[:], nil, tx)
+		require.NoError(err)
+		require.Equal(v[:], val)
+	}
+}
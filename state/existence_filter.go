@@ -0,0 +1,177 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/spaolacci/murmur3"
+
+	"github.com/ledgerwatch/erigon-lib/common/dbg"
+	"github.com/ledgerwatch/erigon-lib/compress"
+)
+
+// ExistenceFilter - bloom filter over keys of 1 state file (.kvf for .kv, .vif for history keys).
+// Answers "key is definitely not in file" - then reader doesn't touch index and data file of it.
+// Format: [keysCount u64][bitsCount u64][hashFuncs u8][bits]
+type ExistenceFilter struct {
+	keysCount uint64
+	bitsCount uint64
+	hashFuncs uint8
+	bits      []byte
+
+	filePath string
+	f        *os.File
+	m        mmap.MMap
+}
+
+const (
+	existenceFilterBitsPerKey = 10 // ~1% of false-positives
+	existenceFilterHashFuncs  = 7
+	existenceFilterHeaderSize = 8 + 8 + 1
+)
+
+// existenceHash - hash of key, computed once per lookup and checked in all files
+type existenceHash struct{ h1, h2 uint64 }
+
+func newExistenceHash(key []byte) existenceHash {
+	h1, h2 := murmur3.Sum128(key)
+	return existenceHash{h1: h1, h2: h2 | 1}
+}
+
+func NewExistenceFilter(keysCount uint64, filePath string) *ExistenceFilter {
+	bitsCount := keysCount * existenceFilterBitsPerKey
+	if bitsCount < 64 {
+		bitsCount = 64
+	}
+	bitsCount = (bitsCount + 7) / 8 * 8
+	return &ExistenceFilter{keysCount: keysCount, bitsCount: bitsCount, hashFuncs: existenceFilterHashFuncs, bits: make([]byte, bitsCount/8), filePath: filePath}
+}
+
+func (f *ExistenceFilter) Add(key []byte) { f.addHash(newExistenceHash(key)) }
+func (f *ExistenceFilter) addHash(h existenceHash) {
+	for i := uint64(0); i < uint64(f.hashFuncs); i++ {
+		n := (h.h1 + i*h.h2) % f.bitsCount
+		f.bits[n/8] |= 1 << (n % 8)
+	}
+}
+
+// Contains - false if key is definitely not in file
+func (f *ExistenceFilter) Contains(key []byte) bool { return f.contains(newExistenceHash(key)) }
+func (f *ExistenceFilter) contains(h existenceHash) bool {
+	for i := uint64(0); i < uint64(f.hashFuncs); i++ {
+		n := (h.h1 + i*h.h2) % f.bitsCount
+		if f.bits[n/8]&(1<<(n%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *ExistenceFilter) Build(noFsync bool) error {
+	data := make([]byte, existenceFilterHeaderSize+len(f.bits))
+	binary.BigEndian.PutUint64(data, f.keysCount)
+	binary.BigEndian.PutUint64(data[8:], f.bitsCount)
+	data[16] = f.hashFuncs
+	copy(data[existenceFilterHeaderSize:], f.bits)
+	tmpPath := f.filePath + ".tmp"
+	if err := writeFileSync(tmpPath, data, noFsync); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, f.filePath)
+}
+
+func OpenExistenceFilter(filePath string) (*ExistenceFilter, error) {
+	f := &ExistenceFilter{filePath: filePath}
+	var err error
+	if f.f, err = os.Open(filePath); err != nil {
+		return nil, err
+	}
+	st, err := f.f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if st.Size() < existenceFilterHeaderSize {
+		f.Close()
+		return nil, fmt.Errorf("%s: file is too short", f.FileName())
+	}
+	if f.m, err = mmap.MapRegion(f.f, int(st.Size()), mmap.RDONLY, 0, 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	f.keysCount = binary.BigEndian.Uint64(f.m)
+	f.bitsCount = binary.BigEndian.Uint64(f.m[8:])
+	f.hashFuncs = f.m[16]
+	f.bits = f.m[existenceFilterHeaderSize:]
+	if f.bitsCount == 0 || uint64(len(f.bits))*8 != f.bitsCount {
+		f.Close()
+		return nil, fmt.Errorf("%s: broken file: bitsCount=%d, size=%d", f.FileName(), f.bitsCount, st.Size())
+	}
+	return f, nil
+}
+
+func (f *ExistenceFilter) FilePath() string { return f.filePath }
+func (f *ExistenceFilter) FileName() string { return filepath.Base(f.filePath) }
+
+func (f *ExistenceFilter) Close() {
+	if f == nil {
+		return
+	}
+	if f.m != nil {
+		if err := f.m.Unmap(); err != nil {
+			log.Log(dbg.FileCloseLogLevel, "unmap", "err", err, "file", f.FileName(), "stack", dbg.Stack())
+		}
+		f.m = nil
+	}
+	if f.f != nil {
+		if err := f.f.Close(); err != nil {
+			log.Log(dbg.FileCloseLogLevel, "close", "err", err, "file", f.FileName(), "stack", dbg.Stack())
+		}
+		f.f = nil
+	}
+	f.bits = nil
+}
+
+// buildExistenceFilterThenOpen - filter over keys of file where words are (key, value) pairs, keys are not compressed
+// and values are written by `c`
+func buildExistenceFilterThenOpen(ctx context.Context, d *compress.Decompressor, c ValueCodec, filePath string, noFsync bool) (*ExistenceFilter, error) {
+	f := NewExistenceFilter(uint64(d.Count()/2), filePath)
+	g := d.MakeGetter()
+	for i := 0; g.HasNext(); i++ {
+		key, _ := g.NextUncompressed()
+		f.Add(key)
+		skipValue(g, c)
+		if i%1024 == 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
+			}
+		}
+	}
+	if err := f.Build(noFsync); err != nil {
+		return nil, fmt.Errorf("build %s: %w", filepath.Base(filePath), err)
+	}
+	return OpenExistenceFilter(filePath)
+}
@@ -0,0 +1,479 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
+	"golang.org/x/exp/slices"
+)
+
+// Files manifest - on-disk list of live data files of one InvertedIndex (.ef), History (.v) or Domain (.kv):
+//
+//	<filenameBase>.<ext>.manifest - json, replaced atomically (write .tmp, fsync, rename, fsync dir)
+//
+// It's write-ahead log of files integration: new file is listed only after it's fully written,
+// old file is removed from disk only after manifest without it is written. So after `kill -9`
+// OpenFolder doesn't need to guess from filenames which files are garbage.
+// Indices (.efi/.vi/.kvi/.bt) are not listed - they are derivatives of data files and can be re-built.
+// Datadir without manifest (created by older version) is opened by filenames, manifest appears after first integration.
+// Files dropped by unwind are listed as `invalid` until file with same name is built again: even frozen ones are garbage.
+// Until DB tx of unwind is committed, dropped files stay listed (see retain): crash before commit opens files before unwind.
+
+const filesManifestVersion = 1
+
+type ManifestFile struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum uint32 `json:"crc32c"`
+}
+
+type FilesManifest struct {
+	Version int            `json:"version"`
+	Files   []ManifestFile `json:"files"`
+	Invalid []string       `json:"invalid,omitempty"`
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func fileChecksum(path string) (size int64, checksum uint32, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	h := crc32.New(crc32cTable)
+	size, err = io.Copy(h, bufio.NewReaderSize(f, 1024*1024))
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, h.Sum32(), nil
+}
+
+type filesManifest struct {
+	lock         sync.Mutex
+	dir          string
+	filenameBase string
+	ext          string // extension of data files: ef, v, kv
+	step         uint64
+	known        map[string]ManifestFile // checksums of already listed files - calculated only once
+	prepared     map[string]ManifestFile // checksums of new files, calculated by prepare before integration
+	invalid      map[string]struct{}     // files dropped by unwind
+	retained     map[string]ManifestFile // files dropped by not committed unwind: still listed, see retain
+	unlisted     map[string]struct{}     // files built by not committed unwind: not listed yet
+}
+
+func newFilesManifest(dir, filenameBase, ext string, aggregationStep uint64) *filesManifest {
+	return &filesManifest{dir: dir, filenameBase: filenameBase, ext: ext, step: aggregationStep,
+		known: map[string]ManifestFile{}, prepared: map[string]ManifestFile{}, invalid: map[string]struct{}{},
+		retained: map[string]ManifestFile{}, unlisted: map[string]struct{}{}}
+}
+
+// prepare - calculates checksum of new (built, merged, truncated) data file. Must be called before integration:
+// update runs under files mutation lock and must not read multi-GB files.
+func (m *filesManifest) prepare(d *compress.Decompressor) error {
+	f := ManifestFile{Name: d.FileName()}
+	var err error
+	if f.Size, f.Checksum, err = fileChecksum(d.FilePath()); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prepared[f.Name] = f
+	return nil
+}
+
+func (m *filesManifest) fileName() string { return m.filenameBase + "." + m.ext + ".manifest" }
+func (m *filesManifest) path() string     { return filepath.Join(m.dir, m.fileName()) }
+
+// read - returns nil if manifest doesn't exist
+func (m *filesManifest) read() (*FilesManifest, error) {
+	data, err := os.ReadFile(m.path())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := &FilesManifest{}
+	if err = json.Unmarshal(data, res); err != nil {
+		return nil, fmt.Errorf("%s: %w", m.fileName(), err)
+	}
+	if res.Version != filesManifestVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", m.fileName(), res.Version)
+	}
+	return res, nil
+}
+
+// parse - returns step range of data file, ok=false if file doesn't belong to this manifest
+func (m *filesManifest) parse(re *regexp.Regexp, name string) (startStep, endStep uint64, ok bool) {
+	subs := re.FindStringSubmatch(name)
+	if len(subs) != 3 {
+		return 0, 0, false
+	}
+	var err error
+	if startStep, err = strconv.ParseUint(subs[1], 10, 64); err != nil {
+		return 0, 0, false
+	}
+	if endStep, err = strconv.ParseUint(subs[2], 10, 64); err != nil {
+		return 0, 0, false
+	}
+	return startStep, endStep, startStep <= endStep
+}
+
+func (m *filesManifest) re() *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(m.filenameBase) + `\.([0-9]+)-([0-9]+)\.` + regexp.QuoteMeta(m.ext) + "$")
+}
+
+// filter - removes from `fNames` data files which are not listed in manifest and returns them as garbage.
+// Frozen files are not filtered: they are immutable and may be downloaded by other process.
+// No manifest - no filtering.
+func (m *filesManifest) filter(fNames []string, logger log.Logger) (live []string, garbage []*filesItem, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	manifest, err := m.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest == nil {
+		return fNames, nil, nil
+	}
+	listed := make(map[string]ManifestFile, len(manifest.Files))
+	for _, f := range manifest.Files {
+		listed[f.Name] = f
+	}
+	for _, name := range manifest.Invalid {
+		m.invalid[name] = struct{}{}
+	}
+	m.retained, m.unlisted = map[string]ManifestFile{}, map[string]struct{}{}
+	re := m.re()
+	live = make([]string, 0, len(fNames))
+	for _, name := range fNames {
+		startStep, endStep, ok := m.parse(re, name)
+		if !ok {
+			live = append(live, name)
+			continue
+		}
+		if f, ok := listed[name]; ok {
+			if info, err := os.Stat(filepath.Join(m.dir, name)); err == nil && info.Size() != f.Size {
+				logger.Warn("[snapshots] file size doesn't match manifest", "file", name, "size", info.Size(), "expected", f.Size)
+			}
+			m.known[name] = f
+			delete(listed, name)
+			live = append(live, name)
+			continue
+		}
+		if _, ok := m.invalid[name]; ok {
+			logger.Debug("[snapshots] file invalidated by unwind, garbage", "file", name)
+			garbage = append(garbage, newFilesItem(startStep*m.step, endStep*m.step, m.step))
+			continue
+		}
+		if endStep-startStep == StepsInBiggestFile {
+			logger.Debug("[snapshots] frozen file not in manifest, adopt", "file", name)
+			live = append(live, name)
+			continue
+		}
+		logger.Debug("[snapshots] file not in manifest, garbage", "file", name)
+		garbage = append(garbage, newFilesItem(startStep*m.step, endStep*m.step, m.step))
+	}
+	for name := range listed {
+		logger.Warn("[snapshots] file from manifest not found", "manifest", m.fileName(), "file", name)
+	}
+	return live, garbage, nil
+}
+
+// update - writes list of files from `files` as manifest. On failure old manifest stays as is (new one is renamed
+// over it only when fully written), next update writes whole list again.
+func (m *filesManifest) update(files *btree2.BTreeG[*filesItem], noFsync bool, logger log.Logger) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if err := m.write(files, noFsync); err != nil {
+		logger.Warn("[snapshots] can't update files manifest", "manifest", m.fileName(), "err", err)
+	}
+}
+
+// invalidate - next update will list `names` as invalid: OpenFolder will not adopt them (even frozen)
+func (m *filesManifest) invalidate(names []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, name := range names {
+		m.invalid[name] = struct{}{}
+	}
+}
+
+// retain - `items` removed from `files` by unwind stay listed by next updates until release,
+// `outs` which replace them are not listed until release
+func (m *filesManifest) retain(items, outs []*filesItem) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, item := range items {
+		if item.decompressor == nil {
+			continue
+		}
+		name := item.decompressor.FileName()
+		f, ok := m.known[name]
+		if !ok {
+			f.Name = name
+			var err error
+			if f.Size, f.Checksum, err = fileChecksum(item.decompressor.FilePath()); err != nil {
+				return err
+			}
+		}
+		m.retained[name] = f
+	}
+	for _, item := range outs {
+		m.unlisted[item.decompressor.FileName()] = struct{}{}
+	}
+	return nil
+}
+
+// release - retained files (except re-built ones) are listed as invalid, unlisted files are listed
+func (m *filesManifest) release(files *btree2.BTreeG[*filesItem], noFsync bool, logger log.Logger) {
+	m.lock.Lock()
+	if len(m.retained) == 0 && len(m.unlisted) == 0 {
+		m.lock.Unlock()
+		return
+	}
+	for name := range m.retained {
+		m.invalid[name] = struct{}{}
+	}
+	m.retained, m.unlisted = map[string]ManifestFile{}, map[string]struct{}{}
+	m.lock.Unlock()
+	m.update(files, noFsync, logger)
+}
+
+func (m *filesManifest) write(files *btree2.BTreeG[*filesItem], noFsync bool) error {
+	manifest := FilesManifest{Version: filesManifestVersion, Files: []ManifestFile{}}
+	var err error
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.decompressor == nil {
+				continue
+			}
+			name := item.decompressor.FileName()
+			if _, ok := m.unlisted[name]; ok {
+				continue
+			}
+			f, ok := m.known[name]
+			if !ok || f.Size != item.decompressor.Size() {
+				f, ok = m.prepared[name]
+			}
+			if !ok || f.Size != item.decompressor.Size() { // file adopted without prepare
+				f.Name = name
+				if f.Size, f.Checksum, err = fileChecksum(item.decompressor.FilePath()); err != nil {
+					return false
+				}
+			}
+			manifest.Files = append(manifest.Files, f)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for name, f := range m.retained {
+		if !slices.ContainsFunc(manifest.Files, func(listed ManifestFile) bool { return listed.Name == name }) {
+			manifest.Files = append(manifest.Files, f)
+		}
+	}
+	slices.SortFunc(manifest.Files, func(a, b ManifestFile) bool { return a.Name < b.Name })
+	for _, f := range manifest.Files {
+		delete(m.invalid, f.Name)
+	}
+	for name := range m.invalid {
+		manifest.Invalid = append(manifest.Invalid, name)
+	}
+	slices.Sort(manifest.Invalid)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := m.path() + ".tmp"
+	if err = writeFileSync(tmpPath, data, noFsync); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err = os.Rename(tmpPath, m.path()); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if !noFsync {
+		if err = fsyncDir(m.dir); err != nil {
+			return err
+		}
+	}
+	m.known = make(map[string]ManifestFile, len(manifest.Files))
+	for _, f := range manifest.Files {
+		m.known[f.Name] = f
+		delete(m.prepared, f.Name)
+	}
+	return nil
+}
+
+func writeFileSync(path string, data []byte, noFsync bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if !noFsync {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+type FileDriftKind string
+
+const (
+	DriftNoManifest       FileDriftKind = "no manifest"
+	DriftMissing          FileDriftKind = "missing"           // listed in manifest, but not on disk
+	DriftSizeMismatch     FileDriftKind = "size mismatch"     // size on disk != size in manifest
+	DriftChecksumMismatch FileDriftKind = "checksum mismatch" // content on disk != checksum in manifest
+	DriftNotInManifest    FileDriftKind = "not in manifest"   // on disk, but not listed in manifest
+	DriftNotOpen          FileDriftKind = "not open"          // listed in manifest, but not open by process
+	DriftNotListed        FileDriftKind = "not listed"        // open by process, but not listed in manifest
+)
+
+type FileDrift struct {
+	Manifest string
+	File     string
+	Kind     FileDriftKind
+	Details  string
+}
+
+func (d FileDrift) String() string {
+	if d.Details == "" {
+		return fmt.Sprintf("%s: %s: %s", d.Manifest, d.File, d.Kind)
+	}
+	return fmt.Sprintf("%s: %s: %s (%s)", d.Manifest, d.File, d.Kind, d.Details)
+}
+
+// check - fsck: compares manifest with files on disk and with files open by process (`files`).
+// Checksums are re-calculated only if `checksums=true` - it reads all files.
+func (m *filesManifest) check(files *btree2.BTreeG[*filesItem], checksums bool) (drift []FileDrift, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	manifest, err := m.read()
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return []FileDrift{{Manifest: m.fileName(), Kind: DriftNoManifest}}, nil
+	}
+	report := func(file string, kind FileDriftKind, details string) {
+		drift = append(drift, FileDrift{Manifest: m.fileName(), File: file, Kind: kind, Details: details})
+	}
+
+	listed := make(map[string]struct{}, len(manifest.Files))
+	for _, f := range manifest.Files {
+		listed[f.Name] = struct{}{}
+		path := filepath.Join(m.dir, f.Name)
+		info, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				report(f.Name, DriftMissing, "")
+				continue
+			}
+			return nil, err
+		}
+		if info.Size() != f.Size {
+			report(f.Name, DriftSizeMismatch, fmt.Sprintf("disk=%d, manifest=%d", info.Size(), f.Size))
+			continue
+		}
+		if checksums {
+			_, sum, err := fileChecksum(path)
+			if err != nil {
+				return nil, err
+			}
+			if sum != f.Checksum {
+				report(f.Name, DriftChecksumMismatch, fmt.Sprintf("disk=%08x, manifest=%08x", sum, f.Checksum))
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+	re := m.re()
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if _, _, ok := m.parse(re, e.Name()); !ok {
+			continue
+		}
+		if _, ok := listed[e.Name()]; !ok {
+			report(e.Name(), DriftNotInManifest, "")
+		}
+	}
+
+	open := map[string]struct{}{}
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.decompressor != nil {
+				open[item.decompressor.FileName()] = struct{}{}
+			}
+		}
+		return true
+	})
+	for _, f := range manifest.Files {
+		if _, ok := open[f.Name]; !ok {
+			report(f.Name, DriftNotOpen, "")
+		}
+	}
+	for name := range open {
+		if _, ok := listed[name]; !ok {
+			report(name, DriftNotListed, "")
+		}
+	}
+	slices.SortFunc(drift, func(a, b FileDrift) bool {
+		if a.File == b.File {
+			return a.Kind < b.Kind
+		}
+		return a.File < b.File
+	})
+	return drift, nil
+}
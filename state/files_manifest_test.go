@@ -0,0 +1,134 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/common/dir"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesManifest(t *testing.T) {
+	logger := log.New()
+	require := require.New(t)
+
+	_, _, fresh := testDbAndHistory(t, false, logger)
+	drift, err := fresh.CheckFiles(false)
+	require.NoError(err)
+	require.Equal([]FileDrift{{Manifest: "hist.ef.manifest", Kind: DriftNoManifest}, {Manifest: "hist.v.manifest", Kind: DriftNoManifest}}, drift)
+
+	path, db, h, txs := filledHistory(t, false, logger)
+	collateAndMergeHistory(t, db, h, txs)
+	drift, err = h.CheckFiles(true)
+	require.NoError(err)
+	require.Empty(drift)
+	// checksums of built and merged files are calculated before integration and consumed by manifest update
+	require.Empty(h.manifest.prepared)
+	require.Empty(h.InvertedIndex.manifest.prepared)
+
+	m, err := h.manifest.read()
+	require.NoError(err)
+	require.Equal(len(h.Files())-len(h.InvertedIndex.Files()), len(m.Files))
+
+	// `kill -9` after file was written, but before it was integrated
+	for _, name := range []string{"hist.100-101.ef", "hist.100-101.efi", "hist.100-101.v", "hist.100-101.vi"} {
+		require.NoError(os.WriteFile(filepath.Join(path, name), []byte("garbage"), 0o644))
+	}
+	drift, err = h.CheckFiles(false)
+	require.NoError(err)
+	require.Equal([]FileDrift{
+		{Manifest: "hist.ef.manifest", File: "hist.100-101.ef", Kind: DriftNotInManifest},
+		{Manifest: "hist.v.manifest", File: "hist.100-101.v", Kind: DriftNotInManifest},
+	}, drift)
+
+	filesBefore := h.Files()
+	require.NoError(h.OpenFolder())
+	require.Equal(filesBefore, h.Files())
+	require.Len(h.garbageFiles, 1)
+	require.Len(h.InvertedIndex.garbageFiles, 1)
+	h.deleteGarbageFiles()
+	for _, name := range []string{"hist.100-101.ef", "hist.100-101.efi", "hist.100-101.v", "hist.100-101.vi"} {
+		require.False(dir.FileExist(filepath.Join(path, name)))
+	}
+
+	// content and existence of live files
+	live := h.InvertedIndex.Files()
+	require.GreaterOrEqual(len(live), 2)
+	f, err := os.OpenFile(filepath.Join(path, live[0]), os.O_RDWR, 0o644)
+	require.NoError(err)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 16)
+	require.NoError(err)
+	require.NoError(f.Close())
+	require.NoError(os.Remove(filepath.Join(path, live[1])))
+
+	drift, err = h.InvertedIndex.CheckFiles(false)
+	require.NoError(err)
+	require.Equal([]FileDrift{{Manifest: "hist.ef.manifest", File: live[1], Kind: DriftMissing}}, drift)
+	drift, err = h.InvertedIndex.CheckFiles(true)
+	require.NoError(err)
+	require.Len(drift, 2)
+	require.Contains(drift, FileDrift{Manifest: "hist.ef.manifest", File: live[1], Kind: DriftMissing})
+	for _, d := range drift {
+		if d.File == live[0] {
+			require.Equal(DriftChecksumMismatch, d.Kind)
+		}
+	}
+}
+
+func TestFilesManifestFailedUpdate(t *testing.T) {
+	logger := log.New()
+	_, db, h, txs := filledHistory(t, false, logger)
+	collateAndMergeHistory(t, db, h, txs)
+
+	before, err := os.ReadFile(h.manifest.path())
+	require.NoError(t, err)
+	// temp file can't be created: update fails, old manifest is kept
+	tmpPath := h.manifest.path() + ".tmp"
+	require.NoError(t, os.Mkdir(tmpPath, 0o755))
+	h.manifest.invalidate([]string{"hist.1000-1001.v"})
+	h.manifest.update(h.files, true, logger)
+	after, err := os.ReadFile(h.manifest.path())
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	_, err = os.Stat(tmpPath)
+	require.True(t, os.IsNotExist(err))
+
+	// next update writes manifest
+	h.manifest.update(h.files, true, logger)
+	m, err := h.manifest.read()
+	require.NoError(t, err)
+	require.Equal(t, []string{"hist.1000-1001.v"}, m.Invalid)
+	require.False(t, dir.FileExist(tmpPath))
+}
+
+func TestFilesManifestFileNames(t *testing.T) {
+	m := newFilesManifest(t.TempDir(), "logs.addrs", "ef", 16)
+	re := m.re()
+	for name, ok := range map[string]bool{
+		"logs.addrs.0-1.ef":  true,
+		"logsXaddrs.0-1.ef":  false,
+		"logs.addrs.0-1Xef":  false,
+		"logs.addrs.0-1.efi": false,
+	} {
+		_, _, parsed := m.parse(re, name)
+		require.Equal(t, ok, parsed, name)
+	}
+}
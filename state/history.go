@@ -63,7 +63,7 @@ type History struct {
 
 	historyValsTable        string // key1+key2+txnNum -> oldValue , stores values BEFORE change
 	compressWorkers         int
-	compressVals            bool
+	codec                   ValueCodec // codec of new files, also codec of files without header
 	integrityFileExtensions []string
 
 	// not large:
@@ -74,7 +74,14 @@ type History struct {
 	//   vals: key1+key2+txNum -> value (not DupSort)
 	largeValues bool // can't use DupSort optimization (aka. prefix-compression) if values size > 4kb
 
-	garbageFiles []*filesItem // files that exist on disk, but ignored on opening folder - because they are garbage
+	// withExistenceFilter - build .vif (and .kvf for Domain) filters for new files,
+	// existing filters are used by readers regardless of this flag
+	withExistenceFilter bool
+
+	garbageFiles  []*filesItem // files that exist on disk, but ignored on opening folder - because they are garbage
+	manifest      *filesManifest
+	retiredFrozen []*filesItem // frozen files removed by owner of datadir, see InvertedIndex.retiredFrozen
+	unwound       []string     // see InvertedIndex.unwound
 
 	wal    *historyWAL
 	logger log.Logger
@@ -82,19 +89,20 @@ type History struct {
 
 func NewHistory(dir, tmpdir string, aggregationStep uint64,
 	filenameBase, indexKeysTable, indexTable, historyValsTable string,
-	compressVals bool, integrityFileExtensions []string, largeValues bool, logger log.Logger) (*History, error) {
+	codec ValueCodec, integrityFileExtensions []string, largeValues bool, logger log.Logger) (*History, error) {
 	h := History{
 		files:                   btree2.NewBTreeGOptions[*filesItem](filesItemLess, btree2.Options{Degree: 128, NoLocks: false}),
 		historyValsTable:        historyValsTable,
-		compressVals:            compressVals,
+		codec:                   codec,
 		compressWorkers:         1,
 		integrityFileExtensions: integrityFileExtensions,
 		largeValues:             largeValues,
 		logger:                  logger,
+		manifest:                newFilesManifest(dir, filenameBase, "v", aggregationStep),
 	}
 	h.roFiles.Store(&[]ctxItem{})
 	var err error
-	h.InvertedIndex, err = NewInvertedIndex(dir, tmpdir, aggregationStep, filenameBase, indexKeysTable, indexTable, true, append(slices.Clone(h.integrityFileExtensions), "v"), logger)
+	h.InvertedIndex, err = NewInvertedIndex(dir, tmpdir, aggregationStep, filenameBase, indexKeysTable, indexTable, RawValues, true, append(slices.Clone(h.integrityFileExtensions), "v"), logger)
 	if err != nil {
 		return nil, fmt.Errorf("NewHistory: %s, %w", filenameBase, err)
 	}
@@ -107,6 +115,9 @@ func NewHistory(dir, tmpdir string, aggregationStep uint64,
 // If some file already open: noop.
 // If some file already open but not in provided list: close and remove from `files` field.
 func (h *History) OpenList(fNames []string) error {
+	if h.readOnly {
+		return h.openListReadOnly(fNames)
+	}
 	if err := h.InvertedIndex.OpenList(fNames); err != nil {
 		return err
 	}
@@ -127,7 +138,36 @@ func (h *History) OpenFolder() error {
 	if err != nil {
 		return err
 	}
-	return h.OpenList(files)
+	files, iiGarbage, err := h.InvertedIndex.manifest.filter(files, h.logger)
+	if err != nil {
+		return err
+	}
+	files, garbage, err := h.manifest.filter(files, h.logger)
+	if err != nil {
+		return err
+	}
+	if h.readOnly {
+		return h.openListReadOnly(filesReadyForReadOnly(files))
+	}
+	if err = h.OpenList(files); err != nil {
+		return err
+	}
+	h.InvertedIndex.garbageFiles = append(h.InvertedIndex.garbageFiles, iiGarbage...)
+	h.garbageFiles = append(h.garbageFiles, garbage...)
+	return nil
+}
+
+// CheckFiles - reports drift between files manifests, files on disk and open files
+func (h *History) CheckFiles(checksums bool) ([]FileDrift, error) {
+	drift, err := h.InvertedIndex.CheckFiles(checksums)
+	if err != nil {
+		return nil, err
+	}
+	hDrift, err := h.manifest.check(h.files, checksums)
+	if err != nil {
+		return nil, err
+	}
+	return append(drift, hDrift...), nil
 }
 
 // scanStateFiles
@@ -206,20 +246,29 @@ func (h *History) openFiles() error {
 	invalidFileItems := make([]*filesItem, 0)
 	h.files.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.decompressor != nil {
-				continue
-			}
 			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
-			datPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, fromStep, toStep))
-			if !dir.FileExist(datPath) {
-				invalidFileItems = append(invalidFileItems, item)
-				continue
+			if item.decompressor == nil {
+				datPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.v", h.filenameBase, fromStep, toStep))
+				if !dir.FileExist(datPath) {
+					invalidFileItems = append(invalidFileItems, item)
+					continue
+				}
+				if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+					h.logger.Debug("Hisrory.openFiles: %w, %s", err, datPath)
+					return false
+				}
+				item.readOnly = h.readOnly
+				if item.codec, err = fileValueCodec(item.decompressor); err != nil {
+					return false
+				}
 			}
-			if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-				h.logger.Debug("Hisrory.openFiles: %w, %s", err, datPath)
-				return false
+			if filterPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vif", h.filenameBase, fromStep, toStep)); item.existence == nil && dir.FileExist(filterPath) {
+				if item.existence, err = OpenExistenceFilter(filterPath); err != nil {
+					return false
+				}
 			}
 
+			// index may be missed before, then built by BuildMissedIndices
 			if item.index != nil {
 				continue
 			}
@@ -245,6 +294,21 @@ func (h *History) openFiles() error {
 	return nil
 }
 
+// openListReadOnly - read-only analog of OpenList: never closes files used by contexts and never deletes garbage
+func (h *History) openListReadOnly(fNames []string) error {
+	if err := h.InvertedIndex.openListReadOnly(fNames); err != nil {
+		return err
+	}
+	retired := retireWhatNotInList(h.files, fNames)
+	h.reCalcRoFiles()
+	_ = h.scanStateFiles(fNames) // garbage belongs to owner of datadir
+	if err := h.openFiles(); err != nil {
+		return fmt.Errorf("History.openListReadOnly: %s, %w", h.filenameBase, err)
+	}
+	h.retiredFrozen = closeRetired(retired, h.retiredFrozen)
+	return nil
+}
+
 func (h *History) closeWhatNotInList(fNames []string) {
 	var toDelete []*filesItem
 	h.files.Walk(func(items []*filesItem) bool {
@@ -268,6 +332,10 @@ func (h *History) closeWhatNotInList(fNames []string) {
 			item.index.Close()
 			item.index = nil
 		}
+		if item.existence != nil {
+			item.existence.Close()
+			item.existence = nil
+		}
 		h.files.Delete(item)
 	}
 }
@@ -275,6 +343,10 @@ func (h *History) closeWhatNotInList(fNames []string) {
 func (h *History) Close() {
 	h.InvertedIndex.Close()
 	h.closeWhatNotInList([]string{})
+	for _, item := range h.retiredFrozen {
+		item.closeFilesAndRemove()
+	}
+	h.retiredFrozen = nil
 	h.reCalcRoFiles()
 }
 
@@ -304,6 +376,22 @@ func (h *History) missedIdxFiles() (l []*filesItem) {
 	return l
 }
 
+func (h *History) missedFilterFiles() (l []*filesItem) {
+	if !h.withExistenceFilter {
+		return nil
+	}
+	h.files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+			if !dir.FileExist(filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vif", h.filenameBase, fromStep, toStep))) {
+				l = append(l, item)
+			}
+		}
+		return true
+	})
+	return l
+}
+
 // BuildMissedIndices - produce .efi/.vi/.kvi from .ef/.v/.kv
 func (hc *HistoryContext) BuildOptionalMissedIndices(ctx context.Context) (err error) {
 	return hc.h.localityIndex.BuildMissedIndices(ctx, hc.ic)
@@ -325,11 +413,11 @@ func (h *History) buildVi(ctx context.Context, item *filesItem, p *background.Pr
 	p.Name.Store(&fName)
 	p.Total.Store(uint64(iiItem.decompressor.Count()) * 2)
 
-	count, err := iterateForVi(item, iiItem, p, h.compressVals, func(v []byte) error { return nil })
+	count, err := iterateForVi(item, iiItem, p, func(v []byte) error { return nil })
 	if err != nil {
 		return err
 	}
-	return buildVi(ctx, item, iiItem, idxPath, h.tmpdir, count, p, h.compressVals, h.logger)
+	return buildVi(ctx, item, iiItem, idxPath, h.tmpdir, count, p, h.logger)
 }
 
 func (h *History) BuildMissedIndices(ctx context.Context, g *errgroup.Group, ps *background.ProgressSet) {
@@ -344,9 +432,26 @@ func (h *History) BuildMissedIndices(ctx context.Context, g *errgroup.Group, ps
 			return h.buildVi(ctx, item, p)
 		})
 	}
+	for _, item := range h.missedFilterFiles() {
+		item := item
+		g.Go(func() error {
+			iiItem, ok := h.InvertedIndex.files.Get(&filesItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum})
+			if !ok {
+				return nil
+			}
+			fromStep, toStep := item.startTxNum/h.aggregationStep, item.endTxNum/h.aggregationStep
+			filterPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vif", h.filenameBase, fromStep, toStep))
+			filter, err := buildExistenceFilterThenOpen(ctx, iiItem.decompressor, iiItem.codec, filterPath, h.noFsync)
+			if err != nil {
+				return fmt.Errorf("build %s: %w", filepath.Base(filterPath), err)
+			}
+			filter.Close()
+			return nil
+		})
+	}
 }
 
-func iterateForVi(historyItem, iiItem *filesItem, p *background.Progress, compressVals bool, f func(v []byte) error) (count int, err error) {
+func iterateForVi(historyItem, iiItem *filesItem, p *background.Progress, f func(v []byte) error) (count int, err error) {
 	var cp CursorHeap
 	heap.Init(&cp)
 	g := iiItem.decompressor.MakeGetter()
@@ -354,7 +459,10 @@ func iterateForVi(historyItem, iiItem *filesItem, p *background.Progress, compre
 	if g.HasNext() {
 		g2 := historyItem.decompressor.MakeGetter()
 		key, _ := g.NextUncompressed()
-		val, _ := g.NextUncompressed()
+		val, err := nextValue(g, iiItem.codec)
+		if err != nil {
+			return 0, err
+		}
 		heap.Push(&cp, &CursorItem{
 			t:        FILE_CURSOR,
 			dg:       g,
@@ -380,10 +488,8 @@ func iterateForVi(historyItem, iiItem *filesItem, p *background.Progress, compre
 			ci1 := cp[0]
 			keysCount := eliasfano32.Count(ci1.val)
 			for i := uint64(0); i < keysCount; i++ {
-				if compressVals {
-					valBuf, _ = ci1.dg2.Next(valBuf[:0])
-				} else {
-					valBuf, _ = ci1.dg2.NextUncompressed()
+				if valBuf, err = nextValue(ci1.dg2, historyItem.codec); err != nil {
+					return count, err
 				}
 				if err = f(valBuf); err != nil {
 					return count, err
@@ -392,7 +498,9 @@ func iterateForVi(historyItem, iiItem *filesItem, p *background.Progress, compre
 			count += int(keysCount)
 			if ci1.dg.HasNext() {
 				ci1.key, _ = ci1.dg.NextUncompressed()
-				ci1.val, _ = ci1.dg.NextUncompressed()
+				if ci1.val, err = nextValue(ci1.dg, iiItem.codec); err != nil {
+					return count, err
+				}
 				heap.Fix(&cp, 0)
 			} else {
 				heap.Remove(&cp, 0)
@@ -404,7 +512,7 @@ func iterateForVi(historyItem, iiItem *filesItem, p *background.Progress, compre
 	return count, nil
 }
 
-func buildVi(ctx context.Context, historyItem, iiItem *filesItem, historyIdxPath, tmpdir string, count int, p *background.Progress, compressVals bool, logger log.Logger) error {
+func buildVi(ctx context.Context, historyItem, iiItem *filesItem, historyIdxPath, tmpdir string, count int, p *background.Progress, logger log.Logger) error {
 	rs, err := recsplit.NewRecSplit(recsplit.RecSplitArgs{
 		KeyCount:    count,
 		Enums:       false,
@@ -441,7 +549,9 @@ func buildVi(ctx context.Context, historyItem, iiItem *filesItem, historyIdxPath
 			}
 
 			keyBuf, _ = g.NextUncompressed()
-			valBuf, _ = g.NextUncompressed()
+			if valBuf, err = nextValue(g, iiItem.codec); err != nil {
+				return err
+			}
 			ef, _ := eliasfano32.ReadEliasFano(valBuf)
 			efIt := ef.Iterator()
 			for efIt.HasNext() {
@@ -451,11 +561,7 @@ func buildVi(ctx context.Context, historyItem, iiItem *filesItem, historyIdxPath
 				if err = rs.AddKey(historyKey, valOffset); err != nil {
 					return err
 				}
-				if compressVals {
-					valOffset, _ = g2.Skip()
-				} else {
-					valOffset, _ = g2.SkipUncompressed()
-				}
+				valOffset = skipValue(g2, historyItem.codec)
 			}
 
 			p.Processed.Add(1)
@@ -652,6 +758,52 @@ func (c HistoryCollation) Close() {
 	}
 }
 
+// collateValues - calls `f` for history values of `keys` at txNums of their bitmaps, in order of .v file.
+// `val` is valid only until `f` returns
+func (h *History) collateValues(roTx kv.Tx, keys []string, indexBitmaps map[string]*roaring64.Bitmap, f func(val []byte) error) error {
+	var cd kv.CursorDupSort
+	var err error
+	if !h.largeValues {
+		if cd, err = roTx.CursorDupSort(h.historyValsTable); err != nil {
+			return err
+		}
+		defer cd.Close()
+	}
+	keyBuf := make([]byte, 256)
+	for _, key := range keys {
+		bitmap := indexBitmaps[key]
+		it := bitmap.Iterator()
+		keyBuf = append(append(keyBuf[:0], key...), make([]byte, 8)...) // txNum is set below
+		for it.HasNext() {
+			txNum := it.Next()
+			binary.BigEndian.PutUint64(keyBuf[len(key):], txNum)
+			var val []byte
+			//TODO: use cursor range
+			if h.largeValues {
+				if val, err = roTx.GetOne(h.historyValsTable, keyBuf); err != nil {
+					return fmt.Errorf("get %s history val [%x]: %w", h.filenameBase, key, err)
+				}
+				if len(val) == 0 {
+					val = nil
+				}
+			} else {
+				if val, err = cd.SeekBothRange(keyBuf[:len(key)], keyBuf[len(key):]); err != nil {
+					return err
+				}
+				if val != nil && binary.BigEndian.Uint64(val) == txNum {
+					val = val[8:]
+				} else {
+					val = nil
+				}
+			}
+			if err = f(val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (h *History) collate(step, txFrom, txTo uint64, roTx kv.Tx) (HistoryCollation, error) {
 	var historyComp *compress.Compressor
 	var err error
@@ -667,6 +819,7 @@ func (h *History) collate(step, txFrom, txTo uint64, roTx kv.Tx) (HistoryCollati
 	if historyComp, err = compress.NewCompressor(context.Background(), "collate history", historyPath, h.tmpdir, compress.MinPatternScore, h.compressWorkers, log.LvlTrace, h.logger); err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s history compressor: %w", h.filenameBase, err)
 	}
+	setValueCodec(historyComp, h.codec, nil)
 	keysCursor, err := roTx.CursorDupSort(h.indexKeysTable)
 	if err != nil {
 		return HistoryCollation{}, fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
@@ -698,59 +851,15 @@ func (h *History) collate(step, txFrom, txTo uint64, roTx kv.Tx) (HistoryCollati
 	}
 	slices.Sort(keys)
 	historyCount := 0
-	keyBuf := make([]byte, 256)
-
-	var c kv.Cursor
-	var cd kv.CursorDupSort
-	if h.largeValues {
-		c, err = roTx.Cursor(h.historyValsTable)
-		if err != nil {
-			return HistoryCollation{}, err
-		}
-		defer c.Close()
-	} else {
-		cd, err = roTx.CursorDupSort(h.historyValsTable)
-		if err != nil {
-			return HistoryCollation{}, err
-		}
-		defer cd.Close()
-	}
-	for _, key := range keys {
-		bitmap := indexBitmaps[key]
-		it := bitmap.Iterator()
-		copy(keyBuf, key)
-		keyBuf = keyBuf[:len(key)+8]
-		for it.HasNext() {
-			txNum := it.Next()
-			binary.BigEndian.PutUint64(keyBuf[len(key):], txNum)
-			//TODO: use cursor range
-			if h.largeValues {
-				val, err := roTx.GetOne(h.historyValsTable, keyBuf)
-				if err != nil {
-					return HistoryCollation{}, fmt.Errorf("get %s history val [%x]: %w", h.filenameBase, k, err)
-				}
-				if len(val) == 0 {
-					val = nil
-				}
-				if err = historyComp.AddUncompressedWord(val); err != nil {
-					return HistoryCollation{}, fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, k, val, err)
-				}
-			} else {
-				val, err := cd.SeekBothRange(keyBuf[:len(key)], keyBuf[len(key):])
-				if err != nil {
-					return HistoryCollation{}, err
-				}
-				if val != nil && binary.BigEndian.Uint64(val) == txNum {
-					val = val[8:]
-				} else {
-					val = nil
-				}
-				if err = historyComp.AddUncompressedWord(val); err != nil {
-					return HistoryCollation{}, fmt.Errorf("add %s history val [%x]=>[%x]: %w", h.filenameBase, k, val, err)
-				}
-			}
-			historyCount++
+	var valBuf []byte
+	if err = h.collateValues(roTx, keys, indexBitmaps, func(val []byte) (err error) {
+		historyCount++
+		if valBuf, err = addCollatedValue(historyComp, h.codec, val, valBuf); err != nil {
+			return fmt.Errorf("add %s history val [%x]: %w", h.filenameBase, val, err)
 		}
+		return nil
+	}); err != nil {
+		return HistoryCollation{}, err
 	}
 	closeComp = false
 	return HistoryCollation{
@@ -766,6 +875,7 @@ type HistoryFiles struct {
 	historyIdx      *recsplit.Index
 	efHistoryDecomp *compress.Decompressor
 	efHistoryIdx    *recsplit.Index
+	historyFilter   *ExistenceFilter
 }
 
 func (sf HistoryFiles) Close() {
@@ -781,6 +891,7 @@ func (sf HistoryFiles) Close() {
 	if sf.efHistoryIdx != nil {
 		sf.efHistoryIdx.Close()
 	}
+	sf.historyFilter.Close()
 }
 func (h *History) reCalcRoFiles() {
 	roFiles := ctxFiles(h.files)
@@ -851,6 +962,9 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 		if historyDecomp, err = compress.NewDecompressor(collation.historyPath); err != nil {
 			return HistoryFiles{}, fmt.Errorf("open %s history decompressor: %w", h.filenameBase, err)
 		}
+		if err = h.manifest.prepare(historyDecomp); err != nil {
+			return HistoryFiles{}, fmt.Errorf("checksum %s history: %w", h.filenameBase, err)
+		}
 
 		// Build history ef
 		efHistoryFileName := fmt.Sprintf("%s.%d-%d.ef", h.filenameBase, step, step+1)
@@ -865,7 +979,8 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 		if h.noFsync {
 			efHistoryComp.DisableFsync()
 		}
-		var buf []byte
+		setValueCodec(efHistoryComp, h.InvertedIndex.codec, nil)
+		var buf, encBuf []byte
 		for _, key := range keys {
 			if err = efHistoryComp.AddUncompressedWord([]byte(key)); err != nil {
 				return HistoryFiles{}, fmt.Errorf("add %s ef history key [%x]: %w", h.InvertedIndex.filenameBase, key, err)
@@ -879,7 +994,7 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 			}
 			ef.Build()
 			buf = ef.AppendBytes(buf[:0])
-			if err = efHistoryComp.AddUncompressedWord(buf); err != nil {
+			if encBuf, err = addCollatedValue(efHistoryComp, h.InvertedIndex.codec, buf, encBuf); err != nil {
 				return HistoryFiles{}, fmt.Errorf("add %s ef history val: %w", h.filenameBase, err)
 			}
 		}
@@ -895,6 +1010,9 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 	if efHistoryDecomp, err = compress.NewDecompressor(efHistoryPath); err != nil {
 		return HistoryFiles{}, fmt.Errorf("open %s ef history decompressor: %w", h.filenameBase, err)
 	}
+	if err = h.InvertedIndex.manifest.prepare(efHistoryDecomp); err != nil {
+		return HistoryFiles{}, fmt.Errorf("checksum %s ef history: %w", h.filenameBase, err)
+	}
 	efHistoryIdxFileName := fmt.Sprintf("%s.%d-%d.efi", h.filenameBase, step, step+1)
 	efHistoryIdxPath := filepath.Join(h.dir, efHistoryIdxFileName)
 	p := ps.AddNew(efHistoryIdxFileName, uint64(len(keys)*2))
@@ -952,12 +1070,21 @@ func (h *History) buildFiles(ctx context.Context, step uint64, collation History
 	if historyIdx, err = recsplit.OpenIndex(historyIdxPath); err != nil {
 		return HistoryFiles{}, fmt.Errorf("open idx: %w", err)
 	}
+	var historyFilter *ExistenceFilter
+	if h.withExistenceFilter {
+		filterPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vif", h.filenameBase, step, step+1))
+		if historyFilter, err = buildExistenceFilterThenOpen(ctx, efHistoryDecomp, h.InvertedIndex.codec, filterPath, h.noFsync); err != nil {
+			historyIdx.Close()
+			return HistoryFiles{}, fmt.Errorf("build %s history filter: %w", h.filenameBase, err)
+		}
+	}
 	closeComp = false
 	return HistoryFiles{
 		historyDecomp:   historyDecomp,
 		historyIdx:      historyIdx,
 		efHistoryDecomp: efHistoryDecomp,
 		efHistoryIdx:    efHistoryIdx,
+		historyFilter:   historyFilter,
 	}, nil
 }
 
@@ -969,8 +1096,11 @@ func (h *History) integrateFiles(sf HistoryFiles, txNumFrom, txNumTo uint64) {
 
 	fi := newFilesItem(txNumFrom, txNumTo, h.aggregationStep)
 	fi.decompressor = sf.historyDecomp
+	fi.codec = h.codec
 	fi.index = sf.historyIdx
+	fi.existence = sf.historyFilter
 	h.files.Set(fi)
+	h.manifest.update(h.files, h.noFsync, h.logger)
 
 	h.reCalcRoFiles()
 }
@@ -1049,15 +1179,24 @@ func (h *History) isEmpty(tx kv.Tx) (bool, error) {
 	return k == nil && k2 == nil, nil
 }
 
-func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+// [txFrom; txTo)
+func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) (stat *PruneStats, err error) {
+	stat = &PruneStats{}
+	defer func(t time.Time) { stat.Took = time.Since(t) }(time.Now())
+	requestedFrom := txFrom
+	progressKey := pruneProgressKey(h.filenameBase, "v")
+	if txFrom, err = txPruneProgress(h.tx, h.pruneProgressTable, progressKey, txFrom); err != nil {
+		return stat, err
+	}
+
 	historyKeysCursorForDeletes, err := h.tx.RwCursorDupSort(h.indexKeysTable)
 	if err != nil {
-		return fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
+		return stat, fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
 	}
 	defer historyKeysCursorForDeletes.Close()
 	historyKeysCursor, err := h.tx.RwCursorDupSort(h.indexKeysTable)
 	if err != nil {
-		return fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
+		return stat, fmt.Errorf("create %s history cursor: %w", h.filenameBase, err)
 	}
 	defer historyKeysCursor.Close()
 	var txKey [8]byte
@@ -1068,13 +1207,13 @@ func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEver
 	if h.largeValues {
 		valsC, err = h.tx.RwCursor(h.historyValsTable)
 		if err != nil {
-			return err
+			return stat, err
 		}
 		defer valsC.Close()
 	} else {
 		valsCDup, err = h.tx.RwCursorDupSort(h.historyValsTable)
 		if err != nil {
-			return err
+			return stat, err
 		}
 		defer valsCDup.Close()
 	}
@@ -1084,37 +1223,43 @@ func (h *History) prune(ctx context.Context, txFrom, txTo, limit uint64, logEver
 			break
 		}
 		if limit == 0 {
-			return nil
+			// rows of `txNum` may be partially deleted: continue from it
+			return stat, saveTxPruneProgress(h.tx, h.pruneProgressTable, progressKey, requestedFrom, txNum)
 		}
 		limit--
 
 		if h.largeValues {
 			seek := append(common.Copy(v), k...)
 			if err := valsC.Delete(seek); err != nil {
-				return err
+				return stat, err
 			}
 		} else {
 			vv, err := valsCDup.SeekBothRange(v, k)
 			if err != nil {
-				return err
+				return stat, err
 			}
 			if binary.BigEndian.Uint64(vv) != txNum {
 				continue
 			}
 			if err = valsCDup.DeleteCurrent(); err != nil {
-				return err
+				return stat, err
 			}
 		}
 
 		// This DeleteCurrent needs to the last in the loop iteration, because it invalidates k and v
 		if _, _, err = historyKeysCursorForDeletes.SeekBothExact(k, v); err != nil {
-			return err
+			return stat, err
 		}
 		if err = historyKeysCursorForDeletes.DeleteCurrent(); err != nil {
-			return err
+			return stat, err
 		}
+		stat.RowsDeleted += 2
 	}
-	return nil
+	if err != nil {
+		return stat, fmt.Errorf("iterate over %s history keys: %w", h.filenameBase, err)
+	}
+	stat.RangesDone++
+	return stat, saveTxPruneProgress(h.tx, h.pruneProgressTable, progressKey, requestedFrom, txTo)
 }
 
 type HistoryContext struct {
@@ -1124,6 +1269,7 @@ type HistoryContext struct {
 	files   []ctxItem // have no garbage (canDelete=true, overlaps, etc...)
 	getters []*compress.Getter
 	readers []*recsplit.IndexReader
+	filters []*ExistenceFilter // aligned with ic.files, see existenceFilter
 
 	trace bool
 }
@@ -1199,6 +1345,22 @@ func (hc *HistoryContext) getFile(from, to uint64) (it ctxItem, ok bool) {
 	return it, false
 }
 
+// existenceFilter - .vif of history file with same range as i-th .ef file (keys are same), nil if there is no filter
+func (hc *HistoryContext) existenceFilter(i int) *ExistenceFilter {
+	if hc.filters == nil {
+		hc.filters = make([]*ExistenceFilter, len(hc.ic.files))
+		for j, item := range hc.ic.files {
+			if hItem, ok := hc.getFile(item.startTxNum, item.endTxNum); ok {
+				hc.filters[j] = hItem.src.existence
+			}
+		}
+	}
+	return hc.filters[i]
+}
+
+// FilesWithKey - names of .ef files which have given key, see InvertedIndexContext.FilesWithKey
+func (hc *HistoryContext) FilesWithKey(key []byte) []string { return hc.ic.FilesWithKey(key) }
+
 func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, error) {
 	exactStep1, exactStep2, lastIndexedTxNum, foundExactShard1, foundExactShard2 := hc.h.localityIndex.lookupIdxFiles(hc.ic.loc, key, txNum)
 
@@ -1206,8 +1368,15 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 	var foundTxNum uint64
 	var foundEndTxNum uint64
 	var foundStartTxNum uint64
-	var found bool
+	var found, pruned bool
+	var efErr error
+	keyHash := newExistenceHash(key)
 	var findInFile = func(item ctxItem) bool {
+		filter := hc.existenceFilter(item.i)
+		if filter != nil && !filter.contains(keyHash) {
+			mxExistenceFilterSkips.Inc()
+			return true
+		}
 		reader := hc.ic.statelessIdxReader(item.i)
 		if reader.Empty() {
 			return true
@@ -1218,12 +1387,19 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		k, _ := g.NextUncompressed()
 
 		if !bytes.Equal(k, key) {
+			if filter != nil {
+				mxExistenceFilterFalsePos.Inc()
+			}
 			//if bytes.Equal(key, hex.MustDecodeString("009ba32869045058a3f05d6f3dd2abb967e338f6")) {
 			//	fmt.Printf("not in this shard: %x, %d, %d-%d\n", k, txNum, item.startTxNum/hc.h.aggregationStep, item.endTxNum/hc.h.aggregationStep)
 			//}
 			return true
 		}
-		eliasVal, _ := g.NextUncompressed()
+		eliasVal, err := nextValue(g, item.src.codec)
+		if err != nil {
+			efErr = fmt.Errorf("%s: %w", item.src.decompressor.FileName(), err)
+			return false
+		}
 		ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 		n, ok := ef.Search(txNum)
 		if hc.trace {
@@ -1231,6 +1407,10 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 			n3, _ := ef.Search(n - 1)
 			fmt.Printf("hist: files: %s %d<-%d->%d->%d, %x\n", hc.h.filenameBase, n3, txNum, n, n2, key)
 		}
+		if ok && item.src.isFence(ef, n, offset) {
+			pruned = true
+			return false
+		}
 		if ok {
 			foundTxNum = n
 			foundEndTxNum = item.endTxNum
@@ -1259,7 +1439,7 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		//	findInFile(exactShard1)
 		//}
 	}
-	if !found && foundExactShard2 {
+	if !found && efErr == nil && foundExactShard2 {
 		from, to := exactStep2*hc.h.aggregationStep, (exactStep2+StepsInBiggestFile)*hc.h.aggregationStep
 		item, ok := hc.ic.getFile(from, to)
 		if ok {
@@ -1275,7 +1455,7 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 	// if there is no LocaliyIndex available
 	// -- LocaliyIndex opimization End --
 
-	if !found {
+	if !found && !pruned && efErr == nil {
 		for _, item := range hc.ic.files {
 			if item.endTxNum <= lastIndexedTxNum {
 				continue
@@ -1286,6 +1466,21 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		}
 		//hc.invIndexFiles.AscendGreaterOrEqual(ctxItem{startTxNum: lastIndexedTxNum, endTxNum: lastIndexedTxNum}, findInFile)
 	}
+	if efErr != nil {
+		return nil, false, efErr
+	}
+
+	// version may be dropped by retention policy: in file where it was found (fence) or in any file before it (KeepSince)
+	if !pruned {
+		pruneCheckTo := uint64(math.MaxUint64)
+		if found {
+			pruneCheckTo = foundTxNum
+		}
+		pruned = hc.ic.prunedBetween(txNum, pruneCheckTo)
+	}
+	if pruned {
+		return nil, false, ErrHistoryPruned
+	}
 
 	if found {
 		historyItem, ok := hc.getFile(foundStartTxNum, foundEndTxNum)
@@ -1299,11 +1494,10 @@ func (hc *HistoryContext) GetNoState(key []byte, txNum uint64) ([]byte, bool, er
 		//fmt.Printf("offset = %d, txKey=[%x], key=[%x]\n", offset, txKey[:], key)
 		g := hc.statelessGetter(historyItem.i)
 		g.Reset(offset)
-		if hc.h.compressVals {
-			v, _ := g.Next(nil)
-			return v, true, nil
+		v, err := nextValue(g, historyItem.src.codec)
+		if err != nil {
+			return nil, false, err
 		}
-		v, _ := g.NextUncompressed()
 		return v, true, nil
 	}
 	return nil, false, nil
@@ -1322,7 +1516,10 @@ func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint6
 		return nil, false, txNum
 	}
 	//fmt.Printf("Found key=%x\n", k)
-	eliasVal, _ := g.NextUncompressed()
+	eliasVal, err := nextValue(g, hs.indexItem.codec)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", hs.indexItem.decompressor.FileName(), err))
+	}
 	ef, _ := eliasfano32.ReadEliasFano(eliasVal)
 	n, ok := ef.Search(txNum)
 	if !ok {
@@ -1334,11 +1531,10 @@ func (hs *HistoryStep) GetNoState(key []byte, txNum uint64) ([]byte, bool, uint6
 	//fmt.Printf("offset = %d, txKey=[%x], key=[%x]\n", offset, txKey[:], key)
 	g = hs.historyFile.getter
 	g.Reset(offset)
-	if hs.compressVals {
-		v, _ := g.Next(nil)
-		return v, true, txNum
+	v, err := nextValue(g, hs.historyItem.codec)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", hs.historyItem.decompressor.FileName(), err))
 	}
-	v, _ := g.NextUncompressed()
 	return v, true, txNum
 }
 
@@ -1354,7 +1550,10 @@ func (hs *HistoryStep) MaxTxNum(key []byte) (bool, uint64) {
 		return false, 0
 	}
 	//fmt.Printf("Found key=%x\n", k)
-	eliasVal, _ := g.NextUncompressed()
+	eliasVal, err := nextValue(g, hs.indexItem.codec)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", hs.indexItem.decompressor.FileName(), err))
+	}
 	return true, eliasfano32.Max(eliasVal)
 }
 
@@ -1419,9 +1618,8 @@ func (hc *HistoryContext) WalkAsOf(startTxNum uint64, from, to []byte, roTx kv.T
 	hi := &StateAsOfIterF{
 		from: from, to: to, limit: limit,
 
-		hc:           hc,
-		compressVals: hc.h.compressVals,
-		startTxNum:   startTxNum,
+		hc:         hc,
+		startTxNum: startTxNum,
 	}
 	for _, item := range hc.ic.files {
 		if item.endTxNum <= startTxNum {
@@ -1432,7 +1630,7 @@ func (hc *HistoryContext) WalkAsOf(startTxNum uint64, from, to []byte, roTx kv.T
 		g.Reset(0)
 		if g.HasNext() {
 			key, offset := g.NextUncompressed()
-			heap.Push(&hi.h, &ReconItem{g: g, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
+			heap.Push(&hi.h, &ReconItem{g: g, codec: item.src.codec, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
 		}
 	}
 	binary.BigEndian.PutUint64(hi.startTxKey[:], startTxNum)
@@ -1464,11 +1662,10 @@ type StateAsOfIterF struct {
 	nextVal  []byte
 	nextKey  []byte
 
-	h            ReconHeap
-	startTxNum   uint64
-	startTxKey   [8]byte
-	txnKey       [8]byte
-	compressVals bool
+	h          ReconHeap
+	startTxNum uint64
+	startTxKey [8]byte
+	txnKey     [8]byte
 
 	k, v, kBackup, vBackup []byte
 }
@@ -1480,18 +1677,12 @@ func (hi *StateAsOfIterF) advanceInFiles() error {
 	for hi.h.Len() > 0 {
 		top := heap.Pop(&hi.h).(*ReconItem)
 		key := top.key
-		var idxVal []byte
-		if hi.compressVals {
-			idxVal, _ = top.g.Next(nil)
-		} else {
-			idxVal, _ = top.g.NextUncompressed()
+		idxVal, err := nextValue(top.g, top.codec)
+		if err != nil {
+			return err
 		}
 		if top.g.HasNext() {
-			if hi.compressVals {
-				top.key, _ = top.g.Next(nil)
-			} else {
-				top.key, _ = top.g.NextUncompressed()
-			}
+			top.key, _ = top.g.NextUncompressed()
 			if hi.to == nil || bytes.Compare(top.key, hi.to) < 0 {
 				heap.Push(&hi.h, top)
 			}
@@ -1520,10 +1711,8 @@ func (hi *StateAsOfIterF) advanceInFiles() error {
 		offset := reader.Lookup2(hi.txnKey[:], hi.nextKey)
 		g := hi.hc.statelessGetter(historyItem.i)
 		g.Reset(offset)
-		if hi.compressVals {
-			hi.nextVal, _ = g.Next(nil)
-		} else {
-			hi.nextVal, _ = g.NextUncompressed()
+		if hi.nextVal, err = nextValue(g, historyItem.src.codec); err != nil {
+			return err
 		}
 		return nil
 	}
@@ -1688,7 +1877,7 @@ func (hi *StateAsOfIterDB) Next() ([]byte, []byte, error) {
 	return hi.kBackup, hi.vBackup, nil
 }
 
-func (hc *HistoryContext) iterateChangedFrozen(fromTxNum, toTxNum int, asc order.By, limit int) (iter.KV, error) {
+func (hc *HistoryContext) iterateChangedFrozen(fromKey []byte, fromTxNum, toTxNum int, asc order.By, limit int) (iter.KV, error) {
 	if asc == false {
 		panic("not supported yet")
 	}
@@ -1701,16 +1890,15 @@ func (hc *HistoryContext) iterateChangedFrozen(fromTxNum, toTxNum int, asc order
 	}
 
 	hi := &HistoryChangesIterFiles{
-		hc:           hc,
-		compressVals: hc.h.compressVals,
-		startTxNum:   cmp.Max(0, uint64(fromTxNum)),
-		endTxNum:     toTxNum,
-		limit:        limit,
+		hc:         hc,
+		startTxNum: cmp.Max(0, uint64(fromTxNum)),
+		endTxNum:   toTxNum,
+		limit:      limit,
 	}
 	if fromTxNum >= 0 {
 		binary.BigEndian.PutUint64(hi.startTxKey[:], uint64(fromTxNum))
 	}
-	for _, item := range hc.ic.files {
+	for i, item := range hc.ic.files {
 		if fromTxNum >= 0 && item.endTxNum <= uint64(fromTxNum) {
 			continue
 		}
@@ -1719,9 +1907,15 @@ func (hc *HistoryContext) iterateChangedFrozen(fromTxNum, toTxNum int, asc order
 		}
 		g := item.src.decompressor.MakeGetter()
 		g.Reset(0)
+		if fromKey != nil {
+			if key, offset := seekUncompressedKey(g, item.src.codec, hc.ic.statelessIdxReader(i), fromKey); key != nil {
+				heap.Push(&hi.h, &ReconItem{g: g, codec: item.src.codec, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
+			}
+			continue
+		}
 		if g.HasNext() {
 			key, offset := g.NextUncompressed()
-			heap.Push(&hi.h, &ReconItem{g: g, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
+			heap.Push(&hi.h, &ReconItem{g: g, codec: item.src.codec, key: key, startTxNum: item.startTxNum, endTxNum: item.endTxNum, txNum: item.endTxNum, startOffset: offset, lastOffset: offset})
 		}
 	}
 	if err := hi.advance(); err != nil {
@@ -1730,7 +1924,32 @@ func (hc *HistoryContext) iterateChangedFrozen(fromTxNum, toTxNum int, asc order
 	return hi, nil
 }
 
-func (hc *HistoryContext) iterateChangedRecent(fromTxNum, toTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.KV, error) {
+// seekUncompressedKey - positions `g` at value of first key >= fromKey in file of uncompressed keys (values are written by `c`), returns the key
+// (nil if there is no such key). Keys of file have no ordered index: recsplit finds key if file has it, else the rest
+// of keys are compared one by one without reading of values.
+func seekUncompressedKey(g *compress.Getter, c ValueCodec, reader *recsplit.IndexReader, fromKey []byte) (key []byte, offset uint64) {
+	if !reader.Empty() {
+		g.Reset(reader.Lookup(fromKey))
+		key, offset = g.NextUncompressed()
+		switch res := bytes.Compare(key, fromKey); {
+		case res == 0:
+			return key, offset
+		case res < 0: // keys are sorted: first key >= fromKey is after found one
+			skipValue(g, c)
+		default:
+			g.Reset(0)
+		}
+	}
+	for g.HasNext() {
+		if key, offset = g.NextUncompressed(); bytes.Compare(key, fromKey) >= 0 {
+			return key, offset
+		}
+		skipValue(g, c)
+	}
+	return nil, 0
+}
+
+func (hc *HistoryContext) iterateChangedRecent(fromKey []byte, fromTxNum, toTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.KV, error) {
 	if asc == order.Desc {
 		panic("not supported yet")
 	}
@@ -1744,6 +1963,7 @@ func (hc *HistoryContext) iterateChangedRecent(fromTxNum, toTxNum int, asc order
 		largeValues: hc.h.largeValues,
 		valsTable:   hc.h.historyValsTable,
 		limit:       limit,
+		fromKey:     fromKey,
 	}
 	if fromTxNum >= 0 {
 		binary.BigEndian.PutUint64(dbi.startTxKey[:], uint64(fromTxNum))
@@ -1755,14 +1975,19 @@ func (hc *HistoryContext) iterateChangedRecent(fromTxNum, toTxNum int, asc order
 }
 
 func (hc *HistoryContext) HistoryRange(fromTxNum, toTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.KV, error) {
+	return hc.historyRange(nil, fromTxNum, toTxNum, asc, limit, roTx)
+}
+
+// historyRange - HistoryRange of keys >= fromKey (nil - all keys)
+func (hc *HistoryContext) historyRange(fromKey []byte, fromTxNum, toTxNum int, asc order.By, limit int, roTx kv.Tx) (iter.KV, error) {
 	if asc == order.Desc {
 		panic("not supported yet")
 	}
-	itOnFiles, err := hc.iterateChangedFrozen(fromTxNum, toTxNum, asc, limit)
+	itOnFiles, err := hc.iterateChangedFrozen(fromKey, fromTxNum, toTxNum, asc, limit)
 	if err != nil {
 		return nil, err
 	}
-	itOnDB, err := hc.iterateChangedRecent(fromTxNum, toTxNum, asc, limit, roTx)
+	itOnDB, err := hc.iterateChangedRecent(fromKey, fromTxNum, toTxNum, asc, limit, roTx)
 	if err != nil {
 		return nil, err
 	}
@@ -1771,15 +1996,14 @@ func (hc *HistoryContext) HistoryRange(fromTxNum, toTxNum int, asc order.By, lim
 }
 
 type HistoryChangesIterFiles struct {
-	hc           *HistoryContext
-	nextVal      []byte
-	nextKey      []byte
-	h            ReconHeap
-	startTxNum   uint64
-	endTxNum     int
-	startTxKey   [8]byte
-	txnKey       [8]byte
-	compressVals bool
+	hc         *HistoryContext
+	nextVal    []byte
+	nextKey    []byte
+	h          ReconHeap
+	startTxNum uint64
+	endTxNum   int
+	startTxKey [8]byte
+	txnKey     [8]byte
 
 	k, v, kBackup, vBackup []byte
 	err                    error
@@ -1793,18 +2017,12 @@ func (hi *HistoryChangesIterFiles) advance() error {
 	for hi.h.Len() > 0 {
 		top := heap.Pop(&hi.h).(*ReconItem)
 		key := top.key
-		var idxVal []byte
-		if hi.compressVals {
-			idxVal, _ = top.g.Next(nil)
-		} else {
-			idxVal, _ = top.g.NextUncompressed()
+		idxVal, err := nextValue(top.g, top.codec)
+		if err != nil {
+			return err
 		}
 		if top.g.HasNext() {
-			if hi.compressVals {
-				top.key, _ = top.g.Next(nil)
-			} else {
-				top.key, _ = top.g.NextUncompressed()
-			}
+			top.key, _ = top.g.NextUncompressed()
 			heap.Push(&hi.h, top)
 		}
 
@@ -1830,10 +2048,8 @@ func (hi *HistoryChangesIterFiles) advance() error {
 		offset := reader.Lookup2(hi.txnKey[:], hi.nextKey)
 		g := hi.hc.statelessGetter(historyItem.i)
 		g.Reset(offset)
-		if hi.compressVals {
-			hi.nextVal, _ = g.Next(nil)
-		} else {
-			hi.nextVal, _ = g.NextUncompressed()
+		if hi.nextVal, err = nextValue(g, historyItem.src.codec); err != nil {
+			return err
 		}
 		return nil
 	}
@@ -1880,6 +2096,7 @@ type HistoryChangesIterDB struct {
 	valsTable       string
 	limit, endTxNum int
 	startTxKey      [8]byte
+	fromKey         []byte
 
 	nextKey, nextVal []byte
 	k, v             []byte
@@ -1906,6 +2123,13 @@ func (hi *HistoryChangesIterDB) advance() (err error) {
 	}
 	return hi.advanceSmallVals()
 }
+func (hi *HistoryChangesIterDB) first(c kv.Cursor) ([]byte, []byte, error) {
+	if hi.fromKey != nil {
+		return c.Seek(hi.fromKey)
+	}
+	return c.First()
+}
+
 func (hi *HistoryChangesIterDB) advanceLargeVals() error {
 	var seek []byte
 	var err error
@@ -1913,7 +2137,7 @@ func (hi *HistoryChangesIterDB) advanceLargeVals() error {
 		if hi.valsC, err = hi.roTx.Cursor(hi.valsTable); err != nil {
 			return err
 		}
-		firstKey, _, err := hi.valsC.First()
+		firstKey, _, err := hi.first(hi.valsC)
 		if err != nil {
 			return err
 		}
@@ -1962,7 +2186,7 @@ func (hi *HistoryChangesIterDB) advanceSmallVals() (err error) {
 			return err
 		}
 
-		if k, _, err = hi.valsCDup.First(); err != nil {
+		if k, _, err = hi.first(hi.valsCDup); err != nil {
 			return err
 		}
 	} else {
@@ -2044,6 +2268,12 @@ func (h *History) EnableReadAhead() *History {
 	})
 	return h
 }
+
+// EnableExistenceFilter - build per-file existence filters for new (collated/merged) files
+func (h *History) EnableExistenceFilter() *History {
+	h.withExistenceFilter = true
+	return h
+}
 func (h *History) EnableMadvWillNeed() *History {
 	h.InvertedIndex.EnableMadvWillNeed()
 	h.files.Walk(func(items []*filesItem) bool {
@@ -2073,11 +2303,10 @@ func (h *History) EnableMadvNormalReadAhead() *History {
 
 // HistoryStep used for incremental state reconsitution, it isolates only one snapshot interval
 type HistoryStep struct {
-	compressVals bool
-	indexItem    *filesItem
-	indexFile    ctxItem
-	historyItem  *filesItem
-	historyFile  ctxItem
+	indexItem   *filesItem
+	indexFile   ctxItem
+	historyItem *filesItem
+	historyFile ctxItem
 }
 
 // MakeSteps [0, toTxNum)
@@ -2090,8 +2319,7 @@ func (h *History) MakeSteps(toTxNum uint64) []*HistoryStep {
 			}
 
 			step := &HistoryStep{
-				compressVals: h.compressVals,
-				indexItem:    item,
+				indexItem: item,
 				indexFile: ctxItem{
 					startTxNum: item.startTxNum,
 					endTxNum:   item.endTxNum,
@@ -2125,8 +2353,7 @@ func (h *History) MakeSteps(toTxNum uint64) []*HistoryStep {
 
 func (hs *HistoryStep) Clone() *HistoryStep {
 	return &HistoryStep{
-		compressVals: hs.compressVals,
-		indexItem:    hs.indexItem,
+		indexItem: hs.indexItem,
 		indexFile: ctxItem{
 			startTxNum: hs.indexFile.startTxNum,
 			endTxNum:   hs.indexFile.endTxNum,
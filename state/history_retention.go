@@ -0,0 +1,222 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+)
+
+// ErrHistoryPruned - requested version of key was dropped by RetentionPolicy. Not same as "not found":
+// "not found" means key had no changes after txNum (and caller can read latest state), "pruned" means answer is unknown.
+var ErrHistoryPruned = errors.New("history: version is pruned by retention policy")
+
+// RetentionPolicy - which versions of keys InvertedIndex/History keep in files. Applied in mergeFiles
+// (files of 1 step are produced as-is), so it affects only merged files. Zero value - keep everything.
+//
+//	KeepLast  - keep only last N versions of each key in each merged file (key which has versions in several files
+//	            keeps up to N in each of them). Key which had more versions keeps 1 extra (oldest) txNum - fence,
+//	            and is listed in `.eft` file: it's used to detect that versions older than fence were dropped. Ignored if 0.
+//	KeepSince - drop versions older than txNum. Ignored if 0.
+//
+// Policy of merged file is stored in `.efr` file next to `.ef` (`.v` files are always aligned with `.ef`).
+// Only GetNoState knows about pruned versions, other readers (IdxRange, HistoryRange, WalkAsOf, ...) just see less data.
+// Policy can be only tightened: merge of files with different policies produces file with strictest one.
+type RetentionPolicy struct {
+	KeepLast  uint64 `json:"keepLast,omitempty"`
+	KeepSince uint64 `json:"keepSince,omitempty"`
+}
+
+func (p RetentionPolicy) Empty() bool { return p.KeepLast == 0 && p.KeepSince == 0 }
+
+func (p RetentionPolicy) String() string {
+	return fmt.Sprintf("keepLast=%d, keepSince=%d", p.KeepLast, p.KeepSince)
+}
+
+// tighten - returns policy which satisfies both `p` and `other`
+func (p RetentionPolicy) tighten(other RetentionPolicy) RetentionPolicy {
+	if other.KeepLast > 0 && (p.KeepLast == 0 || other.KeepLast < p.KeepLast) {
+		p.KeepLast = other.KeepLast
+	}
+	if other.KeepSince > p.KeepSince {
+		p.KeepSince = other.KeepSince
+	}
+	return p
+}
+
+// filter - applies policy to elias-fano list of txNums. Returns nil if nothing left.
+// fenced - KeepLast dropped some versions: first txNum of result is fence.
+func (p RetentionPolicy) filter(efVal, buf []byte) (res []byte, fenced bool, err error) {
+	ef, _ := eliasfano32.ReadEliasFano(efVal)
+	count, from := ef.Count(), uint64(0)
+	if p.KeepSince > 0 {
+		if ef.Max() < p.KeepSince {
+			return nil, false, nil
+		}
+		_, from, _ = ef.SearchIdx(p.KeepSince)
+	}
+	if p.KeepLast > 0 && count-from > p.KeepLast+1 {
+		from, fenced = count-(p.KeepLast+1), true
+	}
+	if from == 0 {
+		return efVal, fenced, nil
+	}
+	newEf := eliasfano32.NewEliasFano(count-from, ef.Max())
+	for i := from; i < count; i++ {
+		newEf.AddOffset(ef.Get(i))
+	}
+	newEf.Build()
+	return newEf.AppendBytes(buf), fenced, nil
+}
+
+// isFence - `n` is first element >= requested txNum of `ef` - value of key at `offset` in file.
+// If it's a fence - requested version is dropped.
+func (i *filesItem) isFence(ef *eliasfano32.EliasFano, n, offset uint64) bool {
+	if i.fenced == nil || n != ef.Min() {
+		return false
+	}
+	v, ok := i.fenced.Search(offset)
+	return ok && v == offset
+}
+
+// keyFenced - `key` (which exists in file) has fence: its versions were dropped by KeepLast
+func (i *filesItem) keyFenced(r *recsplit.IndexReader, key []byte) bool {
+	if i.fenced == nil {
+		return false
+	}
+	offset := r.Lookup(key)
+	v, ok := i.fenced.Search(offset)
+	return ok && v == offset
+}
+
+func retentionFilePath(efPath string) string { return strings.TrimSuffix(efPath, ".ef") + ".efr" }
+
+// fencedFilePath - `.eft`: Elias-Fano list of offsets (in `.ef`) of keys which have fence. No file - no such keys.
+func fencedFilePath(efPath string) string { return strings.TrimSuffix(efPath, ".ef") + ".eft" }
+
+// readFenced - returns nil if file doesn't exist
+func readFenced(efPath string) (*eliasfano32.EliasFano, error) {
+	data, err := os.ReadFile(fencedFilePath(efPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if len(data) < 16 {
+		return nil, fmt.Errorf("%s: too short file", fencedFilePath(efPath))
+	}
+	ef, _ := eliasfano32.ReadEliasFano(data)
+	return ef, nil
+}
+
+// writeFenced - `ordinals` are numbers of fenced keys in `.ef` file `d`, they are converted to offsets of keys.
+// Returns nil if there are no fenced keys - then file is not created.
+func writeFenced(d *compress.Decompressor, ordinals *roaring.Bitmap, noFsync bool) (*eliasfano32.EliasFano, error) {
+	if ordinals.IsEmpty() {
+		return nil, nil
+	}
+	offsets := make([]uint64, 0, ordinals.GetCardinality())
+	g := d.MakeGetter()
+	var offset uint64
+	for ordinal := uint32(0); g.HasNext(); ordinal++ {
+		if ordinals.Contains(ordinal) {
+			offsets = append(offsets, offset)
+		}
+		g.Skip()
+		offset, _ = g.Skip()
+	}
+	ef := eliasfano32.NewEliasFano(uint64(len(offsets)), offsets[len(offsets)-1])
+	for _, o := range offsets {
+		ef.AddOffset(o)
+	}
+	ef.Build()
+	if err := writeFileSync(fencedFilePath(d.FilePath()), ef.AppendBytes(nil), noFsync); err != nil {
+		return nil, err
+	}
+	return ef, nil
+}
+
+func readRetention(efPath string) (p RetentionPolicy, err error) {
+	data, err := os.ReadFile(retentionFilePath(efPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return p, nil
+		}
+		return p, err
+	}
+	if err = json.Unmarshal(data, &p); err != nil {
+		return p, fmt.Errorf("%s: %w", retentionFilePath(efPath), err)
+	}
+	return p, nil
+}
+
+func writeRetention(efPath string, p RetentionPolicy, noFsync bool) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(retentionFilePath(efPath), data, noFsync)
+}
+
+// SetRetention - policy for next merges. Must be set before merges start (not thread-safe).
+func (ii *InvertedIndex) SetRetention(p RetentionPolicy) { ii.retention = p }
+
+// mergeRetention - policy of merged file: current policy tightened by policies of input files
+func (ii *InvertedIndex) mergeRetention(files []*filesItem) RetentionPolicy {
+	p := ii.retention
+	for _, item := range files {
+		p = p.tighten(item.retention)
+	}
+	return p
+}
+
+// keysDropped - true if KeepSince dropped some keys from files: then files don't have all keys which were written
+func (ic *InvertedIndexContext) keysDropped() bool {
+	for _, item := range ic.files {
+		if item.src.retention.KeepSince > item.startTxNum {
+			return true
+		}
+	}
+	return false
+}
+
+// prunedBetween - true if some versions in [from, to) are dropped by KeepSince policy
+func (ic *InvertedIndexContext) prunedBetween(from, to uint64) bool {
+	for _, item := range ic.files {
+		keepSince := item.src.retention.KeepSince
+		if keepSince == 0 || keepSince <= item.startTxNum {
+			continue
+		}
+		droppedTo := keepSince
+		if item.endTxNum < droppedTo {
+			droppedTo = item.endTxNum
+		}
+		if item.startTxNum < to && from < droppedTo {
+			return true
+		}
+	}
+	return false
+}
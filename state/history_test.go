@@ -21,6 +21,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -47,13 +49,14 @@ func testDbAndHistory(tb testing.TB, largeValues bool, logger log.Logger) (strin
 	settingsTable := "Settings"
 	db := mdbx.NewMDBX(logger).InMem(path).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
 		return kv.TableCfg{
-			keysTable:     kv.TableCfgItem{Flags: kv.DupSort},
-			indexTable:    kv.TableCfgItem{Flags: kv.DupSort},
-			valsTable:     kv.TableCfgItem{Flags: kv.DupSort},
-			settingsTable: kv.TableCfgItem{},
+			keysTable:             kv.TableCfgItem{Flags: kv.DupSort},
+			indexTable:            kv.TableCfgItem{Flags: kv.DupSort},
+			valsTable:             kv.TableCfgItem{Flags: kv.DupSort},
+			settingsTable:         kv.TableCfgItem{},
+			kv.TblPruningProgress: kv.TableCfgItem{},
 		}
 	}).MustOpen()
-	h, err := NewHistory(path, path, 16, "hist", keysTable, indexTable, valsTable, false, nil, false, logger)
+	h, err := NewHistory(path, path, 16, "hist", keysTable, indexTable, valsTable, RawValues, nil, false, logger)
 	require.NoError(tb, err)
 	h.DisableFsync()
 	tb.Cleanup(db.Close)
@@ -174,6 +177,49 @@ func TestHistoryCollationBuild(t *testing.T) {
 	})
 }
 
+// key longer than previous key: history value must be read by full key
+func TestHistoryCollateLongerKey(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	test := func(t *testing.T, h *History, db kv.RwDB) {
+		t.Helper()
+		require := require.New(t)
+		tx, err := db.BeginRw(ctx)
+		require.NoError(err)
+		defer tx.Rollback()
+		h.SetTx(tx)
+		h.StartWrites()
+		defer h.FinishWrites()
+
+		longKey := []byte("key-longer-than-previous-key")
+		h.SetTxNum(2)
+		require.NoError(h.AddPrevValue([]byte("k"), nil, []byte("value1")))
+		require.NoError(h.AddPrevValue(longKey, nil, []byte("value2")))
+		require.NoError(h.Rotate().Flush(ctx, tx))
+
+		c, err := h.collate(0, 0, 8, tx)
+		require.NoError(err)
+		sf, err := h.buildFiles(ctx, 0, c, background.NewProgressSet())
+		require.NoError(err)
+		defer sf.Close()
+		var valWords []string
+		g := sf.historyDecomp.MakeGetter()
+		for g.HasNext() {
+			w, _ := g.Next(nil)
+			valWords = append(valWords, string(w))
+		}
+		require.Equal([]string{"value1", "value2"}, valWords)
+	}
+	t.Run("large_values", func(t *testing.T) {
+		_, db, h := testDbAndHistory(t, true, logger)
+		test(t, h, db)
+	})
+	t.Run("small_values", func(t *testing.T) {
+		_, db, h := testDbAndHistory(t, false, logger)
+		test(t, h, db)
+	})
+}
+
 func TestHistoryAfterPrune(t *testing.T) {
 	logger := log.New()
 	logEvery := time.NewTicker(30 * time.Second)
@@ -220,7 +266,7 @@ func TestHistoryAfterPrune(t *testing.T) {
 
 		h.integrateFiles(sf, 0, 16)
 
-		err = h.prune(ctx, 0, 16, math.MaxUint64, logEvery)
+		_, err = h.prune(ctx, 0, 16, math.MaxUint64, logEvery)
 		require.NoError(err)
 		h.SetTx(tx)
 
@@ -245,6 +291,53 @@ func TestHistoryAfterPrune(t *testing.T) {
 	})
 }
 
+func TestHistoryPruneProgress(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	ctx := context.Background()
+	test := func(t *testing.T, h *History, db kv.RwDB) {
+		t.Helper()
+		require := require.New(t)
+		h.pruneProgressTable = kv.TblPruningProgress
+		tx, err := db.BeginRw(ctx)
+		require.NoError(err)
+		defer tx.Rollback()
+		h.SetTx(tx)
+
+		var total PruneStats
+		for i := 0; total.RangesDone == 0; i++ {
+			require.Less(i, 1000)
+			stat, err := h.prune(ctx, 0, 160, 10, logEvery)
+			require.NoError(err)
+			require.LessOrEqual(stat.RowsDeleted, uint64(2*10))
+			total.Accumulate(stat)
+		}
+		require.Positive(total.RowsDeleted)
+
+		progress, err := txPruneProgress(tx, h.pruneProgressTable, pruneProgressKey(h.filenameBase, "v"), 0)
+		require.NoError(err)
+		require.Equal(uint64(160), progress)
+
+		stat, err := h.prune(ctx, 0, 160, 10, logEvery)
+		require.NoError(err)
+		require.Zero(stat.RowsDeleted)
+		require.Equal(uint64(1), stat.RangesDone)
+
+		k, err := kv.FirstKey(tx, h.indexKeysTable)
+		require.NoError(err)
+		require.GreaterOrEqual(binary.BigEndian.Uint64(k), uint64(160))
+	}
+	t.Run("large_values", func(t *testing.T) {
+		_, db, h, _ := filledHistory(t, true, logger)
+		test(t, h, db)
+	})
+	t.Run("small_values", func(t *testing.T) {
+		_, db, h, _ := filledHistory(t, false, logger)
+		test(t, h, db)
+	})
+}
+
 func filledHistory(tb testing.TB, largeValues bool, logger log.Logger) (string, kv.RwDB, *History, uint64) {
 	tb.Helper()
 	path, db, h := testDbAndHistory(tb, largeValues, logger)
@@ -349,7 +442,7 @@ func TestHistoryHistory(t *testing.T) {
 				sf, err := h.buildFiles(ctx, step, c, background.NewProgressSet())
 				require.NoError(err)
 				h.integrateFiles(sf, step*h.aggregationStep, (step+1)*h.aggregationStep)
-				err = h.prune(ctx, step*h.aggregationStep, (step+1)*h.aggregationStep, math.MaxUint64, logEvery)
+				_, err = h.prune(ctx, step*h.aggregationStep, (step+1)*h.aggregationStep, math.MaxUint64, logEvery)
 				require.NoError(err)
 			}()
 		}
@@ -385,7 +478,7 @@ func collateAndMergeHistory(tb testing.TB, db kv.RwDB, h *History, txs uint64) {
 		sf, err := h.buildFiles(ctx, step, c, background.NewProgressSet())
 		require.NoError(err)
 		h.integrateFiles(sf, step*h.aggregationStep, (step+1)*h.aggregationStep)
-		err = h.prune(ctx, step*h.aggregationStep, (step+1)*h.aggregationStep, math.MaxUint64, logEvery)
+		_, err = h.prune(ctx, step*h.aggregationStep, (step+1)*h.aggregationStep, math.MaxUint64, logEvery)
 		require.NoError(err)
 	}
 
@@ -440,6 +533,48 @@ func TestHistoryMergeFiles(t *testing.T) {
 	})
 }
 
+func TestHistoryCollateParallel(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	defer func(chunk int) { historyCollateChunk = chunk }(historyCollateChunk)
+	historyCollateChunk = 4
+
+	test := func(t *testing.T, h *History, db kv.RwDB, txs uint64) {
+		t.Helper()
+		collate := func(step uint64, workers int) (c HistoryCollation, history []byte) {
+			t.Helper()
+			h.collateWorkers = workers
+			c, err := h.collateParallel(ctx, step, step*h.aggregationStep, (step+1)*h.aggregationStep, db)
+			require.NoError(t, err)
+			require.NoError(t, c.historyComp.Compress())
+			history, err = os.ReadFile(c.historyPath)
+			require.NoError(t, err)
+			return c, history
+		}
+		for step := uint64(0); step < txs/h.aggregationStep; step++ {
+			serial, serialHistory := collate(step, 1)
+			parallel, parallelHistory := collate(step, 4)
+			require.Equal(t, serial.historyCount, parallel.historyCount)
+			require.Equal(t, len(serial.indexBitmaps), len(parallel.indexBitmaps))
+			for k, bitmap := range serial.indexBitmaps {
+				require.Equal(t, bitmap.ToArray(), parallel.indexBitmaps[k].ToArray(), "%x", k)
+			}
+			require.Equal(t, serialHistory, parallelHistory, step)
+			serial.Close()
+			parallel.Close()
+		}
+	}
+
+	t.Run("large_values", func(t *testing.T) {
+		_, db, h, txs := filledHistory(t, true, logger)
+		test(t, h, db, txs)
+	})
+	t.Run("small_values", func(t *testing.T) {
+		_, db, h, txs := filledHistory(t, false, logger)
+		test(t, h, db, txs)
+	})
+}
+
 func TestHistoryScanFiles(t *testing.T) {
 	logger := log.New()
 	logEvery := time.NewTicker(30 * time.Second)
@@ -830,3 +965,305 @@ func TestScanStaticFilesH(t *testing.T) {
 	require.Equal(t, 0, h.files.Len())
 
 }
+
+func TestHistoryRetention(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+	test := func(t *testing.T, p RetentionPolicy) {
+		require := require.New(t)
+		path, db, h, txs := filledHistory(t, false, logger)
+		h.SetRetention(p)
+		collateAndMergeHistory(t, db, h, txs)
+		require.NoError(h.OpenFolder()) // retention of files must survive restart
+
+		hc := h.MakeContext()
+		defer hc.Close()
+		// model: first change of key at or after `q` and is it dropped by policy
+		var exactCnt, afterFenceCnt int // found: key with exactly KeepLast+1 versions in file, key fenced in older file
+		pruned := func(keyNum, q uint64) bool {
+			var olderFenced bool
+			for _, item := range hc.ic.files {
+				if p.KeepSince > q && item.startTxNum < p.KeepSince && item.src.retention.KeepSince > 0 {
+					return true
+				}
+				var changes []uint64
+				for n := (item.startTxNum + keyNum - 1) / keyNum * keyNum; n < item.endTxNum; n += keyNum {
+					if n > 0 {
+						changes = append(changes, n)
+					}
+				}
+				if item.endTxNum <= q {
+					if item.src.retention.KeepLast > 0 && uint64(len(changes)) > p.KeepLast+1 {
+						olderFenced = true
+					}
+					continue
+				}
+				if len(changes) == 0 || changes[len(changes)-1] < q {
+					continue
+				}
+				if olderFenced {
+					afterFenceCnt++
+				}
+				if item.src.retention.KeepLast == 0 || uint64(len(changes)) <= p.KeepLast+1 {
+					if item.src.retention.KeepLast > 0 && uint64(len(changes)) == p.KeepLast+1 && q <= changes[0] {
+						exactCnt++
+					}
+					return false
+				}
+				fence := changes[len(changes)-1-int(p.KeepLast)]
+				return q <= fence
+			}
+			return false
+		}
+
+		var prunedCnt, foundCnt int
+		for txNum := uint64(0); txNum <= txs; txNum++ {
+			for keyNum := uint64(1); keyNum <= uint64(31); keyNum++ {
+				var k, v [8]byte
+				binary.BigEndian.PutUint64(k[:], keyNum)
+				binary.BigEndian.PutUint64(v[:], txNum/keyNum)
+				k[0], v[0] = 0x01, 0xff
+				label := fmt.Sprintf("txNum=%d, keyNum=%d", txNum, keyNum)
+				val, ok, err := hc.GetNoState(k[:], txNum+1)
+				if pruned(keyNum, txNum+1) {
+					require.ErrorIs(err, ErrHistoryPruned, label)
+					prunedCnt++
+					continue
+				}
+				require.NoError(err, label)
+				if !ok {
+					continue
+				}
+				foundCnt++
+				if txNum >= keyNum {
+					require.Equal(v[:], val, label)
+				} else {
+					require.Equal([]byte{}, val, label)
+				}
+			}
+		}
+		require.Greater(prunedCnt, 0)
+		require.Greater(foundCnt, 0)
+		if p.KeepLast > 0 {
+			require.Greater(exactCnt, 0)
+			require.Greater(afterFenceCnt, 0)
+		}
+
+		if p.KeepSince > 0 {
+			roTx, err := db.BeginRo(ctx)
+			require.NoError(err)
+			defer roTx.Rollback()
+			it, err := hc.ic.IdxRange([]byte{1, 0, 0, 0, 0, 0, 0, 1}, 0, int(p.KeepSince), order.Asc, -1, roTx)
+			require.NoError(err)
+			require.False(it.HasNext())
+		}
+		require.FileExists(retentionFilePath(filepath.Join(path, "hist.0-32.ef")))
+		if p.KeepLast > 0 {
+			require.FileExists(fencedFilePath(filepath.Join(path, "hist.0-32.ef")))
+		}
+	}
+	t.Run("keep_last", func(t *testing.T) { test(t, RetentionPolicy{KeepLast: 3}) })
+	t.Run("keep_since", func(t *testing.T) { test(t, RetentionPolicy{KeepSince: 300}) })
+	t.Run("both", func(t *testing.T) { test(t, RetentionPolicy{KeepLast: 5, KeepSince: 300}) })
+}
+
+func TestHistoryStateDiff(t *testing.T) {
+	logger := log.New()
+	ctx := context.Background()
+
+	valAt := func(keyNum, txNum uint64) []byte { // value of key after execution of txNum
+		if txNum < keyNum {
+			return []byte{}
+		}
+		var v [8]byte
+		binary.BigEndian.PutUint64(v[:], txNum/keyNum)
+		v[0] = 0xff
+		return v[:]
+	}
+	latest := func(k []byte) ([]byte, error) {
+		return valAt(binary.BigEndian.Uint64(append([]byte{0}, k[1:]...)), 1000), nil
+	}
+	expect := func(from, to uint64) (keys, olds, news []string) {
+		for keyNum := uint64(1); keyNum <= 31; keyNum++ {
+			firstChange := (from + keyNum - 1) / keyNum * keyNum
+			if firstChange == 0 {
+				firstChange = keyNum
+			}
+			if firstChange >= to {
+				continue
+			}
+			var k [8]byte
+			binary.BigEndian.PutUint64(k[:], keyNum)
+			k[0] = 1
+			keys = append(keys, fmt.Sprintf("%x", k))
+			if from == 0 {
+				olds = append(olds, "")
+			} else {
+				olds = append(olds, fmt.Sprintf("%x", valAt(keyNum, from-1)))
+			}
+			news = append(news, fmt.Sprintf("%x", valAt(keyNum, to-1)))
+		}
+		return keys, olds, news
+	}
+	collect := func(t *testing.T, it *StateDiffIter) (keys, olds, news []string) {
+		t.Helper()
+		defer it.Close()
+		for it.HasNext() {
+			k, o, n, err := it.Next()
+			require.NoError(t, err)
+			keys, olds, news = append(keys, fmt.Sprintf("%x", k)), append(olds, fmt.Sprintf("%x", o)), append(news, fmt.Sprintf("%x", n))
+		}
+		return keys, olds, news
+	}
+
+	test := func(t *testing.T, h *History, db kv.RwDB) {
+		t.Helper()
+		roTx, err := db.BeginRo(ctx)
+		require.NoError(t, err)
+		defer roTx.Rollback()
+		hc := h.MakeContext()
+		defer hc.Close()
+
+		for _, r := range [][2]uint64{{0, 1}, {2, 20}, {5, 6}, {30, 62}, {100, 990}, {995, 1000}, {0, 1001}, {980, 1001}} {
+			label := fmt.Sprintf("[%d, %d)", r[0], r[1])
+			it, err := hc.StateDiff(r[0], r[1], nil, -1, latest, roTx)
+			require.NoError(t, err, label)
+			keys, olds, news := collect(t, it)
+			expKeys, expOlds, expNews := expect(r[0], r[1])
+			require.Equal(t, expKeys, keys, label)
+			require.Equal(t, expOlds, olds, label)
+			require.Equal(t, expNews, news, label)
+
+			// same result page by page
+			var pagedKeys []string
+			var cursor []byte
+			for {
+				it, err := hc.StateDiff(r[0], r[1], cursor, 3, latest, roTx)
+				require.NoError(t, err, label)
+				keys, _, _ := collect(t, it)
+				require.LessOrEqual(t, len(keys), 3, label)
+				pagedKeys = append(pagedKeys, keys...)
+				if cursor = it.Cursor(); cursor == nil {
+					break
+				}
+			}
+			require.Equal(t, expKeys, pagedKeys, label)
+
+			// range is seeked to fromKey: same as full range without keys before fromKey
+			rangeKeys := func(fromKey []byte) (keys []string) {
+				it, err := hc.historyRange(fromKey, int(r[0]), int(r[1]), order.Asc, -1, roTx)
+				require.NoError(t, err, label)
+				for it.HasNext() {
+					k, _, err := it.Next()
+					require.NoError(t, err, label)
+					keys = append(keys, fmt.Sprintf("%x", k))
+				}
+				return keys
+			}
+			all := rangeKeys(nil)
+			fromKeys := []string{"00", "ff"}
+			for _, k := range all {
+				fromKeys = append(fromKeys, k, k+"00") // present key and absent key right after it
+			}
+			for _, fromKey := range fromKeys {
+				var exp []string
+				for _, k := range all {
+					if k >= fromKey {
+						exp = append(exp, k)
+					}
+				}
+				require.Equal(t, exp, rangeKeys(hexutility.MustDecodeHex(fromKey)), "%s fromKey=%s", label, fromKey)
+			}
+		}
+
+		// no history after txNum=1000: latest value reader required
+		it, err := hc.StateDiff(980, 1001, nil, -1, nil, roTx)
+		require.NoError(t, err)
+		require.True(t, it.HasNext())
+		_, _, _, err = it.Next()
+		require.Error(t, err)
+		it.Close()
+
+		_, err = hc.StateDiff(10, 5, nil, -1, nil, roTx)
+		require.Error(t, err)
+	}
+	for _, largeValues := range []bool{true, false} {
+		t.Run(fmt.Sprintf("largeValues=%t", largeValues), func(t *testing.T) {
+			_, db, h, txs := filledHistory(t, largeValues, logger)
+			t.Run("before merge", func(t *testing.T) { test(t, h, db) })
+			collateAndMergeHistory(t, db, h, txs)
+			t.Run("after merge", func(t *testing.T) { test(t, h, db) })
+		})
+	}
+}
+
+// xorValueCodec - test codec with non-trivial transformation of values
+type xorValueCodec struct{ compressed bool }
+
+func (c xorValueCodec) Name() string {
+	if c.compressed {
+		return "test-xor-compressed"
+	}
+	return "test-xor"
+}
+func (c xorValueCodec) Compressed() bool      { return c.compressed }
+func (c xorValueCodec) ReuseDictionary() bool { return c.compressed }
+func (c xorValueCodec) Encode(buf, v []byte) []byte {
+	for _, b := range v {
+		buf = append(buf, b^0x5a)
+	}
+	return buf
+}
+func (c xorValueCodec) Decode(buf, v []byte) ([]byte, error) { return c.Encode(buf, v), nil }
+
+func init() {
+	for _, c := range []ValueCodec{xorValueCodec{}, xorValueCodec{compressed: true}} {
+		if err := RegisterValueCodec(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func TestHistoryValueCodec(t *testing.T) {
+	logger := log.New()
+	test := func(t *testing.T, codec ValueCodec, largeValues bool) {
+		path, db, h, txs := filledHistory(t, largeValues, logger)
+		h.codec = codec
+		collateAndMergeHistory(t, db, h, txs)
+		checkHistoryHistory(t, h, txs)
+
+		h.files.Walk(func(items []*filesItem) bool {
+			for _, item := range items {
+				if isDefaultValueCodec(codec) { // same bytes as files written before codecs
+					require.Nil(t, item.decompressor.Metadata(), item.decompressor.FileName())
+					continue
+				}
+				require.Equal(t, "codec="+codec.Name(), string(item.decompressor.Metadata()), item.decompressor.FileName())
+			}
+			return true
+		})
+
+		// codec of files is taken from their header - not from configuration
+		h2, err := NewHistory(path, path, h.aggregationStep, h.filenameBase, h.indexKeysTable, h.indexTable, h.historyValsTable, RawValues, nil, largeValues, logger)
+		require.NoError(t, err)
+		defer h2.Close()
+		require.NoError(t, h2.OpenFolder())
+		checkHistoryHistory(t, h2, txs)
+	}
+	for _, codec := range []ValueCodec{RawValues, CompressedValues, CompressedValuesReuseDict, xorValueCodec{}, xorValueCodec{compressed: true}} {
+		for _, largeValues := range []bool{true, false} {
+			codec, largeValues := codec, largeValues
+			t.Run(fmt.Sprintf("%s largeValues=%t", codec.Name(), largeValues), func(t *testing.T) { test(t, codec, largeValues) })
+		}
+	}
+
+	t.Run("unknown codec", func(t *testing.T) {
+		path, db, h, txs := filledHistory(t, false, logger)
+		h.codec = plainValueCodec{name: "not-registered"}
+		collateAndMergeHistory(t, db, h, txs)
+		h2, err := NewHistory(path, path, h.aggregationStep, h.filenameBase, h.indexKeysTable, h.indexTable, h.historyValsTable, RawValues, nil, false, logger)
+		require.NoError(t, err)
+		defer h2.Close()
+		require.ErrorContains(t, h2.OpenFolder(), "unknown value codec")
+	})
+}
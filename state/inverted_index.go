@@ -62,6 +62,10 @@ type InvertedIndex struct {
 	filenameBase    string
 	aggregationStep uint64
 	compressWorkers int
+	collateWorkers  int        // >1: collate partitions of key space in parallel read transactions, see collateParallel
+	codec           ValueCodec // codec of values (Elias-Fano sequences) of new files
+
+	pruneProgressTable string // if set: prune progress is persisted there, see prune_progress.go
 
 	integrityFileExtensions []string
 	withLocalityIndex       bool
@@ -69,6 +73,8 @@ type InvertedIndex struct {
 	tx                      kv.RwTx
 
 	garbageFiles []*filesItem // files that exist on disk, but ignored on opening folder - because they are garbage
+	manifest     *filesManifest
+	retention    RetentionPolicy // applied to merged files
 
 	// fields for history write
 	txNum      uint64
@@ -77,6 +83,10 @@ type InvertedIndex struct {
 	logger     log.Logger
 
 	noFsync bool // fsync is enabled by default, but tests can manually disable
+
+	readOnly      bool         // files owned by other process, see NewAggregatorV3ReadOnly
+	retiredFrozen []*filesItem // frozen files removed by owner of datadir, have no refcount - closed on Close
+	unwound       []string     // paths of files dropped by unwind, removed from disk by finishUnwind
 }
 
 func NewInvertedIndex(
@@ -85,6 +95,7 @@ func NewInvertedIndex(
 	filenameBase string,
 	indexKeysTable string,
 	indexTable string,
+	codec ValueCodec,
 	withLocalityIndex bool,
 	integrityFileExtensions []string,
 	logger log.Logger,
@@ -97,10 +108,13 @@ func NewInvertedIndex(
 		filenameBase:            filenameBase,
 		indexKeysTable:          indexKeysTable,
 		indexTable:              indexTable,
+		codec:                   codec,
 		compressWorkers:         1,
+		collateWorkers:          1,
 		integrityFileExtensions: integrityFileExtensions,
 		withLocalityIndex:       withLocalityIndex,
 		logger:                  logger,
+		manifest:                newFilesManifest(dir, filenameBase, "ef", aggregationStep),
 	}
 	ii.roFiles.Store(&[]ctxItem{})
 
@@ -130,6 +144,9 @@ func (ii *InvertedIndex) fileNamesOnDisk() ([]string, error) {
 }
 
 func (ii *InvertedIndex) OpenList(fNames []string) error {
+	if ii.readOnly {
+		return ii.openListReadOnly(fNames)
+	}
 	if err := ii.localityIndex.OpenList(fNames); err != nil {
 		return err
 	}
@@ -146,7 +163,23 @@ func (ii *InvertedIndex) OpenFolder() error {
 	if err != nil {
 		return err
 	}
-	return ii.OpenList(files)
+	files, garbage, err := ii.manifest.filter(files, ii.logger)
+	if err != nil {
+		return err
+	}
+	if ii.readOnly {
+		return ii.openListReadOnly(filesReadyForReadOnly(files))
+	}
+	if err = ii.OpenList(files); err != nil {
+		return err
+	}
+	ii.garbageFiles = append(ii.garbageFiles, garbage...)
+	return nil
+}
+
+// CheckFiles - reports drift between files manifest, files on disk and open files
+func (ii *InvertedIndex) CheckFiles(checksums bool) ([]FileDrift, error) {
+	return ii.manifest.check(ii.files, checksums)
 }
 
 func (ii *InvertedIndex) scanStateFiles(fileNames []string) (garbageFiles []*filesItem) {
@@ -298,21 +331,31 @@ func (ii *InvertedIndex) openFiles() error {
 	var invalidFileItems []*filesItem
 	ii.files.Walk(func(items []*filesItem) bool {
 		for _, item := range items {
-			if item.decompressor != nil {
-				continue
-			}
 			fromStep, toStep := item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep
-			datPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, fromStep, toStep))
-			if !dir.FileExist(datPath) {
-				invalidFileItems = append(invalidFileItems, item)
-				continue
-			}
+			if item.decompressor == nil {
+				datPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, fromStep, toStep))
+				if !dir.FileExist(datPath) {
+					invalidFileItems = append(invalidFileItems, item)
+					continue
+				}
 
-			if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
-				ii.logger.Debug("InvertedIndex.openFiles: %w, %s", err, datPath)
-				continue
+				if item.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+					ii.logger.Debug("InvertedIndex.openFiles: %w, %s", err, datPath)
+					continue
+				}
+				item.readOnly = ii.readOnly
+				if item.codec, err = fileValueCodec(item.decompressor); err != nil {
+					return false
+				}
+				if item.retention, err = readRetention(datPath); err != nil {
+					return false
+				}
+				if item.fenced, err = readFenced(datPath); err != nil {
+					return false
+				}
 			}
 
+			// index may be missed before, then built by BuildMissedIndices
 			if item.index != nil {
 				continue
 			}
@@ -338,6 +381,21 @@ func (ii *InvertedIndex) openFiles() error {
 	return nil
 }
 
+// openListReadOnly - read-only analog of OpenList: never closes files used by contexts and never deletes garbage
+func (ii *InvertedIndex) openListReadOnly(fNames []string) error {
+	if err := ii.localityIndex.openListReadOnly(fNames); err != nil {
+		return err
+	}
+	retired := retireWhatNotInList(ii.files, fNames)
+	ii.reCalcRoFiles()
+	_ = ii.scanStateFiles(fNames) // garbage belongs to owner of datadir
+	if err := ii.openFiles(); err != nil {
+		return fmt.Errorf("InvertedIndex.openListReadOnly: %s, %w", ii.filenameBase, err)
+	}
+	ii.retiredFrozen = closeRetired(retired, ii.retiredFrozen)
+	return nil
+}
+
 func (ii *InvertedIndex) closeWhatNotInList(fNames []string) {
 	var toDelete []*filesItem
 	ii.files.Walk(func(items []*filesItem) bool {
@@ -368,6 +426,10 @@ func (ii *InvertedIndex) closeWhatNotInList(fNames []string) {
 func (ii *InvertedIndex) Close() {
 	ii.localityIndex.Close()
 	ii.closeWhatNotInList([]string{})
+	for _, item := range ii.retiredFrozen {
+		item.closeFilesAndRemove()
+	}
+	ii.retiredFrozen = nil
 	ii.reCalcRoFiles()
 }
 
@@ -383,7 +445,7 @@ func (ii *InvertedIndex) Files() (res []string) {
 		}
 		return true
 	})
-	return res
+	return append(res, ii.localityIndex.Files()...)
 }
 
 func (ii *InvertedIndex) SetTx(tx kv.RwTx) {
@@ -583,6 +645,28 @@ func (ic *InvertedIndexContext) statelessIdxReader(i int) *recsplit.IndexReader
 	return r
 }
 
+// FilesWithKey - names of .ef files which have given key. Frozen files which LocalityIndex excludes are not opened. For debugging.
+func (ic *InvertedIndexContext) FilesWithKey(key []byte) (res []string) {
+	li := ic.ii.localityIndex
+	fileNums, lastIndexedTxNum, indexed := li.lookupFiles(ic.loc, key)
+	for i := range ic.files {
+		item := &ic.files[i]
+		if indexed && !li.mayContain(item, fileNums, lastIndexedTxNum) {
+			continue
+		}
+		reader := ic.statelessIdxReader(i)
+		if reader.Empty() {
+			continue
+		}
+		g := ic.statelessGetter(i)
+		g.Reset(reader.Lookup(key))
+		if k, _ := g.NextUncompressed(); bytes.Equal(k, key) {
+			res = append(res, item.src.decompressor.FileName())
+		}
+	}
+	return res
+}
+
 func (ic *InvertedIndexContext) getFile(from, to uint64) (it ctxItem, ok bool) {
 	for _, item := range ic.files {
 		if item.startTxNum == from && item.endTxNum == to {
@@ -746,7 +830,12 @@ func (it *FrozenInvertedIdxIter) HasNext() bool {
 	return it.hasNext
 }
 
-func (it *FrozenInvertedIdxIter) Next() (uint64, error) { return it.next(), nil }
+func (it *FrozenInvertedIdxIter) Next() (uint64, error) {
+	if it.err != nil {
+		return 0, it.err
+	}
+	return it.next(), nil
+}
 
 func (it *FrozenInvertedIdxIter) next() uint64 {
 	it.limit--
@@ -769,7 +858,11 @@ func (it *FrozenInvertedIdxIter) advanceInFiles() {
 			g.Reset(offset)
 			k, _ := g.NextUncompressed()
 			if bytes.Equal(k, it.key) {
-				eliasVal, _ := g.NextUncompressed()
+				eliasVal, err := nextValue(g, item.src.codec)
+				if err != nil {
+					it.err, it.hasNext = err, false
+					return
+				}
 				it.ef.Reset(eliasVal)
 				if it.orderAscend {
 					efiter := it.ef.Iterator()
@@ -995,7 +1088,10 @@ func (it *InvertedIterator1) advanceInFiles() {
 	for it.h.Len() > 0 {
 		top := heap.Pop(&it.h).(*ReconItem)
 		key := top.key
-		val, _ := top.g.NextUncompressed()
+		val, err := nextValue(top.g, top.codec)
+		if err != nil {
+			panic(err)
+		}
 		if top.g.HasNext() {
 			top.key, _ = top.g.NextUncompressed()
 			heap.Push(&it.h, top)
@@ -1106,7 +1202,7 @@ func (ic *InvertedIndexContext) IterateChangedKeys(startTxNum, endTxNum uint64,
 		g := item.src.decompressor.MakeGetter()
 		if g.HasNext() {
 			key, _ := g.NextUncompressed()
-			heap.Push(&ii1.h, &ReconItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, g: g, txNum: ^item.endTxNum, key: key})
+			heap.Push(&ii1.h, &ReconItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, g: g, codec: item.src.codec, txNum: ^item.endTxNum, key: key})
 			ii1.hasNextInFiles = true
 		}
 	}
@@ -1203,7 +1299,8 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, bitmaps ma
 		if err != nil {
 			return InvertedFiles{}, fmt.Errorf("create %s compressor: %w", ii.filenameBase, err)
 		}
-		var buf []byte
+		setValueCodec(comp, ii.codec, nil)
+		var buf, encBuf []byte
 		for _, key := range keys {
 			if err = comp.AddUncompressedWord([]byte(key)); err != nil {
 				return InvertedFiles{}, fmt.Errorf("add %s key [%x]: %w", ii.filenameBase, key, err)
@@ -1216,7 +1313,7 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, bitmaps ma
 			}
 			ef.Build()
 			buf = ef.AppendBytes(buf[:0])
-			if err = comp.AddUncompressedWord(buf); err != nil {
+			if encBuf, err = addCollatedValue(comp, ii.codec, buf, encBuf); err != nil {
 				return InvertedFiles{}, fmt.Errorf("add %s val: %w", ii.filenameBase, err)
 			}
 		}
@@ -1230,6 +1327,9 @@ func (ii *InvertedIndex) buildFiles(ctx context.Context, step uint64, bitmaps ma
 	if decomp, err = compress.NewDecompressor(datPath); err != nil {
 		return InvertedFiles{}, fmt.Errorf("open %s decompressor: %w", ii.filenameBase, err)
 	}
+	if err = ii.manifest.prepare(decomp); err != nil {
+		return InvertedFiles{}, fmt.Errorf("checksum %s: %w", ii.filenameBase, err)
+	}
 
 	idxFileName := fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, txNumFrom/ii.aggregationStep, txNumTo/ii.aggregationStep)
 	idxPath := filepath.Join(ii.dir, idxFileName)
@@ -1246,7 +1346,9 @@ func (ii *InvertedIndex) integrateFiles(sf InvertedFiles, txNumFrom, txNumTo uin
 	fi := newFilesItem(txNumFrom, txNumTo, ii.aggregationStep)
 	fi.decompressor = sf.decomp
 	fi.index = sf.index
+	fi.codec = ii.codec
 	ii.files.Set(fi)
+	ii.manifest.update(ii.files, ii.noFsync, ii.logger)
 
 	ii.reCalcRoFiles()
 }
@@ -1297,27 +1399,40 @@ func (ii *InvertedIndex) warmup(ctx context.Context, txFrom, limit uint64, tx kv
 }
 
 // [txFrom; txTo)
-func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) error {
+func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64, logEvery *time.Ticker) (stat *PruneStats, err error) {
+	stat = &PruneStats{}
+	defer func(t time.Time) { stat.Took = time.Since(t) }(time.Now())
+	requestedFrom, requestedTo := txFrom, txTo
+	progressKey := pruneProgressKey(ii.filenameBase, "ef")
+	if txFrom, err = txPruneProgress(ii.tx, ii.pruneProgressTable, progressKey, txFrom); err != nil {
+		return stat, err
+	}
+
 	keysCursor, err := ii.tx.RwCursorDupSort(ii.indexKeysTable)
 	if err != nil {
-		return fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
+		return stat, fmt.Errorf("create %s keys cursor: %w", ii.filenameBase, err)
 	}
 	defer keysCursor.Close()
 	var txKey [8]byte
 	binary.BigEndian.PutUint64(txKey[:], txFrom)
 	k, v, err := keysCursor.Seek(txKey[:])
 	if err != nil {
-		return err
+		return stat, err
 	}
 	if k == nil {
-		return nil
+		stat.RangesDone++
+		return stat, saveTxPruneProgress(ii.tx, ii.pruneProgressTable, progressKey, requestedFrom, requestedTo)
 	}
 	txFrom = binary.BigEndian.Uint64(k)
 	if limit != math.MaxUint64 && limit != 0 {
 		txTo = cmp.Min(txTo, txFrom+limit)
 	}
 	if txFrom >= txTo {
-		return nil
+		if txFrom >= requestedTo {
+			stat.RangesDone++
+			return stat, saveTxPruneProgress(ii.tx, ii.pruneProgressTable, progressKey, requestedFrom, requestedTo)
+		}
+		return stat, nil
 	}
 
 	collector := etl.NewCollector("snapshots", ii.tmpdir, etl.NewOldestEntryBuffer(etl.BufferOptimalSize), ii.logger)
@@ -1325,12 +1440,12 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 
 	idxCForDeletes, err := ii.tx.RwCursorDupSort(ii.indexTable)
 	if err != nil {
-		return err
+		return stat, err
 	}
 	defer idxCForDeletes.Close()
 	idxC, err := ii.tx.RwCursorDupSort(ii.indexTable)
 	if err != nil {
-		return err
+		return stat, err
 	}
 	defer idxC.Close()
 
@@ -1338,7 +1453,7 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 	// Means: can use DeleteCurrentDuplicates all values of given `txNum`
 	for ; k != nil; k, v, err = keysCursor.NextNoDup() {
 		if err != nil {
-			return err
+			return stat, err
 		}
 		txNum := binary.BigEndian.Uint64(k)
 		if txNum >= txTo {
@@ -1346,25 +1461,26 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 		}
 		for ; v != nil; _, v, err = keysCursor.NextDup() {
 			if err != nil {
-				return err
+				return stat, err
 			}
 			if err := collector.Collect(v, nil); err != nil {
-				return err
+				return stat, err
 			}
+			stat.RowsDeleted++
 		}
 
 		// This DeleteCurrent needs to the last in the loop iteration, because it invalidates k and v
 		if err = ii.tx.Delete(ii.indexKeysTable, k); err != nil {
-			return err
+			return stat, err
 		}
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return stat, ctx.Err()
 		default:
 		}
 	}
 	if err != nil {
-		return fmt.Errorf("iterate over %s keys: %w", ii.filenameBase, err)
+		return stat, fmt.Errorf("iterate over %s keys: %w", ii.filenameBase, err)
 	}
 
 	if err := collector.Load(ii.tx, "", func(key, _ []byte, table etl.CurrentTableReader, next etl.LoadNextFunc) error {
@@ -1383,6 +1499,7 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 			if err = idxCForDeletes.DeleteCurrent(); err != nil {
 				return err
 			}
+			stat.RowsDeleted++
 
 			select {
 			case <-logEvery.C:
@@ -1392,10 +1509,13 @@ func (ii *InvertedIndex) prune(ctx context.Context, txFrom, txTo, limit uint64,
 		}
 		return nil
 	}, etl.TransformArgs{}); err != nil {
-		return err
+		return stat, err
 	}
 
-	return nil
+	if txTo == requestedTo {
+		stat.RangesDone++
+	}
+	return stat, saveTxPruneProgress(ii.tx, ii.pruneProgressTable, progressKey, requestedFrom, txTo)
 }
 
 func (ii *InvertedIndex) DisableReadAhead() {
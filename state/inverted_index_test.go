@@ -46,12 +46,13 @@ func testDbAndInvertedIndex(tb testing.TB, aggStep uint64, logger log.Logger) (s
 	indexTable := "Index"
 	db := mdbx.NewMDBX(logger).InMem(path).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
 		return kv.TableCfg{
-			keysTable:  kv.TableCfgItem{Flags: kv.DupSort},
-			indexTable: kv.TableCfgItem{Flags: kv.DupSort},
+			keysTable:             kv.TableCfgItem{Flags: kv.DupSort},
+			indexTable:            kv.TableCfgItem{Flags: kv.DupSort},
+			kv.TblPruningProgress: kv.TableCfgItem{},
 		}
 	}).MustOpen()
 	tb.Cleanup(db.Close)
-	ii, err := NewInvertedIndex(path, path, aggStep, "inv" /* filenameBase */, keysTable, indexTable, false, nil, logger)
+	ii, err := NewInvertedIndex(path, path, aggStep, "inv" /* filenameBase */, keysTable, indexTable, RawValues, false, nil, logger)
 	require.NoError(tb, err)
 	ii.DisableFsync()
 	tb.Cleanup(ii.Close)
@@ -185,7 +186,7 @@ func TestInvIndexAfterPrune(t *testing.T) {
 
 	ii.integrateFiles(sf, 0, 16)
 
-	err = ii.prune(ctx, 0, 16, math.MaxUint64, logEvery)
+	_, err = ii.prune(ctx, 0, 16, math.MaxUint64, logEvery)
 	require.NoError(t, err)
 	err = tx.Commit()
 	require.NoError(t, err)
@@ -205,6 +206,51 @@ func TestInvIndexAfterPrune(t *testing.T) {
 	}
 }
 
+func TestInvIndexPruneProgress(t *testing.T) {
+	logger := log.New()
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+	_, db, ii, _ := filledInvIndex(t, logger)
+	ii.pruneProgressTable = kv.TblPruningProgress
+	ctx, require := context.Background(), require.New(t)
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	ii.SetTx(tx)
+
+	var total PruneStats
+	for i := 0; total.RangesDone == 0; i++ {
+		require.Less(i, 100)
+		stat, err := ii.prune(ctx, 0, 160, 10, logEvery)
+		require.NoError(err)
+		if total.RangesDone == 0 && stat.RangesDone == 0 {
+			require.Positive(stat.RowsDeleted)
+		}
+		total.Accumulate(stat)
+	}
+	require.Positive(total.RowsDeleted)
+
+	progress, err := txPruneProgress(tx, ii.pruneProgressTable, pruneProgressKey(ii.filenameBase, "ef"), 0)
+	require.NoError(err)
+	require.Equal(uint64(160), progress)
+
+	// range is already pruned: nothing to do
+	stat, err := ii.prune(ctx, 0, 160, 10, logEvery)
+	require.NoError(err)
+	require.Zero(stat.RowsDeleted)
+	require.Equal(uint64(1), stat.RangesDone)
+
+	k, err := kv.FirstKey(tx, ii.indexKeysTable)
+	require.NoError(err)
+	require.GreaterOrEqual(binary.BigEndian.Uint64(k), uint64(160))
+
+	// unwind may write rows again
+	require.NoError(ii.resetPruneProgress())
+	progress, err = txPruneProgress(tx, ii.pruneProgressTable, pruneProgressKey(ii.filenameBase, "ef"), 0)
+	require.NoError(err)
+	require.Zero(progress)
+}
+
 func filledInvIndex(tb testing.TB, logger log.Logger) (string, kv.RwDB, *InvertedIndex, uint64) {
 	tb.Helper()
 	return filledInvIndexOfSize(tb, uint64(1000), 16, 31, logger)
@@ -352,7 +398,7 @@ func mergeInverted(tb testing.TB, db kv.RwDB, ii *InvertedIndex, txs uint64) {
 			sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
 			require.NoError(tb, err)
 			ii.integrateFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
-			err = ii.prune(ctx, step*ii.aggregationStep, (step+1)*ii.aggregationStep, math.MaxUint64, logEvery)
+			_, err = ii.prune(ctx, step*ii.aggregationStep, (step+1)*ii.aggregationStep, math.MaxUint64, logEvery)
 			require.NoError(tb, err)
 			var found bool
 			var startTxNum, endTxNum uint64
@@ -402,7 +448,7 @@ func TestInvIndexRanges(t *testing.T) {
 			sf, err := ii.buildFiles(ctx, step, bs, background.NewProgressSet())
 			require.NoError(t, err)
 			ii.integrateFiles(sf, step*ii.aggregationStep, (step+1)*ii.aggregationStep)
-			err = ii.prune(ctx, step*ii.aggregationStep, (step+1)*ii.aggregationStep, math.MaxUint64, logEvery)
+			_, err = ii.prune(ctx, step*ii.aggregationStep, (step+1)*ii.aggregationStep, math.MaxUint64, logEvery)
 			require.NoError(t, err)
 		}()
 	}
@@ -426,7 +472,7 @@ func TestInvIndexScanFiles(t *testing.T) {
 
 	// Recreate InvertedIndex to scan the files
 	var err error
-	ii, err = NewInvertedIndex(path, path, ii.aggregationStep, ii.filenameBase, ii.indexKeysTable, ii.indexTable, false, nil, logger)
+	ii, err = NewInvertedIndex(path, path, ii.aggregationStep, ii.filenameBase, ii.indexKeysTable, ii.indexTable, RawValues, false, nil, logger)
 	require.NoError(t, err)
 	defer ii.Close()
 
@@ -434,6 +480,32 @@ func TestInvIndexScanFiles(t *testing.T) {
 	checkRanges(t, db, ii, txs)
 }
 
+func TestInvIndexValueCodec(t *testing.T) {
+	logger := log.New()
+	for _, codec := range []ValueCodec{CompressedValuesReuseDict, xorValueCodec{}, xorValueCodec{compressed: true}} {
+		codec := codec
+		t.Run(codec.Name(), func(t *testing.T) {
+			path, db, ii, txs := filledInvIndex(t, logger)
+			ii.codec = codec
+			mergeInverted(t, db, ii, txs)
+			checkRanges(t, db, ii, txs)
+
+			// codec of files is taken from their header - not from configuration
+			ii2, err := NewInvertedIndex(path, path, ii.aggregationStep, ii.filenameBase, ii.indexKeysTable, ii.indexTable, RawValues, false, nil, logger)
+			require.NoError(t, err)
+			defer ii2.Close()
+			require.NoError(t, ii2.OpenFolder())
+			ii2.files.Walk(func(items []*filesItem) bool {
+				for _, item := range items {
+					require.Equal(t, codec.Name(), item.codec.Name(), item.decompressor.FileName())
+				}
+				return true
+			})
+			checkRanges(t, db, ii2, txs)
+		})
+	}
+}
+
 func TestChangedKeysIterator(t *testing.T) {
 	logger := log.New()
 	_, db, ii, txs := filledInvIndex(t, logger)
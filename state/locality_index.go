@@ -33,6 +33,7 @@ import (
 	"github.com/ledgerwatch/erigon-lib/kv/bitmapdb"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
 	"github.com/ledgerwatch/log/v3"
+	"golang.org/x/exp/slices"
 )
 
 const LocalityIndexUint64Limit = 64 //bitmap spend 1 bit per file, stored as uint64
@@ -223,24 +224,72 @@ func (out *ctxLocalityIdx) Close(logger log.Logger) {
 }
 
 func closeLocalityIndexFilesAndRemove(i *ctxLocalityIdx, logger log.Logger) {
+	readOnly := false
 	if i.file.src != nil {
+		readOnly = i.file.src.readOnly
 		i.file.src.closeFilesAndRemove()
 		i.file.src = nil
 	}
 	if i.bm != nil {
 		i.bm.Close()
-		if err := os.Remove(i.bm.FilePath()); err != nil {
-			logger.Trace("os.Remove", "err", err, "file", i.bm.FileName())
+		if !readOnly {
+			if err := os.Remove(i.bm.FilePath()); err != nil {
+				logger.Trace("os.Remove", "err", err, "file", i.bm.FileName())
+			}
 		}
 		i.bm = nil
 	}
 }
 
+// openListReadOnly - read-only analog of OpenList: if list has other (bigger) file than currently open one,
+// opens it and retires current one - it stays open until last context using it is closed.
+func (li *LocalityIndex) openListReadOnly(fNames []string) error {
+	if li == nil {
+		return nil
+	}
+	cur, curBm := li.file, li.bm
+	li.file, li.bm = nil, nil
+	_ = li.scanStateFiles(fNames)
+	if cur != nil && li.file != nil && cur.startTxNum == li.file.startTxNum && cur.endTxNum == li.file.endTxNum {
+		li.file, li.bm = cur, curBm
+		return nil
+	}
+	if li.file != nil {
+		li.file.readOnly = true
+	}
+	if err := li.openFiles(); err != nil {
+		return fmt.Errorf("LocalityIndex.openListReadOnly: %s, %w", li.filenameBase, err)
+	}
+	if li.file == nil {
+		li.roFiles.Store(nil)
+		li.roBmFile.Store(nil)
+	}
+	if cur == nil {
+		return nil
+	}
+	cur.canDelete.Store(true)
+	if cur.refcount.Load() == 0 {
+		closeLocalityIndexFilesAndRemove(&ctxLocalityIdx{file: &ctxItem{src: cur}, bm: curBm}, li.logger)
+	}
+	return nil
+}
+
 func (li *LocalityIndex) Close() {
 	li.closeWhatNotInList([]string{})
 	li.reCalcRoFiles()
 }
-func (li *LocalityIndex) Files() (res []string) { return res }
+func (li *LocalityIndex) Files() (res []string) {
+	if li == nil {
+		return nil
+	}
+	if li.file != nil && li.file.index != nil {
+		res = append(res, li.file.index.FileName())
+	}
+	if li.bm != nil {
+		res = append(res, li.bm.FileName())
+	}
+	return res
+}
 func (li *LocalityIndex) NewIdxReader() *recsplit.IndexReader {
 	if li != nil && li.file != nil && li.file.index != nil {
 		return recsplit.NewIndexReader(li.file.index)
@@ -270,6 +319,31 @@ func (li *LocalityIndex) lookupIdxFiles(loc *ctxLocalityIdx, key []byte, fromTxN
 	return fn1 * StepsInBiggestFile, fn2 * StepsInBiggestFile, loc.file.endTxNum, ok1, ok2
 }
 
+// lookupFiles - numbers of frozen files (of StepsInBiggestFile steps) which may have given key.
+// Only files with endTxNum <= lastIndexedTxNum are covered by index, ok=false if there is no index.
+// For existing key list is exact, for non-existing key it may have false-positives.
+func (li *LocalityIndex) lookupFiles(loc *ctxLocalityIdx, key []byte) (fileNums []uint64, lastIndexedTxNum uint64, ok bool) {
+	if li == nil || loc == nil || loc.bm == nil {
+		return nil, 0, false
+	}
+	if loc.reader == nil {
+		loc.reader = recsplit.NewIndexReader(loc.file.src.index)
+	}
+	fileNums, err := loc.bm.At(loc.reader.Lookup(key))
+	if err != nil {
+		panic(err)
+	}
+	return fileNums, loc.file.endTxNum, true
+}
+
+// mayContain - false if file is covered by lookupFiles result and key is not in it
+func (li *LocalityIndex) mayContain(item *ctxItem, fileNums []uint64, lastIndexedTxNum uint64) bool {
+	if !item.src.frozen || item.endTxNum > lastIndexedTxNum {
+		return true
+	}
+	return slices.Contains(fileNums, item.startTxNum/li.aggregationStep/StepsInBiggestFile)
+}
+
 func (li *LocalityIndex) missedIdxFiles(ii *InvertedIndexContext) (toStep uint64, idxExists bool) {
 	if len(ii.files) == 0 {
 		return 0, true
@@ -319,7 +393,6 @@ func (li *LocalityIndex) buildFiles(ctx context.Context, ic *InvertedIndexContex
 	defer rs.Close()
 	rs.LogLvl(log.LvlTrace)
 
-	i := uint64(0)
 	for {
 		dense, err := bitmapdb.NewFixedSizeBitmapsWriter(filePath, int(it.FilesAmount()), uint64(count), li.logger)
 		if err != nil {
@@ -327,13 +400,15 @@ func (li *LocalityIndex) buildFiles(ctx context.Context, ic *InvertedIndexContex
 		}
 		defer dense.Close()
 
+		i := uint64(0)
 		it = ic.iterateKeysLocality(toStep * li.aggregationStep)
 		for it.HasNext() {
 			k, inFiles := it.Next()
 			if err := dense.AddArray(i, inFiles); err != nil {
 				return nil, err
 			}
-			if err = rs.AddKey(k, 0); err != nil {
+			// recsplit without enums returns stored value: ordinal of key's bitmap
+			if err = rs.AddKey(k, i); err != nil {
 				return nil, err
 			}
 			i++
@@ -375,9 +450,7 @@ func (li *LocalityIndex) buildFiles(ctx context.Context, ic *InvertedIndexContex
 }
 
 func (li *LocalityIndex) integrateFiles(sf LocalityIndexFiles, txNumFrom, txNumTo uint64) {
-	if li.file != nil {
-		li.file.canDelete.Store(true)
-	}
+	cur, curBm := li.file, li.bm
 	li.file = &filesItem{
 		startTxNum: txNumFrom,
 		endTxNum:   txNumTo,
@@ -386,6 +459,14 @@ func (li *LocalityIndex) integrateFiles(sf LocalityIndexFiles, txNumFrom, txNumT
 	}
 	li.bm = sf.bm
 	li.reCalcRoFiles()
+	if cur == nil {
+		return
+	}
+	// previous index is replaced by bigger one: last reader removes it
+	cur.canDelete.Store(true)
+	if cur.refcount.Load() == 0 && (cur.index == nil || sf.index == nil || cur.index.FilePath() != sf.index.FilePath()) {
+		closeLocalityIndexFilesAndRemove(&ctxLocalityIdx{file: &ctxItem{src: cur}, bm: curBm}, li.logger)
+	}
 }
 
 func (li *LocalityIndex) BuildMissedIndices(ctx context.Context, ii *InvertedIndexContext) error {
@@ -423,6 +504,7 @@ type LocalityIterator struct {
 	hc               *InvertedIndexContext
 	h                ReconHeapOlderFirst
 	files, nextFiles []uint64
+	res              []uint64 // returned by Next, valid until next call
 	key, nextKey     []byte
 	progress         uint64
 	hasNext          bool
@@ -434,7 +516,7 @@ func (si *LocalityIterator) advance() {
 	for si.h.Len() > 0 {
 		top := heap.Pop(&si.h).(*ReconItem)
 		key := top.key
-		_, offset := top.g.NextUncompressed()
+		offset := skipValue(top.g, top.codec)
 		si.progress += offset - top.lastOffset
 		top.lastOffset = offset
 		inStep := uint32(top.startTxNum / si.hc.ii.aggregationStep)
@@ -464,7 +546,8 @@ func (si *LocalityIterator) advance() {
 	}
 	si.nextFiles, si.files = si.files, si.nextFiles[:0]
 	si.nextKey = si.key
-	si.hasNext = false
+	si.hasNext = si.key != nil
+	si.key = nil
 }
 
 func (si *LocalityIterator) HasNext() bool { return si.hasNext }
@@ -474,8 +557,10 @@ func (si *LocalityIterator) Progress() float64 {
 func (si *LocalityIterator) FilesAmount() uint64 { return si.filesAmount }
 
 func (si *LocalityIterator) Next() ([]byte, []uint64) {
+	key := si.nextKey
+	si.res = append(si.res[:0], si.nextFiles...)
 	si.advance()
-	return si.nextKey, si.nextFiles
+	return key, si.res
 }
 
 func (ic *InvertedIndexContext) iterateKeysLocality(uptoTxNum uint64) *LocalityIterator {
@@ -493,7 +578,7 @@ func (ic *InvertedIndexContext) iterateKeysLocality(uptoTxNum uint64) *LocalityI
 		if g.HasNext() {
 			key, offset := g.NextUncompressed()
 
-			heapItem := &ReconItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, g: g, txNum: ^item.endTxNum, key: key, startOffset: offset, lastOffset: offset}
+			heapItem := &ReconItem{startTxNum: item.startTxNum, endTxNum: item.endTxNum, g: g, codec: item.src.codec, txNum: ^item.endTxNum, key: key, startOffset: offset, lastOffset: offset}
 			heap.Push(&si.h, heapItem)
 		}
 		si.totalOffsets += uint64(g.Size())
@@ -44,11 +44,11 @@ func TestLocality(t *testing.T) {
 		it := ic.iterateKeysLocality(math.MaxUint64)
 		require.True(it.HasNext())
 		key, bitmap := it.Next()
-		require.Equal(uint64(2), binary.BigEndian.Uint64(key))
+		require.Equal(uint64(1), binary.BigEndian.Uint64(key))
 		require.Equal([]uint64{0, 1}, bitmap)
 		require.True(it.HasNext())
 		key, bitmap = it.Next()
-		require.Equal(uint64(3), binary.BigEndian.Uint64(key))
+		require.Equal(uint64(2), binary.BigEndian.Uint64(key))
 		require.Equal([]uint64{0, 1}, bitmap)
 
 		var last []byte
@@ -0,0 +1,179 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// LogsFilter - eth_getLogs-like filter over LogAddrIdx and LogTopicIdx:
+//   - OR between Addresses
+//   - OR between topics of same position, AND between positions. Empty position - means any topic
+//   - AND between addresses and topics
+//
+// LogTopicIdx doesn't store position of topic - so result is a superset: txNums which have all required
+// topics on any positions. Caller must check receipts of returned txNums anyway.
+type LogsFilter struct {
+	Addresses [][]byte
+	Topics    [][][]byte
+
+	// same semantic as in IdxRange: Asc: [FromTxNum, ToTxNum), Desc: [FromTxNum, ToTxNum) and FromTxNum > ToTxNum. -1 means unbounded
+	FromTxNum, ToTxNum int
+	Order              order.By
+	Limit              int // -1 means unlimited
+}
+
+// LogsRange - returns txNums which match filter. Iterator must be closed.
+// Result is resumable: LogsIter.Cursor() returns filter of next page.
+func (ac *AggregatorV3Context) LogsRange(f LogsFilter, tx kv.Tx) (*LogsIter, error) {
+	return logsRange(ac.logAddrs, ac.logTopics, f, tx)
+}
+
+func logsRange(addrs, topics *InvertedIndexContext, f LogsFilter, tx kv.Tx) (*LogsIter, error) {
+	groups := planLogsFilter(f)
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("LogsRange: filter has no addresses and no topics")
+	}
+	res := &LogsIter{filter: f}
+	if f.Limit == 0 {
+		res.it = iter.EmptyU64
+		return res, nil
+	}
+
+	cmp := func(a, b uint64) int {
+		switch {
+		case a == b:
+			return 0
+		case (a < b) == bool(f.Order):
+			return -1
+		default:
+			return 1
+		}
+	}
+	var ands []iter.Unary[uint64]
+	closeAll := func(its []iter.Unary[uint64]) {
+		for _, it := range its {
+			if c, ok := it.(iter.Closer); ok {
+				c.Close()
+			}
+		}
+	}
+	for gi, group := range groups {
+		ic := topics
+		if gi == 0 && len(f.Addresses) > 0 {
+			ic = addrs
+		}
+		ors := make([]iter.Unary[uint64], 0, len(group))
+		for _, key := range group {
+			it, err := ic.IdxRange(key, f.FromTxNum, f.ToTxNum, f.Order, -1, tx)
+			if err != nil {
+				closeAll(ors)
+				closeAll(ands)
+				return nil, err
+			}
+			ors = append(ors, it)
+		}
+		if len(ors) == 1 {
+			ands = append(ands, ors[0])
+			continue
+		}
+		ands = append(ands, iter.Distinct[uint64](iter.MergeN[uint64](ors, cmp, -1)))
+	}
+	switch {
+	case len(ands) > 1:
+		res.it = iter.IntersectN[uint64](ands, cmp, f.Limit)
+	case f.Limit > 0:
+		res.it = iter.Take[uint64](ands[0], f.Limit)
+	default:
+		res.it = ands[0]
+	}
+	return res, nil
+}
+
+// planLogsFilter - returns groups of keys: OR inside group, AND between groups.
+// First group is addresses (if any). Duplicated keys and "any topic" positions are dropped.
+func planLogsFilter(f LogsFilter) (groups [][][]byte) {
+	if len(f.Addresses) > 0 {
+		groups = append(groups, dedupKeys(f.Addresses))
+	}
+	for _, position := range f.Topics {
+		if len(position) == 0 {
+			continue
+		}
+		groups = append(groups, dedupKeys(position))
+	}
+	return groups
+}
+
+func dedupKeys(keys [][]byte) [][]byte {
+	seen := make(map[string]struct{}, len(keys))
+	res := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		if _, ok := seen[string(k)]; ok {
+			continue
+		}
+		seen[string(k)] = struct{}{}
+		res = append(res, k)
+	}
+	return res
+}
+
+// LogsIter - iter.U64 of txNums matching LogsFilter. Remembers last returned txNum - to resume iteration.
+type LogsIter struct {
+	it       iter.U64
+	filter   LogsFilter
+	last     uint64
+	returned int
+}
+
+func (it *LogsIter) HasNext() bool { return it.it.HasNext() }
+func (it *LogsIter) Next() (uint64, error) {
+	n, err := it.it.Next()
+	if err != nil {
+		return 0, err
+	}
+	it.last, it.returned = n, it.returned+1
+	return n, nil
+}
+func (it *LogsIter) Close() {
+	if c, ok := it.it.(iter.Closer); ok {
+		c.Close()
+	}
+}
+
+// Cursor - filter which continues right after last returned txNum, with same Limit (next page).
+// If nothing was returned yet - returns original filter.
+func (it *LogsIter) Cursor() LogsFilter {
+	f := it.filter
+	if it.returned == 0 {
+		return f
+	}
+	if f.Order {
+		f.FromTxNum = int(it.last) + 1
+		return f
+	}
+	if it.last == 0 {
+		f.Limit = 0 // nothing is lower than txNum=0
+		return f
+	}
+	f.FromTxNum = int(it.last) - 1
+	return f
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+)
+
+func TestLogsRange(t *testing.T) {
+	logger := log.New()
+	_, db, ii, txs := filledInvIndex(t, logger)
+	mergeInverted(t, db, ii, txs)
+
+	roTx, err := db.BeginRo(context.Background())
+	require.NoError(t, err)
+	defer roTx.Rollback()
+	ic := ii.MakeContext()
+	defer ic.Close()
+
+	key := func(n uint64) []byte {
+		var k [8]byte
+		binary.BigEndian.PutUint64(k[:], n)
+		return k[:]
+	}
+	// key N is present in every txNum which is multiple of N, same index is used for addresses and topics
+	f := LogsFilter{
+		Addresses: [][]byte{key(2), key(2)},
+		Topics:    [][][]byte{{key(3), key(5)}, nil, {key(7)}},
+		FromTxNum: 10, ToTxNum: 900,
+		Order: order.Asc, Limit: -1,
+	}
+	var expect []uint64
+	for txNum := uint64(10); txNum < 900; txNum++ {
+		if txNum%2 == 0 && (txNum%3 == 0 || txNum%5 == 0) && txNum%7 == 0 {
+			expect = append(expect, txNum)
+		}
+	}
+
+	it, err := logsRange(ic, ic, f, roTx)
+	require.NoError(t, err)
+	iter.ExpectEqualU64(t, iter.Array(expect), it)
+	it.Close()
+
+	f.Order, f.FromTxNum, f.ToTxNum = order.Desc, 899, 9
+	it, err = logsRange(ic, ic, f, roTx)
+	require.NoError(t, err)
+	iter.ExpectEqualU64(t, iter.ReverseArray(expect), it)
+	it.Close()
+
+	// paging by cursor gives same result
+	for _, asc := range []order.By{order.Asc, order.Desc} {
+		f.Order, f.Limit = asc, 4
+		f.FromTxNum, f.ToTxNum = 10, 900
+		if !asc {
+			f.FromTxNum, f.ToTxNum = 899, 9
+		}
+		var got []uint64
+		for page := 0; page < 100; page++ {
+			it, err = logsRange(ic, ic, f, roTx)
+			require.NoError(t, err)
+			res, err := iter.ToArr[uint64](it)
+			require.NoError(t, err)
+			require.LessOrEqual(t, len(res), 4)
+			got = append(got, res...)
+			f = it.Cursor()
+			it.Close()
+			if len(res) < 4 {
+				break
+			}
+		}
+		if !asc {
+			require.True(t, slices.IsSortedFunc(got, func(a, b uint64) bool { return a > b }))
+			slices.SortFunc(got, func(a, b uint64) bool { return a < b })
+		}
+		require.Equal(t, expect, got)
+	}
+
+	// only topics
+	it, err = logsRange(ic, ic, LogsFilter{Topics: [][][]byte{{key(31)}}, FromTxNum: -1, ToTxNum: -1, Order: order.Asc, Limit: 2}, roTx)
+	require.NoError(t, err)
+	iter.ExpectEqualU64(t, iter.Array([]uint64{31, 62}), it)
+	it.Close()
+
+	_, err = logsRange(ic, ic, LogsFilter{Topics: [][][]byte{nil}, Limit: -1}, roTx)
+	require.Error(t, err)
+}
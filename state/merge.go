@@ -22,10 +22,12 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/ledgerwatch/erigon-lib/common/background"
 	"github.com/ledgerwatch/log/v3"
 
@@ -488,6 +490,7 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 				if historyIn.bindex != nil {
 					historyIn.bindex.Close()
 				}
+				historyIn.existence.Close()
 			}
 			if valuesIn != nil {
 				if valuesIn.decompressor != nil {
@@ -499,6 +502,7 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 				if valuesIn.bindex != nil {
 					valuesIn.bindex.Close()
 				}
+				valuesIn.existence.Close()
 			}
 		}
 	}()
@@ -521,6 +525,7 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 		if comp, err = compress.NewCompressor(ctx, "merge", datPath, d.tmpdir, compress.MinPatternScore, workers, log.LvlTrace, d.logger); err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s history compressor: %w", d.filenameBase, err)
 		}
+		setValueCodec(comp, d.codec, valuesFiles)
 		if d.noFsync {
 			comp.DisableFsync()
 		}
@@ -534,15 +539,14 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 			g.Reset(0)
 			if g.HasNext() {
 				key, _ := g.NextUncompressed()
-				var val []byte
-				if d.compressVals {
-					val, _ = g.Next(nil)
-				} else {
-					val, _ = g.NextUncompressed()
+				val, err := nextValue(g, item.codec)
+				if err != nil {
+					return nil, nil, nil, err
 				}
 				heap.Push(&cp, &CursorItem{
 					t:        FILE_CURSOR,
 					dg:       g,
+					codec:    item.codec,
 					key:      key,
 					val:      val,
 					endTxNum: item.endTxNum,
@@ -556,7 +560,7 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 		// instead, the pair from the previous iteration is processed first - `keyBuf=>valBuf`. After that, `keyBuf` and `valBuf` are assigned
 		// to `lastKey` and `lastVal` correspondingly, and the next step of multi-way merge happens. Therefore, after the multi-way merge loop
 		// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
-		var keyBuf, valBuf []byte
+		var keyBuf, valBuf, encBuf []byte
 		for cp.Len() > 0 {
 			lastKey := common.Copy(cp[0].key)
 			lastVal := common.Copy(cp[0].val)
@@ -565,10 +569,8 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 				ci1 := cp[0]
 				if ci1.dg.HasNext() {
 					ci1.key, _ = ci1.dg.NextUncompressed()
-					if d.compressVals {
-						ci1.val, _ = ci1.dg.Next(ci1.val[:0])
-					} else {
-						ci1.val, _ = ci1.dg.NextUncompressed()
+					if ci1.val, err = nextValue(ci1.dg, ci1.codec); err != nil {
+						return nil, nil, nil, err
 					}
 					heap.Fix(&cp, 0)
 				} else {
@@ -584,15 +586,8 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 						return nil, nil, nil, err
 					}
 					keyCount++ // Only counting keys, not values
-					switch d.compressVals {
-					case true:
-						if err = comp.AddWord(valBuf); err != nil {
-							return nil, nil, nil, err
-						}
-					default:
-						if err = comp.AddUncompressedWord(valBuf); err != nil {
-							return nil, nil, nil, err
-						}
+					if encBuf, err = addValue(comp, d.codec, valBuf, encBuf); err != nil {
+						return nil, nil, nil, err
 					}
 				}
 				keyBuf = append(keyBuf[:0], lastKey...)
@@ -604,14 +599,8 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 				return nil, nil, nil, err
 			}
 			keyCount++ // Only counting keys, not values
-			if d.compressVals {
-				if err = comp.AddWord(valBuf); err != nil {
-					return nil, nil, nil, err
-				}
-			} else {
-				if err = comp.AddUncompressedWord(valBuf); err != nil {
-					return nil, nil, nil, err
-				}
+			if _, err = addValue(comp, d.codec, valBuf, encBuf); err != nil {
+				return nil, nil, nil, err
 			}
 		}
 		if err = comp.Compress(); err != nil {
@@ -624,6 +613,10 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 		if valuesIn.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 			return nil, nil, nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 		}
+		if err = d.manifest.prepare(valuesIn.decompressor); err != nil {
+			return nil, nil, nil, fmt.Errorf("merge %s checksum [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+		}
+		valuesIn.codec = d.codec
 
 		idxFileName := fmt.Sprintf("%s.%d-%d.kvi", d.filenameBase, r.valuesStartTxNum/d.aggregationStep, r.valuesEndTxNum/d.aggregationStep)
 		idxPath := filepath.Join(d.dir, idxFileName)
@@ -650,6 +643,13 @@ func (d *Domain) mergeFiles(ctx context.Context, valuesFiles, indexFiles, histor
 			return nil, nil, nil, fmt.Errorf("merge %s btindex2 [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
 		}
 		valuesIn.bindex = bt
+
+		if d.withExistenceFilter {
+			filterPath := filepath.Join(d.dir, strings.TrimSuffix(idxFileName, "kvi")+"kvf")
+			if valuesIn.existence, err = buildExistenceFilterThenOpen(ctx, valuesIn.decompressor, d.codec, filterPath, d.noFsync); err != nil {
+				return nil, nil, nil, fmt.Errorf("merge %s filter [%d-%d]: %w", d.filenameBase, r.valuesStartTxNum, r.valuesEndTxNum, err)
+			}
+		}
 	}
 	closeItem = false
 	d.stats.MergesCount++
@@ -697,6 +697,7 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 	if ii.noFsync {
 		comp.DisableFsync()
 	}
+	setValueCodec(comp, ii.codec, files)
 	p := ps.AddNew("merge "+datFileName, 1)
 	defer ps.Delete(p)
 
@@ -708,11 +709,15 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 		g.Reset(0)
 		if g.HasNext() {
 			key, _ := g.Next(nil)
-			val, _ := g.Next(nil)
+			val, err := nextValue(g, item.codec)
+			if err != nil {
+				return nil, err
+			}
 			//fmt.Printf("heap push %s [%d] %x\n", item.decompressor.FilePath(), item.endTxNum, key)
 			heap.Push(&cp, &CursorItem{
 				t:        FILE_CURSOR,
 				dg:       g,
+				codec:    item.codec,
 				key:      key,
 				val:      val,
 				endTxNum: item.endTxNum,
@@ -721,21 +726,35 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 		}
 	}
 	keyCount := 0
+	retention := ii.mergeRetention(files)
+	// fence of input file stays fence in merged file: versions before it are dropped
+	fencedInputs := map[uint64]*recsplit.IndexReader{} // endTxNum -> index of input which has fenced keys
+	filesByEnd := map[uint64]*filesItem{}
+	for _, item := range files {
+		if item.fenced != nil {
+			fencedInputs[item.endTxNum], filesByEnd[item.endTxNum] = recsplit.NewIndexReader(item.index), item
+		}
+	}
+	var fencedKeys roaring.Bitmap // ordinals of output keys which have fence
+	var ordinal uint32
 
 	// In the loop below, the pair `keyBuf=>valBuf` is always 1 item behind `lastKey=>lastVal`.
 	// `lastKey` and `lastVal` are taken from the top of the multi-way merge (assisted by the CursorHeap cp), but not processed right away
 	// instead, the pair from the previous iteration is processed first - `keyBuf=>valBuf`. After that, `keyBuf` and `valBuf` are assigned
 	// to `lastKey` and `lastVal` correspondingly, and the next step of multi-way merge happens. Therefore, after the multi-way merge loop
 	// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
-	var keyBuf, valBuf []byte
+	var keyBuf, valBuf, encBuf []byte
 	for cp.Len() > 0 {
 		lastKey := common.Copy(cp[0].key)
 		lastVal := common.Copy(cp[0].val)
-		var mergedOnce bool
+		var mergedOnce, fenced bool
 
 		// Advance all the items that have this key (including the top)
 		for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
 			ci1 := cp[0]
+			if r, ok := fencedInputs[ci1.endTxNum]; ok && !fenced {
+				fenced = filesByEnd[ci1.endTxNum].keyFenced(r, lastKey)
+			}
 			if mergedOnce {
 				if lastVal, err = mergeEfs(ci1.val, lastVal, nil); err != nil {
 					return nil, fmt.Errorf("merge %s inverted index: %w", ii.filenameBase, err)
@@ -746,19 +765,34 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 			//fmt.Printf("multi-way %s [%d] %x\n", ii.indexKeysTable, ci1.endTxNum, ci1.key)
 			if ci1.dg.HasNext() {
 				ci1.key, _ = ci1.dg.NextUncompressed()
-				ci1.val, _ = ci1.dg.NextUncompressed()
+				if ci1.val, err = nextValue(ci1.dg, ci1.codec); err != nil {
+					return nil, err
+				}
 				//fmt.Printf("heap next push %s [%d] %x\n", ii.indexKeysTable, ci1.endTxNum, ci1.key)
 				heap.Fix(&cp, 0)
 			} else {
 				heap.Pop(&cp)
 			}
 		}
+		if !retention.Empty() {
+			var dropped bool
+			if lastVal, dropped, err = retention.filter(lastVal, nil); err != nil {
+				return nil, fmt.Errorf("merge %s inverted index: %w", ii.filenameBase, err)
+			}
+			if lastVal == nil { // all versions are dropped
+				continue
+			}
+			if fenced || dropped {
+				fencedKeys.Add(ordinal)
+			}
+			ordinal++
+		}
 		if keyBuf != nil {
 			if err = comp.AddUncompressedWord(keyBuf); err != nil {
 				return nil, err
 			}
 			keyCount++ // Only counting keys, not values
-			if err = comp.AddUncompressedWord(valBuf); err != nil {
+			if encBuf, err = addValue(comp, ii.codec, valBuf, encBuf); err != nil {
 				return nil, err
 			}
 		}
@@ -770,7 +804,7 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 			return nil, err
 		}
 		keyCount++ // Only counting keys, not values
-		if err = comp.AddUncompressedWord(valBuf); err != nil {
+		if encBuf, err = addValue(comp, ii.codec, valBuf, encBuf); err != nil {
 			return nil, err
 		}
 	}
@@ -779,10 +813,23 @@ func (ii *InvertedIndex) mergeFiles(ctx context.Context, files []*filesItem, sta
 	}
 	comp.Close()
 	comp = nil
+	if !retention.Empty() {
+		if err = writeRetention(datPath, retention, ii.noFsync); err != nil {
+			return nil, fmt.Errorf("merge %s retention [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
+		}
+	}
 	outItem = newFilesItem(startTxNum, endTxNum, ii.aggregationStep)
+	outItem.codec = ii.codec
+	outItem.retention = retention
 	if outItem.decompressor, err = compress.NewDecompressor(datPath); err != nil {
 		return nil, fmt.Errorf("merge %s decompressor [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
 	}
+	if outItem.fenced, err = writeFenced(outItem.decompressor, &fencedKeys, ii.noFsync); err != nil {
+		return nil, fmt.Errorf("merge %s fenced keys [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
+	}
+	if err = ii.manifest.prepare(outItem.decompressor); err != nil {
+		return nil, fmt.Errorf("merge %s checksum [%d-%d]: %w", ii.filenameBase, startTxNum, endTxNum, err)
+	}
 	ps.Delete(p)
 
 	idxFileName := fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, startTxNum/ii.aggregationStep, endTxNum/ii.aggregationStep)
@@ -846,6 +893,7 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 					if historyIn.index != nil {
 						historyIn.index.Close()
 					}
+					historyIn.existence.Close()
 				}
 			}
 		}()
@@ -856,6 +904,7 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		if comp, err = compress.NewCompressor(ctx, "merge", datPath, h.tmpdir, compress.MinPatternScore, workers, log.LvlTrace, h.logger); err != nil {
 			return nil, nil, fmt.Errorf("merge %s history compressor: %w", h.filenameBase, err)
 		}
+		setValueCodec(comp, h.codec, historyFiles)
 		if h.noFsync {
 			comp.DisableFsync()
 		}
@@ -868,9 +917,10 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 			g.Reset(0)
 			if g.HasNext() {
 				var g2 *compress.Getter
+				var codec ValueCodec
 				for _, hi := range historyFiles { // full-scan, because it's ok to have different amount files. by unclean-shutdown.
 					if hi.startTxNum == item.startTxNum && hi.endTxNum == item.endTxNum {
-						g2 = hi.decompressor.MakeGetter()
+						g2, codec = hi.decompressor.MakeGetter(), hi.codec
 						break
 					}
 				}
@@ -878,11 +928,16 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 					panic(fmt.Sprintf("for file: %s, not found corresponding file to merge", g.FileName()))
 				}
 				key, _ := g.NextUncompressed()
-				val, _ := g.NextUncompressed()
+				val, err := nextValue(g, item.codec)
+				if err != nil {
+					return nil, nil, err
+				}
 				heap.Push(&cp, &CursorItem{
 					t:        FILE_CURSOR,
 					dg:       g,
 					dg2:      g2,
+					codec:    codec,
+					idxCodec: item.codec,
 					key:      key,
 					val:      val,
 					endTxNum: item.endTxNum,
@@ -895,35 +950,75 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		// instead, the pair from the previous iteration is processed first - `keyBuf=>valBuf`. After that, `keyBuf` and `valBuf` are assigned
 		// to `lastKey` and `lastVal` correspondingly, and the next step of multi-way merge happens. Therefore, after the multi-way merge loop
 		// (when CursorHeap cp is empty), there is a need to process the last pair `keyBuf=>valBuf`, because it was one step behind
-		var valBuf []byte
+		var valBuf, encBuf []byte
 		var keyCount int
+
+		// retention policy drops oldest versions of key: merged index has only txNums >= `keepFrom`
+		var retainedG *compress.Getter
+		var retainedKey, retainedVal []byte
+		if !indexIn.retention.Empty() {
+			retainedG = indexIn.decompressor.MakeGetter()
+			if retainedG.HasNext() {
+				retainedKey, _ = retainedG.NextUncompressed()
+				if retainedVal, err = nextValue(retainedG, indexIn.codec); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
 		for cp.Len() > 0 {
 			lastKey := common.Copy(cp[0].key)
+			keepFrom := uint64(0)
+			if retainedG != nil {
+				if retainedKey != nil && bytes.Equal(retainedKey, lastKey) {
+					keepFrom = eliasfano32.Min(retainedVal)
+					retainedKey, retainedVal = nil, nil
+					if retainedG.HasNext() {
+						retainedKey, _ = retainedG.NextUncompressed()
+						if retainedVal, err = nextValue(retainedG, indexIn.codec); err != nil {
+							return nil, nil, err
+						}
+					}
+				} else {
+					keepFrom = math.MaxUint64 // all versions are dropped
+				}
+			}
 			// Advance all the items that have this key (including the top)
 			for cp.Len() > 0 && bytes.Equal(cp[0].key, lastKey) {
 				ci1 := cp[0]
 				count := eliasfano32.Count(ci1.val)
+				var efIt *eliasfano32.EliasFanoIter
+				if retainedG != nil {
+					ef, _ := eliasfano32.ReadEliasFano(ci1.val)
+					efIt = ef.Iterator()
+				}
 				for i := uint64(0); i < count; i++ {
 					if !ci1.dg2.HasNext() {
 						panic(fmt.Errorf("assert: no value??? %s, i=%d, count=%d, lastKey=%x, ci1.key=%x", ci1.dg2.FileName(), i, count, lastKey, ci1.key))
 					}
-
-					if h.compressVals {
-						valBuf, _ = ci1.dg2.Next(valBuf[:0])
-						if err = comp.AddWord(valBuf); err != nil {
+					if efIt != nil {
+						txNum, err := efIt.Next()
+						if err != nil {
 							return nil, nil, err
 						}
-					} else {
-						valBuf, _ = ci1.dg2.NextUncompressed()
-						if err = comp.AddUncompressedWord(valBuf); err != nil {
-							return nil, nil, err
+						if txNum < keepFrom {
+							skipValue(ci1.dg2, ci1.codec)
+							continue
 						}
 					}
+					keyCount++
+
+					if valBuf, err = nextValue(ci1.dg2, ci1.codec); err != nil {
+						return nil, nil, err
+					}
+					if encBuf, err = addValue(comp, h.codec, valBuf, encBuf); err != nil {
+						return nil, nil, err
+					}
 				}
-				keyCount += int(count)
 				if ci1.dg.HasNext() {
 					ci1.key, _ = ci1.dg.NextUncompressed()
-					ci1.val, _ = ci1.dg.NextUncompressed()
+					if ci1.val, err = nextValue(ci1.dg, ci1.idxCodec); err != nil {
+						return nil, nil, err
+					}
 					heap.Fix(&cp, 0)
 				} else {
 					heap.Remove(&cp, 0)
@@ -938,6 +1033,9 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		if decomp, err = compress.NewDecompressor(datPath); err != nil {
 			return nil, nil, err
 		}
+		if err = h.manifest.prepare(decomp); err != nil {
+			return nil, nil, err
+		}
 		ps.Delete(p)
 
 		p = ps.AddNew("merge "+idxFileName, uint64(2*keyCount))
@@ -968,7 +1066,9 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 			valOffset = 0
 			for g.HasNext() {
 				keyBuf, _ = g.NextUncompressed()
-				valBuf, _ = g.NextUncompressed()
+				if valBuf, err = nextValue(g, indexIn.codec); err != nil {
+					return nil, nil, err
+				}
 				ef, _ := eliasfano32.ReadEliasFano(valBuf)
 				efIt := ef.Iterator()
 				for efIt.HasNext() {
@@ -978,11 +1078,7 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 					if err = rs.AddKey(historyKey, valOffset); err != nil {
 						return nil, nil, err
 					}
-					if h.compressVals {
-						valOffset, _ = g2.Skip()
-					} else {
-						valOffset, _ = g2.SkipUncompressed()
-					}
+					valOffset = skipValue(g2, h.codec)
 				}
 				p.Processed.Add(1)
 			}
@@ -1004,8 +1100,17 @@ func (h *History) mergeFiles(ctx context.Context, indexFiles, historyFiles []*fi
 		}
 		historyIn = newFilesItem(r.historyStartTxNum, r.historyEndTxNum, h.aggregationStep)
 		historyIn.decompressor = decomp
+		historyIn.codec = h.codec
 		historyIn.index = index
 
+		// keys of history file are keys of .ef file of same range
+		if h.withExistenceFilter && indexIn != nil && indexIn.startTxNum == historyIn.startTxNum && indexIn.endTxNum == historyIn.endTxNum {
+			filterPath := filepath.Join(h.dir, strings.TrimSuffix(idxFileName, "vi")+"vif")
+			if historyIn.existence, err = buildExistenceFilterThenOpen(ctx, indexIn.decompressor, indexIn.codec, filterPath, h.noFsync); err != nil {
+				return nil, nil, fmt.Errorf("merge %s history filter: %w", h.filenameBase, err)
+			}
+		}
+
 		closeItem = false
 	}
 
@@ -1039,6 +1144,7 @@ func (d *Domain) integrateMergedFiles(valuesOuts, indexOuts, historyOuts []*file
 		d.files.Delete(out)
 		out.canDelete.Store(true)
 	}
+	d.manifest.update(d.files, d.noFsync, d.logger)
 	d.reCalcRoFiles()
 }
 
@@ -1067,6 +1173,7 @@ func (ii *InvertedIndex) integrateMergedFiles(outs []*filesItem, in *filesItem)
 		ii.files.Delete(out)
 		out.canDelete.Store(true)
 	}
+	ii.manifest.update(ii.files, ii.noFsync, ii.logger)
 	ii.reCalcRoFiles()
 }
 
@@ -1097,6 +1204,7 @@ func (h *History) integrateMergedFiles(indexOuts, historyOuts []*filesItem, inde
 		h.files.Delete(out)
 		out.canDelete.Store(true)
 	}
+	h.manifest.update(h.files, h.noFsync, h.logger)
 	h.reCalcRoFiles()
 }
 
@@ -1154,6 +1262,13 @@ func (d *Domain) cleanAfterFreeze(frozenTo uint64) {
 		return true
 	})
 
+	// manifest must not list files before they are removed from disk
+	for _, out := range outs {
+		d.files.Delete(out)
+	}
+	if len(outs) > 0 {
+		d.manifest.update(d.files, d.noFsync, d.logger)
+	}
 	for _, out := range outs {
 		if out == nil {
 			panic("must not happen: " + d.filenameBase)
@@ -1189,6 +1304,13 @@ func (h *History) cleanAfterFreeze(frozenTo uint64) {
 		return true
 	})
 
+	// manifest must not list files before they are removed from disk
+	for _, out := range outs {
+		h.files.Delete(out)
+	}
+	if len(outs) > 0 {
+		h.manifest.update(h.files, h.noFsync, h.logger)
+	}
 	for _, out := range outs {
 		if out == nil {
 			panic("must not happen: " + h.filenameBase)
@@ -1232,6 +1354,13 @@ func (ii *InvertedIndex) cleanAfterFreeze(frozenTo uint64) {
 		return true
 	})
 
+	// manifest must not list files before they are removed from disk
+	for _, out := range outs {
+		ii.files.Delete(out)
+	}
+	if len(outs) > 0 {
+		ii.manifest.update(ii.files, ii.noFsync, ii.logger)
+	}
 	for _, out := range outs {
 		if out == nil {
 			panic("must not happen: " + ii.filenameBase)
@@ -1288,6 +1417,8 @@ func (ii *InvertedIndex) deleteGarbageFiles() {
 		f1 := fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep)
 		os.Remove(filepath.Join(ii.dir, f1))
 		log.Debug("[snapshots] delete garbage", f1)
+		os.Remove(retentionFilePath(filepath.Join(ii.dir, f1)))
+		os.Remove(fencedFilePath(filepath.Join(ii.dir, f1)))
 		f2 := fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep)
 		os.Remove(filepath.Join(ii.dir, f2))
 		log.Debug("[snapshots] delete garbage", f2)
@@ -0,0 +1,245 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+)
+
+var ErrMergePlanOutdated = errors.New("merge plan is outdated: files were changed after planning")
+
+// MergePlanItem - merge of some files of 1 component (history or inverted index) into 1 file
+type MergePlanItem struct {
+	Name               string // filenameBase of component: "accounts", "logaddrs", ...
+	Ext                string // extension of data file: "v" - history, "ef" - inverted index
+	StartStep, EndStep uint64 // range of output file
+	Inputs             []string
+
+	InputSize     uint64 // data files of inputs with their indices and existence filters
+	EstimatedSize uint64 // output: merge doesn't drop data (except retention), so it's about InputSize
+	TmpSize       uint64 // tmpdir space: uncompressed words of compressor and recsplit collectors
+}
+
+func (it MergePlanItem) Output() string {
+	return fmt.Sprintf("%s.%d-%d.%s", it.Name, it.StartStep, it.EndStep, it.Ext)
+}
+
+// MergePlan - dry-run of 1 merge step: which files will be merged and how much disk it needs.
+// Made by AggregatorV3.PlanMerge, executed by AggregatorV3.Merge.
+type MergePlan struct {
+	Items []MergePlanItem
+
+	// EstimatedTime - by throughput of previous merges, but not faster than MergeSchedulerCfg.Bandwidth allows
+	// (merge writes about as much as it reads). 0 - unknown: no merges were done yet and bandwidth is not limited
+	EstimatedTime time.Duration
+
+	ranges RangesV3
+}
+
+func (p *MergePlan) Empty() bool { return len(p.Items) == 0 }
+
+// Size - total size of inputs, estimated size of outputs and required temp space.
+// Inputs are removed only after merge, so merge needs `output + tmp` of free disk space.
+func (p *MergePlan) Size() (input, output, tmp uint64) {
+	for _, it := range p.Items {
+		input += it.InputSize
+		output += it.EstimatedSize
+		tmp += it.TmpSize
+	}
+	return input, output, tmp
+}
+
+// String - human-readable report of plan
+func (p *MergePlan) String() string {
+	if p.Empty() {
+		return "merge plan: nothing to merge"
+	}
+	input, output, tmp := p.Size()
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "merge plan: %d files, inputs=%s, output=~%s, tmp=~%s, disk required=~%s",
+		len(p.Items), common.ByteCount(input), common.ByteCount(output), common.ByteCount(tmp), common.ByteCount(output+tmp))
+	if p.EstimatedTime > 0 {
+		fmt.Fprintf(&sb, ", time=~%s", p.EstimatedTime.Round(time.Second))
+	}
+	sb.WriteString("\n")
+	for _, it := range p.Items {
+		fmt.Fprintf(&sb, "  %s <- %s (inputs=%s, output=~%s, tmp=~%s)\n",
+			it.Output(), strings.Join(it.Inputs, ", "), common.ByteCount(it.InputSize), common.ByteCount(it.EstimatedSize), common.ByteCount(it.TmpSize))
+	}
+	return sb.String()
+}
+
+// estimateTime - `throughput` and `bandwidth` are bytes per second, 0 - unknown/unlimited
+func (p *MergePlan) estimateTime(throughput, bandwidth float64) {
+	if bandwidth > 0 && (throughput == 0 || bandwidth < throughput) {
+		throughput = bandwidth
+	}
+	if throughput == 0 {
+		return
+	}
+	input, _, _ := p.Size()
+	p.EstimatedTime = time.Duration(float64(input) / throughput * float64(time.Second))
+}
+
+func (p *MergePlan) sameInputs(other *MergePlan) bool {
+	return slices.EqualFunc(p.Items, other.Items, func(a, b MergePlanItem) bool {
+		return a.Output() == b.Output() && slices.Equal(a.Inputs, b.Inputs)
+	})
+}
+
+func (p *MergePlan) add(name, ext string, aggStep, startTxNum, endTxNum uint64, files []*filesItem) {
+	it := MergePlanItem{Name: name, Ext: ext, StartStep: startTxNum / aggStep, EndStep: endTxNum / aggStep}
+	for _, item := range files {
+		if item == nil || item.decompressor == nil {
+			continue
+		}
+		it.Inputs = append(it.Inputs, item.decompressor.FileName())
+		dataSize, idxSize := uint64(item.decompressor.Size()), uint64(0)
+		if item.index != nil {
+			idxSize = uint64(item.index.Size())
+		}
+		it.InputSize += dataSize + idxSize
+		if item.existence != nil {
+			it.InputSize += existenceFilterHeaderSize + item.existence.bitsCount/8
+		}
+		it.TmpSize += dataSize + idxSize
+	}
+	it.EstimatedSize = it.InputSize
+	p.Items = append(p.Items, it)
+}
+
+func (p *MergePlan) addHistory(h *History, r HistoryRanges, indexFiles, historyFiles []*filesItem) {
+	if r.index {
+		p.add(h.filenameBase, "ef", h.aggregationStep, r.indexStartTxNum, r.indexEndTxNum, indexFiles)
+	}
+	if r.history {
+		p.add(h.filenameBase, "v", h.aggregationStep, r.historyStartTxNum, r.historyEndTxNum, historyFiles)
+	}
+}
+
+func (p *MergePlan) addIndex(ii *InvertedIndex, needMerge bool, startTxNum, endTxNum uint64, files []*filesItem) {
+	if needMerge {
+		p.add(ii.filenameBase, "ef", ii.aggregationStep, startTxNum, endTxNum, files)
+	}
+}
+
+// mergePlan - describes merge of files `sf` selected by `r`
+func (ac *AggregatorV3Context) mergePlan(r RangesV3, sf SelectedStaticFilesV3) *MergePlan {
+	a := ac.a
+	p := &MergePlan{ranges: r}
+	p.addHistory(a.accounts, r.accounts, sf.accountsIdx, sf.accountsHist)
+	p.addHistory(a.storage, r.storage, sf.storageIdx, sf.storageHist)
+	p.addHistory(a.code, r.code, sf.codeIdx, sf.codeHist)
+	p.addIndex(a.logAddrs, r.logAddrs, r.logAddrsStartTxNum, r.logAddrsEndTxNum, sf.logAddrs)
+	p.addIndex(a.logTopics, r.logTopics, r.logTopicsStartTxNum, r.logTopicsEndTxNum, sf.logTopics)
+	p.addIndex(a.tracesFrom, r.tracesFrom, r.tracesFromStartTxNum, r.tracesFromEndTxNum, sf.tracesFrom)
+	p.addIndex(a.tracesTo, r.tracesTo, r.tracesToStartTxNum, r.tracesToEndTxNum, sf.tracesTo)
+	for i, hr := range r.extraHistories {
+		p.addHistory(a.extraHistories[i].h, hr, sf.extraHistoriesIdx[i], sf.extraHistoriesHist[i])
+	}
+	for i, ir := range r.extraIdx {
+		p.addIndex(a.extraIdx[i].ii, ir.needMerge, ir.startTxNum, ir.endTxNum, sf.extraIdx[i])
+	}
+	return p
+}
+
+// PlanMerge - what next step of MergeLoop will do, without doing it. Pass result to Merge to execute it.
+func (a *AggregatorV3) PlanMerge() (*MergePlan, error) {
+	ac := a.MakeContext()
+	defer ac.Close()
+	r := ac.findMergeRange(a.minimaxTxNumInFiles.Load(), a.aggregationStep*StepsInBiggestFile)
+	if !r.any() {
+		return &MergePlan{ranges: r}, nil
+	}
+	sf, err := ac.staticFilesInRange(r)
+	if err != nil {
+		return nil, err
+	}
+	p := ac.mergePlan(r, sf)
+	p.estimateTime(a.scheduler.throughput(JobMerge), a.scheduler.budget.bandwidthLimit())
+	return p, nil
+}
+
+// Merge - executes plan made by PlanMerge. Returns ErrMergePlanOutdated if files of plan were changed after planning
+// (for example: merged by MergeLoop). Plan is executed as JobMerge of scheduler: it doesn't run concurrently with
+// other merges and unwind, it's limited by IOBudget of MergeSchedulerCfg. Blocks until job is done.
+func (a *AggregatorV3) Merge(ctx context.Context, plan *MergePlan, workers int) error {
+	if a.readOnly {
+		return ErrAggregatorReadOnly
+	}
+	if plan.Empty() {
+		return nil
+	}
+	input, _, _ := plan.Size()
+	done := make(chan error, 1)
+	if !a.scheduler.Schedule(JobMerge, "merge plan "+plan.Items[0].Output(), input, func(jobCtx context.Context, budget *IOBudget) error {
+		err := a.mergePlanned(ctx, jobCtx, budget, plan, workers)
+		done <- err
+		return err
+	}) {
+		if err := a.ctx.Err(); err != nil {
+			return err
+		}
+		return ErrMergePlanOutdated // same plan is already queued
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// mergePlanned - job of Merge: stops when caller of Merge or scheduler cancel it
+func (a *AggregatorV3) mergePlanned(ctx, jobCtx context.Context, budget *IOBudget, plan *MergePlan, workers int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-jobCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ac := a.MakeContext()
+	defer ac.Close()
+	sf, err := ac.staticFilesInRange(plan.ranges)
+	if err != nil {
+		return err
+	}
+	if !plan.sameInputs(ac.mergePlan(plan.ranges, sf)) {
+		return ErrMergePlanOutdated
+	}
+	if err = budget.Wait(ctx); err != nil {
+		return err
+	}
+	in, err := a.mergeStaticFiles(ctx, ac, sf, plan.ranges, workers)
+	if err != nil {
+		return err
+	}
+	budget.Spend(writtenFiles(in.items()...))
+	return nil
+}
@@ -0,0 +1,521 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// JobKind - kind of background job. Lower kind has higher priority.
+// Only 1 job of each kind can run at same time (for example: 2 merges can't pick same files).
+type JobKind uint8
+
+const (
+	JobBuildFiles   JobKind = iota // move data from DB to small files - must not wait for merges, to keep DB small
+	JobMerge                       // merge of small files into bigger
+	JobBuildIndices                // optional indices
+)
+
+func (k JobKind) String() string {
+	switch k {
+	case JobBuildFiles:
+		return "build"
+	case JobMerge:
+		return "merge"
+	case JobBuildIndices:
+		return "indices"
+	default:
+		return fmt.Sprintf("kind(%d)", uint8(k))
+	}
+}
+
+type JobState uint8
+
+const (
+	JobQueued JobState = iota
+	JobRunning
+	JobDone
+	JobFailed
+	JobCanceled
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobQueued:
+		return "queued"
+	case JobRunning:
+		return "running"
+	case JobDone:
+		return "done"
+	case JobFailed:
+		return "failed"
+	case JobCanceled:
+		return "canceled"
+	default:
+		return fmt.Sprintf("state(%d)", uint8(s))
+	}
+}
+
+type JobInfo struct {
+	ID    uint64
+	Kind  JobKind
+	Name  string
+	Size  uint64 // estimated amount of bytes job will write. Jobs of same kind: smaller first
+	State JobState
+	Err   error
+
+	Queued, Started, Finished time.Time
+}
+
+type SchedulerStats struct {
+	Paused   bool
+	Queued   []JobInfo // in order of execution
+	Running  []JobInfo
+	Finished []JobInfo // last MergeSchedulerHistory jobs, newest last
+}
+
+type MergeSchedulerCfg struct {
+	Workers   int               // max amount of jobs running at same time
+	Bandwidth datasize.ByteSize // disk write budget per second of all jobs, 0 - unlimited. See IOBudget
+	IOPS      int               // files created per second by all jobs, 0 - unlimited
+}
+
+// DefaultMergeSchedulerCfg - 1 worker per JobKind: same concurrency as before scheduler
+var DefaultMergeSchedulerCfg = MergeSchedulerCfg{Workers: 3}
+
+// MergeSchedulerHistory - how many finished jobs are kept for Stats
+const MergeSchedulerHistory = 64
+
+type JobFunc func(ctx context.Context, budget *IOBudget) error
+
+type schedJob struct {
+	JobInfo
+	run JobFunc
+}
+
+// jobsQueue - priority queue: by kind, then by size, then FIFO
+type jobsQueue []*schedJob
+
+func (q jobsQueue) Len() int { return len(q) }
+func (q jobsQueue) Less(i, j int) bool {
+	if q[i].Kind != q[j].Kind {
+		return q[i].Kind < q[j].Kind
+	}
+	if q[i].Size != q[j].Size {
+		return q[i].Size < q[j].Size
+	}
+	return q[i].ID < q[j].ID
+}
+func (q jobsQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *jobsQueue) Push(x any)   { *q = append(*q, x.(*schedJob)) }
+func (q *jobsQueue) Pop() any {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return x
+}
+
+// MergeScheduler - runs background jobs of AggregatorV3 (build files, merge, optional indices):
+//   - priorities: see JobKind and JobInfo.Size
+//   - concurrency limit and disk budgets (see IOBudget) - to not compete with blocks execution
+//   - Pause/Resume - for example, while executing blocks near chain tip
+type MergeScheduler struct {
+	ctx    context.Context
+	budget *IOBudget
+	logger log.Logger
+
+	lock     sync.Mutex
+	workers  int
+	paused   bool
+	closed   bool
+	nextID   uint64
+	queue    jobsQueue
+	running  map[uint64]*schedJob
+	finished []JobInfo
+	idle     chan struct{} // closed when nothing queued and nothing running
+	onFinish func(JobInfo)
+
+	wg sync.WaitGroup
+}
+
+func NewMergeScheduler(ctx context.Context, cfg MergeSchedulerCfg, logger log.Logger) *MergeScheduler {
+	s := &MergeScheduler{
+		ctx:      ctx,
+		budget:   &IOBudget{},
+		logger:   logger,
+		running:  map[uint64]*schedJob{},
+		onFinish: func(JobInfo) {},
+	}
+	s.SetCfg(cfg)
+	return s
+}
+
+// SetCfg - can be called at any time, new limits apply to next jobs and next IOBudget.Wait calls
+func (s *MergeScheduler) SetCfg(cfg MergeSchedulerCfg) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	s.budget.setLimits(cfg.Bandwidth, cfg.IOPS)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.workers = cfg.Workers
+	s.dispatch()
+}
+
+// OnFinish - hook called (outside of scheduler lock) after each job
+func (s *MergeScheduler) OnFinish(f func(JobInfo)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onFinish = f
+}
+
+// Schedule - adds job to queue. Returns false if job with same name is already queued (not running) - then nothing is added.
+func (s *MergeScheduler) Schedule(kind JobKind, name string, size uint64, run JobFunc) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	for _, j := range s.queue {
+		if j.Name == name {
+			return false
+		}
+	}
+	s.push(kind, name, size, run)
+	return true
+}
+
+// ScheduleExclusive - adds job to queue only if there are no queued or running jobs of same kind. Check and add are atomic.
+func (s *MergeScheduler) ScheduleExclusive(kind JobKind, name string, size uint64, run JobFunc) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed || s.kindQueuedOrRunning(kind) {
+		return false
+	}
+	s.push(kind, name, size, run)
+	return true
+}
+
+// push - must be called under lock
+func (s *MergeScheduler) push(kind JobKind, name string, size uint64, run JobFunc) {
+	s.nextID++
+	heap.Push(&s.queue, &schedJob{JobInfo: JobInfo{ID: s.nextID, Kind: kind, Name: name, Size: size, State: JobQueued, Queued: time.Now()}, run: run})
+	s.dispatch()
+}
+
+// dispatch - starts jobs from queue while it's allowed. Must be called under lock.
+func (s *MergeScheduler) dispatch() {
+	if s.paused || s.closed {
+		s.updateIdle()
+		return
+	}
+	var postponed []*schedJob
+	for len(s.queue) > 0 && len(s.running) < s.workers {
+		j := heap.Pop(&s.queue).(*schedJob)
+		if s.kindRunning(j.Kind) {
+			postponed = append(postponed, j)
+			continue
+		}
+		j.State, j.Started = JobRunning, time.Now()
+		s.running[j.ID] = j
+		s.wg.Add(1)
+		go s.runJob(j)
+	}
+	for _, j := range postponed {
+		heap.Push(&s.queue, j)
+	}
+	s.updateIdle()
+}
+
+func (s *MergeScheduler) kindRunning(kind JobKind) bool {
+	for _, j := range s.running {
+		if j.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MergeScheduler) updateIdle() {
+	isIdle := len(s.queue) == 0 && len(s.running) == 0
+	if isIdle && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+	if !isIdle && s.idle == nil {
+		s.idle = make(chan struct{})
+	}
+}
+
+func (s *MergeScheduler) runJob(j *schedJob) {
+	defer s.wg.Done()
+	err := j.run(s.ctx, s.budget)
+
+	s.lock.Lock()
+	delete(s.running, j.ID)
+	j.Finished, j.Err = time.Now(), err
+	switch {
+	case err == nil:
+		j.State = JobDone
+	case errors.Is(err, context.Canceled):
+		j.State = JobCanceled
+	default:
+		j.State = JobFailed
+		s.logger.Warn("[snapshots] background job", "kind", j.Kind, "name", j.Name, "err", err)
+	}
+	s.finished = append(s.finished, j.JobInfo)
+	if len(s.finished) > MergeSchedulerHistory {
+		s.finished = append(s.finished[:0], s.finished[len(s.finished)-MergeSchedulerHistory:]...)
+	}
+	onFinish := s.onFinish
+	s.dispatch()
+	s.lock.Unlock()
+
+	onFinish(j.JobInfo)
+}
+
+// Pause - queued jobs will not start, running jobs will block on next IOBudget.Wait
+func (s *MergeScheduler) Pause() {
+	s.budget.pause()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.paused = true
+}
+
+func (s *MergeScheduler) Resume() {
+	s.budget.resume()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.paused = false
+	s.dispatch()
+}
+
+// Idle - returns channel which is closed when scheduler has no queued and no running jobs
+func (s *MergeScheduler) Idle() <-chan struct{} {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.updateIdle()
+	if s.idle == nil {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return s.idle
+}
+
+// Running - has queued or running jobs of given kind
+func (s *MergeScheduler) Running(kind JobKind) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.kindQueuedOrRunning(kind)
+}
+
+func (s *MergeScheduler) kindQueuedOrRunning(kind JobKind) bool {
+	if s.kindRunning(kind) {
+		return true
+	}
+	for _, j := range s.queue {
+		if j.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MergeScheduler) Stats() (st SchedulerStats) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	st.Paused = s.paused
+	queue := append(jobsQueue{}, s.queue...)
+	for queue.Len() > 0 {
+		st.Queued = append(st.Queued, heap.Pop(&queue).(*schedJob).JobInfo)
+	}
+	for _, j := range s.running {
+		st.Running = append(st.Running, j.JobInfo)
+	}
+	st.Finished = append(st.Finished, s.finished...)
+	return st
+}
+
+// throughput - bytes per second of successfully finished jobs of `kind` (by their Size), 0 if there are no such jobs
+func (s *MergeScheduler) throughput(kind JobKind) float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var size uint64
+	var took time.Duration
+	for _, j := range s.finished {
+		if j.Kind == kind && j.State == JobDone && j.Size > 0 {
+			size += j.Size
+			took += j.Finished.Sub(j.Started)
+		}
+	}
+	if took <= 0 {
+		return 0
+	}
+	return float64(size) / took.Seconds()
+}
+
+// Close - drops queued jobs and waits for running. Running jobs see cancellation by ctx passed to NewMergeScheduler.
+func (s *MergeScheduler) Close() {
+	s.lock.Lock()
+	s.closed = true
+	s.queue = s.queue[:0]
+	s.updateIdle()
+	s.lock.Unlock()
+	s.budget.resume()
+	s.wg.Wait()
+}
+
+// IOBudget - disk write budget shared by all jobs of MergeScheduler. Job calls Wait before each unit of work
+// (build of 1 step, 1 merge, ...) and Spend after it - with amount of bytes and files the unit really wrote.
+// Writes above budget are paid back by time: Wait blocks next units of all jobs until spent bytes/files fit into
+// Bandwidth/IOPS. So writes of jobs are kept in budget on average, while single unit runs at full disk speed.
+type IOBudget struct {
+	lock      sync.Mutex
+	bandwidth float64 // bytes per second, 0 - unlimited
+	iops      float64 // files per second, 0 - unlimited
+	bytes     float64 // spent and not paid back yet
+	files     float64
+	paidAt    time.Time
+	resumed   chan struct{} // not nil - paused
+}
+
+func (b *IOBudget) setLimits(bandwidth datasize.ByteSize, iops int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.payBack(time.Now())
+	b.bandwidth, b.iops = float64(bandwidth.Bytes()), float64(iops)
+}
+
+// bandwidthLimit - bytes per second allowed by MergeSchedulerCfg.Bandwidth, 0 - unlimited
+func (b *IOBudget) bandwidthLimit() float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.bandwidth
+}
+
+// payBack - must be called under lock
+func (b *IOBudget) payBack(now time.Time) {
+	elapsed := now.Sub(b.paidAt).Seconds()
+	b.paidAt = now
+	b.bytes = paidBack(b.bytes, b.bandwidth, elapsed)
+	b.files = paidBack(b.files, b.iops, elapsed)
+}
+
+func paidBack(spent, perSec, elapsed float64) float64 {
+	if perSec <= 0 || spent <= perSec*elapsed {
+		return 0
+	}
+	return spent - perSec*elapsed
+}
+
+// wait - how long spent bytes/files will be paid back. Must be called under lock.
+func (b *IOBudget) wait() time.Duration {
+	var sec float64
+	if b.bandwidth > 0 {
+		sec = b.bytes / b.bandwidth
+	}
+	if b.iops > 0 && b.files/b.iops > sec {
+		sec = b.files / b.iops
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+func (b *IOBudget) pause() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.resumed == nil {
+		b.resumed = make(chan struct{})
+	}
+}
+
+func (b *IOBudget) resume() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.resumed != nil {
+		close(b.resumed)
+		b.resumed = nil
+	}
+}
+
+// Wait - blocks while scheduler is paused and until bytes/files spent by previous units are paid back
+func (b *IOBudget) Wait(ctx context.Context) error {
+	for {
+		b.lock.Lock()
+		b.payBack(time.Now())
+		resumed, wait := b.resumed, b.wait()
+		b.lock.Unlock()
+		if resumed != nil {
+			select {
+			case <-resumed:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if wait <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// Spend - charges bytes and files really written by unit of work
+func (b *IOBudget) Spend(bytes uint64, files int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.payBack(time.Now())
+	if b.bandwidth > 0 {
+		b.bytes += float64(bytes)
+	}
+	if b.iops > 0 {
+		b.files += float64(files)
+	}
+}
+
+// writtenFiles - amount of bytes and files on disk of `items` (data files with all their indices)
+func writtenFiles(items ...*filesItem) (bytes uint64, files int) {
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		for _, path := range item.filePaths() {
+			if st, err := os.Stat(path); err == nil {
+				bytes += uint64(st.Size())
+				files++
+			}
+		}
+	}
+	return bytes, files
+}
@@ -0,0 +1,167 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewMergeScheduler(ctx, MergeSchedulerCfg{Workers: 1}, log.New())
+	defer s.Close()
+
+	var lock sync.Mutex
+	var order []string
+	job := func(name string, err error) JobFunc {
+		return func(ctx context.Context, budget *IOBudget) error {
+			lock.Lock()
+			defer lock.Unlock()
+			order = append(order, name)
+			return err
+		}
+	}
+
+	t.Run("priorities", func(t *testing.T) {
+		order = nil
+		s.Pause()
+		require.True(t, s.Schedule(JobMerge, "big merge", 100, job("big merge", nil)))
+		require.True(t, s.Schedule(JobBuildIndices, "indices", 0, job("indices", nil)))
+		require.True(t, s.Schedule(JobMerge, "small merge", 10, job("small merge", nil)))
+		require.True(t, s.Schedule(JobBuildFiles, "build", 0, job("build", errors.New("no space"))))
+		require.False(t, s.Schedule(JobBuildFiles, "build", 0, job("build", nil))) // already queued
+
+		st := s.Stats()
+		require.True(t, st.Paused)
+		require.Equal(t, 4, len(st.Queued))
+		require.Equal(t, "build", st.Queued[0].Name)
+		require.Equal(t, "small merge", st.Queued[1].Name) // same kind - smaller first
+
+		s.Resume()
+		<-s.Idle()
+		require.Equal(t, []string{"build", "small merge", "big merge", "indices"}, order)
+		st = s.Stats()
+		require.Equal(t, 0, len(st.Queued)+len(st.Running))
+		require.Equal(t, 4, len(st.Finished))
+		require.Equal(t, JobFailed, st.Finished[0].State)
+		require.Error(t, st.Finished[0].Err)
+		require.Equal(t, JobDone, st.Finished[3].State)
+	})
+
+	t.Run("1 job per kind", func(t *testing.T) {
+		s.SetCfg(MergeSchedulerCfg{Workers: 4})
+		release := make(chan struct{})
+		var running, maxRunning int
+		mergeJob := func(ctx context.Context, budget *IOBudget) error {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			<-release
+			lock.Lock()
+			running--
+			lock.Unlock()
+			return nil
+		}
+		require.True(t, s.Schedule(JobMerge, "merge 1", 0, mergeJob))
+		require.True(t, s.Schedule(JobMerge, "merge 2", 0, mergeJob))
+		require.True(t, s.Schedule(JobMerge, "merge 3", 0, mergeJob))
+		close(release)
+		<-s.Idle()
+		require.Equal(t, 1, maxRunning)
+	})
+
+	t.Run("exclusive", func(t *testing.T) {
+		release := make(chan struct{})
+		blocked := func(ctx context.Context, budget *IOBudget) error { <-release; return nil }
+		require.True(t, s.ScheduleExclusive(JobBuildFiles, "build 1", 0, blocked))
+		require.False(t, s.ScheduleExclusive(JobBuildFiles, "build 2", 0, blocked)) // running
+		s.Pause()
+		require.True(t, s.ScheduleExclusive(JobMerge, "merge 1", 0, blocked))
+		require.False(t, s.ScheduleExclusive(JobMerge, "merge 2", 0, blocked)) // queued
+		s.Resume()
+		close(release)
+		<-s.Idle()
+		require.True(t, s.ScheduleExclusive(JobBuildFiles, "build 3", 0, func(ctx context.Context, budget *IOBudget) error { return nil }))
+		<-s.Idle()
+	})
+
+	t.Run("pause blocks budget", func(t *testing.T) {
+		started, waited := make(chan struct{}), make(chan struct{})
+		require.True(t, s.Schedule(JobMerge, "merge", 0, func(ctx context.Context, budget *IOBudget) error {
+			close(started)
+			err := budget.Wait(ctx)
+			close(waited)
+			return err
+		}))
+		s.Pause()
+		<-started
+		select {
+		case <-waited:
+			t.Fatal("budget must block while paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+		s.Resume()
+		<-waited
+		<-s.Idle()
+	})
+}
+
+func TestIOBudget(t *testing.T) {
+	ctx := context.Background()
+	t.Run("bandwidth", func(t *testing.T) {
+		b := &IOBudget{}
+		b.setLimits(10*datasize.KB, 0)
+		require.NoError(t, b.Wait(ctx)) // nothing spent
+		b.Spend(5*1024, 100)            // files are not limited
+		start := time.Now()
+		require.NoError(t, b.Wait(ctx)) // 5kb of 10kb/sec - ~0.5sec
+		require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+	t.Run("iops", func(t *testing.T) {
+		b := &IOBudget{}
+		b.setLimits(0, 10)
+		b.Spend(1<<40, 5)
+		start := time.Now()
+		require.NoError(t, b.Wait(ctx)) // 5 files of 10 files/sec - ~0.5sec
+		require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	})
+	t.Run("cancel", func(t *testing.T) {
+		b := &IOBudget{}
+		b.setLimits(datasize.KB, 0)
+		b.Spend(1<<20, 0)
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Error(t, b.Wait(ctx))
+	})
+	t.Run("unlimited", func(t *testing.T) {
+		b := &IOBudget{}
+		b.Spend(1<<40, 1<<20)
+		require.NoError(t, b.Wait(ctx))
+	})
+}
@@ -0,0 +1,191 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/kv"
+)
+
+// PruneStats - result of prune of 1 component (InvertedIndex, History or Domain values), or sum of them
+type PruneStats struct {
+	RowsDeleted uint64        // rows deleted from all tables of component
+	RangesDone  uint64        // requested ranges which are fully pruned, others are left for next call
+	Took        time.Duration // time spent
+}
+
+func (ps *PruneStats) Accumulate(other *PruneStats) {
+	if other == nil {
+		return
+	}
+	ps.RowsDeleted += other.RowsDeleted
+	ps.RangesDone += other.RangesDone
+	ps.Took += other.Took
+}
+
+func (ps *PruneStats) String() string {
+	return fmt.Sprintf("deleted=%d, ranges_done=%d, took=%s", ps.RowsDeleted, ps.RangesDone, ps.Took)
+}
+
+// AggregatorPruneStats - PruneStats of every component of aggregator, by name of component (see pruneProgressKey)
+type AggregatorPruneStats struct {
+	Components map[string]*PruneStats
+	Total      PruneStats
+}
+
+func (as *AggregatorPruneStats) add(name string, ps *PruneStats) {
+	if as.Components == nil {
+		as.Components = map[string]*PruneStats{}
+	}
+	if prev, ok := as.Components[name]; ok {
+		prev.Accumulate(ps)
+	} else {
+		cp := *ps
+		as.Components[name] = &cp
+	}
+	as.Total.Accumulate(ps)
+}
+
+func (as *AggregatorPruneStats) Accumulate(other *AggregatorPruneStats) {
+	for name, ps := range other.Components {
+		as.add(name, ps)
+	}
+}
+
+func (as *AggregatorPruneStats) String() string {
+	names := make([]string, 0, len(as.Components))
+	for name := range as.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res := make([]string, 0, len(names)+1)
+	res = append(res, "total: "+as.Total.String())
+	for _, name := range names {
+		res = append(res, name+": "+as.Components[name].String())
+	}
+	return strings.Join(res, "; ")
+}
+
+// Prune progress is persisted in `pruneProgressTable` (usually kv.TblPruningProgress), in same transaction as deletes.
+// Then next prune call doesn't scan rows which were already deleted, but starts from last position:
+//   - InvertedIndex (.ef) and History (.v): [from u64][progress u64] - rows with txNum in [from; progress) are pruned
+//   - Domain values (.kv): [step u64][done u8][key] - keys of `step` before `key` (or all keys if done) are pruned
+//
+// Unwind resets progress: deleted rows may appear again.
+
+func pruneProgressKey(filenameBase, ext string) []byte { return []byte(filenameBase + "." + ext) }
+
+// txPruneProgress - txNum from which prune of [txFrom; ...) can continue, txFrom if there is no applicable progress
+func txPruneProgress(tx kv.Tx, table string, key []byte, txFrom uint64) (uint64, error) {
+	if table == "" {
+		return txFrom, nil
+	}
+	v, err := tx.GetOne(table, key)
+	if err != nil {
+		return txFrom, fmt.Errorf("read prune progress %s: %w", key, err)
+	}
+	if len(v) != 16 {
+		return txFrom, nil
+	}
+	from, progress := binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:])
+	if from <= txFrom && txFrom < progress {
+		return progress, nil
+	}
+	return txFrom, nil
+}
+
+func saveTxPruneProgress(tx kv.RwTx, table string, key []byte, txFrom, progress uint64) error {
+	if table == "" {
+		return nil
+	}
+	// extend known pruned range: prune calls usually go one after another
+	v, err := tx.GetOne(table, key)
+	if err != nil {
+		return fmt.Errorf("read prune progress %s: %w", key, err)
+	}
+	if len(v) == 16 {
+		if from, prev := binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:]); from <= txFrom && txFrom <= prev {
+			txFrom = from
+		}
+	}
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:], txFrom)
+	binary.BigEndian.PutUint64(buf[8:], progress)
+	if err := tx.Put(table, key, buf[:]); err != nil {
+		return fmt.Errorf("save prune progress %s: %w", key, err)
+	}
+	return nil
+}
+
+// stepPruneProgress - key of `step` from which prune can continue (nil - from beginning), done=true if step is fully pruned
+func stepPruneProgress(tx kv.Tx, table string, key []byte, step uint64) (from []byte, done bool, err error) {
+	if table == "" {
+		return nil, false, nil
+	}
+	v, err := tx.GetOne(table, key)
+	if err != nil {
+		return nil, false, fmt.Errorf("read prune progress %s: %w", key, err)
+	}
+	if len(v) < 9 || binary.BigEndian.Uint64(v) != step {
+		return nil, false, nil
+	}
+	return common.Copy(v[9:]), v[8] == 1, nil
+}
+
+func saveStepPruneProgress(tx kv.RwTx, table string, key []byte, step uint64, done bool, from []byte) error {
+	if table == "" {
+		return nil
+	}
+	buf := make([]byte, 9+len(from))
+	binary.BigEndian.PutUint64(buf, step)
+	if done {
+		buf[8] = 1
+	}
+	copy(buf[9:], from)
+	if err := tx.Put(table, key, buf); err != nil {
+		return fmt.Errorf("save prune progress %s: %w", key, err)
+	}
+	return nil
+}
+
+// resetPruneProgress - unwind may write again rows which were pruned
+func (ii *InvertedIndex) resetPruneProgress() error {
+	return resetPruneProgress(ii.tx, ii.pruneProgressTable, pruneProgressKey(ii.filenameBase, "ef"))
+}
+
+func (h *History) resetPruneProgress() error {
+	if err := resetPruneProgress(h.tx, h.pruneProgressTable, pruneProgressKey(h.filenameBase, "v")); err != nil {
+		return err
+	}
+	return h.InvertedIndex.resetPruneProgress()
+}
+
+func resetPruneProgress(tx kv.RwTx, table string, key []byte) error {
+	if table == "" {
+		return nil
+	}
+	if err := tx.Delete(table, key); err != nil {
+		return fmt.Errorf("reset prune progress %s: %w", key, err)
+	}
+	return nil
+}
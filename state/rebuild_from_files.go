@@ -0,0 +1,230 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ledgerwatch/erigon-lib/commitment"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/etl"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+var ErrRebuildRootMismatch = errors.New("commitment root re-computed from files doesn't match stored root")
+
+// RebuildReport - result of Aggregator.RebuildFromFiles
+type RebuildReport struct {
+	RestartTxNum  uint64   // execution must continue from this txNum
+	BlockNum      uint64   // block of last txNum of restored state (RestartTxNum-1)
+	Root          []byte   // commitment root of restored state: stored one, equal to re-computed from files
+	Keys          int      // accounts and storage keys reviewed to re-compute root
+	ClearedTables []string // DB tables of domains and indices, all data of them is in files now
+}
+
+func (r *RebuildReport) String() string {
+	return fmt.Sprintf("restart_txnum=%d, block=%d, root=%x, keys=%d, cleared=%s",
+		r.RestartTxNum, r.BlockNum, r.Root, r.Keys, strings.Join(r.ClearedTables, ","))
+}
+
+// RebuildFromFiles - recovery after loss or corruption of DB tables of recent (not yet in files) data, without full resync:
+//
+//   - missed indices of files are built, files are re-opened
+//   - DB tables of domains and inverted indices are cleared: latest values of domains are served by newest files
+//   - commitment state stored in newest files is restored into commitment trie
+//   - root of restored state is validated: re-computed from scratch over all accounts and storage of files
+//
+// Files which have data after restored state can't be used (their data is not committed) - then error is returned,
+// such files must be removed before next attempt. Changes are made in tx passed to SetTx: on error it must be rolled back.
+// Must be called before StartWrites. Execution must continue from RestartTxNum of report.
+func (a *Aggregator) RebuildFromFiles(ctx context.Context) (*RebuildReport, error) {
+	if a.rwTx == nil {
+		return nil, fmt.Errorf("rebuild from files: no tx set")
+	}
+	domains := []*Domain{a.accounts, a.storage, a.code, a.commitment.Domain}
+	indices := []*InvertedIndex{a.logAddrs, a.logTopics, a.tracesFrom, a.tracesTo}
+
+	if err := a.ReopenFolder(); err != nil { // builds missed indices
+		return nil, fmt.Errorf("rebuild from files: %w", err)
+	}
+	filesTxNum := a.EndTxNumMinimax()
+	if filesTxNum == 0 {
+		return nil, fmt.Errorf("rebuild from files: no files in %s", a.accounts.dir)
+	}
+
+	report := &RebuildReport{}
+	for _, d := range domains {
+		tables := []string{d.keysTable, d.valsTable, d.indexKeysTable, d.historyValsTable, d.indexTable}
+		if err := a.clearTables(tables...); err != nil {
+			return nil, err
+		}
+		report.ClearedTables = append(report.ClearedTables, tables...)
+		if err := resetPruneProgress(a.rwTx, d.pruneProgressTable, pruneProgressKey(d.filenameBase, "kv")); err != nil {
+			return nil, err
+		}
+		if err := d.History.resetPruneProgress(); err != nil {
+			return nil, err
+		}
+	}
+	for _, ii := range indices {
+		if err := a.clearTables(ii.indexKeysTable, ii.indexTable); err != nil {
+			return nil, err
+		}
+		report.ClearedTables = append(report.ClearedTables, ii.indexKeysTable, ii.indexTable)
+		if err := ii.resetPruneProgress(); err != nil {
+			return nil, err
+		}
+	}
+
+	ac := a.MakeContext()
+	defer ac.Close()
+	cs, err := a.commitment.commitmentStateAsOf(ac.commitment, filesTxNum-1, a.rwTx)
+	if err != nil {
+		return nil, fmt.Errorf("rebuild from files: %w", err)
+	}
+	if cs == nil {
+		return nil, fmt.Errorf("rebuild from files: no commitment state in files before txNum %d", filesTxNum)
+	}
+	report.RestartTxNum, report.BlockNum = cs.txNum+1, cs.blockNum
+
+	var ahead []string
+	for _, d := range domains {
+		ahead = filesAfter(ahead, d.files, report.RestartTxNum)
+		ahead = filesAfter(ahead, d.History.files, report.RestartTxNum)
+		ahead = filesAfter(ahead, d.InvertedIndex.files, report.RestartTxNum)
+	}
+	for _, ii := range indices {
+		ahead = filesAfter(ahead, ii.files, report.RestartTxNum)
+	}
+	if len(ahead) > 0 {
+		return nil, fmt.Errorf("rebuild from files: files have data after commitment state of txNum %d, remove them: %s", cs.txNum, strings.Join(ahead, ", "))
+	}
+
+	// stored root
+	stored := &stateAsOfReader{ac: ac, roTx: a.rwTx, txNum: cs.txNum, stateTxNum: cs.txNum, hasState: true, keccak: sha3.NewLegacyKeccak256()}
+	trie := commitment.NewHexPatriciaHashed(length.Addr, stored.branchFn, stored.accountFn, stored.storageFn)
+	if err := trie.SetState(cs.trieState); err != nil {
+		return nil, fmt.Errorf("rebuild from files: restore state of txNum %d: %w", cs.txNum, err)
+	}
+	if report.Root, err = trie.RootHash(); err != nil {
+		return nil, fmt.Errorf("rebuild from files: %w", err)
+	}
+
+	// re-computed root: all keys are reviewed by empty trie, which has no branches
+	root, keys, err := a.rootFromFiles(ctx, ac, cs.txNum)
+	if err != nil {
+		return nil, fmt.Errorf("rebuild from files: %w", err)
+	}
+	report.Keys = keys
+	if !bytes.Equal(root, report.Root) {
+		return nil, fmt.Errorf("%w: txNum=%d, stored=%x, files=%x", ErrRebuildRootMismatch, cs.txNum, report.Root, root)
+	}
+
+	hext, ok := a.commitment.patriciaTrie.(*commitment.HexPatriciaHashed)
+	if !ok {
+		return nil, fmt.Errorf("rebuild from files: state storing is only supported hex patricia trie")
+	}
+	if err := hext.SetState(cs.trieState); err != nil {
+		return nil, fmt.Errorf("rebuild from files: restore state of txNum %d: %w", cs.txNum, err)
+	}
+	a.seekTxNum = report.RestartTxNum
+	a.logger.Info("[snapshots] rebuild from files", "report", report.String())
+	return report, nil
+}
+
+func (a *Aggregator) clearTables(tables ...string) error {
+	for _, table := range tables {
+		if err := a.rwTx.ClearBucket(table); err != nil {
+			return fmt.Errorf("rebuild from files: clear %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// rootFromFiles - commitment root of all accounts and storage as of txNum, computed without stored branches.
+// Keys are sorted by hashed key in tmpdir (etl): memory doesn't depend on size of state.
+func (a *Aggregator) rootFromFiles(ctx context.Context, ac *AggregatorContext, txNum uint64) (root []byte, keys int, err error) {
+	collector := etl.NewCollector("rebuild root", a.tmpdir, etl.NewSortableBuffer(etl.BufferOptimalSize), a.logger)
+	defer collector.Close()
+	collector.LogLvl(log.LvlDebug)
+	for _, dc := range []*DomainContext{ac.accounts, ac.code, ac.storage} {
+		it, err := dc.DomainRange(nil, nil, order.Asc, -1, a.rwTx)
+		if err != nil {
+			return nil, 0, err
+		}
+		for it.HasNext() {
+			k, _, err := it.Next()
+			if err != nil {
+				it.Close()
+				return nil, 0, err
+			}
+			if err = collector.Collect(a.commitment.hashAndNibblizeKey(k), k); err != nil {
+				it.Close()
+				return nil, 0, err
+			}
+			if ctx.Err() != nil {
+				it.Close()
+				return nil, 0, ctx.Err()
+			}
+		}
+		it.Close()
+	}
+
+	r := &stateAsOfReader{ac: ac, roTx: a.rwTx, txNum: txNum, keccak: sha3.NewLegacyKeccak256()}
+	trie := commitment.NewHexPatriciaHashed(length.Addr, r.branchFn, r.accountFn, r.storageFn)
+	trie.Reset()
+	root, err = trie.ReviewKeysFunc(func(review func(plainKey, hashedKey []byte) error) error {
+		var prev []byte
+		return collector.Load(nil, "", func(hashedKey, plainKey []byte, _ etl.CurrentTableReader, _ etl.LoadNextFunc) error {
+			if keys > 0 && bytes.Equal(hashedKey, prev) { // account key is in accounts and code
+				return nil
+			}
+			prev = append(prev[:0], hashedKey...)
+			keys++
+			return review(plainKey, hashedKey)
+		}, etl.TransformArgs{Quit: ctx.Done()})
+	}, func([]byte, commitment.BranchData) error { return nil })
+	if err != nil {
+		return nil, 0, err
+	}
+	if keys == 0 {
+		return common.Copy(commitment.EmptyRootHash), 0, nil
+	}
+	return root, keys, nil
+}
+
+// filesAfter - appends names of files which have data at or after txNum (endTxNum is exclusive)
+func filesAfter(names []string, files *btree2.BTreeG[*filesItem], txNum uint64) []string {
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum > txNum && item.decompressor != nil {
+				names = append(names, item.decompressor.FileName())
+			}
+		}
+		return true
+	})
+	return names
+}
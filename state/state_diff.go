@@ -0,0 +1,153 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// LatestValueFunc - returns latest (current) value of key in domain, or empty value if key doesn't exist.
+// AggregatorV3 has only histories - latest state is stored outside of it, so caller provides it in format of histories.
+type LatestValueFunc func(domain kv.Domain, key []byte, tx kv.Tx) ([]byte, error)
+
+// StateDiff - keys of `domain` changed in [fromTxNum, toTxNum) with value before `fromTxNum` (old) and value before `toTxNum` (new).
+// Multiple changes of key collapsed into 1 pair, keys changed and then reverted to old value are skipped.
+// Keys are sorted, start from `fromKey` (inclusive) and at most `limit` of them returned (-1 means unlimited) -
+// use StateDiffIter.Cursor() as `fromKey` of next call to continue.
+// `latest` is used for keys which have no changes at or after `toTxNum`, can be nil if `toTxNum` is covered by history.
+func (ac *AggregatorV3Context) StateDiff(domain kv.Domain, fromTxNum, toTxNum uint64, fromKey []byte, limit int, latest LatestValueFunc, tx kv.Tx) (*StateDiffIter, error) {
+	var hc *HistoryContext
+	switch domain {
+	case kv.AccountsDomain:
+		hc = ac.accounts
+	case kv.StorageDomain:
+		hc = ac.storage
+	case kv.CodeDomain:
+		hc = ac.code
+	default:
+		return nil, fmt.Errorf("StateDiff: unsupported domain %s", domain)
+	}
+	var latestFn func(key []byte) ([]byte, error)
+	if latest != nil {
+		latestFn = func(key []byte) ([]byte, error) { return latest(domain, key, tx) }
+	}
+	return hc.StateDiff(fromTxNum, toTxNum, fromKey, limit, latestFn, tx)
+}
+
+func (hc *HistoryContext) StateDiff(fromTxNum, toTxNum uint64, fromKey []byte, limit int, latest func(key []byte) ([]byte, error), roTx kv.Tx) (*StateDiffIter, error) {
+	if fromTxNum > toTxNum {
+		return nil, fmt.Errorf("StateDiff: fromTxNum=%d > toTxNum=%d", fromTxNum, toTxNum)
+	}
+	it, err := hc.historyRange(fromKey, int(fromTxNum), int(toTxNum), order.Asc, -1, roTx)
+	if err != nil {
+		return nil, err
+	}
+	s := &StateDiffIter{hc: hc, it: it, toTxNum: toTxNum, fromKey: fromKey, limit: limit, latest: latest, roTx: roTx}
+	s.err = s.advance()
+	return s, nil
+}
+
+// StateDiffIter - sorted by key (key, old value, new value) triples. Empty value means key didn't exist.
+type StateDiffIter struct {
+	hc      *HistoryContext
+	it      iter.KV
+	toTxNum uint64
+	fromKey []byte
+	limit   int
+	latest  func(key []byte) ([]byte, error)
+	roTx    kv.Tx
+
+	nextK, nextOld, nextNew []byte
+	k, oldV, newV           []byte
+	kBackup, oldB, newB     []byte
+	err                     error
+}
+
+func (s *StateDiffIter) advance() error {
+	for s.it.HasNext() {
+		k, oldV, err := s.it.Next()
+		if err != nil {
+			return err
+		}
+		if s.fromKey != nil && bytes.Compare(k, s.fromKey) < 0 { // range is seeked to fromKey, only DB keys of other length may precede it
+			continue
+		}
+		newV, ok, err := s.hc.GetNoStateWithRecent(k, s.toTxNum, s.roTx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if s.latest == nil {
+				return fmt.Errorf("StateDiff: %s has no changes of key %x at or after txNum=%d, latest value reader required", s.hc.h.filenameBase, k, s.toTxNum)
+			}
+			if newV, err = s.latest(k); err != nil {
+				return err
+			}
+		}
+		if bytes.Equal(oldV, newV) {
+			continue
+		}
+		s.nextK = append(s.nextK[:0], k...)
+		s.nextOld = append(s.nextOld[:0], oldV...)
+		s.nextNew = append(s.nextNew[:0], newV...)
+		return nil
+	}
+	s.nextK = nil
+	return nil
+}
+
+func (s *StateDiffIter) HasNext() bool {
+	if s.err != nil { // always true, then .Next() call will return this error
+		return true
+	}
+	if s.limit == 0 { // limit reached
+		return false
+	}
+	return s.nextK != nil
+}
+
+func (s *StateDiffIter) Next() (k, oldV, newV []byte, err error) {
+	if s.err != nil {
+		return nil, nil, nil, s.err
+	}
+	s.limit--
+	s.k, s.oldV, s.newV = append(s.k[:0], s.nextK...), append(s.oldV[:0], s.nextOld...), append(s.newV[:0], s.nextNew...)
+
+	// Satisfy iter.Dual Invariant 2
+	s.k, s.kBackup, s.oldV, s.oldB, s.newV, s.newB = s.kBackup, s.k, s.oldB, s.oldV, s.newB, s.newV
+	s.err = s.advance()
+	return s.kBackup, s.oldB, s.newB, nil
+}
+
+// Cursor - key to pass as `fromKey` to continue iteration after `limit` reached. nil if there are no more keys.
+func (s *StateDiffIter) Cursor() []byte {
+	if s.nextK == nil {
+		return nil
+	}
+	return append([]byte{}, s.nextK...)
+}
+
+func (s *StateDiffIter) Close() {
+	if closer, ok := s.it.(iter.Closer); ok {
+		closer.Close()
+	}
+}
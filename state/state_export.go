@@ -0,0 +1,263 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/common/hexutility"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// State snapshot - standalone artifact with full state (accounts, storage, code) as of some txNum:
+//
+//	<domain>.seg      - sorted key/value pairs (both compressed)
+//	<domain>.bt       - BtIndex over <domain>.seg
+//	manifest.json     - written last: snapshot without manifest is incomplete
+//
+// Keys and values have same format as in AggregatorV3 histories: storage key is addr+loc, account is EncodeAccountBytes.
+
+const StateSnapshotManifestFile = "manifest.json"
+
+var stateSnapshotDomains = []kv.Domain{kv.AccountsDomain, kv.StorageDomain, kv.CodeDomain}
+
+type StateSnapshotFile struct {
+	Domain kv.Domain `json:"domain"`
+	Data   string    `json:"data"`
+	Index  string    `json:"index"`
+	Keys   uint64    `json:"keys"`
+	Size   int64     `json:"size"`
+}
+
+type StateSnapshotManifest struct {
+	TxNum uint64              `json:"txNum"` // state before execution of this txNum
+	Root  hexutility.Bytes    `json:"root"`  // commitment root of state, importer checks it if not empty
+	Files []StateSnapshotFile `json:"files"`
+}
+
+func ReadStateSnapshotManifest(dir string) (*StateSnapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, StateSnapshotManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	m := &StateSnapshotManifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("state snapshot manifest: %w", err)
+	}
+	return m, nil
+}
+
+// LatestStateFunc - returns latest (current) values of domain, sorted by key. AggregatorV3 has only histories -
+// latest state is stored outside of it (PlainState, etc...), so caller provides it in format of histories.
+type LatestStateFunc func(domain kv.Domain, tx kv.Tx) (iter.KV, error)
+
+// ExportState - writes state as of `txNum` to `dir`. State is: history value if key changed at or after `txNum`, otherwise latest value.
+// `root` is commitment root of this state (usually taken from block header) - stored in manifest as-is.
+func (ac *AggregatorV3Context) ExportState(ctx context.Context, txNum uint64, root []byte, latest LatestStateFunc, tx kv.Tx, dir, tmpdir string, logger log.Logger) (*StateSnapshotManifest, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	m := &StateSnapshotManifest{TxNum: txNum, Root: root}
+	for _, d := range stateSnapshotDomains {
+		var hc *HistoryContext
+		switch d {
+		case kv.AccountsDomain:
+			hc = ac.accounts
+		case kv.StorageDomain:
+			hc = ac.storage
+		case kv.CodeDomain:
+			hc = ac.code
+		}
+		latestIt, err := latest(d, tx)
+		if err != nil {
+			return nil, fmt.Errorf("ExportState: %s: %w", d, err)
+		}
+		it := iter.UnionKV(hc.WalkAsOf(txNum, nil, nil, tx, -1), latestIt, -1)
+		f, err := exportStateDomain(ctx, d, hc.h.filenameBase, it, dir, tmpdir, logger)
+		if closer, ok := it.(iter.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ExportState: %s: %w", d, err)
+		}
+		m.Files = append(m.Files, f)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := filepath.Join(dir, StateSnapshotManifestFile+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir, StateSnapshotManifestFile)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func exportStateDomain(ctx context.Context, d kv.Domain, filenameBase string, it iter.KV, dir, tmpdir string, logger log.Logger) (StateSnapshotFile, error) {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	f := StateSnapshotFile{Domain: d, Data: filenameBase + ".seg", Index: filenameBase + ".bt"}
+	dataPath := filepath.Join(dir, f.Data)
+	comp, err := compress.NewCompressor(ctx, "export "+filenameBase, dataPath, tmpdir, compress.MinPatternScore, 1, log.LvlTrace, logger)
+	if err != nil {
+		return f, err
+	}
+	defer comp.Close()
+	for it.HasNext() {
+		k, v, err := it.Next()
+		if err != nil {
+			return f, err
+		}
+		if len(v) == 0 { // key didn't exist at txNum
+			continue
+		}
+		if err = comp.AddWord(k); err != nil {
+			return f, err
+		}
+		if err = comp.AddWord(v); err != nil {
+			return f, err
+		}
+		f.Keys++
+
+		select {
+		case <-ctx.Done():
+			return f, ctx.Err()
+		case <-logEvery.C:
+			logger.Info("[snapshots] export state", "domain", d, "keys", f.Keys, "key", fmt.Sprintf("%x", k))
+		default:
+		}
+	}
+	if err = comp.Compress(); err != nil {
+		return f, err
+	}
+	comp.Close()
+
+	decomp, err := compress.NewDecompressor(dataPath)
+	if err != nil {
+		return f, err
+	}
+	defer decomp.Close()
+	f.Size = decomp.Size()
+	p := &background.Progress{}
+	if err = BuildBtreeIndexWithDecompressor(filepath.Join(dir, f.Index), decomp, p, tmpdir, logger); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// ImportState - writes state snapshot from `dir` to fresh Aggregator and checks commitment root.
+// Aggregator must be ready for writes (SetTx, StartWrites), caller is responsible for FinishWrites/Flush/Commit.
+func ImportState(ctx context.Context, a *Aggregator, dir string, logger log.Logger) (*StateSnapshotManifest, error) {
+	m, err := ReadStateSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	a.SetTxNum(m.TxNum)
+	for _, f := range m.Files {
+		if err := importStateDomain(ctx, a, f, dir, logger); err != nil {
+			return nil, fmt.Errorf("ImportState: %s: %w", f.Domain, err)
+		}
+	}
+	root, err := a.ComputeCommitment(true, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Root) > 0 && !bytes.Equal(root, m.Root) {
+		return nil, fmt.Errorf("ImportState: commitment root mismatch: manifest %x, computed %x", []byte(m.Root), root)
+	}
+	return m, nil
+}
+
+func importStateDomain(ctx context.Context, a *Aggregator, f StateSnapshotFile, dir string, logger log.Logger) error {
+	logEvery := time.NewTicker(30 * time.Second)
+	defer logEvery.Stop()
+
+	decomp, err := compress.NewDecompressor(filepath.Join(dir, f.Data))
+	if err != nil {
+		return err
+	}
+	defer decomp.Close()
+	if uint64(decomp.Count()) != 2*f.Keys {
+		return fmt.Errorf("%s: expected %d keys, file has %d words", f.Data, f.Keys, decomp.Count())
+	}
+	bt, err := OpenBtreeIndexWithDecompressor(filepath.Join(dir, f.Index), DefaultBtreeM, decomp)
+	if err != nil {
+		return err
+	}
+	defer bt.Close()
+	if bt.KeyCount() != f.Keys {
+		return fmt.Errorf("%s: expected %d keys, index has %d", f.Index, f.Keys, bt.KeyCount())
+	}
+
+	g := decomp.MakeGetter()
+	var k, v, prevK []byte
+	var i uint64
+	for g.HasNext() {
+		k, _ = g.Next(k[:0])
+		if !g.HasNext() {
+			return fmt.Errorf("%s: key %x without value", f.Data, k)
+		}
+		v, _ = g.Next(v[:0])
+		if i > 0 && bytes.Compare(prevK, k) >= 0 {
+			return fmt.Errorf("%s: keys are not sorted: %x after %x", f.Data, k, prevK)
+		}
+		prevK = append(prevK[:0], k...)
+		i++
+
+		switch f.Domain {
+		case kv.AccountsDomain:
+			err = a.UpdateAccountData(k, v)
+		case kv.StorageDomain:
+			if len(k) != length.Addr+length.Hash {
+				return fmt.Errorf("%s: unexpected storage key length %d", f.Data, len(k))
+			}
+			err = a.WriteAccountStorage(k[:length.Addr], k[length.Addr:], v)
+		case kv.CodeDomain:
+			err = a.UpdateAccountCode(k, v)
+		default:
+			return fmt.Errorf("unknown domain %s", f.Domain)
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-logEvery.C:
+			logger.Info("[snapshots] import state", "domain", f.Domain, "progress", fmt.Sprintf("%d/%d", i, f.Keys))
+		default:
+		}
+	}
+	return nil
+}
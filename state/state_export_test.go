@@ -0,0 +1,217 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/holiman/uint256"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/iter"
+	"github.com/ledgerwatch/erigon-lib/kv/mdbx"
+)
+
+func testDbAndAggregatorV3(t *testing.T, aggStep uint64) (string, kv.RwDB, *AggregatorV3) {
+	t.Helper()
+	path := t.TempDir()
+	logger := log.New()
+	db := mdbx.NewMDBX(logger).InMem(filepath.Join(path, "db4")).WithTableCfg(func(defaultBuckets kv.TableCfg) kv.TableCfg {
+		return kv.ChaindataTablesCfg
+	}).MustOpen()
+	t.Cleanup(db.Close)
+	dir, tmpdir := filepath.Join(path, "e4"), filepath.Join(path, "e4tmp")
+	require.NoError(t, os.MkdirAll(dir, 0o755))
+	require.NoError(t, os.MkdirAll(tmpdir, 0o755))
+	agg, err := NewAggregatorV3(context.Background(), dir, tmpdir, aggStep, db, logger)
+	require.NoError(t, err)
+	t.Cleanup(agg.Close)
+	return path, db, agg
+}
+
+// stateMaps - latest state in format of AggregatorV3 histories
+type stateMaps map[kv.Domain]map[string][]byte
+
+func (s stateMaps) clone() stateMaps {
+	res := stateMaps{}
+	for d, m := range s {
+		res[d] = map[string][]byte{}
+		for k, v := range m {
+			res[d][k] = v
+		}
+	}
+	return res
+}
+
+func (s stateMaps) sorted(d kv.Domain) (keys, values [][]byte) {
+	ks := make([]string, 0, len(s[d]))
+	for k := range s[d] {
+		ks = append(ks, k)
+	}
+	slices.Sort(ks)
+	for _, k := range ks {
+		keys, values = append(keys, []byte(k)), append(values, s[d][k])
+	}
+	return keys, values
+}
+
+func TestExportImportState(t *testing.T) {
+	ctx, require := context.Background(), require.New(t)
+	path, db, agg := testDbAndAggregatorV3(t, 16)
+	logger := log.New()
+
+	tx, err := db.BeginRw(ctx)
+	require.NoError(err)
+	defer tx.Rollback()
+	agg.SetTx(tx)
+	agg.StartWrites()
+
+	latest := stateMaps{kv.AccountsDomain: {}, kv.StorageDomain: {}, kv.CodeDomain: {}}
+	update := func(d kv.Domain, k, v []byte) {
+		var err error
+		prev := latest[d][string(k)]
+		switch d {
+		case kv.AccountsDomain:
+			err = agg.AddAccountPrev(k, prev)
+		case kv.StorageDomain:
+			err = agg.AddStoragePrev(k[:length.Addr], k[length.Addr:], prev)
+		case kv.CodeDomain:
+			err = agg.AddCodePrev(k, prev)
+		}
+		require.NoError(err)
+		latest[d][string(k)] = v
+	}
+	addr := func(i uint64) []byte {
+		a := make([]byte, length.Addr)
+		binary.BigEndian.PutUint64(a[length.Addr-8:], i)
+		return a
+	}
+
+	const txs, exportTxNum = 100, 61
+	var asOf stateMaps
+	for txNum := uint64(1); txNum <= txs; txNum++ {
+		if txNum == exportTxNum {
+			asOf = latest.clone()
+		}
+		agg.SetTxNum(txNum)
+		update(kv.AccountsDomain, addr(txNum%7), EncodeAccountBytes(txNum, uint256.NewInt(txNum*1000), nil, 0))
+		loc := make([]byte, length.Hash)
+		loc[0] = byte(txNum % 3)
+		update(kv.StorageDomain, append(addr(txNum%5), loc...), []byte{byte(txNum)})
+		if txNum%10 == 0 {
+			update(kv.CodeDomain, addr(txNum%7), []byte{0x60, byte(txNum)})
+		}
+	}
+	require.NoError(agg.Flush(ctx, tx))
+	agg.FinishWrites()
+	require.NoError(tx.Commit())
+	for step := uint64(0); step < 4; step++ {
+		require.NoError(agg.buildFilesInBackground(ctx, step))
+	}
+
+	// reference root: state as-of export txNum, written directly to Aggregator
+	_, refDB, ref := testDbAndAggregator(t, 16)
+	defer ref.Close()
+	refTx, err := refDB.BeginRw(ctx)
+	require.NoError(err)
+	defer refTx.Rollback()
+	ref.SetTx(refTx)
+	ref.StartWrites()
+	ref.SetTxNum(exportTxNum)
+	for _, d := range stateSnapshotDomains {
+		keys, values := asOf.sorted(d)
+		for i := range keys {
+			switch d {
+			case kv.AccountsDomain:
+				err = ref.UpdateAccountData(keys[i], values[i])
+			case kv.StorageDomain:
+				err = ref.WriteAccountStorage(keys[i][:length.Addr], keys[i][length.Addr:], values[i])
+			case kv.CodeDomain:
+				err = ref.UpdateAccountCode(keys[i], values[i])
+			}
+			require.NoError(err)
+		}
+	}
+	root, err := ref.ComputeCommitment(false, false)
+	require.NoError(err)
+	ref.FinishWrites()
+
+	roTx, err := db.BeginRo(ctx)
+	require.NoError(err)
+	defer roTx.Rollback()
+	ac := agg.MakeContext()
+	defer ac.Close()
+	latestFn := func(d kv.Domain, tx kv.Tx) (iter.KV, error) {
+		return iter.PairsArray(latest.sorted(d)), nil
+	}
+	exportDir := filepath.Join(path, "export")
+	m, err := ac.ExportState(ctx, exportTxNum, root, latestFn, roTx, exportDir, t.TempDir(), logger)
+	require.NoError(err)
+	require.Len(m.Files, 3)
+
+	for _, f := range m.Files {
+		keys, values := asOf.sorted(f.Domain)
+		require.Equal(uint64(len(keys)), f.Keys, f.Domain)
+		d, err := compress.NewDecompressor(filepath.Join(exportDir, f.Data))
+		require.NoError(err)
+		g := d.MakeGetter()
+		for i := 0; g.HasNext(); i++ {
+			k, _ := g.Next(nil)
+			v, _ := g.Next(nil)
+			require.Equal(keys[i], k, f.Domain)
+			require.Equal(values[i], v, f.Domain)
+		}
+		d.Close()
+	}
+
+	// import into fresh Aggregator gives same root
+	_, db2, agg2 := testDbAndAggregator(t, 16)
+	defer agg2.Close()
+	tx2, err := db2.BeginRw(ctx)
+	require.NoError(err)
+	defer tx2.Rollback()
+	agg2.SetTx(tx2)
+	agg2.StartWrites()
+	m2, err := ImportState(ctx, agg2, exportDir, logger)
+	require.NoError(err)
+	require.Equal(m, m2)
+	agg2.FinishWrites()
+
+	// wrong root in manifest
+	m.Root = make([]byte, length.Hash)
+	_, err = ac.ExportState(ctx, exportTxNum, m.Root, latestFn, roTx, exportDir, t.TempDir(), logger)
+	require.NoError(err)
+	_, db3, agg3 := testDbAndAggregator(t, 16)
+	defer agg3.Close()
+	tx3, err := db3.BeginRw(ctx)
+	require.NoError(err)
+	defer tx3.Rollback()
+	agg3.SetTx(tx3)
+	agg3.StartWrites()
+	defer agg3.FinishWrites()
+	_, err = ImportState(ctx, agg3, exportDir, logger)
+	require.ErrorContains(err, "root mismatch")
+}
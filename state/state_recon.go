@@ -19,6 +19,7 @@ package state
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 
 	"github.com/ledgerwatch/erigon-lib/compress"
 	"github.com/ledgerwatch/erigon-lib/recsplit"
@@ -29,6 +30,7 @@ import (
 
 type ReconItem struct {
 	g           *compress.Getter
+	codec       ValueCodec // codec of values of file, see ValueCodec
 	key         []byte
 	txNum       uint64
 	startTxNum  uint64
@@ -93,6 +95,7 @@ func (rh ReconHeapOlderFirst) Less(i, j int) bool {
 
 type ScanIteratorInc struct {
 	g         *compress.Getter
+	codec     ValueCodec
 	key       []byte
 	nextTxNum uint64
 	hasNext   bool
@@ -106,7 +109,10 @@ func (sii *ScanIteratorInc) advance() {
 		sii.hasNext = false
 		return
 	}
-	val, _ := sii.g.NextUncompressed()
+	val, err := nextValue(sii.g, sii.codec)
+	if err != nil {
+		panic(fmt.Errorf("%s: %w", sii.g.FileName(), err))
+	}
 	max := eliasfano32.Max(val)
 	sii.nextTxNum = max
 	if sii.g.HasNext() {
@@ -129,6 +135,7 @@ func (sii *ScanIteratorInc) Next() (uint64, error) {
 func (hs *HistoryStep) iterateTxs() *ScanIteratorInc {
 	var sii ScanIteratorInc
 	sii.g = hs.indexFile.getter
+	sii.codec = hs.indexItem.codec
 	sii.g.Reset(0)
 	if sii.g.HasNext() {
 		sii.key, _ = sii.g.NextUncompressed()
@@ -141,15 +148,16 @@ func (hs *HistoryStep) iterateTxs() *ScanIteratorInc {
 }
 
 type HistoryIteratorInc struct {
-	uptoTxNum    uint64
-	indexG       *compress.Getter
-	historyG     *compress.Getter
-	r            *recsplit.IndexReader
-	key          []byte
-	nextKey      []byte
-	nextVal      []byte
-	hasNext      bool
-	compressVals bool
+	uptoTxNum uint64
+	indexG    *compress.Getter
+	historyG  *compress.Getter
+	r         *recsplit.IndexReader
+	key       []byte
+	nextKey   []byte
+	nextVal   []byte
+	hasNext   bool
+	codec     ValueCodec // of history file
+	idxCodec  ValueCodec // of index file
 }
 
 func (hs *HistoryStep) interateHistoryBeforeTxNum(txNum uint64) *HistoryIteratorInc {
@@ -157,7 +165,8 @@ func (hs *HistoryStep) interateHistoryBeforeTxNum(txNum uint64) *HistoryIterator
 	hii.indexG = hs.indexFile.getter
 	hii.historyG = hs.historyFile.getter
 	hii.r = hs.historyFile.reader
-	hii.compressVals = hs.compressVals
+	hii.codec = hs.historyItem.codec
+	hii.idxCodec = hs.indexItem.codec
 	hii.indexG.Reset(0)
 	if hii.indexG.HasNext() {
 		hii.key, _ = hii.indexG.NextUncompressed()
@@ -180,7 +189,10 @@ func (hii *HistoryIteratorInc) advance() {
 	}
 	hii.nextKey = nil
 	for hii.nextKey == nil && hii.key != nil {
-		val, _ := hii.indexG.NextUncompressed()
+		val, err := nextValue(hii.indexG, hii.idxCodec)
+		if err != nil {
+			panic(fmt.Errorf("%s: %w", hii.indexG.FileName(), err))
+		}
 		ef, _ := eliasfano32.ReadEliasFano(val)
 		if n, ok := ef.Search(hii.uptoTxNum); ok {
 			var txKey [8]byte
@@ -188,10 +200,8 @@ func (hii *HistoryIteratorInc) advance() {
 			offset := hii.r.Lookup2(txKey[:], hii.key)
 			hii.historyG.Reset(offset)
 			hii.nextKey = hii.key
-			if hii.compressVals {
-				hii.nextVal, _ = hii.historyG.Next(nil)
-			} else {
-				hii.nextVal, _ = hii.historyG.NextUncompressed()
+			if hii.nextVal, err = nextValue(hii.historyG, hii.codec); err != nil {
+				panic(fmt.Errorf("%s: %w", hii.historyG.FileName(), err))
 			}
 		}
 		if hii.indexG.HasNext() {
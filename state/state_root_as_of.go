@@ -0,0 +1,242 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"github.com/google/btree"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ledgerwatch/erigon-lib/commitment"
+	"github.com/ledgerwatch/erigon-lib/common"
+	"github.com/ledgerwatch/erigon-lib/common/length"
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/kv/order"
+)
+
+// StateRootAsOf - state root after execution of txNum. Used to debug consensus issues: root is re-computed
+// from history, instead of reading roots recorded during execution.
+//
+//   - nearest commitment state stored at or before txNum (see storeCommitmentState) is restored into separate trie
+//   - keys of accounts, code and storage changed after that state and up to txNum are collected from history
+//   - their values as of txNum are reviewed by the trie (as in CommitmentModeDirect), branches are read as of restored state
+//
+// Live trie of the aggregator is not touched. Pending writes are flushed, so must be called between StartWrites and FinishWrites.
+func (a *Aggregator) StateRootAsOf(txNum uint64) ([]byte, error) {
+	if a.defaultCtx == nil {
+		return nil, fmt.Errorf("state root as of %d: aggregator has no writes started", txNum)
+	}
+	if txNum > a.txNum {
+		return nil, fmt.Errorf("state root as of %d: txNum is ahead of aggregator txNum %d", txNum, a.txNum)
+	}
+	if err := a.Flush(context.Background()); err != nil {
+		return nil, err
+	}
+	ac := a.MakeContext()
+	defer ac.Close()
+
+	cs, err := a.commitment.commitmentStateAsOf(ac.commitment, txNum, a.rwTx)
+	if err != nil {
+		return nil, err
+	}
+	r := &stateAsOfReader{ac: ac, roTx: a.rwTx, txNum: txNum, keccak: sha3.NewLegacyKeccak256()}
+	trie := commitment.NewHexPatriciaHashed(length.Addr, r.branchFn, r.accountFn, r.storageFn)
+	fromTxNum := uint64(0)
+	if cs != nil {
+		r.stateTxNum, r.hasState = cs.txNum, true
+		fromTxNum = cs.txNum + 1
+	}
+
+	plainKeys, hashedKeys, err := r.changes(a.commitment, fromTxNum)
+	if err != nil {
+		return nil, err
+	}
+	if len(plainKeys) == 0 {
+		if cs == nil {
+			return common.Copy(commitment.EmptyRootHash), nil
+		}
+		// nothing changed since stored state: its root is the answer
+		if err := trie.SetState(cs.trieState); err != nil {
+			return nil, fmt.Errorf("state root as of %d: restore state of txNum %d: %w", txNum, cs.txNum, err)
+		}
+		return trie.RootHash()
+	}
+	// same as DomainCommitted.ComputeCommitment does in CommitmentModeDirect: root is unfolded from branches
+	// as of txNum (see branchFn), so stored trie state is not needed
+	trie.Reset()
+	rootHash, _, err := trie.ReviewKeys(plainKeys, hashedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("state root as of %d: %w", txNum, err)
+	}
+	return rootHash, nil
+}
+
+// commitmentStateAsOf - latest commitment state stored at or before txNum, nil if there is no such state
+func (d *DomainCommitted) commitmentStateAsOf(dc *DomainContext, txNum uint64, roTx kv.Tx) (*commitmentState, error) {
+	key := make([]byte, len(keyCommitmentState)+2)
+	copy(key, keyCommitmentState)
+	for step := int64(txNum / d.aggregationStep); step >= 0; step-- {
+		binary.BigEndian.PutUint16(key[len(keyCommitmentState):], uint16(step))
+		v, err := dc.GetBeforeTxNum(key, txNum+1, roTx)
+		if err != nil {
+			return nil, err
+		}
+		if len(v) == 0 {
+			continue
+		}
+		cs := &commitmentState{}
+		if err := cs.Decode(v); err != nil {
+			return nil, err
+		}
+		if cs.txNum <= txNum {
+			return cs, nil
+		}
+	}
+	return nil, nil
+}
+
+// stateAsOfReader - data accessing functions for commitment trie: values are read as of txNum,
+// branches - as of restored commitment state (stateTxNum)
+type stateAsOfReader struct {
+	ac         *AggregatorContext
+	roTx       kv.Tx
+	txNum      uint64
+	stateTxNum uint64
+	hasState   bool
+	keccak     hash.Hash
+}
+
+func (r *stateAsOfReader) branchFn(prefix []byte) ([]byte, error) {
+	if !r.hasState {
+		return nil, nil
+	}
+	stateValue, err := r.ac.ReadCommitmentBeforeTxNum(prefix, r.stateTxNum+1, r.roTx)
+	if err != nil {
+		return nil, fmt.Errorf("failed read branch %x: %w", commitment.CompactedKeyToHex(prefix), err)
+	}
+	if len(stateValue) == 0 {
+		return nil, nil
+	}
+	return stateValue[2:], nil // Skip touchMap but keep afterMap
+}
+
+func (r *stateAsOfReader) codeHash(addr []byte) ([]byte, error) {
+	code, err := r.ac.ReadAccountCodeBeforeTxNum(addr, r.txNum+1, r.roTx)
+	if err != nil || len(code) == 0 {
+		return nil, err
+	}
+	r.keccak.Reset()
+	r.keccak.Write(code)
+	return r.keccak.Sum(nil), nil
+}
+
+func (r *stateAsOfReader) accountFn(plainKey []byte, cell *commitment.Cell) error {
+	encAccount, err := r.ac.ReadAccountDataBeforeTxNum(plainKey, r.txNum+1, r.roTx)
+	if err != nil {
+		return err
+	}
+	cell.Nonce = 0
+	cell.Balance.Clear()
+	copy(cell.CodeHash[:], commitment.EmptyCodeHash)
+	if len(encAccount) > 0 {
+		nonce, balance, _ := DecodeAccountBytes(encAccount)
+		cell.Nonce = nonce
+		cell.Balance.Set(balance)
+	}
+	codeHash, err := r.codeHash(plainKey)
+	if err != nil {
+		return err
+	}
+	if codeHash != nil {
+		copy(cell.CodeHash[:], codeHash)
+	}
+	cell.Delete = len(encAccount) == 0 && codeHash == nil
+	return nil
+}
+
+func (r *stateAsOfReader) storageFn(plainKey []byte, cell *commitment.Cell) error {
+	enc, err := r.ac.ReadAccountStorageBeforeTxNum(plainKey[:length.Addr], plainKey[length.Addr:], r.txNum+1, r.roTx)
+	if err != nil {
+		return err
+	}
+	cell.StorageLen = len(enc)
+	copy(cell.Storage[:], enc)
+	cell.Delete = cell.StorageLen == 0
+	return nil
+}
+
+// changes - keys changed in [fromTxNum, txNum], sorted by hashed key
+func (r *stateAsOfReader) changes(d *DomainCommitted, fromTxNum uint64) (plainKeys, hashedKeys [][]byte, err error) {
+	tree := btree.NewG[*CommitmentItem](32, commitmentItemLess)
+	for _, dc := range []*DomainContext{r.ac.accounts, r.ac.code, r.ac.storage} {
+		it, err := dc.hc.HistoryRange(int(fromTxNum), int(r.txNum+1), order.Asc, -1, r.roTx)
+		if err != nil {
+			return nil, nil, err
+		}
+		for it.HasNext() {
+			k, _, err := it.Next()
+			if err != nil {
+				return nil, nil, err
+			}
+			item := &CommitmentItem{hashedKey: d.hashAndNibblizeKey(k)}
+			if tree.Has(item) {
+				continue
+			}
+			// key created and removed after restored state is absent in both tries, trie must not unfold
+			// branches for it (there are no such branches)
+			existed, err := r.exists(k, r.txNum+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !existed && r.hasState {
+				if existed, err = r.exists(k, r.stateTxNum+1); err != nil {
+					return nil, nil, err
+				}
+			}
+			if existed {
+				item.plainKey = common.Copy(k)
+				tree.ReplaceOrInsert(item)
+			}
+		}
+	}
+	plainKeys = make([][]byte, 0, tree.Len())
+	hashedKeys = make([][]byte, 0, tree.Len())
+	tree.Ascend(func(item *CommitmentItem) bool {
+		plainKeys = append(plainKeys, item.plainKey)
+		hashedKeys = append(hashedKeys, item.hashedKey)
+		return true
+	})
+	return plainKeys, hashedKeys, nil
+}
+
+// exists - key (addr or addr+loc) has value before txNum
+func (r *stateAsOfReader) exists(key []byte, txNum uint64) (bool, error) {
+	if len(key) > length.Addr {
+		v, err := r.ac.ReadAccountStorageBeforeTxNum(key[:length.Addr], key[length.Addr:], txNum, r.roTx)
+		return len(v) > 0, err
+	}
+	v, err := r.ac.ReadAccountDataBeforeTxNum(key, txNum, r.roTx)
+	if err != nil || len(v) > 0 {
+		return len(v) > 0, err
+	}
+	v, err = r.ac.ReadAccountCodeBeforeTxNum(key, txNum, r.roTx)
+	return len(v) > 0, err
+}
@@ -0,0 +1,583 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ledgerwatch/erigon-lib/common/background"
+	"github.com/ledgerwatch/erigon-lib/compress"
+	"github.com/ledgerwatch/erigon-lib/recsplit"
+	"github.com/ledgerwatch/erigon-lib/recsplit/eliasfano32"
+	"github.com/ledgerwatch/log/v3"
+	btree2 "github.com/tidwall/btree"
+)
+
+// Unwind of files. If `txUnwindTo` is inside of files (even frozen), then files which have data at or after
+// step of `txUnwindTo` are replaced by files with data before the step (with same spans as merges produce),
+// replaced files are listed as invalid in files manifest and removed from disk. Data of partial step
+// [step, txUnwindTo) is moved back to DB - next BuildFiles will collate it again together with re-executed txs.
+// Readers see new files immediately, but DB changes are durable only after commit of tx passed to SetTx. So replaced
+// files stay on disk and listed in files manifests until FinishUnwind: crash (or rollback and OpenFolder) before it
+// returns to files before unwind, which match not changed DB. New files are not listed in manifests yet - they are garbage then.
+
+// unwindRanges - step-aligned ranges which cover [from, to) by spans which merges would produce
+func unwindRanges(from, to, aggregationStep uint64) (ranges [][2]uint64) {
+	for from < to {
+		span := StepsInBiggestFile * aggregationStep
+		for span > aggregationStep && (from%span != 0 || from+span > to) {
+			span /= 2
+		}
+		ranges = append(ranges, [2]uint64{from, from + span})
+		from += span
+	}
+	return ranges
+}
+
+// efInRange - elias-fano list of txNums of `efVal` which are in [from, to). Returns nil if nothing left.
+// `txNums` and `buf` are re-usable buffers, result may point to `efVal`.
+func efInRange(efVal []byte, from, to uint64, txNums []uint64, buf []byte) (res []byte, _ []uint64, _ []byte) {
+	ef, _ := eliasfano32.ReadEliasFano(efVal)
+	if ef.Min() >= from && ef.Max() < to {
+		return efVal, txNums, buf
+	}
+	txNums = txNums[:0]
+	it := ef.Iterator()
+	for it.HasNext() {
+		txNum, _ := it.Next()
+		if txNum >= to {
+			break
+		}
+		if txNum >= from {
+			txNums = append(txNums, txNum)
+		}
+	}
+	if len(txNums) == 0 {
+		return nil, txNums, buf
+	}
+	newEf := eliasfano32.NewEliasFano(uint64(len(txNums)), txNums[len(txNums)-1])
+	for _, txNum := range txNums {
+		newEf.AddOffset(txNum)
+	}
+	newEf.Build()
+	buf = newEf.AppendBytes(buf[:0])
+	return buf, txNums, buf
+}
+
+// filesToUnwind - visible files which have data at or after `txNum`
+func filesToUnwind(roFiles []ctxItem, txNum uint64) (res []*filesItem) {
+	for _, item := range roFiles {
+		if item.endTxNum > txNum {
+			res = append(res, item.src)
+		}
+	}
+	return res
+}
+
+func closeUnwindOuts(outs []*filesItem) {
+	for _, item := range outs {
+		item.closeFilesAndRemove()
+	}
+}
+
+// checkUnwindFiles - files with KeepLast retention can't be truncated: fences of keys (see RetentionPolicy) would be lost
+func (ii *InvertedIndex) checkUnwindFiles(txUnwindTo uint64) error {
+	for _, item := range filesToUnwind(*ii.roFiles.Load(), txUnwindTo/ii.aggregationStep*ii.aggregationStep) {
+		if item.retention.KeepLast > 0 && item.startTxNum < txUnwindTo {
+			return fmt.Errorf("unwind %s to %d: can't truncate file %d-%d with retention %s", ii.filenameBase, txUnwindTo,
+				item.startTxNum/ii.aggregationStep, item.endTxNum/ii.aggregationStep, item.retention)
+		}
+	}
+	return nil
+}
+
+func (ii *InvertedIndex) unwindFiles(ctx context.Context, txUnwindTo uint64, ps *background.ProgressSet) error {
+	stepFrom := txUnwindTo / ii.aggregationStep * ii.aggregationStep
+	victims := filesToUnwind(*ii.roFiles.Load(), stepFrom)
+	if len(victims) == 0 {
+		return nil
+	}
+	outs, err := ii.extractFiles(ctx, victims, stepFrom, ps)
+	if err != nil {
+		return err
+	}
+	for _, victim := range victims {
+		if err = ii.restoreToDB(ctx, victim, stepFrom, txUnwindTo); err != nil {
+			closeUnwindOuts(outs)
+			return err
+		}
+	}
+	if err = ii.integrateUnwoundFiles(victims[0].startTxNum, outs); err != nil {
+		closeUnwindOuts(outs)
+		return err
+	}
+	return nil
+}
+
+// extractFiles - files with data of `victims` before `to`
+func (ii *InvertedIndex) extractFiles(ctx context.Context, victims []*filesItem, to uint64, ps *background.ProgressSet) (outs []*filesItem, err error) {
+	for _, victim := range victims {
+		if victim.startTxNum >= to {
+			continue
+		}
+		for _, r := range unwindRanges(victim.startTxNum, to, ii.aggregationStep) {
+			out, err := ii.extractFile(ctx, victim, r[0], r[1], ps)
+			if err != nil {
+				closeUnwindOuts(outs)
+				return nil, err
+			}
+			outs = append(outs, out)
+		}
+	}
+	return outs, nil
+}
+
+func (ii *InvertedIndex) extractFile(ctx context.Context, src *filesItem, from, to uint64, ps *background.ProgressSet) (*filesItem, error) {
+	var outItem *filesItem
+	var comp *compress.Compressor
+	var err error
+	closeItem := true
+	defer func() {
+		if closeItem {
+			if comp != nil {
+				comp.Close()
+			}
+			if outItem != nil {
+				outItem.closeFilesAndRemove()
+			}
+		}
+	}()
+	fromStep, toStep := from/ii.aggregationStep, to/ii.aggregationStep
+	datFileName := fmt.Sprintf("%s.%d-%d.ef", ii.filenameBase, fromStep, toStep)
+	datPath := filepath.Join(ii.dir, datFileName)
+	if comp, err = compress.NewCompressor(ctx, "unwind", datPath, ii.tmpdir, compress.MinPatternScore, ii.compressWorkers, log.LvlTrace, ii.logger); err != nil {
+		return nil, fmt.Errorf("unwind %s inverted index compressor: %w", ii.filenameBase, err)
+	}
+	if ii.noFsync {
+		comp.DisableFsync()
+	}
+	setValueCodec(comp, ii.codec, []*filesItem{src})
+	p := ps.AddNew("unwind "+datFileName, uint64(src.decompressor.Count()/2))
+	defer ps.Delete(p)
+
+	var keyCount int
+	var txNums []uint64
+	var buf, encBuf []byte
+	g := src.decompressor.MakeGetter()
+	for g.HasNext() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		key, _ := g.NextUncompressed()
+		val, err := nextValue(g, src.codec)
+		if err != nil {
+			return nil, err
+		}
+		p.Processed.Add(1)
+		var res []byte
+		if res, txNums, buf = efInRange(val, from, to, txNums, buf); res == nil {
+			continue
+		}
+		if err = comp.AddUncompressedWord(key); err != nil {
+			return nil, err
+		}
+		keyCount++
+		if encBuf, err = addValue(comp, ii.codec, res, encBuf); err != nil {
+			return nil, err
+		}
+	}
+	if err = comp.Compress(); err != nil {
+		return nil, err
+	}
+	comp.Close()
+	comp = nil
+	outItem = newFilesItem(from, to, ii.aggregationStep)
+	outItem.codec = ii.codec
+	if !src.retention.Empty() {
+		if err = writeRetention(datPath, src.retention, ii.noFsync); err != nil {
+			return nil, fmt.Errorf("unwind %s retention [%d-%d]: %w", ii.filenameBase, fromStep, toStep, err)
+		}
+		outItem.retention = src.retention
+	}
+	if outItem.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+		return nil, fmt.Errorf("unwind %s decompressor [%d-%d]: %w", ii.filenameBase, fromStep, toStep, err)
+	}
+	if err = ii.manifest.prepare(outItem.decompressor); err != nil {
+		return nil, fmt.Errorf("unwind %s checksum [%d-%d]: %w", ii.filenameBase, fromStep, toStep, err)
+	}
+	idxPath := filepath.Join(ii.dir, fmt.Sprintf("%s.%d-%d.efi", ii.filenameBase, fromStep, toStep))
+	if outItem.index, err = buildIndexThenOpen(ctx, outItem.decompressor, idxPath, ii.tmpdir, keyCount, false /* values */, p, ii.logger, ii.noFsync); err != nil {
+		return nil, fmt.Errorf("unwind %s buildIndex [%d-%d]: %w", ii.filenameBase, fromStep, toStep, err)
+	}
+	closeItem = false
+	return outItem, nil
+}
+
+// restoreToDB - puts txNums of [from, to) from file `src` back to DB, in same format as `add` does
+func (ii *InvertedIndex) restoreToDB(ctx context.Context, src *filesItem, from, to uint64) error {
+	if from >= to || src.endTxNum <= from || src.startTxNum >= to {
+		return nil
+	}
+	var txKey [8]byte
+	var txNums []uint64
+	var buf []byte
+	g := src.decompressor.MakeGetter()
+	for g.HasNext() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		key, _ := g.NextUncompressed()
+		val, err := nextValue(g, src.codec)
+		if err != nil {
+			return err
+		}
+		var res []byte
+		if res, txNums, buf = efInRange(val, from, to, txNums, buf); res == nil {
+			continue
+		}
+		ef, _ := eliasfano32.ReadEliasFano(res)
+		it := ef.Iterator()
+		for it.HasNext() {
+			txNum, _ := it.Next()
+			binary.BigEndian.PutUint64(txKey[:], txNum)
+			if err := ii.tx.Put(ii.indexKeysTable, txKey[:], key); err != nil {
+				return err
+			}
+			if err := ii.tx.Put(ii.indexTable, key, txKey[:]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// integrateUnwoundFiles - replaces files which end after `from` by `outs`
+func (ii *InvertedIndex) integrateUnwoundFiles(from uint64, outs []*filesItem) error {
+	retired, err := replaceUnwoundFiles(ii.files, from, outs, ii.manifest, ii.noFsync, ii.logger)
+	if err != nil {
+		return fmt.Errorf("unwind %s: %w", ii.filenameBase, err)
+	}
+	ii.reCalcRoFiles()
+	ii.retiredFrozen, ii.unwound = closeUnwound(retired, ii.retiredFrozen, ii.unwound)
+	ii.localityIndex.unwind(from)
+	return nil
+}
+
+// finishUnwind - files replaced by unwind are listed as invalid and removed from disk
+func (ii *InvertedIndex) finishUnwind() {
+	ii.manifest.release(ii.files, ii.noFsync, ii.logger)
+	removeUnwound(ii.unwound, ii.files, ii.logger)
+	ii.unwound = nil
+}
+
+func (h *History) unwindFiles(ctx context.Context, txUnwindTo uint64, ps *background.ProgressSet) (err error) {
+	stepFrom := txUnwindTo / h.aggregationStep * h.aggregationStep
+	victims := filesToUnwind(*h.InvertedIndex.roFiles.Load(), stepFrom)
+	if len(victims) == 0 {
+		return nil
+	}
+	histVictims := make([]*filesItem, len(victims))
+	for i, victim := range victims {
+		item, ok := h.files.Get(victim)
+		if !ok || item.decompressor == nil {
+			return fmt.Errorf("unwind %s: no history file for %d-%d", h.filenameBase, victim.startTxNum/h.aggregationStep, victim.endTxNum/h.aggregationStep)
+		}
+		histVictims[i] = item
+	}
+	efOuts, err := h.InvertedIndex.extractFiles(ctx, victims, stepFrom, ps)
+	if err != nil {
+		return err
+	}
+	var histOuts []*filesItem
+	defer func() {
+		if err != nil {
+			closeUnwindOuts(efOuts)
+			closeUnwindOuts(histOuts)
+		}
+	}()
+	for _, efOut := range efOuts {
+		for i, victim := range victims {
+			if victim.startTxNum <= efOut.startTxNum && efOut.endTxNum <= victim.endTxNum {
+				out, err := h.extractFile(ctx, victim, histVictims[i], efOut, ps)
+				if err != nil {
+					return err
+				}
+				histOuts = append(histOuts, out)
+				break
+			}
+		}
+	}
+	for i, victim := range victims {
+		if err = h.restoreToDB(ctx, victim, histVictims[i], stepFrom, txUnwindTo); err != nil {
+			return err
+		}
+	}
+	// checksums of history files are read before integration: failure after it leaves index and history inconsistent
+	if err = h.manifest.retain(histVictims, nil); err != nil {
+		return fmt.Errorf("unwind %s: %w", h.filenameBase, err)
+	}
+	if err = h.InvertedIndex.integrateUnwoundFiles(victims[0].startTxNum, efOuts); err != nil {
+		return err
+	}
+	efOuts = nil // owned by InvertedIndex now
+	retired, err := replaceUnwoundFiles(h.files, victims[0].startTxNum, histOuts, h.manifest, h.noFsync, h.logger)
+	if err != nil {
+		return fmt.Errorf("unwind %s: %w", h.filenameBase, err)
+	}
+	h.reCalcRoFiles()
+	h.retiredFrozen, h.unwound = closeUnwound(retired, h.retiredFrozen, h.unwound)
+	return nil
+}
+
+// finishUnwind - see InvertedIndex.finishUnwind
+func (h *History) finishUnwind() {
+	h.InvertedIndex.finishUnwind()
+	h.manifest.release(h.files, h.noFsync, h.logger)
+	removeUnwound(h.unwound, h.files, h.logger)
+	h.unwound = nil
+}
+
+// extractFile - history values of `efSrc`/`histSrc` which have txNum in range of already extracted `efOut`
+func (h *History) extractFile(ctx context.Context, efSrc, histSrc, efOut *filesItem, ps *background.ProgressSet) (*filesItem, error) {
+	var outItem *filesItem
+	var comp *compress.Compressor
+	var err error
+	closeItem := true
+	defer func() {
+		if closeItem {
+			if comp != nil {
+				comp.Close()
+			}
+			if outItem != nil {
+				outItem.closeFilesAndRemove()
+			}
+		}
+	}()
+	from, to := efOut.startTxNum, efOut.endTxNum
+	fromStep, toStep := from/h.aggregationStep, to/h.aggregationStep
+	datFileName := fmt.Sprintf("%s.%d-%d.v", h.filenameBase, fromStep, toStep)
+	datPath := filepath.Join(h.dir, datFileName)
+	if comp, err = compress.NewCompressor(ctx, "unwind", datPath, h.tmpdir, compress.MinPatternScore, h.compressWorkers, log.LvlTrace, h.logger); err != nil {
+		return nil, fmt.Errorf("unwind %s history compressor: %w", h.filenameBase, err)
+	}
+	setValueCodec(comp, h.codec, []*filesItem{histSrc})
+	if h.noFsync {
+		comp.DisableFsync()
+	}
+	p := ps.AddNew("unwind "+datFileName, uint64(efSrc.decompressor.Count()/2))
+	defer ps.Delete(p)
+
+	var valBuf, encBuf []byte
+	var count int
+	g, g2 := efSrc.decompressor.MakeGetter(), histSrc.decompressor.MakeGetter()
+	for g.HasNext() {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		g.SkipUncompressed()
+		val, err := nextValue(g, efSrc.codec)
+		if err != nil {
+			return nil, err
+		}
+		ef, _ := eliasfano32.ReadEliasFano(val)
+		it := ef.Iterator()
+		for it.HasNext() {
+			txNum, _ := it.Next()
+			if txNum < from || txNum >= to {
+				skipValue(g2, histSrc.codec)
+				continue
+			}
+			if valBuf, err = nextValue(g2, histSrc.codec); err != nil {
+				return nil, err
+			}
+			if encBuf, err = addValue(comp, h.codec, valBuf, encBuf); err != nil {
+				return nil, err
+			}
+			count++
+		}
+		p.Processed.Add(1)
+	}
+	if err = comp.Compress(); err != nil {
+		return nil, err
+	}
+	comp.Close()
+	comp = nil
+	outItem = newFilesItem(from, to, h.aggregationStep)
+	outItem.codec = h.codec
+	if outItem.decompressor, err = compress.NewDecompressor(datPath); err != nil {
+		return nil, fmt.Errorf("unwind %s history decompressor [%d-%d]: %w", h.filenameBase, fromStep, toStep, err)
+	}
+	if err = h.manifest.prepare(outItem.decompressor); err != nil {
+		return nil, fmt.Errorf("unwind %s history checksum [%d-%d]: %w", h.filenameBase, fromStep, toStep, err)
+	}
+	idxPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vi", h.filenameBase, fromStep, toStep))
+	if err = buildVi(ctx, outItem, efOut, idxPath, h.tmpdir, count, p, h.logger); err != nil {
+		return nil, fmt.Errorf("unwind %s history idx [%d-%d]: %w", h.filenameBase, fromStep, toStep, err)
+	}
+	if outItem.index, err = recsplit.OpenIndex(idxPath); err != nil {
+		return nil, fmt.Errorf("unwind %s history idx [%d-%d]: %w", h.filenameBase, fromStep, toStep, err)
+	}
+	if h.withExistenceFilter {
+		filterPath := filepath.Join(h.dir, fmt.Sprintf("%s.%d-%d.vif", h.filenameBase, fromStep, toStep))
+		if outItem.existence, err = buildExistenceFilterThenOpen(ctx, efOut.decompressor, efOut.codec, filterPath, h.noFsync); err != nil {
+			return nil, fmt.Errorf("unwind %s history filter [%d-%d]: %w", h.filenameBase, fromStep, toStep, err)
+		}
+	}
+	closeItem = false
+	return outItem, nil
+}
+
+// restoreToDB - puts history of [from, to) from files `efSrc`/`histSrc` back to DB, in same format as `AddPrevValue` does
+func (h *History) restoreToDB(ctx context.Context, efSrc, histSrc *filesItem, from, to uint64) error {
+	if from >= to || efSrc.endTxNum <= from || efSrc.startTxNum >= to {
+		return nil
+	}
+	var txKey [8]byte
+	var historyKey []byte
+	g, g2 := efSrc.decompressor.MakeGetter(), histSrc.decompressor.MakeGetter()
+	for g.HasNext() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		key, _ := g.NextUncompressed()
+		val, err := nextValue(g, efSrc.codec)
+		if err != nil {
+			return err
+		}
+		ef, _ := eliasfano32.ReadEliasFano(val)
+		it := ef.Iterator()
+		for it.HasNext() {
+			txNum, _ := it.Next()
+			if txNum < from || txNum >= to {
+				skipValue(g2, histSrc.codec)
+				continue
+			}
+			v, err := nextValue(g2, histSrc.codec)
+			if err != nil {
+				return err
+			}
+			binary.BigEndian.PutUint64(txKey[:], txNum)
+			if err = h.tx.Put(h.indexKeysTable, txKey[:], key); err != nil {
+				return err
+			}
+			if h.largeValues {
+				historyKey = append(append(historyKey[:0], key...), txKey[:]...)
+				err = h.tx.Put(h.historyValsTable, historyKey, v)
+			} else {
+				historyKey = append(append(historyKey[:0], txKey[:]...), v...)
+				err = h.tx.Put(h.historyValsTable, key, historyKey)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaceUnwoundFiles - removes from `files` items which end after `from`, adds `outs` and updates manifest:
+// until release (see filesManifest.retain) removed files stay listed and `outs` are not listed
+func replaceUnwoundFiles(files *btree2.BTreeG[*filesItem], from uint64, outs []*filesItem, m *filesManifest, noFsync bool, logger log.Logger) (retired []*filesItem, err error) {
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			if item.endTxNum > from {
+				retired = append(retired, item)
+			}
+		}
+		return true
+	})
+	if err = m.retain(retired, outs); err != nil {
+		return nil, err
+	}
+	for _, item := range retired {
+		files.Delete(item)
+	}
+	for _, item := range outs {
+		files.Set(item)
+	}
+	m.update(files, noFsync, logger)
+	return retired, nil
+}
+
+// closeUnwound - retired files are closed by last reader, but stay on disk until finishUnwind: their paths are
+// added to `unwound`. Must be called after reCalcRoFiles.
+func closeUnwound(retired, frozen []*filesItem, unwound []string) ([]*filesItem, []string) {
+	for _, item := range retired {
+		unwound = append(unwound, item.filePaths()...)
+		item.readOnly = true
+		item.canDelete.Store(true)
+	}
+	return closeRetired(retired, frozen), unwound
+}
+
+// removeUnwound - removes from disk files dropped by unwind, except ones re-built with same name
+func removeUnwound(unwound []string, files *btree2.BTreeG[*filesItem], logger log.Logger) {
+	if len(unwound) == 0 {
+		return
+	}
+	live := map[string]struct{}{}
+	files.Walk(func(items []*filesItem) bool {
+		for _, item := range items {
+			for _, path := range item.filePaths() {
+				live[path] = struct{}{}
+			}
+		}
+		return true
+	})
+	for _, path := range unwound {
+		if _, ok := live[path]; ok {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Trace("os.Remove", "err", err, "file", path)
+		}
+	}
+}
+
+// unwind - removes index which covers files after `txNum` from disk, it's closed by last reader.
+// New index will be built by BuildMissedIndices.
+func (li *LocalityIndex) unwind(txNum uint64) {
+	if li == nil || li.file == nil || li.file.endTxNum <= txNum {
+		return
+	}
+	cur, curBm := li.file, li.bm
+	li.file, li.bm = nil, nil
+	li.roFiles.Store(nil)
+	li.roBmFile.Store(nil)
+	cur.unlink()
+	if curBm != nil {
+		if err := os.Remove(curBm.FilePath()); err != nil {
+			li.logger.Trace("os.Remove", "err", err, "file", curBm.FileName())
+		}
+	}
+	cur.canDelete.Store(true)
+	if cur.refcount.Load() == 0 {
+		closeLocalityIndexFilesAndRemove(&ctxLocalityIdx{file: &ctxItem{src: cur}, bm: curBm}, li.logger)
+	}
+}
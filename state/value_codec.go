@@ -0,0 +1,194 @@
+/*
+   Copyright 2023 Erigon contributors
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/ledgerwatch/erigon-lib/compress"
+)
+
+// ValueCodec - how values are stored in files of Domain (.kv), History (.v) and InvertedIndex (.ef - values are
+// Elias-Fano sequences of txNums, keys are always stored as-is). Chosen at construction of Domain/History/InvertedIndex.
+// Name of codec is written to header of produced file: readers use codec of file (not current configuration),
+// so configuration can change without re-generation of existing files. Default codecs (RawValues, CompressedValues)
+// write no header: their files are byte-compatible with files written before codecs were introduced, see headerlessValues.
+// Values in DB are not affected by codec. Empty values (key didn't exist) are stored as-is and never passed to codec.
+type ValueCodec interface {
+	Name() string // must be unique, see RegisterValueCodec
+	// Compressed - values of merged files go through pattern-dictionary compression (AddWord), otherwise stored as-is
+	// (AddUncompressedWord/NextUncompressed). Collation always stores values as-is (see addCollatedValue): Getter.Next
+	// reads both kinds of words, so readers of compressed codec don't depend on how file was built.
+	Compressed() bool
+	// ReuseDictionary - merge compresses values by dictionary of biggest input file instead of building new one from samples.
+	// Saves time of merge, but dictionary may become outdated if nature of values change.
+	ReuseDictionary() bool
+	// Encode - transformation of value before writing it to file. Appends result to `buf`.
+	Encode(buf, v []byte) []byte
+	// Decode - inverse of Encode. Appends result to `buf`, or returns `v` as-is if there is no transformation.
+	Decode(buf, v []byte) ([]byte, error)
+}
+
+type plainValueCodec struct {
+	name                  string
+	compressed, reuseDict bool
+}
+
+func (c plainValueCodec) Name() string                         { return c.name }
+func (c plainValueCodec) Compressed() bool                     { return c.compressed }
+func (c plainValueCodec) ReuseDictionary() bool                { return c.reuseDict }
+func (c plainValueCodec) Encode(buf, v []byte) []byte          { return append(buf, v...) }
+func (c plainValueCodec) Decode(buf, v []byte) ([]byte, error) { return v, nil }
+
+var (
+	RawValues                 ValueCodec = plainValueCodec{name: "raw"}
+	CompressedValues          ValueCodec = plainValueCodec{name: "compressed", compressed: true}
+	CompressedValuesReuseDict ValueCodec = plainValueCodec{name: "compressed-reusedict", compressed: true, reuseDict: true}
+)
+
+// headerlessValues - reader of files without header: written by default codec (or before codecs were introduced).
+// Getter.Next reads both compressed and uncompressed words - so it reads files of RawValues and CompressedValues.
+var headerlessValues ValueCodec = plainValueCodec{name: "headerless", compressed: true}
+
+func isDefaultValueCodec(c ValueCodec) bool {
+	return c.Name() == RawValues.Name() || c.Name() == CompressedValues.Name()
+}
+
+var valueCodecs = struct {
+	sync.RWMutex
+	byName map[string]ValueCodec
+}{byName: map[string]ValueCodec{}}
+
+func init() {
+	for _, c := range []ValueCodec{RawValues, CompressedValues, CompressedValuesReuseDict} {
+		if err := RegisterValueCodec(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterValueCodec - makes codec known to readers of files. Custom codecs must be registered before opening files written by them.
+func RegisterValueCodec(c ValueCodec) error {
+	valueCodecs.Lock()
+	defer valueCodecs.Unlock()
+	if _, ok := valueCodecs.byName[c.Name()]; ok {
+		return fmt.Errorf("value codec %q already registered", c.Name())
+	}
+	valueCodecs.byName[c.Name()] = c
+	return nil
+}
+
+// File header: "codec=<name>"
+var valueCodecHeaderPrefix = []byte("codec=")
+
+func valueCodecHeader(c ValueCodec) []byte {
+	return append(append([]byte{}, valueCodecHeaderPrefix...), c.Name()...)
+}
+
+// fileValueCodec - codec used to write file
+func fileValueCodec(d *compress.Decompressor) (ValueCodec, error) {
+	meta := d.Metadata()
+	if meta == nil {
+		return headerlessValues, nil
+	}
+	if !bytes.HasPrefix(meta, valueCodecHeaderPrefix) {
+		return nil, fmt.Errorf("%s: unexpected file header %q", d.FileName(), meta)
+	}
+	valueCodecs.RLock()
+	defer valueCodecs.RUnlock()
+	c, ok := valueCodecs.byName[string(meta[len(valueCodecHeaderPrefix):])]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown value codec %q, see RegisterValueCodec", d.FileName(), meta[len(valueCodecHeaderPrefix):])
+	}
+	return c, nil
+}
+
+// setValueCodec - records codec in header of file (except default codecs). If codec reuses dictionary: takes it from
+// biggest compressed input (of merge) written by same codec.
+func setValueCodec(comp *compress.Compressor, c ValueCodec, inputs []*filesItem) {
+	if !isDefaultValueCodec(c) {
+		comp.SetMetadata(valueCodecHeader(c))
+	}
+	if !c.Compressed() || !c.ReuseDictionary() {
+		return
+	}
+	var biggest *filesItem
+	for _, item := range inputs {
+		if item.codec == nil || item.codec.Name() != c.Name() {
+			continue
+		}
+		if biggest == nil || item.decompressor.Size() > biggest.decompressor.Size() {
+			biggest = item
+		}
+	}
+	if biggest != nil {
+		comp.SetDictionary(compress.DictionaryBuilderFromDecompressor(biggest.decompressor))
+	}
+}
+
+// addValue - writes encoded value. `buf` is re-used for encoding and returned.
+func addValue(comp *compress.Compressor, c ValueCodec, v, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	if len(v) > 0 {
+		buf = c.Encode(buf, v)
+	}
+	if c.Compressed() {
+		return buf, comp.AddWord(buf)
+	}
+	return buf, comp.AddUncompressedWord(buf)
+}
+
+// addCollatedValue - writes encoded value to file built by collation. Such files are small and short-lived
+// (until merge), so values are not compressed - same as before codecs were introduced.
+func addCollatedValue(comp *compress.Compressor, c ValueCodec, v, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	if len(v) > 0 {
+		buf = c.Encode(buf, v)
+	}
+	return buf, comp.AddUncompressedWord(buf)
+}
+
+// nextValue - reads and decodes value written by `c`. Without transformation result points to file's memory.
+func nextValue(g *compress.Getter, c ValueCodec) ([]byte, error) {
+	var v []byte
+	if c.Compressed() {
+		v, _ = g.Next(nil)
+	} else {
+		v, _ = g.NextUncompressed()
+	}
+	return decodeValue(c, v)
+}
+
+// skipValue - skips value written by `c`, returns offset of next word
+func skipValue(g *compress.Getter, c ValueCodec) uint64 {
+	if c.Compressed() {
+		offset, _ := g.Skip()
+		return offset
+	}
+	offset, _ := g.SkipUncompressed()
+	return offset
+}
+
+// decodeValue - decodes value of file written by `c` (for values read not by nextValue, for example by BtIndex)
+func decodeValue(c ValueCodec, v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return v, nil
+	}
+	return c.Decode(nil, v)
+}